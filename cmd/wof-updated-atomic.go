@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
-	"github.com/whosonfirst/go-whosonfirst-csv"
 	"github.com/whosonfirst/go-whosonfirst-repo"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"github.com/whosonfirst/go-whosonfirst-updated/stream"
 	"github.com/whosonfirst/go-whosonfirst-uri"
 	"gopkg.in/redis.v1"
 	"log"
@@ -20,25 +20,28 @@ func main() {
 
 	var dryrun = flag.Bool("dryrun", false, "Just show which files would be updated but don't actually do anything.")
 	var verbose = flag.Bool("verbose", false, "Enable verbose logging.")
+	var format = flag.String("format", "csv", "The format of the message to send. Valid options are: csv, json.")
 
 	var redis_host = flag.String("redis-host", "localhost", "Redis host")
 	var redis_port = flag.Int("redis-port", 6379, "Redis port")
-	var redis_channel = flag.String("redis-channel", "updated", "Redis channel")
+	var redis_channel = flag.String("redis-channel", "updated", "Redis channel (or the name of the stream if -redis-mode is 'stream')")
+	var redis_mode = flag.String("redis-mode", "pubsub", "How to send messages to Redis. Valid options are: pubsub, stream.")
+	var redis_maxlen = flag.Int64("redis-maxlen", 0, "The (approximate) maximum number of messages to keep in the stream, if -redis-mode is 'stream'. 0 means no limit.")
 
 	flag.Parse()
 
-	var b bytes.Buffer
-	buf := bufio.NewWriter(&b)
+	if !message.IsValidFormat(*format) {
+		log.Fatalf("Invalid -format '%s'", *format)
+	}
 
-	// please add support for multiwriters here to send
-	// verbose output to STDOUT
+	if !stream.IsValidMode(*redis_mode) {
+		log.Fatalf("Invalid -redis-mode '%s'", *redis_mode)
+	}
 
-	fieldnames := []string{"hash", "repo", "path"}
-	writer, err := csv.NewDictWriter(buf, fieldnames)
+	// one task per repo, in the order they were passed in
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	tasks := make([]updated.UpdateTask, 0)
+	lookup := make(map[string]int)
 
 	for _, a := range flag.Args() {
 
@@ -73,18 +76,33 @@ func main() {
 		// check WOF ID against repo because a) general validation and
 		// b) https://github.com/whosonfirst/go-whosonfirst-updated/issues/17
 
-		row := make(map[string]string)
-		row["hash"] = "atomic-update"
-		row["repo"] = repo_name
-		row["path"] = path
+		idx, ok := lookup[repo_name]
+
+		if !ok {
+
+			t := updated.UpdateTask{
+				Hash:  "atomic-update",
+				Repo:  repo_name,
+				Files: make([]updated.UpdateFile, 0),
+			}
 
-		writer.WriteRow(row)
+			tasks = append(tasks, t)
+
+			idx = len(tasks) - 1
+			lookup[repo_name] = idx
+		}
+
+		tasks[idx].Files = append(tasks[idx].Files, updated.NewUpdateFile(path, updated.ChangeUnknown))
 	}
 
-	buf.Flush()
+	msg, err := message.Encode(tasks, *format)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *verbose {
-		log.Println(b.String())
+		log.Println(msg)
 	}
 
 	if !*dryrun {
@@ -97,8 +115,7 @@ func main() {
 
 		defer redis_client.Close()
 
-		rsp := redis_client.Publish(*redis_channel, b.String())
-		err := rsp.Err()
+		err := stream.Publish(redis_client, *redis_mode, *redis_channel, msg, *redis_maxlen)
 
 		if err != nil {
 			log.Fatal(err)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/deadletter"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"github.com/whosonfirst/go-whosonfirst-updated/stream"
+	"gopkg.in/redis.v1"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+
+	var dir = flag.String("deadletter-dir", "", "The directory where wof-updated is storing dead letters.")
+	var mode = flag.String("mode", "list", "What to do with dead letters. Valid options are: list, show, requeue, remove.")
+	var all = flag.Bool("all", false, "Apply -mode to every dead letter rather than the IDs passed as arguments.")
+	var keep = flag.Bool("keep", false, "Do not remove dead letters from the store after they have been re-queued.")
+	var format = flag.String("format", "csv", "The format of re-queued messages. Valid options are: csv, json.")
+
+	var dryrun = flag.Bool("dryrun", false, "Just show which tasks would be re-queued or removed but don't actually do anything.")
+	var verbose = flag.Bool("verbose", false, "Enable verbose logging.")
+
+	var redis_host = flag.String("redis-host", "localhost", "Redis host")
+	var redis_port = flag.Int("redis-port", 6379, "Redis port")
+	var redis_channel = flag.String("redis-channel", "updated", "Redis channel (or the name of the stream if -redis-mode is 'stream')")
+	var redis_mode = flag.String("redis-mode", "pubsub", "How to send messages to Redis. Valid options are: pubsub, stream.")
+	var redis_maxlen = flag.Int64("redis-maxlen", 0, "The (approximate) maximum number of messages to keep in the stream, if -redis-mode is 'stream'. 0 means no limit.")
+
+	flag.Parse()
+
+	if !message.IsValidFormat(*format) {
+		log.Fatalf("Invalid -format '%s'", *format)
+	}
+
+	if !stream.IsValidMode(*redis_mode) {
+		log.Fatalf("Invalid -redis-mode '%s'", *redis_mode)
+	}
+
+	if *dir == "" {
+		log.Fatal("Missing -deadletter-dir")
+	}
+
+	store, err := deadletter.NewStore(*dir)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	letters := make([]*deadletter.Letter, 0)
+
+	if *all || (*mode == "list" && len(flag.Args()) == 0) {
+
+		l, err := store.List()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		letters = l
+
+	} else {
+
+		for _, id := range flag.Args() {
+
+			l, err := store.Get(id)
+
+			if err != nil {
+				log.Fatalf("Failed to load dead letter %s, because %s", id, err)
+			}
+
+			letters = append(letters, l)
+		}
+	}
+
+	switch *mode {
+
+	case "list":
+
+		for _, l := range letters {
+
+			created := time.Unix(l.Created, 0)
+
+			fmt.Printf("%s\t%s\t%s\t%s\t%s#%s\t%d attempt(s)\t%s\n", l.Id, created.Format(time.RFC3339), l.Stage, l.Processor, l.Task.Repo, l.Task.Hash, l.Attempts, l.Error)
+		}
+
+	case "show":
+
+		for _, l := range letters {
+
+			body, err := json.MarshalIndent(l, "", "  ")
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println(string(body))
+		}
+
+	case "requeue":
+
+		var redis_client *redis.Client
+
+		if !*dryrun {
+
+			redis_endpoint := fmt.Sprintf("%s:%d", *redis_host, *redis_port)
+
+			redis_client = redis.NewTCPClient(&redis.Options{
+				Addr: redis_endpoint,
+			})
+
+			defer redis_client.Close()
+		}
+
+		for _, l := range letters {
+
+			tasks := []updated.UpdateTask{l.Task}
+			msg, err := message.Encode(tasks, *format)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if *verbose {
+				log.Println(msg)
+			}
+
+			log.Printf("re-queue %s (%s#%s, %d files)\n", l.Id, l.Task.Repo, l.Task.Hash, len(l.Task.Files))
+
+			if *dryrun {
+				continue
+			}
+
+			err = stream.Publish(redis_client, *redis_mode, *redis_channel, msg, *redis_maxlen)
+
+			if err != nil {
+				log.Fatalf("Failed to re-queue %s, because %s", l.Id, err)
+			}
+
+			if *keep {
+				continue
+			}
+
+			err = store.Remove(l.Id)
+
+			if err != nil {
+				log.Fatalf("Failed to remove %s, because %s", l.Id, err)
+			}
+		}
+
+	case "remove":
+
+		for _, l := range letters {
+
+			log.Printf("remove %s (%s#%s)\n", l.Id, l.Task.Repo, l.Task.Hash)
+
+			if *dryrun {
+				continue
+			}
+
+			err := store.Remove(l.Id)
+
+			if err != nil {
+				log.Fatalf("Failed to remove %s, because %s", l.Id, err)
+			}
+		}
+
+	default:
+		log.Fatalf("Invalid -mode '%s', valid options are: %s", *mode, strings.Join([]string{"list", "show", "requeue", "remove"}, ", "))
+	}
+
+	os.Exit(0)
+}
@@ -1,81 +1,83 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/whosonfirst/go-whosonfirst-csv"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"github.com/whosonfirst/go-whosonfirst-updated/stream"
 	"gopkg.in/redis.v1"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	_ "time"
+	"time"
 )
 
 func main() {
 
 	var dryrun = flag.Bool("dryrun", false, "Just show which files would be updated but don't actually do anything.")
 	var verbose = flag.Bool("verbose", false, "Enable verbose logging.")
+	var format = flag.String("format", "csv", "The format of the message to send. Valid options are: csv, json.")
 
 	var redis_host = flag.String("redis-host", "localhost", "Redis host")
 	var redis_port = flag.Int("redis-port", 6379, "Redis port")
-	var redis_channel = flag.String("redis-channel", "updated", "Redis channel")
+	var redis_channel = flag.String("redis-channel", "updated", "Redis channel (or the name of the stream if -redis-mode is 'stream')")
+	var redis_mode = flag.String("redis-mode", "pubsub", "How to send messages to Redis. Valid options are: pubsub, stream.")
+	var redis_maxlen = flag.Int64("redis-maxlen", 0, "The (approximate) maximum number of messages to keep in the stream, if -redis-mode is 'stream'. 0 means no limit.")
 
 	var repo = flag.String("repo", "", "The path to a valid Who's On First repo to run updates from")
 	var start_commit = flag.String("start-commit", "", "A valid Git commit hash to start updates from. If empty then the current hash will be used.")
 	var stop_commit = flag.String("stop-commit", "", "A valid Git commit hash to limit updates to.")
 
-	flag.Parse()
+	var max_rows = flag.Int("max-rows", 1000, "The maximum number of files to include in a single message. 0 means no limit.")
+	var max_bytes = flag.Int("max-bytes", 1024*1024, "The maximum size, in bytes, of a single message. 0 means no limit.")
+	var delay = flag.Duration("delay", 100*time.Millisecond, "How long to wait between sending messages.")
+	var state_file = flag.String("state-file", "", "The path to a file used to record progress. If it already exists, and describes the same replay, then messages that have already been sent are skipped.")
 
-	_, err := os.Stat(*repo)
+	flag.Parse()
 
-	if os.IsNotExist(err) {
-		log.Fatal("Repo does not exist", *repo)
+	if !message.IsValidFormat(*format) {
+		log.Fatalf("Invalid -format '%s'", *format)
 	}
 
-	cwd, err := os.Getwd()
+	if !stream.IsValidMode(*redis_mode) {
+		log.Fatalf("Invalid -redis-mode '%s'", *redis_mode)
+	}
 
-	if err != nil {
-		log.Fatal(err)
+	if *max_rows < 0 || *max_bytes < 0 {
+		log.Fatal("Invalid -max-rows or -max-bytes")
 	}
 
-	// I wish this wasn't necessary. I wish I could make sense of the
-	// libgit2 documentation... (20161222/thisisaaronland)
+	// git commands are run with their working directory set to the repo rather than
+	// by calling os.Chdir
 
 	// See also: https://github.com/whosonfirst/go-whosonfirst-updated/issues/1
 
-	err = os.Chdir(*repo)
+	r, err := git.NewRepo(*repo, nil)
 
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid repo %s, because %s", *repo, err)
 	}
 
+	ctx := context.Background()
+
 	// https://git-scm.com/docs/git-diff
 
 	if *start_commit == "" {
 
-		git_args := []string{
-			"log", "--pretty=format:%H", "-n", "1",
-		}
-
-		log.Println(strings.Join(git_args, " "))
-
-		cmd := exec.Command("git", git_args...)
-		hash, err := cmd.Output()
+		hash, err := r.Head(ctx)
 
 		if err != nil {
-			log.Fatal("Can not determined start hash for %s", *repo)
+			log.Fatalf("Can not determined start hash for %s, because %s", *repo, err)
 		}
 
 		log.Printf("Current hash %s\n", hash)
-		*start_commit = string(hash)
-	}
-
-	git_args := []string{
-		"show", "--pretty=format:#%H", "--name-only",
+		*start_commit = hash
 	}
 
 	var commit_range string
@@ -86,91 +88,234 @@ func main() {
 		commit_range = fmt.Sprintf("%s^...%s", *start_commit, *stop_commit)
 	}
 
-	git_args = append(git_args, commit_range)
+	log.Printf("show --name-status %s\n", commit_range)
+
+	tasks, err := r.Show(ctx, commit_range)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// commits are listed newest first and merges list the files that were changed on the
+	// branch that was merged, so a file may be listed more than once. Only its most recent
+	// change is sent, so each file is only replayed once. Commits that are left without
+	// any GeoJSON files aren't worth sending.
+
+	pruned := make([]updated.UpdateTask, 0)
+	seen := make(map[string]bool)
+
+	rows := 0
+
+	for _, t := range tasks {
 
-	log.Println(strings.Join(git_args, " "))
+		files := make([]updated.UpdateFile, 0)
 
-	cmd := exec.Command("git", git_args...)
-	out, err := cmd.Output()
+		for _, f := range t.Files {
 
-	os.Chdir(cwd)
+			key := fmt.Sprintf("%s#%s", t.Repo, f.Path)
+
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			files = append(files, f)
+		}
+
+		if len(files) > 0 {
+			t.Files = files
+			pruned = append(pruned, t)
+			rows += len(t.Files)
+		}
+	}
+
+	tasks = pruned
+
+	chunks, err := message.Chunk(tasks, *format, *max_rows, *max_bytes)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var b bytes.Buffer
-	buf := bufio.NewWriter(&b)
+	log.Printf("sending %d rows (%d commits) in %d messages\n", rows, len(tasks), len(chunks))
 
-	// please add support for multiwriters here to send
-	// verbose output to STDOUT
+	/*
 
-	fieldnames := []string{"hash", "repo", "path"}
-	writer, err := csv.NewDictWriter(buf, fieldnames)
+		Messages used to be sent all at once which doesn't work for very large replays...
 
-	var hash string
+		./bin/wof-updated-replay -repo /usr/local/data/whosonfirst-data -start-commit 2569568cd91df9a682c01793930009a9e2850e90
+		2017/08/03 15:04:45 log --pretty=format:#%H --name-only 2569568cd91df9a682c01793930009a9e2850e90
+		2017/08/03 15:05:32 sending 6609492 rows
+		2017/08/03 15:05:33 write tcp 127.0.0.1:49847->127.0.0.1:6379: write: connection reset by peer
 
-	rows := 0
+		I suppose there is a config flag somewhere in the Redis/PubSub stack to enable MASSIVE messages?
+		I haven't found it yet if it exists (20170803/thisisaaronland)
 
-	for _, ln := range strings.Split(string(out), "\n") {
+	*/
 
-		if strings.HasPrefix(ln, "#") {
-			hash = strings.Replace(ln, "#", "", 1)
-		}
+	state := &ReplayState{
+		Repo:        filepath.Base(*repo),
+		StartCommit: strings.TrimSpace(*start_commit),
+		StopCommit:  *stop_commit,
+		Format:      *format,
+		MaxRows:     *max_rows,
+		MaxBytes:    *max_bytes,
+		Chunks:      len(chunks),
+		Sent:        0,
+	}
 
-		if strings.HasSuffix(ln, ".geojson") {
+	if *state_file != "" {
 
-			row := make(map[string]string)
-			row["hash"] = hash
-			row["repo"] = filepath.Base(*repo)
-			row["path"] = ln
+		prev, err := readReplayState(*state_file)
 
-			writer.WriteRow(row)
-			rows += 1
+		if err != nil {
+			log.Fatalf("Failed to read state file %s, because %s", *state_file, err)
 		}
-	}
 
-	buf.Flush()
+		if prev != nil {
 
-	// see above inre multiwriters...
+			if !prev.Matches(state) {
+				log.Fatalf("State file %s is for a different replay (%s), remove it and try again", *state_file, prev)
+			}
 
-	if *verbose {
-		log.Println(b.String())
+			state.Sent = prev.Sent
+			log.Printf("resuming after message %d of %d\n", state.Sent, state.Chunks)
+		}
 	}
 
-	log.Printf("sending %d rows\n", rows)
+	var redis_client *redis.Client
 
 	if !*dryrun {
 
 		redis_endpoint := fmt.Sprintf("%s:%d", *redis_host, *redis_port)
 
-		redis_client := redis.NewTCPClient(&redis.Options{
+		redis_client = redis.NewTCPClient(&redis.Options{
 			Addr: redis_endpoint,
 		})
 
 		defer redis_client.Close()
+	}
 
-		rsp := redis_client.Publish(*redis_channel, b.String())
-		err := rsp.Err()
+	resume := state.Sent
 
-		/*
+	for i := resume; i < len(chunks); i++ {
 
-			For example...
+		msg := chunks[i]
 
-			./bin/wof-updated-replay -repo /usr/local/data/whosonfirst-data -start-commit 2569568cd91df9a682c01793930009a9e2850e90
-			2017/08/03 15:04:45 log --pretty=format:#%H --name-only 2569568cd91df9a682c01793930009a9e2850e90
-			2017/08/03 15:05:32 sending 6609492 rows
-			2017/08/03 15:05:33 write tcp 127.0.0.1:49847->127.0.0.1:6379: write: connection reset by peer
+		if *verbose {
+			log.Println(msg)
+		}
 
-			I suppose there is a config flag somewhere in the Redis/PubSub stack to enable MASSIVE messages?
-			I haven't found it yet if it exists (20170803/thisisaaronland)
+		log.Printf("send message %d of %d (%d bytes)\n", i+1, len(chunks), len(msg))
 
-		*/
+		if *dryrun {
+			continue
+		}
+
+		if i > resume && *delay > 0 {
+			time.Sleep(*delay)
+		}
+
+		err := stream.Publish(redis_client, *redis_mode, *redis_channel, msg, *redis_maxlen)
 
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Failed to send message %d of %d, because %s", i+1, len(chunks), err)
+		}
+
+		if *state_file == "" {
+			continue
+		}
+
+		state.Sent = i + 1
+		err = writeReplayState(*state_file, state)
+
+		if err != nil {
+			log.Fatalf("Failed to write state file %s, because %s", *state_file, err)
+		}
+	}
+
+	if *state_file != "" && !*dryrun {
+
+		err := os.Remove(*state_file)
+
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to remove state file %s, because %s", *state_file, err)
 		}
 	}
 
 	os.Exit(0)
 }
+
+// ReplayState records how many messages of a replay have been sent so that it can be
+// resumed if something goes wrong part of the way through.
+
+type ReplayState struct {
+	Repo        string `json:"repo"`
+	StartCommit string `json:"start_commit"`
+	StopCommit  string `json:"stop_commit"`
+	Format      string `json:"format"`
+	MaxRows     int    `json:"max_rows"`
+	MaxBytes    int    `json:"max_bytes"`
+	Chunks      int    `json:"chunks"`
+	Sent        int    `json:"sent"`
+}
+
+// Matches returns true if other is the same replay, meaning that it will be split in
+// to exactly the same messages.
+
+func (s *ReplayState) Matches(other *ReplayState) bool {
+
+	return s.Repo == other.Repo &&
+		s.StartCommit == other.StartCommit &&
+		s.StopCommit == other.StopCommit &&
+		s.Format == other.Format &&
+		s.MaxRows == other.MaxRows &&
+		s.MaxBytes == other.MaxBytes &&
+		s.Chunks == other.Chunks
+}
+
+func (s *ReplayState) String() string {
+	return fmt.Sprintf("%s %s...%s, %d of %d messages sent", s.Repo, s.StartCommit, s.StopCommit, s.Sent, s.Chunks)
+}
+
+func readReplayState(path string) (*ReplayState, error) {
+
+	body, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s ReplayState
+
+	err = json.Unmarshal(body, &s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func writeReplayState(path string, s *ReplayState) error {
+
+	body, err := json.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	tmp_path := path + ".tmp"
+
+	err = ioutil.WriteFile(tmp_path, body, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp_path, path)
+}
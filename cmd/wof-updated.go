@@ -1,56 +1,153 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/whosonfirst/go-slackcat-writer"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	t38_flags "github.com/whosonfirst/go-whosonfirst-tile38/flags"
 	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/config"
+	"github.com/whosonfirst/go-whosonfirst-updated/deadletter"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-updated/filter"
+	"github.com/whosonfirst/go-whosonfirst-updated/flags"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
+	"github.com/whosonfirst/go-whosonfirst-updated/journal"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"github.com/whosonfirst/go-whosonfirst-updated/metrics"
 	"github.com/whosonfirst/go-whosonfirst-updated/process"
-	"gopkg.in/redis.v1"
+	"github.com/whosonfirst/go-whosonfirst-updated/retry"
+	"github.com/whosonfirst/go-whosonfirst-updated/routing"
+	"github.com/whosonfirst/go-whosonfirst-updated/source"
+	"github.com/whosonfirst/go-whosonfirst-updated/status"
+	"github.com/whosonfirst/go-whosonfirst-updated/stream"
 	"io"
 	golog "log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// inboundTask is one of the tasks in a message from a source. ack is only set on the
+// last task in a message and acknowledges the message once that task has been processed.
+
+type inboundTask struct {
+	task updated.UpdateTask
+	ack  func()
+}
+
 func main() {
 
 	var t38_endpoints t38_flags.Endpoints
 
 	flag.Var(&t38_endpoints, "tile38-endpoint", "One or more Tile38 'host:port' (or simply 'host' in which case port is assumed to be '9851') endpoints to connect to.")
 
-	var data_root = flag.String("data-root", "", "...")
-	var es_host = flag.String("es-host", "localhost", "")
-	var es_port = flag.String("es-port", "9200", "")
-	var es_index = flag.String("es-index", "whosonfirst", "")
-	var es_index_tool = flag.String("es-index-tool", "/usr/local/bin/wof-es-index-filelist", "")
+	var pre_process_uris flags.ProcessFlags
+	var process_uris flags.ProcessFlags
+	var post_process_uris flags.ProcessFlags
+
+	flag.Var(&pre_process_uris, "pre-process", "One or more process URIs to run, in order, before all other processors. Valid schemes are: "+strings.Join(process.Schemes(), ","))
+	flag.Var(&process_uris, "process", "One or more process URIs to run asynchronously. Valid schemes are: "+strings.Join(process.Schemes(), ","))
+	flag.Var(&post_process_uris, "post-process", "One or more process URIs to run, in order, after all the async processors have completed. Valid schemes are: "+strings.Join(process.Schemes(), ","))
+
+	var data_root = flag.String("data-root", "", "The directory that contains a copy of each repo, for processors that read files (or run git) locally.")
+	var es_host = flag.String("es-host", "localhost", "The Elasticsearch host to index records in (if -processors includes 'es').")
+	var es_port = flag.String("es-port", "9200", "The port of the Elasticsearch host (if -processors includes 'es').")
+	var es_index = flag.String("es-index", "whosonfirst", "The Elasticsearch index to add records to (if -processors includes 'es').")
+	var es_index_tool = flag.String("es-index-tool", "", "DEPRECATED: records are now indexed in Elasticsearch natively and this flag is ignored.")
 	var log_file = flag.String("log-file", "", "Write logging information to this file")
 	var log_level = flag.String("log-level", "info", "The amount of logging information to include, valid options are: debug, info, status, warning, error, fatal")
 	var log_prefix = flag.String("log-prefix", "", "A string to prefix logging messages with")
-	var log_slack = flag.Bool("log-slack", false, "...")
-	var log_slack_conf = flag.String("log-slack-conf", "", "...")
-	var log_slack_level = flag.String("log-slack-level", "", "status")
-	var processors = flag.String("processors", "", "Valid options include: es,null,s3")
-	var post_processors = flag.String("post-processors", "", "Valid options include: pubsub")
-	var pre_processors = flag.String("pre-processors", "", "Valid options include: pull")
+	var log_format = flag.String("log-format", "text", "The format of logging information written to STDOUT and -log-file. Valid options are: text, json. In 'json' mode every line is an event and events about a task include its task_id, repo, hash, processor, stage, duration and error.")
+	var log_slack = flag.Bool("log-slack", false, "Send log messages to Slack. For one message per commit use a notify:// post-processor instead.")
+	var log_slack_conf = flag.String("log-slack-conf", "", "The path to a slackcat config file (if -log-slack is true).")
+	var log_slack_level = flag.String("log-slack-level", "status", "The amount of logging information to send to Slack")
+	var log_slack_events = flag.String("log-slack-events", "", "A comma-separated list of events to send to Slack, for example: task.failed,task.deadlettered. Plain log messages are always sent. If empty then all events are sent.")
+	var processors = flag.String("processors", "", "A comma-separated list of async processors. Valid options include: es,lfs,null,s3,tile38 (this is the same as passing the equivalent -process URIs)")
+	var post_processors = flag.String("post-processors", "", "A comma-separated list of post processors. Valid options include: pubsub (this is the same as passing the equivalent -post-process URIs)")
+	var pre_processors = flag.String("pre-processors", "", "A comma-separated list of pre processors. Valid options include: pull (this is the same as passing the equivalent -pre-process URIs)")
 	var pubsub_host = flag.String("pubsub-host", "localhost", "PubSub host (for notifications)")
 	var pubsub_port = flag.Int("pubsub-port", 6379, "PubSub port (for notifications)")
 	var pubsub_channel = flag.String("pubsub-channel", "pubssed", "PubSub channel (for notifications)")
 	var redis_host = flag.String("redis-host", "localhost", "Redis host")
 	var redis_port = flag.Int("redis-port", 6379, "Redis port")
-	var redis_channel = flag.String("redis-channel", "updated", "Redis channel")
+	var redis_channel = flag.String("redis-channel", "updated", "Redis channel (or the name of the stream if -redis-mode is 'stream')")
+	var redis_mode = flag.String("redis-mode", "pubsub", "How to receive messages from Redis. Valid options are: pubsub, stream. In 'stream' mode messages are read from a Redis stream as part of a consumer group and are not lost if wof-updated isn't running when they are sent.")
+	var redis_group = flag.String("redis-group", "wof-updated", "The name of the consumer group to read messages with (if -redis-mode is 'stream').")
+	var redis_consumer = flag.String("redis-consumer", "", "The name of this consumer in the consumer group (if -redis-mode is 'stream'). This should be unique, and stay the same across restarts, for each instance of wof-updated. If empty the hostname is used.")
+	var redis_claim_idle = flag.Duration("redis-claim-idle", time.Minute*5, "How long a message must have gone unacknowledged by another consumer before this one takes it over (if -redis-mode is 'stream'). 0 means never.")
+
+	var source_uris flags.SourceFlags
+	flag.Var(&source_uris, "source", "One or more source URIs to read messages from. If empty then a 'redis://' source is configured using the -redis-* flags. Valid schemes are: "+strings.Join(source.Schemes(), ","))
 	var t38_collection = flag.String("tile38-collection", "", "Tile38 collection")
-	var s3_bucket = flag.String("s3-bucket", "whosonfirst.mapzen.com", "...")
-	var s3_prefix = flag.String("s3-prefix", "", "...")
-	var stdout = flag.Bool("stdout", false, "...")
+	var s3_bucket = flag.String("s3-bucket", "whosonfirst.mapzen.com", "The S3 bucket to publish files to (if -processors includes 's3').")
+	var s3_prefix = flag.String("s3-prefix", "", "The prefix to add to files published to S3 (if -processors includes 's3').")
+	var stdout = flag.Bool("stdout", false, "Write logging information to STDOUT.")
+	var journal_dir = flag.String("journal-dir", "", "If set, every task is recorded in a journal stored in this directory before it is processed and any tasks that were not completed by every processor are replayed on start up.")
+	var journal_segment_size = flag.Int64("journal-segment-size", 64*1024*1024, "The maximum size in bytes of an individual journal segment file.")
+	var retry_attempts = flag.Int("retry-attempts", 3, "The default maximum number of times to try processing a task. This may be overridden for individual processors with a 'retry-attempts' process URI parameter.")
+	var retry_backoff = flag.Duration("retry-backoff", time.Second*1, "The default amount of time to wait before retrying a failed task, doubled after each attempt. This may be overridden for individual processors with a 'retry-backoff' process URI parameter.")
+	var retry_max_backoff = flag.Duration("retry-max-backoff", time.Minute*1, "The default maximum amount of time to wait before retrying a failed task. This may be overridden for individual processors with a 'retry-max-backoff' process URI parameter.")
+	var retry_jitter = flag.Float64("retry-jitter", 0.2, "The default fraction (0-1) by which to randomly adjust the time to wait before retrying a failed task. This may be overridden for individual processors with a 'retry-jitter' process URI parameter.")
+	var deadletter_dir = flag.String("deadletter-dir", "", "If set, tasks that still fail after being retried are stored in this directory. They can be inspected and re-queued with the wof-updated-deadletter tool.")
+	var resolve_files = flag.Bool("resolve-files", false, "If true, tasks that don't list any files (because the message only names a commit, or a range of commits) have their files determined from the copy of the repo in -data-root, after any pre-processors have run.")
+	var flush_interval = flag.Duration("flush-interval", time.Second*60, "The default amount of time between flushing processors, which processes any files they are still holding on to. This may be overridden for individual processors with a 'flush-interval' process URI parameter.")
+	var metrics_addr = flag.String("metrics-addr", "", "If set, publish Prometheus metrics at http://{METRICS_ADDR}/metrics, for example 'localhost:9090'.")
+	var status_addr = flag.String("status-addr", "", "If set, report the health of wof-updated at http://{STATUS_ADDR}/health and what its sources and processors are doing at http://{STATUS_ADDR}/status, for example 'localhost:9091'. This may be the same as -metrics-addr.")
+	var shutdown_timeout = flag.Duration("shutdown-timeout", time.Minute*5, "The maximum amount of time to wait for processors to finish any buffered work when shutting down.")
+
+	var routing_rules = flag.String("routing", "", "The path to a JSON file (or the JSON itself) with rules that decide which async and post processors handle which files, by repo, placetype and path.")
+	var config_file = flag.String("config", "", "The path to a JSON config file. Flags, and WOF_UPDATED_* environment variables (for example WOF_UPDATED_DATA_ROOT for -data-root), take precedence over it.")
+	var check_config = flag.Bool("check-config", false, "Check that the configuration (from flags, environment variables and -config) is valid, print it and exit.")
 
 	flag.Parse()
 
+	config_path := *config_file
+
+	if config_path == "" {
+		config_path = os.Getenv(config.EnvName("config"))
+	}
+
+	var cfg *config.Config
+
+	if config_path != "" {
+
+		c, err := config.Load(config_path)
+
+		if err != nil {
+			golog.Fatal(err)
+		}
+
+		cfg = c
+	}
+
+	err := config.Apply(flag.CommandLine, cfg)
+
+	if err != nil {
+		golog.Fatal(err)
+	}
+
+	if !stream.IsValidMode(*redis_mode) {
+		golog.Fatalf("Invalid -redis-mode '%s'", *redis_mode)
+	}
+
+	if *flush_interval <= 0 {
+		golog.Fatal("Invalid -flush-interval")
+	}
+
+	if !events.IsValidFormat(*log_format) {
+		golog.Fatalf("Invalid -log-format '%s'", *log_format)
+	}
+
 	writers := make([]io.Writer, 0)
 
 	if *stdout {
@@ -82,8 +179,25 @@ func main() {
 		prefix = fmt.Sprintf("%s %s", *log_prefix, prefix)
 	}
 
+	// everything is logged as an event; messages sent to logger (including those
+	// from processors) become plain 'log' events so that every writer gets them in
+	// its own format
+
 	logger := log.NewWOFLogger(prefix)
-	logger.AddLogger(writer, *log_level)
+	event_logger := events.NewLogger(logger.Prefix)
+
+	err = event_logger.AddWriter(writer, *log_format, *log_level, nil)
+
+	if err != nil {
+		golog.Fatal(err)
+	}
+
+	// make sure that whatever is wrong with the configuration is reported, even
+	// if logging hasn't been set up to go anywhere
+
+	if *check_config {
+		event_logger.AddWriter(os.Stderr, events.FormatText, events.LevelError, nil)
+	}
 
 	if *log_slack {
 
@@ -93,14 +207,33 @@ func main() {
 			golog.Fatal(err)
 		}
 
-		logger.AddLogger(slack_logger, *log_slack_level)
+		var filter events.Filter
+
+		if *log_slack_events != "" {
+
+			names := make([]string, 0)
+
+			for _, n := range strings.Split(*log_slack_events, ",") {
+				names = append(names, strings.TrimSpace(n))
+			}
+
+			filter = events.NameFilter(names...)
+		}
+
+		err = event_logger.AddWriter(slack_logger, events.FormatText, *log_slack_level, filter)
+
+		if err != nil {
+			golog.Fatal(err)
+		}
 	}
 
+	logger.AddLogger(event_logger.LogWriter(logger.Prefix), events.LevelDebug)
+
 	logger.Status("Starting up wof-updated")
 
-	processors_pre := make([]process.Process, 0)
-	processors_post := make([]process.Process, 0)
-	processors_async := make([]process.Process, 0)
+	if *es_index_tool != "" {
+		logger.Warning("The -es-index-tool flag is deprecated and will be ignored")
+	}
 
 	/*
 
@@ -110,299 +243,1452 @@ func main() {
 
 	*/
 
-	for _, name := range strings.Split(*pre_processors, ",") {
-
-		logger.Debug("Configure pre processor %s", name)
+	// the -pre-processors, -processors and -post-processors flags are still supported
+	// but are simply translated in to their equivalent process URIs
 
-		if name == "pull" {
-			pr, err := process.NewPullProcess(*data_root, logger)
+	for _, name := range strings.Split(*pre_processors, ",") {
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate Git hooks processor %v", err)
-			}
+		name = strings.TrimSpace(name)
 
-			processors_pre = append(processors_pre, pr)
+		if name == "" {
+			continue
 		}
+
+		pre_process_uris.Set(fmt.Sprintf("%s://", name))
 	}
 
 	for _, name := range strings.Split(*processors, ",") {
 
-		logger.Debug("Configure async processor %s", name)
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "":
+			continue
+		case "s3":
+			process_uris.Set(fmt.Sprintf("s3://%s/%s", *s3_bucket, *s3_prefix))
+		case "es":
+			process_uris.Set(fmt.Sprintf("es://%s:%s/%s", *es_host, *es_port, *es_index))
 
-		if name == "s3" {
+		case "tile38":
 
-			pr, err := process.NewS3Process(*data_root, *s3_bucket, *s3_prefix, logger)
+			q := url.Values{}
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate S3 hooks processor %v", err)
+			for _, e := range t38_endpoints {
+				q.Add("endpoint", e)
 			}
 
-			processors_async = append(processors_async, pr)
+			process_uris.Set(fmt.Sprintf("tile38:///%s?%s", *t38_collection, q.Encode()))
+
+		default:
+			process_uris.Set(fmt.Sprintf("%s://", name))
 		}
+	}
 
-		if name == "es" {
+	for _, name := range strings.Split(*post_processors, ",") {
 
-			pr, err := process.NewElasticsearchProcess(*data_root, *es_index_tool, *es_host, *es_port, *es_index, logger)
+		name = strings.TrimSpace(name)
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate Elasticsearch hooks processor %v", err)
-			}
+		switch name {
+		case "":
+			continue
+		case "pubsub":
+			post_process_uris.Set(fmt.Sprintf("pubsub://%s:%d/%s", *pubsub_host, *pubsub_port, *pubsub_channel))
+		default:
+			post_process_uris.Set(fmt.Sprintf("%s://", name))
+		}
+	}
+
+	process_opts := &process.ProcessOptions{
+		DataRoot: *data_root,
+		Logger:   logger,
+		Events:   event_logger,
+	}
+
+	logger.Debug("Configure pre processors %s", pre_process_uris.URIs())
+
+	processors_pre, err := pre_process_uris.ToProcesses(process_opts)
+
+	if err != nil {
+		logger.Fatal("Failed to instantiate pre processors, %v", err)
+	}
+
+	logger.Debug("Configure async processors %s", process_uris.URIs())
+
+	processors_async, err := process_uris.ToProcesses(process_opts)
+
+	if err != nil {
+		logger.Fatal("Failed to instantiate async processors, %v", err)
+	}
+
+	logger.Debug("Configure post processors %s", post_process_uris.URIs())
+
+	processors_post, err := post_process_uris.ToProcesses(process_opts)
+
+	if err != nil {
+		logger.Fatal("Failed to instantiate post processors, %v", err)
+	}
+
+	if len(processors_pre) == 0 && len(processors_async) == 0 && len(processors_post) == 0 {
+		logger.Fatal("You forgot to specify any processors, silly")
+	}
+
+	all_processors := make([]process.Process, 0)
+	all_processors = append(all_processors, processors_pre...)
+	all_processors = append(all_processors, processors_async...)
+	all_processors = append(all_processors, processors_post...)
+
+	// processors are identified in the journal by their URI since there may be
+	// more than one processor with the same name
+
+	pre_keys := pre_process_uris.URIs()
+	async_keys := process_uris.URIs()
+	post_keys := post_process_uris.URIs()
+
+	all_keys := make([]string, 0)
+	all_keys = append(all_keys, pre_keys...)
+	all_keys = append(all_keys, async_keys...)
+	all_keys = append(all_keys, post_keys...)
+
+	// post-processors that send notifications are run once everything else has
+	// finished with a task, whatever happened to it (see process_task below)
+
+	notifier_keys := make(map[string]bool)
+
+	for idx, pr := range processors_post {
 
-			processors_async = append(processors_async, pr)
+		_, ok := pr.(process.Notifier)
+
+		if ok {
+			notifier_keys[post_keys[idx]] = true
 		}
+	}
 
-		if name == "tile38" {
+	// the flush interval may be overridden for individual processors with a
+	// 'flush-interval' query parameter in the process URI
 
-			t38_clients, err := t38_endpoints.ToClients()
+	intervals := make([]time.Duration, 0)
 
-			if err != nil {
-				logger.Fatal("failed to convert endpoints to clients because %v", err)
-			}
+	for _, key := range all_keys {
 
-			pr, err := process.NewTile38Process(*data_root, t38_clients, *t38_collection, logger)
+		interval := *flush_interval
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate Tile38 hooks processor, %v", err)
-			}
+		u, err := url.Parse(key)
 
-			processors_async = append(processors_async, pr)
+		if err != nil {
+			logger.Fatal("Failed to parse process URI %s, because %s", key, err)
 		}
 
-		if name == "lfs" {
+		str_interval := u.Query().Get("flush-interval")
 
-			pr, err := process.NewLFSProcess(*data_root, logger)
+		if str_interval != "" {
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate LFS hooks processor, %v", err)
+			d, err := time.ParseDuration(str_interval)
+
+			if err != nil || d <= 0 {
+				logger.Fatal("Invalid flush-interval parameter for %s", key)
 			}
 
-			processors_async = append(processors_async, pr)
+			interval = d
 		}
 
-		if name == "null" {
+		intervals = append(intervals, interval)
+	}
 
-			pr, err := process.NewNullProcess(*data_root, logger)
+	default_policy := retry.NewDefaultPolicy()
+	default_policy.MaxAttempts = *retry_attempts
+	default_policy.Backoff = *retry_backoff
+	default_policy.MaxBackoff = *retry_max_backoff
+	default_policy.Jitter = *retry_jitter
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate null hooks processor, %v", err)
-			}
+	// retry policies may be overridden for individual processors with 'retry-*'
+	// query parameters in the process URI
 
-			processors_async = append(processors_async, pr)
+	policies := make(map[string]*retry.Policy)
+
+	for _, key := range all_keys {
+
+		p, err := retry.NewPolicyFromURI(default_policy, key)
+
+		if err != nil {
+			logger.Fatal("Failed to parse retry policy for %s, because %s", key, err)
 		}
 
+		policies[key] = p
 	}
 
-	for _, name := range strings.Split(*post_processors, ",") {
+	// the -redis-* flags are still supported but are simply translated in to the
+	// equivalent source URI if no other sources have been specified
 
-		logger.Debug("Configure post processor %s", name)
+	if len(source_uris.URIs()) == 0 {
 
-		if name == "pubsub" {
+		q := url.Values{}
 
-			pr, err := process.NewPubSubProcess(*data_root, *pubsub_host, *pubsub_port, *pubsub_channel, logger)
+		if *redis_mode == stream.ModeStream {
 
-			if err != nil {
-				logger.Fatal("Failed to instantiate PubSub hooks processor, %v", err)
+			q.Set("mode", stream.ModeStream)
+			q.Set("group", *redis_group)
+			q.Set("claim-idle", redis_claim_idle.String())
+
+			if *redis_consumer != "" {
+				q.Set("consumer", *redis_consumer)
 			}
+		}
 
-			processors_post = append(processors_post, pr)
+		source_uri := fmt.Sprintf("redis://%s:%d/%s", *redis_host, *redis_port, *redis_channel)
+
+		if len(q) > 0 {
+			source_uri = fmt.Sprintf("%s?%s", source_uri, q.Encode())
 		}
+
+		source_uris.Set(source_uri)
 	}
 
-	if len(processors_pre) == 0 && len(processors_async) == 0 && len(processors_post) == 0 {
-		logger.Fatal("You forgot to specify any processors, silly")
+	source_opts := &source.SourceOptions{
+		Logger: logger,
 	}
 
-	ps_messages := make(chan string)
-	up_messages := make(chan updated.UpdateTask)
+	logger.Debug("Configure sources %s", source_uris.URIs())
 
-	go func() {
+	sources, err := source_uris.ToSources(source_opts)
 
-		redis_endpoint := fmt.Sprintf("%s:%d", *redis_host, *redis_port)
+	if err != nil {
+		logger.Fatal("Failed to instantiate sources, %v", err)
+	}
 
-		redis_client := redis.NewTCPClient(&redis.Options{
-			Addr: redis_endpoint,
-		})
+	// pushes that don't list every file become tasks without any files, which would
+	// otherwise be quietly ignored by every processor after the pre-processors
+
+	for _, uri := range source_uris.URIs() {
+
+		u, err := url.Parse(uri)
+
+		if err != nil {
+			continue
+		}
+
+		if u.Scheme == "github" && !*resolve_files {
+			logger.Fatal("The github source (%s) requires -resolve-files", status.Redact(uri))
+		}
+	}
+
+	// routing rules only apply to async and post processors since pre-processors
+	// (like pull) are run before the files in a task can be looked at
 
-		defer redis_client.Close()
+	var router *routing.Router
 
-		pubsub_client := redis_client.PubSub()
-		defer pubsub_client.Close()
+	if *routing_rules != "" {
 
-		err := pubsub_client.Subscribe(*redis_channel)
+		rules, err := routing.Load(*routing_rules)
 
 		if err != nil {
-			logger.Fatal("Failed to subscribe to Redis channel: %s", err)
+			logger.Fatal("Failed to load routing rules, %s", err)
 		}
 
-		logger.Debug("Ready to receive (updated) PubSub messages")
+		routed_keys := make([]string, 0)
+		routed_keys = append(routed_keys, async_keys...)
+		routed_keys = append(routed_keys, post_keys...)
 
-		for {
+		r, err := routing.NewRouter(rules, routed_keys, routing.NewFilePlacetypeFunc(*data_root))
+
+		if err != nil {
+			logger.Fatal("Failed to set up routing, %s", err)
+		}
 
-			i, _ := pubsub_client.Receive()
+		router = r
+	}
 
-			if msg, _ := i.(*redis.Message); msg != nil {
-				ps_messages <- msg.Payload
-			}
+	// filters may be set for individual async and post processors with 'filter'
+	// query parameters in the process URI
+
+	filters := make(map[string]*filter.Filter)
+
+	for _, key := range append(append([]string{}, async_keys...), post_keys...) {
+
+		f, err := filter.NewFilterFromURI(*data_root, key)
+
+		if err != nil {
+			logger.Fatal("Failed to parse filter for %s, because %s", key, err)
 		}
 
-	}()
+		if f != nil {
+			filters[key] = f
+		}
+	}
 
-	go func() {
+	// everything has been set up (but not started) so if all we're doing is
+	// checking the configuration we're done
 
-		logger.Debug("Ready to process (updated) PubSub messages")
+	if *check_config {
 
-		for {
+		for _, ln := range config.Describe(flag.CommandLine, status.Redact) {
+			fmt.Println(ln)
+		}
 
-			// we are assuming this:
-			// https://github.com/whosonfirst/go-webhookd/blob/master/transformations/github.commits.go
+		fmt.Println("Configuration is valid")
+		os.Exit(0)
+	}
 
-			msg := <-ps_messages
+	// metrics are always collected but only published if there is a -metrics-addr
 
-			rdr := csv.NewReader(strings.NewReader(msg))
+	registry := metrics.NewRegistry()
 
-			tasks := make(map[string]map[string][]string)
+	metrics_messages := registry.NewCounter("wof_updated_messages_received_total", "The number of messages received from all sources.")
+	metrics_invalid := registry.NewCounter("wof_updated_messages_invalid_total", "The number of messages that could not be read.")
+	metrics_tasks := registry.NewCounter("wof_updated_tasks_parsed_total", "The number of tasks read from messages.", "repo")
+	metrics_processed := registry.NewCounter("wof_updated_files_processed_total", "The number of files in tasks that a processor completed successfully.", "processor", "uri", "repo")
+	metrics_failed := registry.NewCounter("wof_updated_files_failed_total", "The number of files in tasks that a processor failed to complete, after any retries.", "processor", "uri", "repo")
+	metrics_duration := registry.NewHistogram("wof_updated_process_duration_seconds", "How long it takes a processor to process a task, including any retries.", metrics.DefaultBuckets, "processor", "uri")
 
-			for {
-				row, err := rdr.Read()
+	// there may be more than one processor of the same type (two es:// processors for
+	// different indices, say) so they are told apart by their (redacted) URIs
 
-				if err == io.EOF {
-					break
-				}
+	metric_uris := make(map[string]string)
 
-				if err != nil {
-					logger.Error("Failed to read data: %s", err)
-					break
-				}
+	for _, key := range all_keys {
+		metric_uris[key] = status.Redact(key)
+	}
 
-				if len(row) != 3 {
-					logger.Warning("No idea how to process row", row)
-					continue
-				}
+	// buffered files and in-flight repos are only known to processors that implement
+	// the process.Inspector interface
 
-				hash := row[0]
-				repo := row[1]
-				path := row[2]
+	inspectors := func() ([][]string, []process.Inspector) {
 
-				_, ok := tasks[repo]
+		labels := make([][]string, 0)
+		inspectors := make([]process.Inspector, 0)
 
-				if !ok {
-					tasks[repo] = make(map[string][]string)
-				}
+		for idx, pr := range all_processors {
 
-				commits, ok := tasks[repo][hash]
+			i, ok := pr.(process.Inspector)
 
-				if !ok {
-					commits = make([]string, 0)
+			if ok {
+				labels = append(labels, []string{pr.Name(), metric_uris[all_keys[idx]]})
+				inspectors = append(inspectors, i)
+			}
+		}
+
+		return labels, inspectors
+	}
+
+	registry.NewGaugeFunc("wof_updated_buffered_files", "The number of files (including deletions) that a processor is holding on to.", func() []metrics.Sample {
+
+		samples := make([]metrics.Sample, 0)
+		labels, inspectors := inspectors()
+
+		for idx, i := range inspectors {
+
+			for repo, count := range i.BufferedFiles() {
+
+				s := metrics.Sample{
+					LabelValues: append(append([]string{}, labels[idx]...), repo),
+					Value:       float64(count),
 				}
 
-				commits = append(commits, path)
-				tasks[repo][hash] = commits
+				samples = append(samples, s)
 			}
+		}
 
-			for repo, details := range tasks {
+		return samples
 
-				for hash, commits := range details {
+	}, "processor", "uri", "repo")
 
-					t := updated.UpdateTask{
-						Hash:    hash,
-						Repo:    repo,
-						Commits: commits,
-					}
+	registry.NewGaugeFunc("wof_updated_inflight_repos", "The number of repos that a processor is currently processing.", func() []metrics.Sample {
 
-					up_messages <- t
-				}
+		samples := make([]metrics.Sample, 0)
+		labels, inspectors := inspectors()
+
+		for idx, i := range inspectors {
+
+			s := metrics.Sample{
+				LabelValues: labels[idx],
+				Value:       float64(len(i.Processing())),
 			}
+
+			samples = append(samples, s)
 		}
-	}()
 
-	logger.Debug("Ready to process (updated) tasks")
+		return samples
 
-	all_processors := [][]process.Process{
-		processors_pre,
-		processors_async,
-		processors_post,
-	}
+	}, "processor", "uri")
 
-	for _, pr_group := range all_processors {
+	// sources and processors are added to the tracker once they have been set up
 
-		for _, pr := range pr_group {
+	tracker := status.NewTracker()
 
-			logger.Debug("Set up monitoring for %s", pr.Name())
+	// metrics and status are served on the same address if -metrics-addr and
+	// -status-addr are the same
 
-			go func(pr process.Process) {
+	muxes := make(map[string]*http.ServeMux)
 
-				buffer := time.Second * 60
+	get_mux := func(addr string) *http.ServeMux {
 
-				for {
+		mux, ok := muxes[addr]
 
-					timer := time.NewTimer(buffer)
-					<-timer.C
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[addr] = mux
+		}
 
-					// logger.Debug("Invoking flush for %s", pr.Name())
-					pr.Flush()
-				}
-			}(pr)
+		return mux
+	}
+
+	if *metrics_addr != "" {
+		get_mux(*metrics_addr).Handle("/metrics", registry.Handler())
+		logger.Status("Publishing metrics at http://%s/metrics", *metrics_addr)
+	}
+
+	if *status_addr != "" {
+
+		mux := get_mux(*status_addr)
+		mux.Handle("/health", tracker.HealthHandler())
+		mux.Handle("/status", tracker.StatusHandler())
+
+		logger.Status("Publishing status at http://%s/status", *status_addr)
+	}
+
+	http_servers := make([]*http.Server, 0)
+
+	for addr, mux := range muxes {
+
+		server := &http.Server{
+			Addr:    addr,
+			Handler: mux,
 		}
+
+		http_servers = append(http_servers, server)
+
+		go func(server *http.Server) {
+
+			err := server.ListenAndServe()
+
+			if err != nil && err != http.ErrServerClosed {
+				logger.Error("Failed to listen for HTTP requests at %s, because %s", server.Addr, err)
+			}
+		}(server)
 	}
 
-	for {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		task := <-up_messages
-		logger.Status("Processing commit %s (%s)", task.Hash, task.Repo)
+	signal_ch := make(chan os.Signal, 1)
+	signal.Notify(signal_ch, os.Interrupt, syscall.SIGTERM)
 
-		ok_pre := true
+	go func() {
+		sig := <-signal_ch
+		logger.Status("Received %s signal, shutting down", sig)
+		cancel()
+	}()
+
+	for idx, src := range sources {
+		tracker.AddSource(source_uris.URIs()[idx], src)
+	}
+
+	ps_messages := make(chan *source.Message)
+	up_messages := make(chan inboundTask)
 
-		for _, pr := range processors_pre {
+	sources_wg := new(sync.WaitGroup)
+	var sources_failed int32
 
-			name := pr.Name()
-			logger.Debug("Invoking pre-processor %s (%s)", name, task)
+	for _, src := range sources {
 
-			err := pr.ProcessTask(task)
+		sources_wg.Add(1)
+
+		go func(src source.Source) {
+
+			defer sources_wg.Done()
+
+			err := src.Start(ctx, ps_messages)
 
 			if err != nil {
-				logger.Error("Failed to complete %s process for task (%s) because: %s", name, task, err)
-				ok_pre = false
-				break
+				logger.Error("Failed to read messages from %s source, because %s", src.Name(), err)
+				tracker.SourceFailed(src, err)
+				atomic.StoreInt32(&sources_failed, 1)
+				return
 			}
 
-		}
+			logger.Debug("Finished reading messages from %s source", src.Name())
+		}(src)
+	}
 
-		if !ok_pre {
-			logger.Debug("Skipping remaining for processes for task %s", task)
-			continue
-		}
+	// once every source has finished (which, for sources like 'stdin://', may happen
+	// before we've been told to shut down) there won't be any more messages
 
-		wg := new(sync.WaitGroup)
+	go func() {
+		sources_wg.Wait()
+		close(ps_messages)
+	}()
 
-		for _, pr := range processors_async {
+	go func() {
 
-			name := pr.Name()
-			logger.Debug("Invoking async processor %s (%s)", name, task)
+		defer close(up_messages)
 
-			wg.Add(1)
+		logger.Debug("Ready to process (updated) messages")
 
-			go func(pr process.Process, wg *sync.WaitGroup) {
-				defer wg.Done()
-				pr.ProcessTask(task)
-			}(pr, wg)
+		for {
 
-		}
+			var msg *source.Message
+			var ok bool
 
-		// This does not account for things that might still be in a
-		// pending queue waiting to be processed, usually because some
-		// other earlier process hasn't finished (20161227/thisisaaronland)
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok = <-ps_messages:
+				// pass
+			}
 
-		wg.Wait()
+			if !ok {
+				return
+			}
+
+			metrics_messages.Inc()
+
+			tasks, err := message.Decode(msg.Body, logger)
+
+			// there's no point in seeing a message that can't be read again so
+			// it is acknowledged anyway
+
+			if err != nil {
+				logger.Error("Failed to read data: %s", err)
+				metrics_invalid.Inc()
+				msg.Ack()
+				continue
+			}
+
+			for _, t := range tasks {
+				metrics_tasks.Inc(t.Repo)
+			}
+
+			if len(tasks) == 0 {
+				msg.Ack()
+				continue
+			}
+
+			for idx, t := range tasks {
 
-		for _, pr := range processors_post {
+				it := inboundTask{task: t}
 
-			name := pr.Name()
-			logger.Debug("Invoking post-processor %s (%s)", name, task)
+				if idx == len(tasks)-1 {
+					it.ack = msg.Ack
+				}
 
-			pr.ProcessTask(task)
+				select {
+				case up_messages <- it:
+					// pass
+				case <-ctx.Done():
+					return
+				}
+			}
 		}
+	}()
+
+	logger.Debug("Ready to process (updated) tasks")
+
+	for idx, pr := range processors_pre {
+		tracker.AddProcessor(pre_keys[idx], "pre", pr)
+	}
+
+	for idx, pr := range processors_async {
+		tracker.AddProcessor(async_keys[idx], "async", pr)
+	}
+
+	for idx, pr := range processors_post {
+		tracker.AddProcessor(post_keys[idx], "post", pr)
+	}
+
+	for idx, pr := range all_processors {
+
+		interval := intervals[idx]
+
+		logger.Debug("Set up monitoring for %s, flushing every %v", pr.Name(), interval)
+
+		go func(pr process.Process, interval time.Duration) {
 
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+
+					// what happened to each task's files has already been reported
+					// by processors that implement process.Deferred
+
+					err := pr.Flush(ctx)
+
+					if err != nil {
+						logger.Debug("Failed to flush %s, because %s", pr.Name(), err)
+					}
+				}
+			}
+		}(pr, interval)
+	}
+
+	// tasks that have already been started are allowed to finish even if we've been
+	// told to shut down so they get their own context
+
+	task_ctx := context.Background()
+
+	var jrnl *journal.Journal
+
+	if *journal_dir != "" {
+
+		j, err := journal.NewJournal(*journal_dir, *journal_segment_size)
+
+		if err != nil {
+			logger.Fatal("Failed to open journal, because %s", err)
+		}
+
+		jrnl = j
+
+		go func() {
+
+			ticker := time.NewTicker(time.Second * 5)
+			defer ticker.Stop()
+
+			for {
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+
+					err := jrnl.AckDeferred()
+
+					if err != nil {
+						logger.Warning("Failed to acknowledge deferred journal entries, because %s", err)
+					}
+				}
+			}
+		}()
+	}
+
+	var dlq *deadletter.Store
+
+	if *deadletter_dir != "" {
+
+		s, err := deadletter.NewStore(*deadletter_dir)
+
+		if err != nil {
+			logger.Fatal("Failed to open dead letter store, because %s", err)
+		}
+
+		dlq = s
+	}
+
+	// ack records that the processor identified by key is done with the journal entry id,
+	// or will be once it has finished with (or given up on) any of the task's files it is
+	// still holding on to
+
+	ack := func(id int64, key string, pr process.Process, task updated.UpdateTask) {
+
+		if jrnl == nil || id == 0 {
+			return
+		}
+
+		d, ok := pr.(process.Deferred)
+
+		if ok && d.IsTaskPending(task) {
+
+			jrnl.AckWhen(id, key, func() bool {
+				return !d.IsTaskPending(task)
+			})
+
+			return
+		}
+
+		b, ok := pr.(process.Buffered)
+
+		if ok && b.IsPending(task.Repo) {
+
+			repo := task.Repo
+
+			jrnl.AckWhen(id, key, func() bool {
+				return !b.IsPending(repo)
+			})
+
+			return
+		}
+
+		err := jrnl.Ack(id, key)
+
+		if err != nil {
+			logger.Warning("Failed to acknowledge journal entry %d for %s, because %s", id, key, err)
+		}
+	}
+
+	// task_event returns an event about task, identified by task_id, for the processor pr
+	// (which may be nil) running in stage
+
+	task_event := func(name string, level string, task_id string, task updated.UpdateTask, stage string, pr process.Process) *events.Event {
+
+		e := events.Event{
+			Name:   name,
+			Level:  level,
+			TaskId: task_id,
+			Repo:   task.Repo,
+			Hash:   task.Hash,
+			Stage:  stage,
+			Files:  len(task.Files),
+		}
+
+		if pr != nil {
+			e.Processor = pr.Name()
+		}
+
+		return &e
+	}
+
+	// deadletter records task in the dead letter store (assuming there is one) on behalf
+	// of the processor identified by key, returning true if it was
+
+	dead_letter := func(key string, stage string, pr process.Process, task updated.UpdateTask, task_id string, err error, attempts int) bool {
+
+		if dlq == nil {
+			return false
+		}
+
+		l := deadletter.NewLetter(key, stage, task, err, attempts)
+
+		put_err := dlq.Put(l)
+
+		if put_err != nil {
+			logger.Error("Failed to add task (%s) to dead letter store, because %s", task, put_err)
+			return false
+		}
+
+		e := task_event(events.TaskDeadLettered, events.LevelWarning, task_id, task, stage, pr)
+		e.Message = fmt.Sprintf("Added task (%s) for %s to dead letter store as %s", task, pr.Name(), l.Id)
+		e.Error = err.Error()
+		event_logger.Emit(e)
+
+		// the dead letter store is now responsible for the task's files so the
+		// processor shouldn't keep trying them
+
+		d, ok := pr.(process.Deferred)
+
+		if ok {
+			d.Discard(task)
+		}
+
+		return true
+	}
+
+	// processors that finish with files after ProcessTask has returned report what
+	// happened to them here, long after run (below) has recorded the task as pending
+
+	for stage, keys := range map[string][]string{"pre": pre_keys, "async": async_keys, "post": post_keys} {
+
+		var stage_processors []process.Process
+
+		switch stage {
+		case "pre":
+			stage_processors = processors_pre
+		case "async":
+			stage_processors = processors_async
+		default:
+			stage_processors = processors_post
+		}
+
+		for idx, pr := range stage_processors {
+
+			d, ok := pr.(process.Deferred)
+
+			if !ok {
+				continue
+			}
+
+			key := keys[idx]
+			stage := stage
+			pr := pr
+
+			d.SetReporter(func(r *process.BatchResult) {
+
+				task := r.Task
+
+				if r.Error == nil {
+
+					metrics_processed.Add(float64(len(task.Files)), pr.Name(), metric_uris[key], task.Repo)
+					tracker.Success(key, task)
+
+					e := task_event(events.ProcessCompleted, events.LevelInfo, r.TaskId, task, stage, pr)
+					e.Message = fmt.Sprintf("Completed %s process for buffered files in task (%s)", pr.Name(), task)
+					e.Attempts = r.Attempts
+					event_logger.Emit(e)
+
+					return
+				}
+
+				tracker.Failure(key, task, r.Error)
+
+				e := task_event(events.ProcessFailed, events.LevelWarning, r.TaskId, task, stage, pr)
+				e.Message = fmt.Sprintf("Failed to complete %s process for buffered files in task (%s), will try again, because: %s", pr.Name(), task, r.Error)
+				e.Attempts = r.Attempts
+				e.Error = r.Error.Error()
+
+				if r.Abandoned {
+					e.Level = events.LevelError
+					e.Message = fmt.Sprintf("Gave up on %s process for buffered files in task (%s) after %d attempt(s) because: %s", pr.Name(), task, r.Attempts, r.Error)
+				}
+
+				event_logger.Emit(e)
+
+				if r.Abandoned {
+					metrics_failed.Add(float64(len(task.Files)), pr.Name(), metric_uris[key], task.Repo)
+					dead_letter(key, stage, pr, task, r.TaskId, r.Error, r.Attempts)
+				}
+			})
+		}
+	}
+
+	// run invokes a processor, retrying it according to its policy, and if it still
+	// fails records the task in the dead letter store (assuming there is one). It returns
+	// whether or not the task was dead-lettered and the last error. The outcome is added
+	// to results, which processors can read from their context, so that post-processors
+	// can report on what happened to the task. If the processor is still holding on to
+	// some of the task's files the outcome is pending, rather than a success, and what
+	// eventually happens to them is reported above.
+
+	run := func(stage string, key string, pr process.Process, task updated.UpdateTask, task_id string, results *process.Results) (bool, error) {
+
+		e := task_event(events.ProcessStarted, events.LevelDebug, task_id, task, stage, pr)
+		e.Message = fmt.Sprintf("Invoking %s processor %s (%s)", stage, pr.Name(), task)
+		event_logger.Emit(e)
+
+		t1 := time.Now()
+
+		run_ctx := events.WithTaskId(task_ctx, task_id)
+		run_ctx = process.WithResults(run_ctx, results)
+
+		attempts, err := retry.Do(run_ctx, policies[key], func(ctx context.Context) error {
+			return pr.ProcessTask(ctx, task)
+		})
+
+		duration := time.Since(t1).Seconds()
+		metrics_duration.Observe(duration, pr.Name(), metric_uris[key])
+
+		result := process.Result{
+			Processor: pr.Name(),
+			Stage:     stage,
+			Attempts:  attempts,
+			Duration:  duration,
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		d, deferred := pr.(process.Deferred)
+
+		if err == nil && deferred && d.IsTaskPending(task) {
+
+			result.Pending = true
+			results.Add(result)
+
+			e := task_event(events.ProcessPending, events.LevelInfo, task_id, task, stage, pr)
+			e.Message = fmt.Sprintf("Accepted task (%s) for %s process, some files are still waiting to be processed", task, pr.Name())
+			e.Attempts = attempts
+			e.Duration = duration
+			event_logger.Emit(e)
+
+			return false, nil
+		}
+
+		results.Add(result)
+
+		if err == nil {
+
+			metrics_processed.Add(float64(len(task.Files)), pr.Name(), metric_uris[key], task.Repo)
+			tracker.Success(key, task)
+
+			e := task_event(events.ProcessCompleted, events.LevelInfo, task_id, task, stage, pr)
+			e.Message = fmt.Sprintf("Completed %s process for task (%s)", pr.Name(), task)
+			e.Attempts = attempts
+			e.Duration = duration
+			event_logger.Emit(e)
+
+			return false, nil
+		}
+
+		metrics_failed.Add(float64(len(task.Files)), pr.Name(), metric_uris[key], task.Repo)
+		tracker.Failure(key, task, err)
+
+		e = task_event(events.ProcessFailed, events.LevelError, task_id, task, stage, pr)
+		e.Message = fmt.Sprintf("Failed to complete %s process for task (%s) after %d attempt(s) because: %s", pr.Name(), task, attempts, err)
+		e.Attempts = attempts
+		e.Duration = duration
+		e.Error = err.Error()
+		event_logger.Emit(e)
+
+		return dead_letter(key, stage, pr, task, task_id, err, attempts), err
+	}
+
+	// reject records that the processor identified by key failed to process task without
+	// running it, because of err, the same way that run records a processor that fails.
+	// It returns whether or not the task was dead-lettered.
+
+	reject := func(stage string, key string, pr process.Process, task updated.UpdateTask, task_id string, results *process.Results, err error) bool {
+
+		result := process.Result{
+			Processor: pr.Name(),
+			Stage:     stage,
+			Error:     err.Error(),
+		}
+
+		results.Add(result)
+
+		metrics_failed.Add(float64(len(task.Files)), pr.Name(), metric_uris[key], task.Repo)
+		tracker.Failure(key, task, err)
+
+		e := task_event(events.ProcessFailed, events.LevelError, task_id, task, stage, pr)
+		e.Message = fmt.Sprintf("Failed to route task (%s) to %s process because: %s", task, pr.Name(), err)
+		e.Error = err.Error()
+		event_logger.Emit(e)
+
+		return dead_letter(key, stage, pr, task, task_id, err, 0)
+	}
+
+	// notify sends a notification about task, once, with the post-processor identified by
+	// key. Notifications aren't retried and a notification that can't be sent doesn't
+	// mean the task failed, so the task is never dead-lettered because of one.
+
+	notify := func(key string, pr process.Process, n process.Notifier, task updated.UpdateTask, task_id string, results *process.Results) {
+
+		e := task_event(events.ProcessStarted, events.LevelDebug, task_id, task, "post", pr)
+		e.Message = fmt.Sprintf("Invoking post processor %s (%s)", pr.Name(), task)
+		event_logger.Emit(e)
+
+		t1 := time.Now()
+
+		run_ctx := events.WithTaskId(task_ctx, task_id)
+		run_ctx = process.WithResults(run_ctx, results)
+
+		err := n.Notify(run_ctx, task)
+
+		duration := time.Since(t1).Seconds()
+		metrics_duration.Observe(duration, pr.Name(), metric_uris[key])
+
+		if err == nil {
+
+			tracker.Success(key, task)
+
+			e := task_event(events.ProcessCompleted, events.LevelInfo, task_id, task, "post", pr)
+			e.Message = fmt.Sprintf("Completed %s process for task (%s)", pr.Name(), task)
+			e.Attempts = 1
+			e.Duration = duration
+			event_logger.Emit(e)
+
+			return
+		}
+
+		tracker.Failure(key, task, err)
+
+		e = task_event(events.ProcessFailed, events.LevelWarning, task_id, task, "post", pr)
+		e.Message = fmt.Sprintf("Failed to send %s notification for task (%s) because: %s", pr.Name(), task, err)
+		e.Attempts = 1
+		e.Duration = duration
+		e.Error = err.Error()
+		event_logger.Emit(e)
+	}
+
+	// resolve returns the files changed by a task's commit (or range of commits) according
+	// to the copy of its repo in -data-root
+
+	resolve := func(task updated.UpdateTask) ([]updated.UpdateFile, error) {
+
+		r, err := git.NewRepo(filepath.Join(*data_root, task.Repo), logger)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return r.Changes(task_ctx, task.Hash)
+	}
+
+	// acked is nil for new tasks and the list of processors that have already
+	// completed a task when it is being replayed from the journal
+
+	process_task := func(task updated.UpdateTask, id int64, acked map[string]bool) {
+
+		// the task ID is included in every event about the task, and passed to
+		// processors in the context, so that it can be followed through every stage
+
+		task_id := events.NewTaskId()
+		results := process.NewResults()
+		t1 := time.Now()
+
+		if jrnl != nil && id == 0 {
+
+			new_id, err := jrnl.Append(task, all_keys)
+
+			if err != nil {
+				logger.Error("Failed to record task (%s) in journal, because %s", task, err)
+			} else {
+				id = new_id
+			}
+		}
+
+		e := task_event(events.TaskReceived, events.LevelStatus, task_id, task, "", nil)
+		e.Message = fmt.Sprintf("Processing commit %s (%s)", task.Hash, task.Repo)
+		e.JournalId = id
+		event_logger.Emit(e)
+
+		// failed is the number of processors that failed to complete the task
+
+		var failed int32
+
+		defer func() {
+
+			e := task_event(events.TaskCompleted, events.LevelInfo, task_id, task, "", nil)
+			e.Message = fmt.Sprintf("Finished processing commit %s (%s)", task.Hash, task.Repo)
+			e.Duration = time.Since(t1).Seconds()
+
+			n := atomic.LoadInt32(&failed)
+
+			if n > 0 {
+				e.Name = events.TaskFailed
+				e.Level = events.LevelError
+				e.Message = fmt.Sprintf("Failed to process commit %s (%s)", task.Hash, task.Repo)
+				e.Error = fmt.Sprintf("%d processor(s) failed", n)
+			}
+
+			event_logger.Emit(e)
+		}()
+
+		// route_task returns the part of the task that the processor identified by key
+		// should handle, according to the routing rules, or false if it shouldn't be run
+		// at all, in which case it is acknowledged in the journal straight away. Files
+		// whose records don't match the processor's filter are passed on as deletions, so
+		// that records which stop matching are removed. If the filter can't be applied
+		// then an error is returned, along with the task as it was routed. The task is
+		// routed the first time it is called, which is once its files have been resolved
+		// unless a pre-processor failed.
+
+		var routed map[string]updated.UpdateTask
+
+		route_task := func(key string) (updated.UpdateTask, bool, error) {
+
+			t := task
+			ok := true
+
+			if router != nil {
+
+				if routed == nil {
+					routed = router.Route(task)
+				}
+
+				t, ok = routed[key]
+
+				if !ok {
+					logger.Debug("Routing rules skip %s for task (%s)", key, task)
+				}
+			}
+
+			f, has_filter := filters[key]
+
+			if ok && has_filter && len(t.Files) > 0 {
+
+				files, err := f.Apply(t.Repo, t.Files)
+
+				if err != nil {
+					return t, false, err
+				}
+
+				t.Files = files
+			}
+
+			if !ok && jrnl != nil && id != 0 {
+				jrnl.Ack(id, key)
+			}
+
+			return t, ok, nil
+		}
+
+		// post-processors that send notifications report on whatever happened to the
+		// task, so they are run last however far the task got
+
+		defer func() {
+
+			for idx, pr := range processors_post {
+
+				n, ok := pr.(process.Notifier)
+
+				if !ok {
+					continue
+				}
+
+				key := post_keys[idx]
+
+				if acked[key] {
+					continue
+				}
+
+				// a notification is still sent if the notifier's filter can't be
+				// applied, just without filtering
+
+				routed_task, ok, err := route_task(key)
+
+				if err != nil {
+					logger.Warning("Failed to filter task (%s) for %s, because %s", task, key, err)
+					ok = true
+				}
+
+				if !ok {
+					continue
+				}
+
+				notify(key, pr, n, routed_task, task_id, results)
+				ack(id, key, pr, routed_task)
+			}
+		}()
+
+		ok_pre := true
+
+		for idx, pr := range processors_pre {
+
+			key := pre_keys[idx]
+
+			if acked[key] {
+				continue
+			}
+
+			dead, err := run("pre", key, pr, task, task_id, results)
+
+			if err != nil {
+
+				atomic.AddInt32(&failed, 1)
+
+				// the dead letter store is now responsible for the task so there's
+				// no point in replaying it from the journal
+
+				if dead && jrnl != nil && id != 0 {
+
+					for _, k := range all_keys {
+
+						// notifiers still run, and acknowledge the task themselves
+
+						if notifier_keys[k] {
+							continue
+						}
+
+						jrnl.Ack(id, k)
+					}
+				}
+
+				ok_pre = false
+				break
+			}
+
+			ack(id, key, pr, task)
+		}
+
+		if !ok_pre {
+			logger.Debug("Skipping remaining for processes for task %s", task)
+			return
+		}
+
+		// tasks that only name a commit (or a range of commits) have their files
+		// worked out from the repo, now that any pre-processors have updated it
+
+		if *resolve_files && len(task.Files) == 0 {
+
+			files, err := resolve(task)
+
+			if err != nil {
+
+				atomic.AddInt32(&failed, 1)
+
+				logger.Error("Failed to determine files for task (%s), because %s", task, err)
+
+				if dlq == nil {
+					return
+				}
+
+				l := deadletter.NewLetter("resolve", "pre", task, err, 1)
+
+				put_err := dlq.Put(l)
+
+				if put_err != nil {
+					logger.Error("Failed to add task (%s) to dead letter store, because %s", task, put_err)
+					return
+				}
+
+				e := task_event(events.TaskDeadLettered, events.LevelWarning, task_id, task, "pre", nil)
+				e.Processor = "resolve"
+				e.Message = fmt.Sprintf("Added task (%s) to dead letter store as %s", task, l.Id)
+				e.Error = err.Error()
+				event_logger.Emit(e)
+
+				if jrnl != nil && id != 0 {
+
+					for _, k := range all_keys {
+
+						if notifier_keys[k] {
+							continue
+						}
+
+						jrnl.Ack(id, k)
+					}
+				}
+
+				return
+			}
+
+			task.Files = files
+
+			e := task_event(events.TaskResolved, events.LevelDebug, task_id, task, "pre", nil)
+			e.Message = fmt.Sprintf("Determined %d files for task (%s)", len(files), task)
+			event_logger.Emit(e)
+
+		} else if len(task.Files) == 0 {
+
+			// there's nothing for the remaining processors to do but that doesn't
+			// mean the task is done, so it isn't acknowledged and is replayed from
+			// the journal (hopefully with -resolve-files) next time
+
+			remaining := false
+
+			for _, key := range append(append([]string{}, async_keys...), post_keys...) {
+
+				if !acked[key] && !notifier_keys[key] {
+					remaining = true
+				}
+			}
+
+			if remaining {
+				logger.Warning("Task (%s) doesn't list any files and -resolve-files is not enabled, skipping remaining processors", task)
+				return
+			}
+		}
+
+		wg := new(sync.WaitGroup)
+
+		for idx, pr := range processors_async {
+
+			key := async_keys[idx]
+
+			if acked[key] {
+				continue
+			}
+
+			routed_task, ok, err := route_task(key)
+
+			if err != nil {
+
+				atomic.AddInt32(&failed, 1)
+
+				if reject("async", key, pr, routed_task, task_id, results, err) && jrnl != nil && id != 0 {
+					jrnl.Ack(id, key)
+				}
+
+				continue
+			}
+
+			if !ok {
+				continue
+			}
+
+			wg.Add(1)
+
+			go func(pr process.Process, key string, task updated.UpdateTask, wg *sync.WaitGroup) {
+
+				defer wg.Done()
+
+				dead, err := run("async", key, pr, task, task_id, results)
+
+				if err != nil {
+
+					atomic.AddInt32(&failed, 1)
+
+					if dead && jrnl != nil && id != 0 {
+						jrnl.Ack(id, key)
+					}
+
+					return
+				}
+
+				ack(id, key, pr, task)
+
+			}(pr, key, routed_task, wg)
+
+		}
+
+		// This does not account for things that might still be in a
+		// pending queue waiting to be processed, usually because some
+		// other earlier process hasn't finished (20161227/thisisaaronland)
+
+		wg.Wait()
+
+		for idx, pr := range processors_post {
+
+			key := post_keys[idx]
+
+			if acked[key] {
+				continue
+			}
+
+			// see above
+
+			if notifier_keys[key] {
+				continue
+			}
+
+			routed_task, ok, err := route_task(key)
+
+			if err != nil {
+
+				atomic.AddInt32(&failed, 1)
+
+				if reject("post", key, pr, routed_task, task_id, results, err) && jrnl != nil && id != 0 {
+					jrnl.Ack(id, key)
+				}
+
+				continue
+			}
+
+			if !ok {
+				continue
+			}
+
+			dead, err := run("post", key, pr, routed_task, task_id, results)
+
+			if err != nil {
+
+				atomic.AddInt32(&failed, 1)
+
+				if dead && jrnl != nil && id != 0 {
+					jrnl.Ack(id, key)
+				}
+
+				continue
+			}
+
+			ack(id, key, pr, routed_task)
+		}
+	}
+
+	if jrnl != nil {
+
+		configured := make(map[string]bool)
+
+		for _, key := range all_keys {
+			configured[key] = true
+		}
+
+		for _, e := range jrnl.Pending() {
+
+			if ctx.Err() != nil {
+				break
+			}
+
+			acked := make(map[string]bool)
+			replay := false
+
+			for _, key := range e.Processors {
+
+				if e.IsAcknowledged(key) {
+					acked[key] = true
+					continue
+				}
+
+				// the processor is no longer configured so there is no way
+				// it will ever acknowledge the task...
+
+				if !configured[key] {
+					logger.Warning("Journal entry %d is waiting on %s which is no longer configured, skipping", e.Id, key)
+					jrnl.Ack(e.Id, key)
+					continue
+				}
+
+				replay = true
+			}
+
+			if !replay {
+				continue
+			}
+
+			logger.Status("Replaying journal entry %d (%s)", e.Id, e.Task)
+			process_task(e.Task, e.Id, acked)
+		}
+	}
+
+	for {
+
+		var it inboundTask
+		var ok bool
+
+		select {
+		case <-ctx.Done():
+			// pass
+		case it, ok = <-up_messages:
+			// pass
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if !ok {
+			logger.Status("No more messages to process")
+			break
+		}
+
+		process_task(it.task, 0, nil)
+
+		if it.ack != nil {
+			it.ack()
+		}
+	}
+
+	// stop anything else (sources, tickers) that might still be running if we got
+	// here because there are no more messages
+
+	cancel()
+
+	logger.Status("Stopped consuming tasks, closing processors")
+
+	close_ctx, close_cancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+	defer close_cancel()
+
+	exit_code := 0
+
+	if atomic.LoadInt32(&sources_failed) != 0 {
+		exit_code = 1
+	}
+
+	for _, pr := range all_processors {
+
+		logger.Debug("Close %s", pr.Name())
+
+		err := pr.Close(close_ctx)
+
+		if err != nil {
+			logger.Error("Failed to close %s cleanly, because %s", pr.Name(), err)
+			exit_code = 1
+		}
+	}
+
+	for _, server := range http_servers {
+		server.Shutdown(close_ctx)
+	}
+
+	if jrnl != nil {
+
+		err := jrnl.AckDeferred()
+
+		if err != nil {
+			logger.Warning("Failed to acknowledge deferred journal entries, because %s", err)
+		}
+
+		err = jrnl.Close()
+
+		if err != nil {
+			logger.Error("Failed to close journal, because %s", err)
+			exit_code = 1
+		}
 	}
 
-	os.Exit(0)
+	logger.Status("Shut down wof-updated")
+	os.Exit(exit_code)
 }
@@ -0,0 +1,538 @@
+package config
+
+// A config file is a JSON document that describes the same things as wof-updated's
+// flags: sources, the pre, async and post processor pipelines (with per-repo overrides)
+// and logging. Rather than duplicating what every flag does the config is turned back in
+// to flag values, which is what lets flags and WOF_UPDATED_* environment variables take
+// precedence over it.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables that override config files. The
+// rest of the name is the flag's name in upper case with dashes replaced by underscores,
+// for example WOF_UPDATED_DATA_ROOT for -data-root.
+
+const EnvPrefix = "WOF_UPDATED_"
+
+// these flags may be passed more than once, and their environment variables may list
+// more than one value separated by whitespace
+
+var multi_flags = map[string]bool{
+	"source":          true,
+	"pre-process":     true,
+	"process":         true,
+	"post-process":    true,
+	"tile38-endpoint": true,
+}
+
+// ProcessConfig is a processor URI plus (optionally) parameters that are added to its
+// query string, and parameters for individual repos which are added as '{PARAM}.{REPO}'
+// (for example 'branch.whosonfirst-data'). In a config file it may also be written as
+// just the URI.
+
+type ProcessConfig struct {
+	URI    string                       `json:"uri"`
+	Params map[string]string            `json:"params,omitempty"`
+	Repos  map[string]map[string]string `json:"repos,omitempty"`
+}
+
+func (pc *ProcessConfig) UnmarshalJSON(b []byte) error {
+
+	var uri string
+
+	err := json.Unmarshal(b, &uri)
+
+	if err == nil {
+		pc.URI = uri
+		return nil
+	}
+
+	type process_config ProcessConfig
+
+	var c process_config
+
+	err = strictUnmarshal(b, &c)
+
+	if err != nil {
+		return err
+	}
+
+	*pc = ProcessConfig(c)
+	return nil
+}
+
+// String returns the processor's URI with all of its parameters.
+
+func (pc *ProcessConfig) String() (string, error) {
+
+	if pc.URI == "" {
+		return "", errors.New("Missing processor URI")
+	}
+
+	if len(pc.Params) == 0 && len(pc.Repos) == 0 {
+		return pc.URI, nil
+	}
+
+	u, err := url.Parse(pc.URI)
+
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+
+	for k, v := range pc.Params {
+		q.Set(k, v)
+	}
+
+	for repo, params := range pc.Repos {
+
+		for k, v := range params {
+			q.Set(fmt.Sprintf("%s.%s", k, repo), v)
+		}
+	}
+
+	// the URI is put back together by hand because url.URL.String drops the '//'
+	// from URIs without a host, like 'pull://'
+
+	base := strings.SplitN(pc.URI, "?", 2)[0]
+	return base + "?" + q.Encode(), nil
+}
+
+type PipelineConfig struct {
+	Pre   []ProcessConfig `json:"pre,omitempty"`
+	Async []ProcessConfig `json:"async,omitempty"`
+	Post  []ProcessConfig `json:"post,omitempty"`
+}
+
+type SlackConfig struct {
+	Enabled *bool    `json:"enabled,omitempty"`
+	Config  *string  `json:"config,omitempty"`
+	Level   *string  `json:"level,omitempty"`
+	Events  []string `json:"events,omitempty"`
+}
+
+type LogConfig struct {
+	Level  *string      `json:"level,omitempty"`
+	Format *string      `json:"format,omitempty"`
+	File   *string      `json:"file,omitempty"`
+	Prefix *string      `json:"prefix,omitempty"`
+	Stdout *bool        `json:"stdout,omitempty"`
+	Slack  *SlackConfig `json:"slack,omitempty"`
+}
+
+type JournalConfig struct {
+	Dir         *string `json:"dir,omitempty"`
+	SegmentSize *int64  `json:"segment_size,omitempty"`
+}
+
+type RetryConfig struct {
+	Attempts   *int     `json:"attempts,omitempty"`
+	Backoff    *string  `json:"backoff,omitempty"`
+	MaxBackoff *string  `json:"max_backoff,omitempty"`
+	Jitter     *float64 `json:"jitter,omitempty"`
+}
+
+// ElasticsearchConfig, S3Config and Tile38Config are the settings used by the es, s3 and
+// tile38 processors that are configured with -processors, rather than with a URI.
+
+type ElasticsearchConfig struct {
+	Host  *string `json:"host,omitempty"`
+	Port  *string `json:"port,omitempty"`
+	Index *string `json:"index,omitempty"`
+}
+
+type S3Config struct {
+	Bucket *string `json:"bucket,omitempty"`
+	Prefix *string `json:"prefix,omitempty"`
+}
+
+type Tile38Config struct {
+	Endpoints  []string `json:"endpoints,omitempty"`
+	Collection *string  `json:"collection,omitempty"`
+}
+
+// PubSubConfig is where the pubsub post-processor that is configured with
+// -post-processors publishes notifications.
+
+type PubSubConfig struct {
+	Host    *string `json:"host,omitempty"`
+	Port    *int    `json:"port,omitempty"`
+	Channel *string `json:"channel,omitempty"`
+}
+
+// RedisConfig is the Redis source that is used if there aren't any other sources.
+
+type RedisConfig struct {
+	Host      *string `json:"host,omitempty"`
+	Port      *int    `json:"port,omitempty"`
+	Channel   *string `json:"channel,omitempty"`
+	Mode      *string `json:"mode,omitempty"`
+	Group     *string `json:"group,omitempty"`
+	Consumer  *string `json:"consumer,omitempty"`
+	ClaimIdle *string `json:"claim_idle,omitempty"`
+}
+
+// Config is everything a config file may contain. Anything that is left out keeps the
+// value of the equivalent flag. Durations are strings like "60s" or "5m". Routing is
+// either the path to a file of routing rules or the rules themselves.
+
+type Config struct {
+	DataRoot        *string              `json:"data_root,omitempty"`
+	Sources         []string             `json:"sources,omitempty"`
+	Processors      *PipelineConfig      `json:"processors,omitempty"`
+	Log             *LogConfig           `json:"log,omitempty"`
+	Journal         *JournalConfig       `json:"journal,omitempty"`
+	Retry           *RetryConfig         `json:"retry,omitempty"`
+	DeadLetterDir   *string              `json:"deadletter_dir,omitempty"`
+	ResolveFiles    *bool                `json:"resolve_files,omitempty"`
+	FlushInterval   *string              `json:"flush_interval,omitempty"`
+	MetricsAddr     *string              `json:"metrics_addr,omitempty"`
+	StatusAddr      *string              `json:"status_addr,omitempty"`
+	ShutdownTimeout *string              `json:"shutdown_timeout,omitempty"`
+	Routing         json.RawMessage      `json:"routing,omitempty"`
+	Elasticsearch   *ElasticsearchConfig `json:"es,omitempty"`
+	S3              *S3Config            `json:"s3,omitempty"`
+	Tile38          *Tile38Config        `json:"tile38,omitempty"`
+	PubSub          *PubSubConfig        `json:"pubsub,omitempty"`
+	Redis           *RedisConfig         `json:"redis,omitempty"`
+}
+
+// Load reads the config file at path. Unknown keys are errors, so that typos don't go
+// unnoticed.
+
+func Load(path string) (*Config, error) {
+
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+
+	err = strictUnmarshal(body, &c)
+
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse %s, %s", path, err)
+		return nil, errors.New(msg)
+	}
+
+	return &c, nil
+}
+
+// FlagValues returns the flag values that are equivalent to c, keyed by flag name.
+
+func (c *Config) FlagValues() (map[string][]string, error) {
+
+	values := make(map[string][]string)
+
+	set_string := func(name string, v *string) {
+
+		if v != nil {
+			values[name] = []string{*v}
+		}
+	}
+
+	set_bool := func(name string, v *bool) {
+
+		if v != nil {
+			values[name] = []string{strconv.FormatBool(*v)}
+		}
+	}
+
+	set_int := func(name string, v *int) {
+
+		if v != nil {
+			values[name] = []string{strconv.Itoa(*v)}
+		}
+	}
+
+	set_string("data-root", c.DataRoot)
+
+	if len(c.Sources) > 0 {
+		values["source"] = c.Sources
+	}
+
+	if c.Processors != nil {
+
+		stages := map[string][]ProcessConfig{
+			"pre-process":  c.Processors.Pre,
+			"process":      c.Processors.Async,
+			"post-process": c.Processors.Post,
+		}
+
+		for name, procs := range stages {
+
+			if len(procs) == 0 {
+				continue
+			}
+
+			uris := make([]string, 0)
+
+			for _, pc := range procs {
+
+				uri, err := pc.String()
+
+				if err != nil {
+					return nil, err
+				}
+
+				uris = append(uris, uri)
+			}
+
+			values[name] = uris
+		}
+	}
+
+	if c.Log != nil {
+
+		set_string("log-level", c.Log.Level)
+		set_string("log-format", c.Log.Format)
+		set_string("log-file", c.Log.File)
+		set_string("log-prefix", c.Log.Prefix)
+		set_bool("stdout", c.Log.Stdout)
+
+		if c.Log.Slack != nil {
+
+			set_bool("log-slack", c.Log.Slack.Enabled)
+			set_string("log-slack-conf", c.Log.Slack.Config)
+			set_string("log-slack-level", c.Log.Slack.Level)
+
+			if len(c.Log.Slack.Events) > 0 {
+				values["log-slack-events"] = []string{strings.Join(c.Log.Slack.Events, ",")}
+			}
+		}
+	}
+
+	if c.Journal != nil {
+
+		set_string("journal-dir", c.Journal.Dir)
+
+		if c.Journal.SegmentSize != nil {
+			values["journal-segment-size"] = []string{strconv.FormatInt(*c.Journal.SegmentSize, 10)}
+		}
+	}
+
+	if c.Retry != nil {
+
+		set_int("retry-attempts", c.Retry.Attempts)
+
+		set_string("retry-backoff", c.Retry.Backoff)
+		set_string("retry-max-backoff", c.Retry.MaxBackoff)
+
+		if c.Retry.Jitter != nil {
+			values["retry-jitter"] = []string{strconv.FormatFloat(*c.Retry.Jitter, 'f', -1, 64)}
+		}
+	}
+
+	set_string("deadletter-dir", c.DeadLetterDir)
+	set_bool("resolve-files", c.ResolveFiles)
+	set_string("flush-interval", c.FlushInterval)
+	set_string("metrics-addr", c.MetricsAddr)
+	set_string("status-addr", c.StatusAddr)
+	set_string("shutdown-timeout", c.ShutdownTimeout)
+
+	if c.Elasticsearch != nil {
+		set_string("es-host", c.Elasticsearch.Host)
+		set_string("es-port", c.Elasticsearch.Port)
+		set_string("es-index", c.Elasticsearch.Index)
+	}
+
+	if c.S3 != nil {
+		set_string("s3-bucket", c.S3.Bucket)
+		set_string("s3-prefix", c.S3.Prefix)
+	}
+
+	if c.Tile38 != nil {
+
+		if len(c.Tile38.Endpoints) > 0 {
+			values["tile38-endpoint"] = c.Tile38.Endpoints
+		}
+
+		set_string("tile38-collection", c.Tile38.Collection)
+	}
+
+	if c.PubSub != nil {
+		set_string("pubsub-host", c.PubSub.Host)
+		set_int("pubsub-port", c.PubSub.Port)
+		set_string("pubsub-channel", c.PubSub.Channel)
+	}
+
+	if c.Redis != nil {
+		set_string("redis-host", c.Redis.Host)
+		set_int("redis-port", c.Redis.Port)
+		set_string("redis-channel", c.Redis.Channel)
+		set_string("redis-mode", c.Redis.Mode)
+		set_string("redis-group", c.Redis.Group)
+		set_string("redis-consumer", c.Redis.Consumer)
+		set_string("redis-claim-idle", c.Redis.ClaimIdle)
+	}
+
+	if len(c.Routing) > 0 {
+
+		var path string
+
+		err := json.Unmarshal(c.Routing, &path)
+
+		if err == nil {
+			values["routing"] = []string{path}
+		} else {
+
+			var b bytes.Buffer
+
+			err := json.Compact(&b, c.Routing)
+
+			if err != nil {
+				return nil, err
+			}
+
+			values["routing"] = []string{b.String()}
+		}
+	}
+
+	return values, nil
+}
+
+// EnvName returns the name of the environment variable for the flag called name.
+
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Apply sets the flags in fs, for every flag that wasn't passed on the command line, to
+// the value of its WOF_UPDATED_* environment variable or, if there isn't one, its value
+// in c (which may be nil). fs must already have been parsed. Flags that can be passed
+// more than once get all of their values from the same place.
+
+func Apply(fs *flag.FlagSet, c *Config) error {
+
+	set_on_cmdline := make(map[string]bool)
+
+	fs.Visit(func(f *flag.Flag) {
+		set_on_cmdline[f.Name] = true
+	})
+
+	from_config := make(map[string][]string)
+
+	if c != nil {
+
+		values, err := c.FlagValues()
+
+		if err != nil {
+			return err
+		}
+
+		from_config = values
+	}
+
+	for name, _ := range from_config {
+
+		if fs.Lookup(name) == nil {
+			msg := fmt.Sprintf("Config sets unknown flag -%s", name)
+			return errors.New(msg)
+		}
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+
+		if err != nil || set_on_cmdline[f.Name] {
+			return
+		}
+
+		values, ok := envValues(f.Name)
+
+		if !ok {
+			values, ok = from_config[f.Name]
+		}
+
+		if !ok {
+			return
+		}
+
+		for _, v := range values {
+
+			set_err := fs.Set(f.Name, v)
+
+			if set_err != nil {
+				msg := fmt.Sprintf("Invalid value '%s' for -%s, %s", v, f.Name, set_err)
+				err = errors.New(msg)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// Describe returns the value of every flag in fs, sorted by name, for example to show
+// the configuration that wof-updated would run with. Each value (or each of the values of
+// a flag that may be passed more than once) is passed through redact, if it isn't nil, so
+// that credentials in URIs can be removed.
+
+func Describe(fs *flag.FlagSet, redact func(string) string) []string {
+
+	lines := make([]string, 0)
+
+	fs.VisitAll(func(f *flag.Flag) {
+
+		value := f.Value.String()
+
+		if redact != nil {
+
+			values := strings.Split(value, "\n")
+
+			for i, v := range values {
+				values[i] = redact(v)
+			}
+
+			value = strings.Join(values, "\n")
+		}
+
+		if multi_flags[f.Name] {
+			value = strings.Replace(value, "\n", " ", -1)
+		}
+
+		lines = append(lines, fmt.Sprintf("-%s=%s", f.Name, value))
+	})
+
+	sort.Strings(lines)
+	return lines
+}
+
+func envValues(name string) ([]string, bool) {
+
+	v, ok := os.LookupEnv(EnvName(name))
+
+	if !ok {
+		return nil, false
+	}
+
+	if multi_flags[name] {
+		return strings.Fields(v), true
+	}
+
+	return []string{v}, true
+}
+
+func strictUnmarshal(b []byte, v interface{}) error {
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceSettings(t *testing.T) {
+
+	body := `{
+  "es": {"host": "es.example.com", "index": "spelunker"},
+  "s3": {"bucket": "example"},
+  "tile38": {"endpoints": ["one:9851", "two:9851"]},
+  "pubsub": {"port": 6380},
+  "redis": {"host": "redis.example.com", "mode": "stream", "claim_idle": "1m"}
+}`
+
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	err := ioutil.WriteFile(path, []byte(body), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write config, %s", err)
+	}
+
+	c, err := Load(path)
+
+	if err != nil {
+		t.Fatalf("Failed to load config, %s", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	es_host := fs.String("es-host", "localhost", "")
+	es_port := fs.String("es-port", "9200", "")
+	es_index := fs.String("es-index", "whosonfirst", "")
+	s3_bucket := fs.String("s3-bucket", "", "")
+	pubsub_port := fs.Int("pubsub-port", 6379, "")
+	redis_host := fs.String("redis-host", "localhost", "")
+	redis_mode := fs.String("redis-mode", "pubsub", "")
+	redis_claim_idle := fs.Duration("redis-claim-idle", time.Minute*5, "")
+
+	var endpoints testFlags
+	fs.Var(&endpoints, "tile38-endpoint", "")
+
+	fs.Parse([]string{"-es-index", "from-flag"})
+
+	err = Apply(fs, c)
+
+	if err != nil {
+		t.Fatalf("Failed to apply config, %s", err)
+	}
+
+	if *es_host != "es.example.com" || *es_port != "9200" || *es_index != "from-flag" {
+		t.Fatalf("Unexpected ES settings %s %s %s", *es_host, *es_port, *es_index)
+	}
+
+	if *s3_bucket != "example" || *pubsub_port != 6380 {
+		t.Fatalf("Unexpected S3 bucket %s or PubSub port %d", *s3_bucket, *pubsub_port)
+	}
+
+	if *redis_host != "redis.example.com" || *redis_mode != "stream" || *redis_claim_idle != time.Minute {
+		t.Fatalf("Unexpected Redis settings %s %s %v", *redis_host, *redis_mode, *redis_claim_idle)
+	}
+
+	if len(endpoints) != 2 || endpoints[1] != "two:9851" {
+		t.Fatalf("Unexpected Tile38 endpoints %v", endpoints)
+	}
+}
+
+func TestDescribeRedactsValues(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	var sources testFlags
+	fs.Var(&sources, "source", "")
+
+	fs.Parse([]string{"-source", "redis://localhost:6379/updated", "-source", "http://localhost:8080/?token=s33kret"})
+
+	redact := func(v string) string {
+		return strings.Replace(v, "s33kret", "xxxxx", -1)
+	}
+
+	lines := Describe(fs, redact)
+
+	if len(lines) != 1 || lines[0] != "-source=redis://localhost:6379/updated http://localhost:8080/?token=xxxxx" {
+		t.Fatalf("Unexpected description %v", lines)
+	}
+}
+
+type testFlags []string
+
+func (fl *testFlags) String() string {
+	return strings.Join(*fl, "\n")
+}
+
+func (fl *testFlags) Set(value string) error {
+	*fl = append(*fl, value)
+	return nil
+}
@@ -0,0 +1,200 @@
+package deadletter
+
+// The dead-letter store is just a directory of JSON files, one for each task that a
+// processor gave up on, so that they can be inspected (or fixed) by hand and then
+// re-queued with the wof-updated-deadletter tool.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const letter_ext = ".json"
+
+type Letter struct {
+	Id        string             `json:"id"`
+	Processor string             `json:"processor"`
+	Stage     string             `json:"stage"`
+	Task      updated.UpdateTask `json:"task"`
+	Error     string             `json:"error"`
+	Attempts  int                `json:"attempts"`
+	Created   int64              `json:"created"`
+}
+
+func NewLetter(processor string, stage string, task updated.UpdateTask, err error, attempts int) *Letter {
+
+	now := time.Now()
+
+	str_err := ""
+
+	if err != nil {
+		str_err = err.Error()
+	}
+
+	key := fmt.Sprintf("%d %s %s %s", now.UnixNano(), processor, task.Repo, task.Hash)
+
+	h := sha1.New()
+	h.Write([]byte(key))
+
+	id := fmt.Sprintf("%d-%s", now.Unix(), hex.EncodeToString(h.Sum(nil))[0:12])
+
+	l := Letter{
+		Id:        id,
+		Processor: processor,
+		Stage:     stage,
+		Task:      task,
+		Error:     str_err,
+		Attempts:  attempts,
+		Created:   now.Unix(),
+	}
+
+	return &l
+}
+
+type Store struct {
+	root string
+}
+
+func NewStore(root string) (*Store, error) {
+
+	root, err := filepath.Abs(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := Store{
+		root: root,
+	}
+
+	return &s, nil
+}
+
+func (s *Store) Put(l *Letter) error {
+
+	body, err := json.MarshalIndent(l, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that nothing ever sees a partial letter
+
+	tmpfile, err := ioutil.TempFile(s.root, ".deadletter")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpfile.Write(body)
+
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	err = tmpfile.Close()
+
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), s.path(l.Id))
+}
+
+func (s *Store) Get(id string) (*Letter, error) {
+
+	if strings.ContainsAny(id, "/\\") {
+		msg := fmt.Sprintf("Invalid dead letter ID '%s'", id)
+		return nil, errors.New(msg)
+	}
+
+	body, err := ioutil.ReadFile(s.path(id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var l Letter
+
+	err = json.Unmarshal(body, &l)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// List returns all the letters in the store, oldest first.
+
+func (s *Store) List() ([]*Letter, error) {
+
+	files, err := ioutil.ReadDir(s.root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*Letter, 0)
+
+	for _, info := range files {
+
+		fname := info.Name()
+
+		if strings.HasPrefix(fname, ".") || !strings.HasSuffix(fname, letter_ext) {
+			continue
+		}
+
+		l, err := s.Get(strings.TrimSuffix(fname, letter_ext))
+
+		if err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, l)
+	}
+
+	sort.Slice(letters, func(a, b int) bool {
+
+		if letters[a].Created == letters[b].Created {
+			return letters[a].Id < letters[b].Id
+		}
+
+		return letters[a].Created < letters[b].Created
+	})
+
+	return letters, nil
+}
+
+func (s *Store) Remove(id string) error {
+
+	if strings.ContainsAny(id, "/\\") {
+		msg := fmt.Sprintf("Invalid dead letter ID '%s'", id)
+		return errors.New(msg)
+	}
+
+	return os.Remove(s.path(id))
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.root, id+letter_ext)
+}
@@ -0,0 +1,204 @@
+package deadletter
+
+import (
+	"errors"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+
+	s, err := NewStore(filepath.Join(t.TempDir(), "deadletter"))
+
+	if err != nil {
+		t.Fatalf("Failed to create store, %s", err)
+	}
+
+	return s
+}
+
+func testTask(hash string) updated.UpdateTask {
+
+	task := updated.UpdateTask{
+		Hash: hash,
+		Repo: "whosonfirst-data",
+		Files: []updated.UpdateFile{
+			updated.NewUpdateFile("data/101/736/545/101736545.geojson", updated.ChangeModified),
+			updated.NewUpdateFile("data/85/632/685/85632685.geojson", updated.ChangeDeleted),
+		},
+	}
+
+	return task
+}
+
+func TestPutAndList(t *testing.T) {
+
+	s := newTestStore(t)
+
+	letters := []*Letter{
+		NewLetter("es://localhost:9200/whosonfirst", "async", testTask("one"), errors.New("broken"), 3),
+		NewLetter("s3://example", "async", testTask("two"), nil, 1),
+	}
+
+	// make sure the order doesn't depend on the IDs
+
+	letters[0].Created = 100
+	letters[1].Created = 50
+
+	for _, l := range letters {
+
+		err := s.Put(l)
+
+		if err != nil {
+			t.Fatalf("Failed to put %s, %s", l.Id, err)
+		}
+	}
+
+	// anything that isn't a letter, or is a partially written one, is ignored
+
+	err := ioutil.WriteFile(filepath.Join(s.root, ".deadletter123"), []byte("{"), 0644)
+
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s.root, "README.txt"), []byte("hello"), 0644)
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to write file, %s", err)
+	}
+
+	listed, err := s.List()
+
+	if err != nil {
+		t.Fatalf("Failed to list letters, %s", err)
+	}
+
+	if len(listed) != 2 || listed[0].Id != letters[1].Id || listed[1].Id != letters[0].Id {
+		t.Fatalf("Expected the letters oldest first, got %v", listed)
+	}
+
+	if !reflect.DeepEqual(listed[1], letters[0]) {
+		t.Fatalf("Expected %v, got %v", letters[0], listed[1])
+	}
+
+	if listed[1].Error != "broken" || listed[1].Attempts != 3 || listed[0].Error != "" {
+		t.Fatalf("Unexpected letters %v", listed)
+	}
+
+	l, err := s.Get(letters[0].Id)
+
+	if err != nil {
+		t.Fatalf("Failed to get %s, %s", letters[0].Id, err)
+	}
+
+	if !reflect.DeepEqual(l, letters[0]) {
+		t.Fatalf("Expected %v, got %v", letters[0], l)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+
+	s := newTestStore(t)
+
+	task := testTask("one")
+
+	err := s.Put(NewLetter("tile38://localhost:9851", "async", task, errors.New("broken"), 3))
+
+	if err != nil {
+		t.Fatalf("Failed to put letter, %s", err)
+	}
+
+	letters, err := s.List()
+
+	if err != nil {
+		t.Fatalf("Failed to list letters, %s", err)
+	}
+
+	// this is what wof-updated-deadletter -mode requeue does, minus sending the
+	// message to Redis
+
+	for _, format := range message.Formats() {
+
+		msg, err := message.Encode([]updated.UpdateTask{letters[0].Task}, format)
+
+		if err != nil {
+			t.Fatalf("Failed to encode %s, %s", format, err)
+		}
+
+		tasks, err := message.Decode(msg, log.SimpleWOFLogger())
+
+		if err != nil {
+			t.Fatalf("Failed to decode %s, %s", format, err)
+		}
+
+		if len(tasks) != 1 || !reflect.DeepEqual(tasks[0], task) {
+			t.Fatalf("Expected the re-queued (%s) task to be %v, got %v", format, task, tasks)
+		}
+	}
+
+	err = s.Remove(letters[0].Id)
+
+	if err != nil {
+		t.Fatalf("Failed to remove %s, %s", letters[0].Id, err)
+	}
+
+	letters, err = s.List()
+
+	if err != nil {
+		t.Fatalf("Failed to list letters, %s", err)
+	}
+
+	if len(letters) != 0 {
+		t.Fatalf("Expected the store to be empty, got %v", letters)
+	}
+}
+
+func TestRemove(t *testing.T) {
+
+	s := newTestStore(t)
+
+	l := NewLetter("null://", "post", testTask("one"), nil, 1)
+
+	err := s.Put(l)
+
+	if err != nil {
+		t.Fatalf("Failed to put letter, %s", err)
+	}
+
+	for _, id := range []string{"../" + l.Id, `..\` + l.Id, "a/b"} {
+
+		err := s.Remove(id)
+
+		if err == nil {
+			t.Fatalf("Expected removing '%s' to fail", id)
+		}
+
+		_, err = s.Get(id)
+
+		if err == nil {
+			t.Fatalf("Expected getting '%s' to fail", id)
+		}
+	}
+
+	err = s.Remove(l.Id)
+
+	if err != nil {
+		t.Fatalf("Failed to remove %s, %s", l.Id, err)
+	}
+
+	_, err = s.Get(l.Id)
+
+	if err == nil {
+		t.Fatalf("Expected %s to have been removed", l.Id)
+	}
+
+	err = s.Remove(l.Id)
+
+	if err == nil {
+		t.Fatalf("Expected removing %s twice to fail", l.Id)
+	}
+}
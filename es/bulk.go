@@ -0,0 +1,575 @@
+package es
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ActionIndex  = "index"
+	ActionDelete = "delete"
+)
+
+// Action is a single operation in a bulk request. Document is only required for
+// ActionIndex.
+
+type Action struct {
+	Op       string
+	Id       int64
+	Type     string
+	Document map[string]interface{}
+}
+
+func NewIndexAction(doc *Document) *Action {
+
+	a := Action{
+		Op:       ActionIndex,
+		Id:       doc.Id,
+		Type:     doc.Placetype,
+		Document: doc.Body,
+	}
+
+	return &a
+}
+
+// NewDeleteAction returns an action to remove the record with ID id. If placetype is
+// empty and the indexer is using placetypes as document types then the placetype will
+// be looked up before the record is deleted.
+
+func NewDeleteAction(id int64, placetype string) *Action {
+
+	a := Action{
+		Op:   ActionDelete,
+		Id:   id,
+		Type: placetype,
+	}
+
+	return &a
+}
+
+// ItemError is the error reported by Elasticsearch for an individual action in
+// a bulk request.
+
+type ItemError struct {
+	Op     string
+	Id     string
+	Status int
+	Reason string
+	index  int
+}
+
+func (e *ItemError) String() string {
+	return fmt.Sprintf("%s %s (%d) %s", e.Op, e.Id, e.Status, e.Reason)
+}
+
+// BulkError is returned when one or more of the actions in a bulk request failed.
+
+type BulkError struct {
+	Items []*ItemError
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%d bulk action(s) failed", len(e.Items))
+}
+
+type BulkOptions struct {
+	// Endpoint is the root URL of the Elasticsearch server, for example 'http://localhost:9200'
+	Endpoint string
+	Index    string
+	// DocType is the document type to use for each action. If it is "placetype" then
+	// the placetype of each document is used. If it is empty then no type is sent at all,
+	// which is what newer versions of Elasticsearch expect.
+	DocType   string
+	BatchSize int
+	Workers   int
+	Timeout   time.Duration
+	// MaxRetries is the number of times a batch is sent again if Elasticsearch responds
+	// with a 429 or 5xx status, or rejects individual actions with a 429 status, waiting
+	// RetryBackoff (doubled after each attempt) in between.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func NewDefaultBulkOptions() *BulkOptions {
+
+	opts := BulkOptions{
+		Endpoint:     "http://localhost:9200",
+		Index:        "whosonfirst",
+		DocType:      "placetype",
+		BatchSize:    500,
+		Workers:      4,
+		Timeout:      time.Minute * 2,
+		MaxRetries:   3,
+		RetryBackoff: time.Second,
+	}
+
+	return &opts
+}
+
+type BulkIndexer struct {
+	options *BulkOptions
+	client  *http.Client
+}
+
+func NewBulkIndexer(opts *BulkOptions) (*BulkIndexer, error) {
+
+	if opts.Endpoint == "" {
+		return nil, errors.New("Missing Elasticsearch endpoint")
+	}
+
+	if opts.Index == "" {
+		return nil, errors.New("Missing Elasticsearch index")
+	}
+
+	if opts.BatchSize < 1 {
+		return nil, errors.New("Invalid batch size")
+	}
+
+	if opts.Workers < 1 {
+		return nil, errors.New("Invalid number of workers")
+	}
+
+	if opts.MaxRetries < 0 || opts.RetryBackoff < 0 {
+		return nil, errors.New("Invalid retry options")
+	}
+
+	client := &http.Client{
+		Timeout: opts.Timeout,
+	}
+
+	b := BulkIndexer{
+		options: opts,
+		client:  client,
+	}
+
+	return &b, nil
+}
+
+// Do sends actions to Elasticsearch in batches of (up to) BatchSize actions, with up
+// to Workers batches in flight at once. All of the actions for the same ID are sent in
+// the same batch, in the order they were given, so that (for example) a delete followed
+// by an index of the same record can't be reordered by batches running concurrently. If
+// any individual actions fail then a *BulkError listing all of them is returned once
+// every batch has been sent.
+
+func (b *BulkIndexer) Do(ctx context.Context, actions []*Action) error {
+
+	actions, err := b.resolveTypes(ctx, actions)
+
+	if err != nil {
+		return err
+	}
+
+	batches := b.batches(actions)
+
+	throttle := make(chan bool, b.options.Workers)
+
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	items := make([]*ItemError, 0)
+	var last_err error
+
+	for _, batch := range batches {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		throttle <- true
+		wg.Add(1)
+
+		go func(batch []*Action) {
+
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			failed, err := b.send(ctx, batch)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				last_err = err
+				return
+			}
+
+			items = append(items, failed...)
+
+		}(batch)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if last_err != nil {
+		return last_err
+	}
+
+	if len(items) > 0 {
+		return &BulkError{Items: items}
+	}
+
+	return nil
+}
+
+// batches splits actions in to batches of (up to) BatchSize actions without splitting
+// the actions for an ID across batches.
+
+func (b *BulkIndexer) batches(actions []*Action) [][]*Action {
+
+	ids := make([]int64, 0)
+	groups := make(map[int64][]*Action)
+
+	for _, a := range actions {
+
+		_, ok := groups[a.Id]
+
+		if !ok {
+			ids = append(ids, a.Id)
+		}
+
+		groups[a.Id] = append(groups[a.Id], a)
+	}
+
+	batches := make([][]*Action, 0)
+	batch := make([]*Action, 0)
+
+	for _, id := range ids {
+
+		group := groups[id]
+
+		if len(batch) > 0 && len(batch)+len(group) > b.options.BatchSize {
+			batches = append(batches, batch)
+			batch = make([]*Action, 0)
+		}
+
+		batch = append(batch, group...)
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// statusError is returned by post when Elasticsearch responds with anything other than
+// a 200 status.
+
+type statusError struct {
+	status int
+	body   []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Bulk request failed with status %d: %s", e.status, e.body)
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// send posts batch to Elasticsearch, trying again (up to MaxRetries times) if the whole
+// request is rejected with a 429 or 5xx status or, for just the actions that failed, if
+// individual actions are rejected with a 429 status.
+
+func (b *BulkIndexer) send(ctx context.Context, batch []*Action) ([]*ItemError, error) {
+
+	backoff := b.options.RetryBackoff
+
+	pending := batch
+	failed := make([]*ItemError, 0)
+
+	for attempt := 0; ; attempt++ {
+
+		can_retry := attempt < b.options.MaxRetries
+
+		items, err := b.post(ctx, pending)
+
+		retry := make([]*Action, 0)
+
+		if err != nil {
+
+			status_err, ok := err.(*statusError)
+
+			if !ok || !isRetryableStatus(status_err.status) || !can_retry {
+				return nil, err
+			}
+
+			retry = pending
+
+		} else {
+
+			for _, item := range items {
+
+				if item.Status == http.StatusTooManyRequests && can_retry {
+					retry = append(retry, pending[item.index])
+					continue
+				}
+
+				failed = append(failed, item)
+			}
+		}
+
+		if len(retry) == 0 {
+			return failed, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+			// pass
+		}
+
+		backoff = backoff * 2
+		pending = retry
+	}
+}
+
+func (b *BulkIndexer) post(ctx context.Context, batch []*Action) ([]*ItemError, error) {
+
+	var buf bytes.Buffer
+
+	for _, a := range batch {
+
+		meta := map[string]interface{}{
+			"_index": b.options.Index,
+			"_id":    strconv.FormatInt(a.Id, 10),
+		}
+
+		switch b.options.DocType {
+		case "":
+			// pass
+		case "placetype":
+			meta["_type"] = a.Type
+		default:
+			meta["_type"] = b.options.DocType
+		}
+
+		enc_meta, err := json.Marshal(map[string]interface{}{a.Op: meta})
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(enc_meta)
+		buf.WriteString("\n")
+
+		if a.Op == ActionDelete {
+			continue
+		}
+
+		enc_doc, err := json.Marshal(a.Document)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(enc_doc)
+		buf.WriteString("\n")
+	}
+
+	endpoint := strings.TrimRight(b.options.Endpoint, "/") + "/_bulk"
+
+	req, err := http.NewRequest("POST", endpoint, &buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	rsp, err := b.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+
+		e := statusError{
+			status: rsp.StatusCode,
+			body:   body,
+		}
+
+		return nil, &e
+	}
+
+	return parseBulkResponse(body)
+}
+
+// resolveTypes looks up the document type for any delete actions that don't have one,
+// when the indexer is using placetypes as document types, since there is no way to know
+// the placetype of a file that has been deleted. Actions for records that are not in the
+// index are removed.
+
+func (b *BulkIndexer) resolveTypes(ctx context.Context, actions []*Action) ([]*Action, error) {
+
+	if b.options.DocType != "placetype" {
+		return actions, nil
+	}
+
+	resolved := make([]*Action, 0)
+
+	for _, a := range actions {
+
+		if a.Op != ActionDelete || a.Type != "" {
+			resolved = append(resolved, a)
+			continue
+		}
+
+		// this only works with versions of Elasticsearch that still have document types
+		// which is the only time we'd be here in the first place...
+
+		endpoint := fmt.Sprintf("%s/%s/_all/%d", strings.TrimRight(b.options.Endpoint, "/"), url.PathEscape(b.options.Index), a.Id)
+
+		req, err := http.NewRequest("GET", endpoint, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req = req.WithContext(ctx)
+
+		rsp, err := b.client.Do(req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rsp.StatusCode == http.StatusNotFound {
+			continue
+		}
+
+		if rsp.StatusCode != http.StatusOK {
+			msg := fmt.Sprintf("Failed to look up document %d with status %d: %s", a.Id, rsp.StatusCode, body)
+			return nil, errors.New(msg)
+		}
+
+		var doc struct {
+			Type  string `json:"_type"`
+			Found bool   `json:"found"`
+		}
+
+		err = json.Unmarshal(body, &doc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !doc.Found || doc.Type == "" {
+			continue
+		}
+
+		a.Type = doc.Type
+		resolved = append(resolved, a)
+	}
+
+	return resolved, nil
+}
+
+func parseBulkResponse(body []byte) ([]*ItemError, error) {
+
+	var rsp struct {
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+
+	err := json.Unmarshal(body, &rsp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make([]*ItemError, 0)
+
+	if !rsp.Errors {
+		return failed, nil
+	}
+
+	for idx, item := range rsp.Items {
+
+		for op, details := range item {
+
+			details_err, ok := details["error"]
+
+			if !ok || details_err == nil {
+				continue
+			}
+
+			e := &ItemError{
+				Op:    op,
+				index: idx,
+			}
+
+			switch details["_id"].(type) {
+			case string:
+				e.Id = details["_id"].(string)
+			default:
+				e.Id = fmt.Sprintf("%v", details["_id"])
+			}
+
+			status, ok := details["status"].(float64)
+
+			if ok {
+				e.Status = int(status)
+			}
+
+			switch details_err.(type) {
+			case string:
+				e.Reason = details_err.(string)
+			case map[string]interface{}:
+
+				reason, _ := details_err.(map[string]interface{})["reason"].(string)
+
+				if reason == "" {
+					enc, _ := json.Marshal(details_err)
+					reason = string(enc)
+				}
+
+				e.Reason = reason
+			default:
+				e.Reason = fmt.Sprintf("%v", details_err)
+			}
+
+			failed = append(failed, e)
+		}
+	}
+
+	return failed, nil
+}
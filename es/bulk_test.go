@@ -0,0 +1,325 @@
+package es
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkRequest is one action (and its document, if any) as received by the stand-in
+// Elasticsearch server.
+
+type bulkRequest struct {
+	Op string
+	Id string
+}
+
+// stubServer is an httptest stand-in for the Elasticsearch _bulk endpoint. respond is
+// called for every request with the (zero-based) number of the request and the actions
+// in it and returns the status and body to send back.
+
+type stubServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests [][]bulkRequest
+}
+
+func newStubServer(t *testing.T, respond func(n int, actions []bulkRequest) (int, string)) *stubServer {
+
+	s := &stubServer{
+		requests: make([][]bulkRequest, 0),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.URL.Path != "/_bulk" {
+			t.Errorf("Unexpected request for %s", req.URL.Path)
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
+		actions := make([]bulkRequest, 0)
+		scanner := bufio.NewScanner(req.Body)
+
+		for scanner.Scan() {
+
+			var meta map[string]map[string]interface{}
+
+			err := json.Unmarshal(scanner.Bytes(), &meta)
+
+			if err != nil {
+				t.Errorf("Failed to parse bulk line %s, %s", scanner.Text(), err)
+				return
+			}
+
+			for op, details := range meta {
+
+				actions = append(actions, bulkRequest{Op: op, Id: details["_id"].(string)})
+
+				if op == ActionIndex {
+					scanner.Scan()
+				}
+			}
+		}
+
+		s.mu.Lock()
+		n := len(s.requests)
+		s.requests = append(s.requests, actions)
+		s.mu.Unlock()
+
+		status, body := respond(n, actions)
+
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.WriteHeader(status)
+		rsp.Write([]byte(body))
+	}))
+
+	return s
+}
+
+func (s *stubServer) Requests() [][]bulkRequest {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]bulkRequest{}, s.requests...)
+}
+
+// itemsBody returns a bulk response where the actions with an ID in failures have
+// failed with that status and the rest have succeeded.
+
+func itemsBody(actions []bulkRequest, failures map[string]int) string {
+
+	items := make([]string, 0)
+	errors := false
+
+	for _, a := range actions {
+
+		status, failed := failures[a.Id]
+
+		if !failed {
+			items = append(items, fmt.Sprintf(`{"%s":{"_id":"%s","status":200}}`, a.Op, a.Id))
+			continue
+		}
+
+		errors = true
+		items = append(items, fmt.Sprintf(`{"%s":{"_id":"%s","status":%d,"error":{"type":"x","reason":"failed %s"}}}`, a.Op, a.Id, status, a.Id))
+	}
+
+	return fmt.Sprintf(`{"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func newTestIndexer(t *testing.T, endpoint string) *BulkIndexer {
+
+	opts := NewDefaultBulkOptions()
+	opts.Endpoint = endpoint
+	opts.DocType = ""
+	opts.Workers = 1
+	opts.RetryBackoff = time.Millisecond
+
+	b, err := NewBulkIndexer(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create indexer, %s", err)
+	}
+
+	return b
+}
+
+func indexAction(id int64) *Action {
+
+	doc := Document{
+		Id:        id,
+		Placetype: "locality",
+		Body:      map[string]interface{}{"wof:id": id},
+	}
+
+	return NewIndexAction(&doc)
+}
+
+func TestDoPartialFailures(t *testing.T) {
+
+	s := newStubServer(t, func(n int, actions []bulkRequest) (int, string) {
+		return http.StatusOK, itemsBody(actions, map[string]int{"2": 400})
+	})
+
+	defer s.Close()
+
+	b := newTestIndexer(t, s.URL)
+
+	err := b.Do(context.Background(), []*Action{indexAction(1), indexAction(2), NewDeleteAction(3, "")})
+
+	bulk_err, ok := err.(*BulkError)
+
+	if !ok {
+		t.Fatalf("Expected a *BulkError, got %v", err)
+	}
+
+	if len(bulk_err.Items) != 1 {
+		t.Fatalf("Expected 1 failed item, got %d", len(bulk_err.Items))
+	}
+
+	item := bulk_err.Items[0]
+
+	if item.Id != "2" || item.Op != ActionIndex || item.Status != 400 || item.Reason != "failed 2" {
+		t.Fatalf("Unexpected item error %s", item)
+	}
+
+	if len(s.Requests()) != 1 {
+		t.Fatalf("Expected failures other than 429 not to be retried, got %d requests", len(s.Requests()))
+	}
+}
+
+func TestDoRetriesRetryableStatus(t *testing.T) {
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+
+		s := newStubServer(t, func(n int, actions []bulkRequest) (int, string) {
+
+			if n < 2 {
+				return status, `{"error":"busy"}`
+			}
+
+			return http.StatusOK, itemsBody(actions, nil)
+		})
+
+		b := newTestIndexer(t, s.URL)
+
+		err := b.Do(context.Background(), []*Action{indexAction(1), indexAction(2)})
+
+		if err != nil {
+			t.Fatalf("Expected request to succeed after retrying status %d, got %s", status, err)
+		}
+
+		requests := s.Requests()
+
+		if len(requests) != 3 {
+			t.Fatalf("Expected 3 requests for status %d, got %d", status, len(requests))
+		}
+
+		if len(requests[2]) != 2 {
+			t.Fatalf("Expected the whole batch to be sent again, got %v", requests[2])
+		}
+
+		s.Close()
+	}
+}
+
+func TestDoGivesUpAfterMaxRetries(t *testing.T) {
+
+	s := newStubServer(t, func(n int, actions []bulkRequest) (int, string) {
+		return http.StatusBadGateway, `{"error":"bad gateway"}`
+	})
+
+	defer s.Close()
+
+	b := newTestIndexer(t, s.URL)
+	b.options.MaxRetries = 2
+
+	err := b.Do(context.Background(), []*Action{indexAction(1)})
+
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if len(s.Requests()) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(s.Requests()))
+	}
+}
+
+func TestDoDoesNotRetryClientErrors(t *testing.T) {
+
+	s := newStubServer(t, func(n int, actions []bulkRequest) (int, string) {
+		return http.StatusBadRequest, `{"error":"bad request"}`
+	})
+
+	defer s.Close()
+
+	b := newTestIndexer(t, s.URL)
+
+	err := b.Do(context.Background(), []*Action{indexAction(1)})
+
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if len(s.Requests()) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(s.Requests()))
+	}
+}
+
+func TestDoRetriesRejectedItems(t *testing.T) {
+
+	s := newStubServer(t, func(n int, actions []bulkRequest) (int, string) {
+
+		if n == 0 {
+			return http.StatusOK, itemsBody(actions, map[string]int{"2": 429, "3": 400})
+		}
+
+		return http.StatusOK, itemsBody(actions, nil)
+	})
+
+	defer s.Close()
+
+	b := newTestIndexer(t, s.URL)
+
+	err := b.Do(context.Background(), []*Action{indexAction(1), indexAction(2), indexAction(3)})
+
+	bulk_err, ok := err.(*BulkError)
+
+	if !ok {
+		t.Fatalf("Expected a *BulkError, got %v", err)
+	}
+
+	if len(bulk_err.Items) != 1 || bulk_err.Items[0].Id != "3" {
+		t.Fatalf("Expected only 3 to fail, got %v", bulk_err.Items)
+	}
+
+	requests := s.Requests()
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+
+	if len(requests[1]) != 1 || requests[1][0].Id != "2" {
+		t.Fatalf("Expected only the rejected action to be sent again, got %v", requests[1])
+	}
+}
+
+func TestBatchesKeepActionsForAnIdTogether(t *testing.T) {
+
+	b := newTestIndexer(t, "http://localhost:9200")
+	b.options.BatchSize = 2
+
+	actions := []*Action{
+		NewDeleteAction(1, ""),
+		NewDeleteAction(2, ""),
+		indexAction(3),
+		indexAction(1),
+	}
+
+	batches := b.batches(actions)
+
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches, got %d", len(batches))
+	}
+
+	first := batches[0]
+
+	if len(first) != 2 || first[0].Id != 1 || first[0].Op != ActionDelete || first[1].Id != 1 || first[1].Op != ActionIndex {
+		t.Fatalf("Expected the delete and index of 1 to be in the same batch, in order")
+	}
+
+	second := batches[1]
+
+	if len(second) != 2 || second[0].Id != 2 || second[1].Id != 3 {
+		t.Fatalf("Unexpected second batch")
+	}
+}
@@ -0,0 +1,268 @@
+package es
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is a single record to be indexed, derived from a GeoJSON feature in
+// roughly the same way that the (Python) wof-es-index-filelist tool does for the
+// spelunker: the feature's properties become the document and a handful of extra
+// properties are added to make them easier to search on.
+
+type Document struct {
+	Id        int64
+	Placetype string
+	Body      map[string]interface{}
+}
+
+func NewDocumentFromFile(path string) (*Document, error) {
+
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDocument(body)
+}
+
+func NewDocument(body []byte) (*Document, error) {
+
+	var feature struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	err := json.Unmarshal(body, &feature)
+
+	if err != nil {
+		return nil, err
+	}
+
+	props := feature.Properties
+
+	if props == nil {
+		return nil, errors.New("Feature is missing properties")
+	}
+
+	id, err := int64Property(props, "wof:id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	placetype, _ := props["wof:placetype"].(string)
+
+	if placetype == "" {
+		msg := fmt.Sprintf("Feature %d is missing wof:placetype", id)
+		return nil, errors.New(msg)
+	}
+
+	prepareNames(props)
+	prepareConcordances(props)
+	prepareEDTF(props)
+	prepareExistential(props)
+
+	doc := Document{
+		Id:        id,
+		Placetype: placetype,
+		Body:      props,
+	}
+
+	return &doc, nil
+}
+
+// prepareNames adds 'names_all', 'names_preferred', 'names_variant' and 'names_colloquial'
+// properties (as well as 'translations', the list of languages with a name) so that
+// all the names for a place can be searched in a single field.
+
+func prepareNames(props map[string]interface{}) {
+
+	all := make([]string, 0)
+	preferred := make([]string, 0)
+	variant := make([]string, 0)
+	colloquial := make([]string, 0)
+
+	languages := make(map[string]bool)
+
+	keys := make([]string, 0)
+
+	for k, _ := range props {
+
+		if strings.HasPrefix(k, "name:") {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+
+		names := stringsProperty(props[k])
+
+		if len(names) == 0 {
+			continue
+		}
+
+		label := strings.TrimPrefix(k, "name:")
+		parts := strings.Split(label, "_x_")
+
+		languages[parts[0]] = true
+
+		all = append(all, names...)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[1] {
+		case "preferred":
+			preferred = append(preferred, names...)
+		case "variant":
+			variant = append(variant, names...)
+		case "colloquial":
+			colloquial = append(colloquial, names...)
+		default:
+			// pass
+		}
+	}
+
+	translations := make([]string, 0)
+
+	for lang, _ := range languages {
+		translations = append(translations, lang)
+	}
+
+	sort.Strings(translations)
+
+	props["names_all"] = unique(all)
+	props["names_preferred"] = unique(preferred)
+	props["names_variant"] = unique(variant)
+	props["names_colloquial"] = unique(colloquial)
+	props["translations"] = translations
+}
+
+// prepareConcordances adds a 'wof:concordances_sources' property listing the
+// sources that a place has concordances with.
+
+func prepareConcordances(props map[string]interface{}) {
+
+	sources := make([]string, 0)
+
+	concordances, ok := props["wof:concordances"].(map[string]interface{})
+
+	if ok {
+
+		for src, _ := range concordances {
+			sources = append(sources, src)
+		}
+	}
+
+	sort.Strings(sources)
+	props["wof:concordances_sources"] = sources
+}
+
+// prepareEDTF removes EDTF dates that mean "unknown" or "not applicable" since they
+// can't be indexed as dates.
+
+func prepareEDTF(props map[string]interface{}) {
+
+	for k, v := range props {
+
+		if !strings.HasPrefix(k, "edtf:") {
+			continue
+		}
+
+		str_v, ok := v.(string)
+
+		if !ok {
+			continue
+		}
+
+		switch str_v {
+		case "", "u", "uuuu", "open":
+			delete(props, k)
+		default:
+			// pass
+		}
+	}
+}
+
+// prepareExistential ensures that the 'mz:is_current' property is always present
+// (and -1 if it's unknown) so that it can be filtered on.
+
+func prepareExistential(props map[string]interface{}) {
+
+	_, err := int64Property(props, "mz:is_current")
+
+	if err != nil {
+		props["mz:is_current"] = -1
+	}
+}
+
+func int64Property(props map[string]interface{}, key string) (int64, error) {
+
+	v, ok := props[key]
+
+	if !ok {
+		msg := fmt.Sprintf("Feature is missing %s", key)
+		return -1, errors.New(msg)
+	}
+
+	switch v.(type) {
+	case float64:
+		return int64(v.(float64)), nil
+	case string:
+		return strconv.ParseInt(v.(string), 10, 64)
+	default:
+		msg := fmt.Sprintf("Invalid %s property", key)
+		return -1, errors.New(msg)
+	}
+}
+
+func stringsProperty(v interface{}) []string {
+
+	values := make([]string, 0)
+
+	switch v.(type) {
+	case string:
+		values = append(values, v.(string))
+	case []interface{}:
+
+		for _, i := range v.([]interface{}) {
+
+			str_i, ok := i.(string)
+
+			if ok && str_i != "" {
+				values = append(values, str_i)
+			}
+		}
+	default:
+		// pass
+	}
+
+	return values
+}
+
+func unique(values []string) []string {
+
+	seen := make(map[string]bool)
+	unique := make([]string, 0)
+
+	for _, v := range values {
+
+		if seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		unique = append(unique, v)
+	}
+
+	return unique
+}
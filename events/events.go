@@ -0,0 +1,359 @@
+package events
+
+// Events are structured log lines. Every event about a task carries the same task ID so
+// that what happened to a task can be followed through the pre, async and post stages.
+// Events are written to one or more writers, each of which has its own format, minimum
+// level and (optionally) filter, so that for example a log file gets every event as JSON
+// while Slack only gets failures as text.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// These are the same levels (and the same order) as go-whosonfirst-log.
+
+const (
+	LevelFatal   = "fatal"
+	LevelError   = "error"
+	LevelWarning = "warning"
+	LevelStatus  = "status"
+	LevelInfo    = "info"
+	LevelDebug   = "debug"
+)
+
+var levels = map[string]int{
+	LevelFatal:   0,
+	LevelError:   10,
+	LevelWarning: 20,
+	LevelStatus:  25,
+	LevelInfo:    30,
+	LevelDebug:   40,
+}
+
+// Log is the name of events that are plain log messages, rather than something that
+// happened to a task.
+
+const Log = "log"
+
+// These are the names of the events that wof-updated emits for tasks.
+
+const (
+	TaskReceived     = "task.received"
+	TaskResolved     = "task.resolved"
+	TaskFailed       = "task.failed"
+	TaskDeadLettered = "task.deadlettered"
+	TaskCompleted    = "task.completed"
+	ProcessStarted   = "process.started"
+	ProcessPending   = "process.pending"
+	ProcessCompleted = "process.completed"
+	ProcessFailed    = "process.failed"
+)
+
+type Event struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Name      string    `json:"event"`
+	Message   string    `json:"message"`
+	TaskId    string    `json:"task_id,omitempty"`
+	JournalId int64     `json:"journal_id,omitempty"`
+	Repo      string    `json:"repo,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Processor string    `json:"processor,omitempty"`
+	Stage     string    `json:"stage,omitempty"`
+	Files     int       `json:"files,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Duration  float64   `json:"duration_seconds,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Filter returns true if an event should be written.
+
+type Filter func(e *Event) bool
+
+// NameFilter returns a Filter that only allows events with one of names. Plain log
+// messages are always allowed, so that things like fatal errors aren't lost.
+
+func NameFilter(names ...string) Filter {
+
+	allowed := make(map[string]bool)
+
+	for _, n := range names {
+		allowed[n] = true
+	}
+
+	return func(e *Event) bool {
+		return e.Name == Log || allowed[e.Name]
+	}
+}
+
+func IsValidFormat(format string) bool {
+
+	switch format {
+	case FormatText, FormatJSON:
+		return true
+	default:
+		return false
+	}
+}
+
+func IsValidLevel(level string) bool {
+	_, ok := levels[level]
+	return ok
+}
+
+type writer struct {
+	out      io.Writer
+	format   string
+	minlevel int
+	filter   Filter
+}
+
+type Logger struct {
+	prefix  string
+	writers []*writer
+	mu      *sync.Mutex
+}
+
+// NewLogger returns a Logger without any writers. prefix is only used by the text format,
+// where it is written after the time, the same way go-whosonfirst-log does.
+
+func NewLogger(prefix string) *Logger {
+
+	l := Logger{
+		prefix:  prefix,
+		writers: make([]*writer, 0),
+		mu:      new(sync.Mutex),
+	}
+
+	return &l
+}
+
+// AddWriter writes events at minlevel, or more important, that pass filter (which may be
+// nil) to out in format.
+
+func (l *Logger) AddWriter(out io.Writer, format string, minlevel string, filter Filter) error {
+
+	if !IsValidFormat(format) {
+		msg := fmt.Sprintf("Invalid format '%s'", format)
+		return errors.New(msg)
+	}
+
+	if !IsValidLevel(minlevel) {
+		msg := fmt.Sprintf("Invalid level '%s'", minlevel)
+		return errors.New(msg)
+	}
+
+	w := writer{
+		out:      out,
+		format:   format,
+		minlevel: levels[minlevel],
+		filter:   filter,
+	}
+
+	l.mu.Lock()
+	l.writers = append(l.writers, &w)
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Emit writes e to every writer that wants it. If e doesn't have a time or a level they
+// are set to now and "info" respectively.
+
+func (l *Logger) Emit(e *Event) {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if e.Level == "" {
+		e.Level = LevelInfo
+	}
+
+	level, ok := levels[e.Level]
+
+	if !ok {
+		level = levels[LevelInfo]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, w := range l.writers {
+
+		if level > w.minlevel {
+			continue
+		}
+
+		if w.filter != nil && !w.filter(e) {
+			continue
+		}
+
+		var b []byte
+
+		switch w.format {
+		case FormatJSON:
+
+			enc, err := json.Marshal(e)
+
+			if err != nil {
+				continue
+			}
+
+			b = append(enc, '\n')
+
+		default:
+			b = []byte(l.text(e))
+		}
+
+		w.out.Write(b)
+	}
+}
+
+// text formats e the same way go-whosonfirst-log formats messages, followed by any of
+// the task details that aren't already part of the message.
+
+func (l *Logger) text(e *Event) string {
+
+	var b bytes.Buffer
+
+	b.WriteString(e.Time.Format("15:04:05.000000"))
+	b.WriteString(" ")
+
+	if l.prefix != "" {
+		b.WriteString(l.prefix)
+		b.WriteString(" ")
+	}
+
+	b.WriteString(strings.ToUpper(e.Level))
+	b.WriteString(" ")
+	b.WriteString(e.Message)
+
+	details := make([]string, 0)
+
+	if e.TaskId != "" {
+		details = append(details, "task_id="+e.TaskId)
+	}
+
+	if e.Duration > 0 {
+		details = append(details, fmt.Sprintf("duration=%.3fs", e.Duration))
+	}
+
+	if len(details) > 0 {
+		b.WriteString(" [")
+		b.WriteString(strings.Join(details, " "))
+		b.WriteString("]")
+	}
+
+	b.WriteString("\n")
+	return b.String()
+}
+
+// LogWriter returns an io.Writer that turns the lines written by a go-whosonfirst-log
+// logger, whose prefix is prefix, in to plain log events. This is how messages logged by
+// processors (which don't know about events) end up in the same place, and in the same
+// format, as everything else.
+
+func (l *Logger) LogWriter(prefix string) io.Writer {
+
+	w := logWriter{
+		logger: l,
+		prefix: prefix,
+	}
+
+	return &w
+}
+
+type logWriter struct {
+	logger *Logger
+	prefix string
+}
+
+// Write expects lines that look like '15:04:05.000000 {PREFIX} {LEVEL} {MESSAGE}'
+// which is what go-whosonfirst-log writes, one message per call. Anything else is logged
+// as is.
+
+func (w *logWriter) Write(p []byte) (int, error) {
+
+	ln := strings.TrimRight(string(p), "\n")
+
+	e := Event{
+		Name:    Log,
+		Level:   LevelInfo,
+		Message: ln,
+	}
+
+	parts := strings.SplitN(ln, " ", 2)
+
+	if len(parts) == 2 {
+
+		rest := parts[1]
+
+		if w.prefix != "" {
+			rest = strings.TrimPrefix(rest, w.prefix+" ")
+		}
+
+		fields := strings.SplitN(rest, " ", 2)
+		level := strings.ToLower(fields[0])
+
+		if len(fields) == 2 && IsValidLevel(level) {
+			e.Level = level
+			e.Message = fields[1]
+		}
+	}
+
+	w.logger.Emit(&e)
+	return len(p), nil
+}
+
+// NewTaskId returns a random identifier for a task.
+
+func NewTaskId() string {
+
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+type task_id_key struct{}
+
+// WithTaskId returns a copy of ctx that carries id, so that processors can include it in
+// anything they log or send on about a task.
+
+func WithTaskId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, task_id_key{}, id)
+}
+
+// TaskId returns the task ID carried by ctx or an empty string if there isn't one.
+
+func TaskId(ctx context.Context) string {
+
+	id, ok := ctx.Value(task_id_key{}).(string)
+
+	if !ok {
+		return ""
+	}
+
+	return id
+}
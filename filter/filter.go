@@ -0,0 +1,466 @@
+package filter
+
+// Filters decide which files a processor sees by looking at the records themselves, so
+// that (for example) a Tile38 instance only holds current localities. A filter is a list
+// of predicates, all of which a record must match. Predicates are one of:
+//
+//	wof:placetype=locality          a property is (or, for lists, contains) a value
+//	wof:placetype!=county           the opposite
+//	wof:placetype in (locality, neighbourhood)
+//	wof:placetype not in (county, region)
+//	wof:name~^San                   a property matches a regular expression
+//	is_current                      an existential flag is known to be true
+//	!is_deprecated                  the opposite (also 'not is_deprecated')
+//
+// Property names are paths relative to a record's properties, with '.' separating keys
+// and list indices, for example 'wof:hierarchy.0.country_id'. Numbers are compared as
+// numbers so 'mz:is_current=1' matches 1 as well as "1". The existential flags are
+// is_current, is_deprecated, is_ceased, is_superseded and is_superseding and are worked
+// out the same way as go-whosonfirst-geojson-v2 does.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-geojson-v2"
+	"github.com/whosonfirst/go-whosonfirst-geojson-v2/feature"
+	"github.com/whosonfirst/go-whosonfirst-geojson-v2/properties/whosonfirst"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// these are the names of existential flags that may be used as predicates and the
+// functions that work them out
+
+var existential_flags = map[string]func(geojson.Feature) (bool, error){
+	"is_current": func(f geojson.Feature) (bool, error) {
+		fl, err := whosonfirst.IsCurrent(f)
+		return err == nil && fl.IsKnown() && fl.IsTrue(), err
+	},
+	"is_deprecated": func(f geojson.Feature) (bool, error) {
+		fl, err := whosonfirst.IsDeprecated(f)
+		return err == nil && fl.IsKnown() && fl.IsTrue(), err
+	},
+	"is_ceased": func(f geojson.Feature) (bool, error) {
+		fl, err := whosonfirst.IsCeased(f)
+		return err == nil && fl.IsKnown() && fl.IsTrue(), err
+	},
+	"is_superseded": func(f geojson.Feature) (bool, error) {
+		fl, err := whosonfirst.IsSuperseded(f)
+		return err == nil && fl.IsKnown() && fl.IsTrue(), err
+	},
+	"is_superseding": func(f geojson.Feature) (bool, error) {
+		fl, err := whosonfirst.IsSuperseding(f)
+		return err == nil && fl.IsKnown() && fl.IsTrue(), err
+	},
+}
+
+var re_in = regexp.MustCompile(`(?i)^(\S+)\s+(not\s+)?in\s*\((.*)\)$`)
+
+type record struct {
+	feature    geojson.Feature
+	properties map[string]interface{}
+}
+
+type predicate struct {
+	source string
+	negate bool
+	match  func(r *record) (bool, error)
+}
+
+type Filter struct {
+	predicates []*predicate
+	data_root  string
+}
+
+// NewFilter returns a Filter for the records in the copy of each repo in data_root that
+// match all of predicates. Each of predicates may itself be several predicates separated
+// by ';'.
+
+func NewFilter(data_root string, predicates ...string) (*Filter, error) {
+
+	f := Filter{
+		predicates: make([]*predicate, 0),
+		data_root:  data_root,
+	}
+
+	for _, str := range predicates {
+
+		for _, src := range strings.Split(str, ";") {
+
+			src = strings.TrimSpace(src)
+
+			if src == "" {
+				continue
+			}
+
+			p, err := parsePredicate(src)
+
+			if err != nil {
+				msg := fmt.Sprintf("Invalid filter '%s', %s", src, err)
+				return nil, errors.New(msg)
+			}
+
+			f.predicates = append(f.predicates, p)
+		}
+	}
+
+	if len(f.predicates) == 0 {
+		return nil, errors.New("Filter does not have any predicates")
+	}
+
+	return &f, nil
+}
+
+// NewFilterFromURI returns a Filter for the 'filter' parameters in a processor's URI, or
+// nil if there aren't any.
+
+func NewFilterFromURI(data_root string, uri string) (*Filter, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	predicates, ok := u.Query()["filter"]
+
+	if !ok {
+		return nil, nil
+	}
+
+	return NewFilter(data_root, predicates...)
+}
+
+func (f *Filter) String() string {
+
+	sources := make([]string, 0)
+
+	for _, p := range f.predicates {
+		sources = append(sources, p.source)
+	}
+
+	return strings.Join(sources, "; ")
+}
+
+// Match returns true if the record in file matches every predicate. Files that have been
+// deleted always match, since there is nothing left to look at and processors need to
+// know about them, as do files that aren't GeoJSON which processors skip anyway.
+
+func (f *Filter) Match(repo string, file updated.UpdateFile) (bool, error) {
+
+	if file.Change == updated.ChangeDeleted {
+		return true, nil
+	}
+
+	if !strings.HasSuffix(file.Path, ".geojson") {
+		return true, nil
+	}
+
+	path := filepath.Join(f.data_root, repo, file.Path)
+
+	feat, err := feature.LoadWOFFeatureFromFile(path)
+
+	if err != nil {
+		return false, err
+	}
+
+	var doc struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	err = json.Unmarshal(feat.Bytes(), &doc)
+
+	if err != nil {
+		return false, err
+	}
+
+	r := record{
+		feature:    feat,
+		properties: doc.Properties,
+	}
+
+	for _, p := range f.predicates {
+
+		ok, err := p.match(&r)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to evaluate '%s', %s", p.source, err)
+			return false, errors.New(msg)
+		}
+
+		if ok == p.negate {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Apply returns a copy of files in which every file whose record doesn't match has been
+// turned in to a deletion, so that a record which stops matching (for example because it
+// has been deprecated) is removed by processors that have it rather than being left as it
+// was. It returns an error if any of the files can't be matched.
+
+func (f *Filter) Apply(repo string, files []updated.UpdateFile) ([]updated.UpdateFile, error) {
+
+	filtered := make([]updated.UpdateFile, 0)
+
+	for _, file := range files {
+
+		ok, err := f.Match(repo, file)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to filter %s, %s", file.Path, err)
+			return nil, errors.New(msg)
+		}
+
+		if !ok {
+			file.Change = updated.ChangeDeleted
+		}
+
+		filtered = append(filtered, file)
+	}
+
+	return filtered, nil
+}
+
+func parsePredicate(src string) (*predicate, error) {
+
+	p := predicate{
+		source: src,
+	}
+
+	str := src
+
+	switch {
+	case strings.HasPrefix(str, "!"):
+		p.negate = true
+		str = strings.TrimSpace(str[1:])
+	case strings.HasPrefix(strings.ToLower(str), "not "):
+		p.negate = true
+		str = strings.TrimSpace(str[4:])
+	default:
+		// pass
+	}
+
+	if fn, ok := existential_flags[strings.ToLower(str)]; ok {
+
+		p.match = func(r *record) (bool, error) {
+			return fn(r.feature)
+		}
+
+		return &p, nil
+	}
+
+	if p.negate {
+		return nil, errors.New("only existential flags may be negated with '!' or 'not'")
+	}
+
+	m := re_in.FindStringSubmatch(str)
+
+	if m != nil {
+
+		values := make([]string, 0)
+
+		for _, v := range strings.Split(m[3], ",") {
+
+			v = strings.TrimSpace(v)
+
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+
+		if len(values) == 0 {
+			return nil, errors.New("empty list of values")
+		}
+
+		p.negate = m[2] != ""
+		p.match = propertyMatch(m[1], func(v string) bool {
+
+			for _, candidate := range values {
+
+				if equal(v, candidate) {
+					return true
+				}
+			}
+
+			return false
+		})
+
+		return &p, nil
+	}
+
+	idx, op := findOperator(str)
+
+	if idx == -1 {
+		return nil, errors.New("unknown predicate")
+	}
+
+	path := strings.TrimSpace(str[:idx])
+	value := strings.TrimSpace(str[idx+len(op):])
+
+	if path == "" {
+		return nil, errors.New("missing property")
+	}
+
+	switch op {
+	case "~":
+
+		re, err := regexp.Compile(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.match = propertyMatch(path, re.MatchString)
+
+	case "!=":
+		p.negate = true
+		fallthrough
+	default:
+		p.match = propertyMatch(path, func(v string) bool {
+			return equal(v, value)
+		})
+	}
+
+	return &p, nil
+}
+
+// findOperator returns the position and value of the first '=', '!=' or '~' in str so
+// that regular expressions may themselves contain those characters.
+
+func findOperator(str string) (int, string) {
+
+	for i := 0; i < len(str); i++ {
+
+		switch str[i] {
+		case '=', '~':
+			return i, string(str[i])
+		case '!':
+
+			if i+1 < len(str) && str[i+1] == '=' {
+				return i, "!="
+			}
+
+		default:
+			// pass
+		}
+	}
+
+	return -1, ""
+}
+
+// propertyMatch returns a function that is true if the property at path exists and
+// test is true for its value or, if it is a list, any of the values in it.
+
+func propertyMatch(path string, test func(string) bool) func(r *record) (bool, error) {
+
+	return func(r *record) (bool, error) {
+
+		v, ok := lookup(r.properties, path)
+
+		if !ok {
+			return false, nil
+		}
+
+		values, is_list := v.([]interface{})
+
+		if !is_list {
+			values = []interface{}{v}
+		}
+
+		for _, v := range values {
+
+			if test(stringify(v)) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+}
+
+func lookup(properties map[string]interface{}, path string) (interface{}, bool) {
+
+	var v interface{} = properties
+
+	for _, key := range strings.Split(path, ".") {
+
+		switch node := v.(type) {
+		case map[string]interface{}:
+
+			child, ok := node[key]
+
+			if !ok {
+				return nil, false
+			}
+
+			v = child
+
+		case []interface{}:
+
+			idx, err := strconv.Atoi(key)
+
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+
+			v = node[idx]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func stringify(v interface{}) string {
+
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case nil:
+		return "null"
+	default:
+
+		enc, err := json.Marshal(t)
+
+		if err != nil {
+			return fmt.Sprintf("%v", t)
+		}
+
+		return string(enc)
+	}
+}
+
+func equal(a string, b string) bool {
+
+	if a == b {
+		return true
+	}
+
+	fa, err := strconv.ParseFloat(a, 64)
+
+	if err != nil {
+		return false
+	}
+
+	fb, err := strconv.ParseFloat(b, 64)
+
+	if err != nil {
+		return false
+	}
+
+	return fa == fb
+}
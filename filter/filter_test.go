@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const test_feature = `{"type": "Feature", "id": %d, "properties": {"wof:id": %d, "wof:name": "example", "wof:placetype": "%s", "wof:repo": "repo", "geom:latitude": 0, "geom:longitude": 0, "geom:bbox": "0,0,0,0"}, "geometry": {"type": "Point", "coordinates": [0, 0]}}`
+
+func writeRecord(t *testing.T, root string, path string, body string) {
+
+	abs_path := filepath.Join(root, "repo", path)
+
+	err := os.MkdirAll(filepath.Dir(abs_path), 0755)
+
+	if err == nil {
+		err = ioutil.WriteFile(abs_path, []byte(body), 0644)
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", path, err)
+	}
+}
+
+func TestApplyTurnsNonMatchingFilesInToDeletions(t *testing.T) {
+
+	root := t.TempDir()
+
+	writeRecord(t, root, "data/1.geojson", fmt.Sprintf(test_feature, 1, 1, "locality"))
+	writeRecord(t, root, "data/2.geojson", fmt.Sprintf(test_feature, 2, 2, "county"))
+
+	f, err := NewFilter(root, "wof:placetype=locality")
+
+	if err != nil {
+		t.Fatalf("Failed to create filter, %s", err)
+	}
+
+	files := []updated.UpdateFile{
+		updated.NewUpdateFile("data/1.geojson", updated.ChangeModified),
+		updated.NewUpdateFile("data/2.geojson", updated.ChangeAdded),
+		updated.NewUpdateFile("data/3.geojson", updated.ChangeDeleted),
+	}
+
+	filtered, err := f.Apply("repo", files)
+
+	if err != nil {
+		t.Fatalf("Failed to apply filter, %s", err)
+	}
+
+	expected := []updated.ChangeType{updated.ChangeModified, updated.ChangeDeleted, updated.ChangeDeleted}
+
+	if len(filtered) != len(expected) {
+		t.Fatalf("Expected %d files, got %d", len(expected), len(filtered))
+	}
+
+	for i, change := range expected {
+
+		if filtered[i].Path != files[i].Path || filtered[i].Change != change {
+			t.Fatalf("Expected %s to be %s, got %s", files[i].Path, change, filtered[i].Change)
+		}
+	}
+
+	// the files that were passed in are left alone
+
+	if files[1].Change != updated.ChangeAdded {
+		t.Fatalf("Expected the original file to be unchanged, got %s", files[1].Change)
+	}
+}
+
+func TestApplyFailsOnInvalidFiles(t *testing.T) {
+
+	root := t.TempDir()
+
+	writeRecord(t, root, "data/1.geojson", "{")
+
+	f, err := NewFilter(root, "wof:placetype=locality")
+
+	if err != nil {
+		t.Fatalf("Failed to create filter, %s", err)
+	}
+
+	files := []updated.UpdateFile{
+		updated.NewUpdateFile("data/1.geojson", updated.ChangeModified),
+	}
+
+	_, err = f.Apply("repo", files)
+
+	if err == nil {
+		t.Fatal("Expected an invalid file to be an error")
+	}
+}
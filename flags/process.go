@@ -2,10 +2,12 @@ package flags
 
 import (
 	"github.com/whosonfirst/go-whosonfirst-updated/process"
-	"strconv"
 	"strings"
 )
 
+// ProcessFlags collects one or more process URIs, for example
+// -process 's3://bucket/prefix?procs=20' -process 'tile38://localhost:9851/collection'
+
 type ProcessFlags struct {
 	flags []string
 }
@@ -19,12 +21,23 @@ func (fl *ProcessFlags) Set(value string) error {
 	return nil
 }
 
-func (fl ProcessFlags) ToProcesses() ([]process.Process, error) {
+func (fl ProcessFlags) URIs() []string {
+	return fl.flags
+}
+
+func (fl ProcessFlags) ToProcesses(opts *process.ProcessOptions) ([]process.Process, error) {
 
 	procs := make([]process.Process, 0)
 
-	for _, p := range fl.flags {
+	for _, uri := range fl.flags {
+
+		pr, err := process.NewProcess(uri, opts)
+
+		if err != nil {
+			return nil, err
+		}
 
+		procs = append(procs, pr)
 	}
 
 	return procs, nil
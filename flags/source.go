@@ -0,0 +1,44 @@
+package flags
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-updated/source"
+	"strings"
+)
+
+// SourceFlags collects one or more source URIs, for example
+// -source 'redis://localhost:6379/updated' -source 'http://localhost:8080/updated'
+
+type SourceFlags struct {
+	flags []string
+}
+
+func (fl *SourceFlags) String() string {
+	return strings.Join(fl.flags, "\n")
+}
+
+func (fl *SourceFlags) Set(value string) error {
+	fl.flags = append(fl.flags, value)
+	return nil
+}
+
+func (fl SourceFlags) URIs() []string {
+	return fl.flags
+}
+
+func (fl SourceFlags) ToSources(opts *source.SourceOptions) ([]source.Source, error) {
+
+	sources := make([]source.Source, 0)
+
+	for _, uri := range fl.flags {
+
+		s, err := source.NewSource(uri, opts)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, s)
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,230 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var re_hash = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+var re_zeros = regexp.MustCompile(`^0+$`)
+
+// commit lines look like '#{HASH}\t{AUTHOR}\t{UNIX TIMESTAMP}'
+
+const pretty_format = "--pretty=format:#%H%x09%an%x09%at"
+
+// IsHash returns true if str looks like a (possibly abbreviated) commit hash.
+
+func IsHash(str string) bool {
+	return re_hash.MatchString(str)
+}
+
+// Changes returns the GeoJSON files changed by hash, which may be a single commit or a
+// range of commits ("before..after"), in the order they were changed. A range that
+// starts with an all-zero hash (which is what GitHub sends when a branch is created) is
+// treated as the last commit on its own. Merge commits are compared with their first
+// parent, so merging a branch changes whatever files the branch changed. Files that were
+// changed by more than one commit in a range are only listed once, with their last change.
+
+func (r *Repo) Changes(ctx context.Context, hash string) ([]updated.UpdateFile, error) {
+
+	var rev string
+
+	parts := strings.Split(hash, "..")
+
+	switch len(parts) {
+	case 1:
+
+		if !IsHash(parts[0]) {
+			break
+		}
+
+		rev = parts[0] + "^!"
+
+	case 2:
+
+		if !IsHash(parts[0]) || !IsHash(parts[1]) {
+			break
+		}
+
+		if re_zeros.MatchString(parts[0]) {
+			rev = parts[1] + "^!"
+		} else {
+			rev = parts[0] + ".." + parts[1]
+		}
+
+	default:
+		// pass
+	}
+
+	if rev == "" {
+		msg := fmt.Sprintf("Invalid commit or range of commits '%s'", hash)
+		return nil, errors.New(msg)
+	}
+
+	tasks, err := r.Log(ctx, rev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]updated.UpdateFile, 0)
+
+	for _, t := range tasks {
+		files = append(files, t.Files...)
+	}
+
+	return lastChanges(files), nil
+}
+
+// lastChanges returns files, which are in the order they were changed, with only the
+// last change to each path.
+
+func lastChanges(files []updated.UpdateFile) []updated.UpdateFile {
+
+	last := make(map[string]int)
+
+	for i, f := range files {
+		last[f.Path] = i
+	}
+
+	changes := make([]updated.UpdateFile, 0)
+
+	for i, f := range files {
+
+		if last[f.Path] == i {
+			changes = append(changes, f)
+		}
+	}
+
+	return changes
+}
+
+// Show returns a task, with the GeoJSON files it changed, for each commit that `git show`
+// lists for revs. Commits that didn't change any GeoJSON files are included with an empty
+// list of files. Merge commits are compared with their first parent since, by default,
+// git doesn't list the files that merges change at all.
+
+func (r *Repo) Show(ctx context.Context, revs ...string) ([]updated.UpdateTask, error) {
+
+	args := []string{"show", "-m", "--first-parent", pretty_format, "--name-status"}
+	args = append(args, revs...)
+
+	return r.changes(ctx, args...)
+}
+
+// Log is like Show except that it uses `git log` and lists commits oldest first, so that
+// if the same file is changed more than once the last change wins. Only the first parent
+// of merge commits is followed, so the commits on a merged branch are not listed
+// separately from the merge itself.
+
+func (r *Repo) Log(ctx context.Context, revs ...string) ([]updated.UpdateTask, error) {
+
+	args := []string{"log", "--reverse", "-m", "--first-parent", pretty_format, "--name-status"}
+	args = append(args, revs...)
+
+	return r.changes(ctx, args...)
+}
+
+func (r *Repo) changes(ctx context.Context, args ...string) ([]updated.UpdateTask, error) {
+
+	out, err := r.Run(ctx, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// not knowing the branch is not a reason to give up
+
+	branch, _ := r.Branch(ctx)
+
+	return ParseChanges(string(out), filepath.Base(r.path), branch), nil
+}
+
+// ParseChanges parses the output of `git show` or `git log` run with the `--name-status`
+// flag and the pretty format above in to a list of tasks for repo.
+
+func ParseChanges(out string, repo string, branch string) []updated.UpdateTask {
+
+	tasks := make([]updated.UpdateTask, 0)
+
+	var author string
+	var timestamp int64
+
+	add_file := func(path string, change updated.ChangeType) {
+
+		if !strings.HasSuffix(path, ".geojson") || len(tasks) == 0 {
+			return
+		}
+
+		f := updated.NewUpdateFile(path, change)
+		f.Author = author
+		f.Timestamp = timestamp
+		f.Branch = branch
+
+		t := &tasks[len(tasks)-1]
+		t.Files = append(t.Files, f)
+	}
+
+	for _, ln := range strings.Split(out, "\n") {
+
+		if strings.HasPrefix(ln, "#") {
+
+			details := strings.Split(strings.Replace(ln, "#", "", 1), "\t")
+
+			author = ""
+			timestamp = 0
+
+			if len(details) == 3 {
+
+				author = details[1]
+
+				ts, err := strconv.ParseInt(details[2], 10, 64)
+
+				if err == nil {
+					timestamp = ts
+				}
+			}
+
+			t := updated.UpdateTask{
+				Hash:  details[0],
+				Repo:  repo,
+				Files: make([]updated.UpdateFile, 0),
+			}
+
+			tasks = append(tasks, t)
+			continue
+		}
+
+		// lines look like 'M\tdata/101/736/545/101736545.geojson' or, for renames,
+		// 'R100\told/path.geojson\tnew/path.geojson'
+
+		parts := strings.Split(ln, "\t")
+
+		if len(parts) < 2 {
+			continue
+		}
+
+		change, err := updated.ParseChangeType(parts[0])
+
+		if err != nil {
+			continue
+		}
+
+		if change == updated.ChangeRenamed && len(parts) == 3 {
+			add_file(parts[1], updated.ChangeDeleted)
+			add_file(parts[2], updated.ChangeRenamed)
+			continue
+		}
+
+		add_file(parts[len(parts)-1], change)
+	}
+
+	return tasks
+}
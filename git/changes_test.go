@@ -0,0 +1,191 @@
+package git
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepo returns a new repo with a master branch and a single commit, or skips the
+// test if git isn't installed.
+
+func newTestRepo(t *testing.T) *Repo {
+
+	_, err := exec.LookPath("git")
+
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root, err := ioutil.TempDir("", "changes")
+
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %s", err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+
+	r, err := NewRepo(root, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create repo, %s", err)
+	}
+
+	run(t, r, "init", "-q")
+	run(t, r, "checkout", "-q", "-b", "master")
+	run(t, r, "config", "user.name", "example")
+	run(t, r, "config", "user.email", "example@example.com")
+
+	commit(t, r, "data/1.geojson", "one")
+
+	return r
+}
+
+func run(t *testing.T, r *Repo, args ...string) string {
+
+	out, err := r.Run(context.Background(), args...)
+
+	if err != nil {
+		t.Fatalf("Failed to run git %s, %s", strings.Join(args, " "), err)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes body to path, commits it and returns the new commit's hash.
+
+func commit(t *testing.T, r *Repo, path string, body string) string {
+
+	abs_path := filepath.Join(r.Path(), path)
+
+	err := os.MkdirAll(filepath.Dir(abs_path), 0755)
+
+	if err == nil {
+		err = ioutil.WriteFile(abs_path, []byte(body), 0644)
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", path, err)
+	}
+
+	run(t, r, "add", path)
+	run(t, r, "commit", "-q", "-m", path)
+
+	return run(t, r, "rev-parse", "HEAD")
+}
+
+func assertPaths(t *testing.T, files []updated.UpdateFile, expected ...string) {
+
+	t.Helper()
+
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+
+	for i, path := range expected {
+
+		if files[i].Path != path {
+			t.Fatalf("Expected %v, got %v", expected, files)
+		}
+	}
+}
+
+func TestChangesForMergeCommits(t *testing.T) {
+
+	r := newTestRepo(t)
+	ctx := context.Background()
+
+	before := run(t, r, "rev-parse", "HEAD")
+
+	run(t, r, "checkout", "-q", "-b", "branch")
+	commit(t, r, "data/2.geojson", "two")
+	commit(t, r, "data/3.geojson", "three")
+
+	run(t, r, "checkout", "-q", "master")
+	commit(t, r, "data/4.geojson", "four")
+
+	run(t, r, "merge", "-q", "--no-ff", "--no-edit", "branch")
+	merge := run(t, r, "rev-parse", "HEAD")
+
+	files, err := r.Changes(ctx, merge)
+
+	if err != nil {
+		t.Fatalf("Failed to get changes for %s, %s", merge, err)
+	}
+
+	assertPaths(t, files, "data/2.geojson", "data/3.geojson")
+
+	files, err = r.Changes(ctx, before+".."+merge)
+
+	if err != nil {
+		t.Fatalf("Failed to get changes for %s..%s, %s", before, merge, err)
+	}
+
+	// the branch's commits are only listed once, as part of the merge
+
+	assertPaths(t, files, "data/4.geojson", "data/2.geojson", "data/3.geojson")
+
+	tasks, err := r.Show(ctx, merge)
+
+	if err != nil {
+		t.Fatalf("Failed to show %s, %s", merge, err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Hash != merge {
+		t.Fatalf("Expected a single task for %s, got %v", merge, tasks)
+	}
+
+	assertPaths(t, tasks[0].Files, "data/2.geojson", "data/3.geojson")
+}
+
+func TestChangesForNewBranch(t *testing.T) {
+
+	r := newTestRepo(t)
+
+	hash := commit(t, r, "data/2.geojson", "two")
+
+	files, err := r.Changes(context.Background(), "0000000000000000000000000000000000000000.."+hash)
+
+	if err != nil {
+		t.Fatalf("Failed to get changes for %s, %s", hash, err)
+	}
+
+	assertPaths(t, files, "data/2.geojson")
+}
+
+func TestChangesListsEachFileOnce(t *testing.T) {
+
+	r := newTestRepo(t)
+	ctx := context.Background()
+
+	before := run(t, r, "rev-parse", "HEAD")
+
+	commit(t, r, "data/2.geojson", "two")
+	commit(t, r, "data/3.geojson", "three")
+	commit(t, r, "data/2.geojson", "two again")
+
+	run(t, r, "rm", "-q", "data/3.geojson")
+	run(t, r, "commit", "-q", "-m", "remove")
+
+	after := run(t, r, "rev-parse", "HEAD")
+
+	files, err := r.Changes(ctx, before+".."+after)
+
+	if err != nil {
+		t.Fatalf("Failed to get changes for %s..%s, %s", before, after, err)
+	}
+
+	assertPaths(t, files, "data/2.geojson", "data/3.geojson")
+
+	if files[0].Change != updated.ChangeModified || files[1].Change != updated.ChangeDeleted {
+		t.Fatalf("Expected the last change to each file, got %v", files)
+	}
+}
@@ -0,0 +1,249 @@
+package git
+
+// This is a thin wrapper around the git command line tool. Every command is run with its
+// working directory set to the repo (rather than by calling os.Chdir, which changes the
+// working directory for the whole process) so it is safe to use from more than one
+// goroutine at a time.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Error is returned by Run when git fails. ExitCode is -1 if git could not be run at all
+// or was killed.
+
+type Error struct {
+	Args     []string
+	Stderr   string
+	ExitCode int
+	err      error
+}
+
+func (e *Error) Error() string {
+
+	details := e.Stderr
+
+	if details == "" {
+		details = e.err.Error()
+	}
+
+	return fmt.Sprintf("git %s failed: %s", strings.Join(e.Args, " "), details)
+}
+
+type Repo struct {
+	path   string
+	logger *log.WOFLogger
+}
+
+func NewRepo(path string, logger *log.WOFLogger) (*Repo, error) {
+
+	abs_path, err := filepath.Abs(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(abs_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		msg := fmt.Sprintf("%s is not a directory", abs_path)
+		return nil, errors.New(msg)
+	}
+
+	r := Repo{
+		path:   abs_path,
+		logger: logger,
+	}
+
+	return &r, nil
+}
+
+func (r *Repo) Path() string {
+	return r.path
+}
+
+// Run runs git with args in the repo and returns whatever it wrote to STDOUT. If git
+// fails then the error includes whatever it wrote to STDERR.
+
+func (r *Repo) Run(ctx context.Context, args ...string) ([]byte, error) {
+
+	str_args := strings.Join(args, " ")
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.path
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	r.debug("git %s (%s)", str_args, r.path)
+
+	t1 := time.Now()
+
+	out, err := cmd.Output()
+
+	r.debug("Time to git %s: %v", str_args, time.Since(t1))
+
+	if err != nil {
+
+		exit_code := -1
+
+		if e, ok := err.(*exec.ExitError); ok {
+			exit_code = e.ExitCode()
+		}
+
+		git_err := Error{
+			Args:     args,
+			Stderr:   strings.TrimSpace(stderr.String()),
+			ExitCode: exit_code,
+			err:      err,
+		}
+
+		return nil, &git_err
+	}
+
+	return out, nil
+}
+
+// Head returns the hash of the current commit.
+
+func (r *Repo) Head(ctx context.Context) (string, error) {
+
+	out, err := r.Run(ctx, "rev-parse", "HEAD")
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Branch returns the name of the current branch.
+
+func (r *Repo) Branch(ctx context.Context) (string, error) {
+
+	out, err := r.Run(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *Repo) ResetHard(ctx context.Context, ref string) error {
+
+	_, err := r.Run(ctx, "reset", "--hard", ref)
+	return err
+}
+
+func (r *Repo) Fetch(ctx context.Context, remote string, branch string) error {
+
+	_, err := r.Run(ctx, "fetch", remote, branch)
+	return err
+}
+
+func (r *Repo) Merge(ctx context.Context, refs ...string) error {
+
+	args := append([]string{"merge"}, refs...)
+
+	_, err := r.Run(ctx, args...)
+
+	if err != nil {
+		r.Run(context.Background(), "merge", "--abort")
+	}
+
+	return err
+}
+
+func (r *Repo) Rebase(ctx context.Context, ref string) error {
+
+	_, err := r.Run(ctx, "rebase", ref)
+
+	if err != nil {
+		r.Run(context.Background(), "rebase", "--abort")
+	}
+
+	return err
+}
+
+// IsAncestor returns true if commit is an ancestor of (or the same as) ref. An error is
+// returned if either commit or ref are not known to the repo.
+
+func (r *Repo) IsAncestor(ctx context.Context, commit string, ref string) (bool, error) {
+
+	for _, c := range []string{commit, ref} {
+
+		_, err := r.Run(ctx, "rev-parse", "--verify", "--quiet", c+"^{commit}")
+
+		if err != nil {
+			msg := fmt.Sprintf("unknown commit %s", c)
+			return false, errors.New(msg)
+		}
+	}
+
+	_, err := r.Run(ctx, "merge-base", "--is-ancestor", commit, ref)
+
+	if err == nil {
+		return true, nil
+	}
+
+	if e, ok := err.(*Error); ok && e.ExitCode == 1 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// Previous returns the contents of path, relative to the repo, as of the commit before
+// the last commit that changed it. This is how the details of a file that has just been
+// deleted (like its placetype) are looked up.
+
+func (r *Repo) Previous(ctx context.Context, path string) ([]byte, error) {
+
+	out, err := r.Run(ctx, "rev-list", "-1", "HEAD", "--", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commit := strings.TrimSpace(string(out))
+
+	if commit == "" {
+		msg := fmt.Sprintf("%s is not in the history of %s", path, r.path)
+		return nil, errors.New(msg)
+	}
+
+	return r.Run(ctx, "show", fmt.Sprintf("%s^:%s", commit, filepath.ToSlash(path)))
+}
+
+func (r *Repo) LFSFetch(ctx context.Context) error {
+
+	_, err := r.Run(ctx, "lfs", "fetch")
+	return err
+}
+
+func (r *Repo) LFSCheckout(ctx context.Context) error {
+
+	_, err := r.Run(ctx, "lfs", "checkout")
+	return err
+}
+
+func (r *Repo) debug(format string, v ...interface{}) {
+
+	if r.logger != nil {
+		r.logger.Debug(format, v...)
+	}
+}
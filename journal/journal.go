@@ -0,0 +1,551 @@
+package journal
+
+// This is an append-only journal of tasks, stored as a sequence of segment files
+// each containing one JSON-encoded record per line. Tasks are written (and synced)
+// before they are handed to any processor and each processor acknowledges a task
+// once it is done with it. Anything that hasn't been acknowledged by every processor
+// when wof-updated starts up is replayed.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segment_ext = ".journal"
+
+type Entry struct {
+	Id         int64              `json:"id"`
+	Task       updated.UpdateTask `json:"task"`
+	Processors []string           `json:"processors"`
+	Created    int64              `json:"created"`
+	acked      map[string]bool
+	segment    int64
+}
+
+// Unacknowledged returns the list of processors that have not acknowledged the entry.
+
+func (e *Entry) Unacknowledged() []string {
+
+	pending := make([]string, 0)
+
+	for _, name := range e.Processors {
+
+		if !e.acked[name] {
+			pending = append(pending, name)
+		}
+	}
+
+	return pending
+}
+
+func (e *Entry) IsAcknowledged(processor string) bool {
+	return e.acked[processor]
+}
+
+type record struct {
+	Op         string              `json:"op"`
+	Id         int64               `json:"id"`
+	Task       *updated.UpdateTask `json:"task,omitempty"`
+	Processors []string            `json:"processors,omitempty"`
+	Processor  string              `json:"processor,omitempty"`
+	Created    int64               `json:"created,omitempty"`
+}
+
+type deferred struct {
+	id        int64
+	processor string
+	done      func() bool
+}
+
+type Journal struct {
+	root             string
+	mu               *sync.Mutex
+	fh               *os.File
+	segment          int64
+	segment_size     int64
+	max_segment_size int64
+	last_id          int64
+	entries          map[int64]*Entry
+	outstanding      map[int64]int
+	deferred         []*deferred
+}
+
+// NewJournal opens (or creates) the journal stored in root, reading any existing
+// segments in order to determine which tasks still need to be replayed. Segments
+// are rolled over once they are larger than max_segment_size bytes.
+
+func NewJournal(root string, max_segment_size int64) (*Journal, error) {
+
+	root, err := filepath.Abs(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	j := Journal{
+		root:             root,
+		mu:               new(sync.Mutex),
+		max_segment_size: max_segment_size,
+		last_id:          0,
+		entries:          make(map[int64]*Entry),
+		outstanding:      make(map[int64]int),
+		deferred:         make([]*deferred, 0),
+	}
+
+	segments, err := j.segments()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segments {
+
+		err := j.readSegment(seg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if seg > j.segment {
+			j.segment = seg
+		}
+	}
+
+	err = j.roll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// Append records task, which must be acknowledged by each of processors, and returns
+// the ID of the new journal entry. The segment file is synced before Append returns.
+
+func (j *Journal) Append(task updated.UpdateTask, processors []string) (int64, error) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.last_id += 1
+
+	e := &Entry{
+		Id:         j.last_id,
+		Task:       task,
+		Processors: processors,
+		Created:    time.Now().Unix(),
+		acked:      make(map[string]bool),
+		segment:    j.segment,
+	}
+
+	r := record{
+		Op:         "task",
+		Id:         e.Id,
+		Task:       &task,
+		Processors: processors,
+		Created:    e.Created,
+	}
+
+	err := j.write(r, true)
+
+	if err != nil {
+		return -1, err
+	}
+
+	j.entries[e.Id] = e
+	j.outstanding[e.segment] += 1
+
+	if len(processors) == 0 {
+		j.complete(e)
+	}
+
+	return e.Id, nil
+}
+
+// Ack records that processor is done with the journal entry id.
+
+func (j *Journal) Ack(id int64, processor string) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.ack(id, processor)
+}
+
+// AckWhen acknowledges the journal entry id on behalf of processor the first time
+// that done returns true, as checked by AckDeferred. This is for processors that
+// buffer files after ProcessTask has returned.
+
+func (j *Journal) AckWhen(id int64, processor string, done func() bool) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	d := &deferred{
+		id:        id,
+		processor: processor,
+		done:      done,
+	}
+
+	j.deferred = append(j.deferred, d)
+}
+
+// AckDeferred acknowledges any entries registered with AckWhen that are now done.
+
+func (j *Journal) AckDeferred() error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	remaining := make([]*deferred, 0)
+
+	var last_err error
+
+	for _, d := range j.deferred {
+
+		if !d.done() {
+			remaining = append(remaining, d)
+			continue
+		}
+
+		err := j.ack(d.id, d.processor)
+
+		if err != nil {
+			last_err = err
+		}
+	}
+
+	j.deferred = remaining
+	return last_err
+}
+
+// Pending returns all the entries that have not been acknowledged by every processor,
+// oldest first.
+
+func (j *Journal) Pending() []*Entry {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := make([]*Entry, 0)
+
+	for _, e := range j.entries {
+
+		// return a copy so that callers can safely check what has been
+		// acknowledged while other acks are being recorded
+
+		acked := make(map[string]bool)
+
+		for k, v := range e.acked {
+			acked[k] = v
+		}
+
+		c := *e
+		c.acked = acked
+
+		pending = append(pending, &c)
+	}
+
+	sort.Slice(pending, func(a, b int) bool {
+		return pending[a].Id < pending[b].Id
+	})
+
+	return pending
+}
+
+func (j *Journal) Close() error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.fh == nil {
+		return nil
+	}
+
+	err := j.fh.Sync()
+
+	if err != nil {
+		return err
+	}
+
+	err = j.fh.Close()
+	j.fh = nil
+
+	return err
+}
+
+func (j *Journal) ack(id int64, processor string) error {
+
+	e, ok := j.entries[id]
+
+	if !ok {
+		msg := fmt.Sprintf("Unknown (or already completed) journal entry %d", id)
+		return errors.New(msg)
+	}
+
+	if e.acked[processor] {
+		return nil
+	}
+
+	r := record{
+		Op:        "ack",
+		Id:        id,
+		Processor: processor,
+	}
+
+	// acks aren't synced because the worst thing that can happen if one is lost
+	// is that a task gets processed twice
+
+	err := j.write(r, false)
+
+	if err != nil {
+		return err
+	}
+
+	e.acked[processor] = true
+
+	if len(e.Unacknowledged()) == 0 {
+		j.complete(e)
+	}
+
+	return nil
+}
+
+func (j *Journal) complete(e *Entry) {
+
+	delete(j.entries, e.Id)
+	j.outstanding[e.segment] -= 1
+
+	if e.segment != j.segment {
+		j.prune()
+	}
+}
+
+// prune removes old segments but only in order, and only once every task recorded in
+// a segment and every segment before it has been acknowledged. This ensures that any
+// acks recorded in a segment that is removed only refer to entries that are also gone.
+
+func (j *Journal) prune() {
+
+	segments, err := j.segments()
+
+	if err != nil {
+		return
+	}
+
+	for _, seg := range segments {
+
+		if seg == j.segment {
+			break
+		}
+
+		if j.outstanding[seg] > 0 {
+			break
+		}
+
+		err := os.Remove(j.segmentPath(seg))
+
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+
+		delete(j.outstanding, seg)
+	}
+}
+
+func (j *Journal) write(r record, sync bool) error {
+
+	body, err := json.Marshal(r)
+
+	if err != nil {
+		return err
+	}
+
+	body = append(body, '\n')
+
+	if j.segment_size+int64(len(body)) > j.max_segment_size && j.segment_size > 0 {
+
+		err := j.roll()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := j.fh.Write(body)
+
+	if err != nil {
+		return err
+	}
+
+	j.segment_size += int64(n)
+
+	if sync {
+		return j.fh.Sync()
+	}
+
+	return nil
+}
+
+func (j *Journal) roll() error {
+
+	if j.fh != nil {
+
+		err := j.fh.Sync()
+
+		if err != nil {
+			return err
+		}
+
+		err = j.fh.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	j.segment += 1
+
+	path := j.segmentPath(j.segment)
+
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	j.fh = fh
+	j.segment_size = 0
+
+	j.prune()
+	return nil
+}
+
+func (j *Journal) readSegment(seg int64) error {
+
+	fh, err := os.Open(j.segmentPath(seg))
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+
+		var r record
+
+		err := json.Unmarshal(scanner.Bytes(), &r)
+
+		// a partially written final line is what you get if we crashed
+		// while appending and is safe to ignore
+
+		if err != nil {
+			continue
+		}
+
+		if r.Id > j.last_id {
+			j.last_id = r.Id
+		}
+
+		switch r.Op {
+		case "task":
+
+			if r.Task == nil {
+				continue
+			}
+
+			e := &Entry{
+				Id:         r.Id,
+				Task:       *r.Task,
+				Processors: r.Processors,
+				Created:    r.Created,
+				acked:      make(map[string]bool),
+				segment:    seg,
+			}
+
+			j.entries[e.Id] = e
+			j.outstanding[seg] += 1
+
+		case "ack":
+
+			e, ok := j.entries[r.Id]
+
+			if !ok {
+				continue
+			}
+
+			e.acked[r.Processor] = true
+
+			if len(e.Unacknowledged()) == 0 {
+				delete(j.entries, e.Id)
+				j.outstanding[e.segment] -= 1
+			}
+
+		default:
+			continue
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (j *Journal) segments() ([]int64, error) {
+
+	files, err := ioutil.ReadDir(j.root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int64, 0)
+
+	for _, info := range files {
+
+		fname := info.Name()
+
+		if !strings.HasSuffix(fname, segment_ext) {
+			continue
+		}
+
+		seg, err := strconv.ParseInt(strings.TrimSuffix(fname, segment_ext), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, seg)
+	}
+
+	sort.Slice(segments, func(a, b int) bool {
+		return segments[a] < segments[b]
+	})
+
+	return segments, nil
+}
+
+func (j *Journal) segmentPath(seg int64) string {
+	fname := fmt.Sprintf("%020d%s", seg, segment_ext)
+	return filepath.Join(j.root, fname)
+}
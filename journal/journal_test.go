@@ -0,0 +1,328 @@
+package journal
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestJournal(t *testing.T, root string, max_segment_size int64) *Journal {
+
+	j, err := NewJournal(root, max_segment_size)
+
+	if err != nil {
+		t.Fatalf("Failed to open journal, %s", err)
+	}
+
+	t.Cleanup(func() {
+		j.Close()
+	})
+
+	return j
+}
+
+func testTask(hash string) updated.UpdateTask {
+
+	task := updated.UpdateTask{
+		Hash: hash,
+		Repo: "repo",
+		Files: []updated.UpdateFile{
+			updated.NewUpdateFile("data/1.geojson", updated.ChangeModified),
+		},
+	}
+
+	return task
+}
+
+func pendingHashes(j *Journal) []string {
+
+	hashes := make([]string, 0)
+
+	for _, e := range j.Pending() {
+		hashes = append(hashes, e.Task.Hash)
+	}
+
+	return hashes
+}
+
+func countSegments(t *testing.T, root string) int {
+
+	matches, err := filepath.Glob(filepath.Join(root, "*"+segment_ext))
+
+	if err != nil {
+		t.Fatalf("Failed to list segments, %s", err)
+	}
+
+	return len(matches)
+}
+
+func TestReplayUnacknowledged(t *testing.T) {
+
+	root := t.TempDir()
+	processors := []string{"es://", "s3://"}
+
+	j := newTestJournal(t, root, 1024*1024)
+
+	ids := make([]int64, 0)
+
+	for _, hash := range []string{"one", "two", "three"} {
+
+		id, err := j.Append(testTask(hash), processors)
+
+		if err != nil {
+			t.Fatalf("Failed to append %s, %s", hash, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	for _, p := range processors {
+
+		err := j.Ack(ids[0], p)
+
+		if err != nil {
+			t.Fatalf("Failed to ack %s, %s", p, err)
+		}
+	}
+
+	err := j.Ack(ids[1], "es://")
+
+	if err != nil {
+		t.Fatalf("Failed to ack, %s", err)
+	}
+
+	// acking a completed entry is an error
+
+	err = j.Ack(ids[0], "es://")
+
+	if err == nil {
+		t.Fatalf("Expected acking a completed entry to fail")
+	}
+
+	err = j.Close()
+
+	if err != nil {
+		t.Fatalf("Failed to close journal, %s", err)
+	}
+
+	j = newTestJournal(t, root, 1024*1024)
+
+	pending := j.Pending()
+
+	if len(pending) != 2 || pending[0].Task.Hash != "two" || pending[1].Task.Hash != "three" {
+		t.Fatalf("Expected two and three to be replayed, got %v", pendingHashes(j))
+	}
+
+	if !pending[0].IsAcknowledged("es://") || pending[0].IsAcknowledged("s3://") {
+		t.Fatalf("Expected two to be acknowledged by es:// only, got %v", pending[0].Unacknowledged())
+	}
+
+	if len(pending[1].Unacknowledged()) != 2 {
+		t.Fatalf("Expected three to be unacknowledged, got %v", pending[1].Unacknowledged())
+	}
+
+	// IDs carry on from where the previous journal left off
+
+	id, err := j.Append(testTask("four"), processors)
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	if id != ids[2]+1 {
+		t.Fatalf("Expected ID %d, got %d", ids[2]+1, id)
+	}
+}
+
+func TestReplayTornWrite(t *testing.T) {
+
+	root := t.TempDir()
+
+	j := newTestJournal(t, root, 1024*1024)
+
+	_, err := j.Append(testTask("one"), []string{"es://"})
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	path := j.segmentPath(j.segment)
+
+	err = j.Close()
+
+	if err != nil {
+		t.Fatalf("Failed to close journal, %s", err)
+	}
+
+	// this is what's left behind if we crash half way through appending a task
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to open segment, %s", err)
+	}
+
+	_, err = fh.Write([]byte(`{"op":"task","id":2,"task":{"hash":"tw`))
+
+	if err != nil {
+		t.Fatalf("Failed to write segment, %s", err)
+	}
+
+	fh.Close()
+
+	j = newTestJournal(t, root, 1024*1024)
+
+	hashes := pendingHashes(j)
+
+	if len(hashes) != 1 || hashes[0] != "one" {
+		t.Fatalf("Expected only one to be replayed, got %v", hashes)
+	}
+
+	id, err := j.Append(testTask("two"), []string{"es://"})
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	err = j.Close()
+
+	if err != nil {
+		t.Fatalf("Failed to close journal, %s", err)
+	}
+
+	j = newTestJournal(t, root, 1024*1024)
+
+	hashes = pendingHashes(j)
+
+	if len(hashes) != 2 || hashes[1] != "two" {
+		t.Fatalf("Expected one and two to be replayed, got %v", hashes)
+	}
+
+	if j.Pending()[1].Id != id {
+		t.Fatalf("Expected two to have ID %d, got %d", id, j.Pending()[1].Id)
+	}
+}
+
+func TestSegmentPruning(t *testing.T) {
+
+	root := t.TempDir()
+
+	// every record is bigger than this so each one ends up in its own segment
+
+	j := newTestJournal(t, root, 1)
+
+	one, err := j.Append(testTask("one"), []string{"es://"})
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	two, err := j.Append(testTask("two"), []string{"es://"})
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	if countSegments(t, root) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", countSegments(t, root))
+	}
+
+	// two's segment can't be removed while the one before it still has an
+	// entry that hasn't been acknowledged
+
+	err = j.Ack(two, "es://")
+
+	if err != nil {
+		t.Fatalf("Failed to ack, %s", err)
+	}
+
+	if countSegments(t, root) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", countSegments(t, root))
+	}
+
+	err = j.Ack(one, "es://")
+
+	if err != nil {
+		t.Fatalf("Failed to ack, %s", err)
+	}
+
+	// only the segment currently being written to is left
+
+	if countSegments(t, root) != 1 {
+		t.Fatalf("Expected 1 segment, got %d", countSegments(t, root))
+	}
+
+	err = j.Close()
+
+	if err != nil {
+		t.Fatalf("Failed to close journal, %s", err)
+	}
+
+	j = newTestJournal(t, root, 1)
+
+	if len(j.Pending()) != 0 {
+		t.Fatalf("Expected nothing to be replayed, got %v", pendingHashes(j))
+	}
+}
+
+func TestAckDeferred(t *testing.T) {
+
+	root := t.TempDir()
+
+	j := newTestJournal(t, root, 1024*1024)
+
+	id, err := j.Append(testTask("one"), []string{"es://", "s3://"})
+
+	if err != nil {
+		t.Fatalf("Failed to append, %s", err)
+	}
+
+	es_done := false
+	s3_done := false
+
+	j.AckWhen(id, "es://", func() bool { return es_done })
+	j.AckWhen(id, "s3://", func() bool { return s3_done })
+
+	err = j.AckDeferred()
+
+	if err != nil {
+		t.Fatalf("Failed to ack deferred, %s", err)
+	}
+
+	if len(j.Pending()) != 1 || len(j.Pending()[0].Unacknowledged()) != 2 {
+		t.Fatalf("Expected nothing to be acknowledged yet")
+	}
+
+	es_done = true
+
+	err = j.AckDeferred()
+
+	if err != nil {
+		t.Fatalf("Failed to ack deferred, %s", err)
+	}
+
+	pending := j.Pending()
+
+	if len(pending) != 1 || !pending[0].IsAcknowledged("es://") || pending[0].IsAcknowledged("s3://") {
+		t.Fatalf("Expected the entry to be acknowledged by es:// only")
+	}
+
+	s3_done = true
+
+	err = j.AckDeferred()
+
+	if err != nil {
+		t.Fatalf("Failed to ack deferred, %s", err)
+	}
+
+	if len(j.Pending()) != 0 {
+		t.Fatalf("Expected the entry to be complete, got %v", pendingHashes(j))
+	}
+
+	// and once they've been acknowledged deferred acks aren't checked again
+
+	if len(j.deferred) != 0 {
+		t.Fatalf("Expected no deferred acks, got %d", len(j.deferred))
+	}
+}
@@ -0,0 +1,574 @@
+package message
+
+// Messages are what gets published to (and read from) the Redis channel that wof-updated
+// listens to. There are two formats: the original CSV format, with one row per file, and a
+// versioned JSON envelope containing a list of tasks. Decode will figure out which one it's
+// been handed.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// repo names are used as directory names (inside -data-root) so they are restricted to
+// the characters that GitHub allows and may not be '.' or '..' or contain a path separator
+
+var re_repo = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Version is the current (and most recent) version of the JSON envelope.
+
+const Version = 1
+
+type Envelope struct {
+	Version int                  `json:"version"`
+	Tasks   []updated.UpdateTask `json:"tasks"`
+}
+
+func NewEnvelope(tasks []updated.UpdateTask) *Envelope {
+
+	e := Envelope{
+		Version: Version,
+		Tasks:   tasks,
+	}
+
+	return &e
+}
+
+// IsValidRepo returns true if repo is a plain repository name, like 'whosonfirst-data',
+// that is safe to append to a path.
+
+func IsValidRepo(repo string) bool {
+
+	if !re_repo.MatchString(repo) {
+		return false
+	}
+
+	if repo == "." || strings.Contains(repo, "..") || strings.ContainsAny(repo, `/\`) {
+		return false
+	}
+
+	return true
+}
+
+func Formats() []string {
+	return []string{FormatCSV, FormatJSON}
+}
+
+func IsValidFormat(format string) bool {
+
+	for _, f := range Formats() {
+
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decode returns the tasks in msg which may be either a JSON envelope or CSV. Invalid
+// CSV rows are logged (to logger) and skipped.
+
+func Decode(msg string, logger *log.WOFLogger) ([]updated.UpdateTask, error) {
+
+	if strings.HasPrefix(strings.TrimSpace(msg), "{") {
+		return DecodeJSON(msg)
+	}
+
+	return DecodeCSV(msg, logger)
+}
+
+func DecodeJSON(msg string) ([]updated.UpdateTask, error) {
+
+	var e Envelope
+
+	err := json.Unmarshal([]byte(msg), &e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Version < 1 || e.Version > Version {
+		msg := fmt.Sprintf("Unsupported message version %d", e.Version)
+		return nil, errors.New(msg)
+	}
+
+	tasks := make([]updated.UpdateTask, 0)
+
+	for _, t := range e.Tasks {
+
+		if t.Repo == "" || t.Hash == "" {
+			return nil, errors.New("Task is missing repo or hash")
+		}
+
+		if !IsValidRepo(t.Repo) {
+			msg := fmt.Sprintf("Invalid repo name '%s'", t.Repo)
+			return nil, errors.New(msg)
+		}
+
+		// IDs and alt-ness are always derived from the path rather than trusting
+		// whatever the sender thinks they are
+
+		files := make([]updated.UpdateFile, 0)
+
+		for _, f := range t.Files {
+
+			if f.Path == "" {
+				continue
+			}
+
+			norm := updated.NewUpdateFile(f.Path, f.Change)
+			norm.Author = f.Author
+			norm.Timestamp = f.Timestamp
+			norm.Branch = f.Branch
+
+			files = append(files, norm)
+		}
+
+		t.Files = files
+		tasks = append(tasks, t)
+	}
+
+	return tasks, nil
+}
+
+// DecodeCSV returns the tasks in msg, grouped by repo and hash in the order they
+// first appear. The first three columns are always 'hash,repo,path' and are followed by
+// (optional) 'change,author,timestamp,branch' columns where change describes what happened
+// to the file, for example 'added' or 'deleted' (or simply 'A' or 'D') and timestamp is
+// the Unix time of the commit. A row may also be just 'hash,repo' in which case the task
+// has no files.
+
+func DecodeCSV(msg string, logger *log.WOFLogger) ([]updated.UpdateTask, error) {
+
+	// we are assuming this:
+	// https://github.com/whosonfirst/go-webhookd/blob/master/transformations/github.commits.go
+
+	rdr := csv.NewReader(strings.NewReader(msg))
+	rdr.FieldsPerRecord = -1
+
+	tasks := make([]*updated.UpdateTask, 0)
+	lookup := make(map[string]*updated.UpdateTask)
+
+	task_for := func(hash string, repo string) *updated.UpdateTask {
+
+		key := fmt.Sprintf("%s#%s", repo, hash)
+
+		t, ok := lookup[key]
+
+		if !ok {
+
+			t = &updated.UpdateTask{
+				Hash:  hash,
+				Repo:  repo,
+				Files: make([]updated.UpdateFile, 0),
+			}
+
+			lookup[key] = t
+			tasks = append(tasks, t)
+		}
+
+		return t
+	}
+
+	for {
+		row, err := rdr.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(row) < 2 || len(row) > 7 {
+			logger.Warning("No idea how to process row %v", row)
+			continue
+		}
+
+		hash := row[0]
+		repo := row[1]
+
+		if !IsValidRepo(repo) {
+			logger.Warning("No idea how to process row %v, because '%s' is not a valid repo name", row, repo)
+			continue
+		}
+
+		// a row without a path is a task whose files are worked out from the repo itself
+
+		if len(row) == 2 || row[2] == "" {
+			task_for(hash, repo)
+			continue
+		}
+
+		path := row[2]
+
+		change := updated.ChangeUnknown
+
+		if len(row) > 3 {
+
+			ch, err := updated.ParseChangeType(row[3])
+
+			if err != nil {
+				logger.Warning("No idea how to process row %v, because %s", row, err)
+				continue
+			}
+
+			change = ch
+		}
+
+		f := updated.NewUpdateFile(path, change)
+
+		if len(row) > 4 {
+			f.Author = row[4]
+		}
+
+		if len(row) > 5 && row[5] != "" {
+
+			ts, err := strconv.ParseInt(row[5], 10, 64)
+
+			if err != nil {
+				logger.Warning("No idea how to process row %v, because %s", row, err)
+				continue
+			}
+
+			f.Timestamp = ts
+		}
+
+		if len(row) > 6 {
+			f.Branch = row[6]
+		}
+
+		t := task_for(hash, repo)
+		t.Files = append(t.Files, f)
+	}
+
+	decoded := make([]updated.UpdateTask, len(tasks))
+
+	for i, t := range tasks {
+		decoded[i] = *t
+	}
+
+	return decoded, nil
+}
+
+func Encode(tasks []updated.UpdateTask, format string) (string, error) {
+
+	switch format {
+	case FormatCSV:
+		return EncodeCSV(tasks)
+	case FormatJSON:
+		return EncodeJSON(tasks)
+	default:
+		msg := fmt.Sprintf("Invalid message format '%s'", format)
+		return "", errors.New(msg)
+	}
+}
+
+func EncodeJSON(tasks []updated.UpdateTask) (string, error) {
+
+	body, err := json.Marshal(NewEnvelope(tasks))
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+func EncodeCSV(tasks []updated.UpdateTask) (string, error) {
+
+	var b bytes.Buffer
+	writer := csv.NewWriter(&b)
+
+	for _, t := range tasks {
+
+		if len(t.Files) == 0 {
+
+			err := writer.Write([]string{t.Hash, t.Repo})
+
+			if err != nil {
+				return "", err
+			}
+
+			continue
+		}
+
+		for _, f := range t.Files {
+
+			timestamp := ""
+
+			if f.Timestamp != 0 {
+				timestamp = strconv.FormatInt(f.Timestamp, 10)
+			}
+
+			row := []string{
+				t.Hash,
+				t.Repo,
+				f.Path,
+				string(f.Change),
+				f.Author,
+				timestamp,
+				f.Branch,
+			}
+
+			err := writer.Write(row)
+
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	writer.Flush()
+
+	err := writer.Error()
+
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Chunk encodes tasks as a list of messages in format, none of which contain more than
+// max_rows files or (unless a single file is bigger than that) max_bytes bytes. Tasks
+// are split across messages if necessary. A value of 0 for max_rows or max_bytes means
+// no limit. The same tasks and limits will always produce the same messages.
+
+func Chunk(tasks []updated.UpdateTask, format string, max_rows int, max_bytes int) ([]string, error) {
+
+	if !IsValidFormat(format) {
+		msg := fmt.Sprintf("Invalid message format '%s'", format)
+		return nil, errors.New(msg)
+	}
+
+	base := 0
+
+	if format == FormatJSON {
+
+		enc, err := EncodeJSON([]updated.UpdateTask{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		base = len(enc)
+	}
+
+	messages := make([]string, 0)
+
+	chunk := make([]updated.UpdateTask, 0)
+	rows := 0
+	size := base
+
+	flush := func() error {
+
+		if rows == 0 {
+			return nil
+		}
+
+		msg, err := Encode(chunk, format)
+
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, msg)
+
+		chunk = make([]updated.UpdateTask, 0)
+		rows = 0
+		size = base
+
+		return nil
+	}
+
+	for _, t := range tasks {
+
+		// tasks without any files (where the files are left for wof-updated to work
+		// out for itself) are counted as a single row
+
+		if len(t.Files) == 0 {
+
+			cost, err := taskSize(t, format)
+
+			if err != nil {
+				return nil, err
+			}
+
+			full := max_rows > 0 && rows+1 > max_rows
+			too_big := max_bytes > 0 && rows > 0 && size+cost > max_bytes
+
+			if full || too_big {
+
+				err := flush()
+
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			ct := updated.UpdateTask{
+				Hash:  t.Hash,
+				Repo:  t.Repo,
+				Files: make([]updated.UpdateFile, 0),
+			}
+
+			chunk = append(chunk, ct)
+
+			rows += 1
+			size += cost
+			continue
+		}
+
+		for i, f := range t.Files {
+
+			new_task := i == 0 || len(chunk) == 0
+
+			cost, err := rowSize(t, f, format, new_task)
+
+			if err != nil {
+				return nil, err
+			}
+
+			full := max_rows > 0 && rows+1 > max_rows
+			too_big := max_bytes > 0 && rows > 0 && size+cost > max_bytes
+
+			if full || too_big {
+
+				err := flush()
+
+				if err != nil {
+					return nil, err
+				}
+
+				new_task = true
+
+				cost, err = rowSize(t, f, format, new_task)
+
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if new_task {
+
+				ct := updated.UpdateTask{
+					Hash:  t.Hash,
+					Repo:  t.Repo,
+					Files: make([]updated.UpdateFile, 0),
+				}
+
+				chunk = append(chunk, ct)
+			}
+
+			last := &chunk[len(chunk)-1]
+			last.Files = append(last.Files, f)
+
+			rows += 1
+			size += cost
+		}
+	}
+
+	err := flush()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// taskSize returns the number of bytes that adding t, without any files, to a message
+// will cost.
+
+func taskSize(t updated.UpdateTask, format string) (int, error) {
+
+	task := updated.UpdateTask{
+		Hash:  t.Hash,
+		Repo:  t.Repo,
+		Files: make([]updated.UpdateFile, 0),
+	}
+
+	if format == FormatCSV {
+
+		enc, err := EncodeCSV([]updated.UpdateTask{task})
+
+		if err != nil {
+			return 0, err
+		}
+
+		return len(enc), nil
+	}
+
+	enc, err := json.Marshal(task)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(enc) + 1, nil
+}
+
+// rowSize returns the (maximum) number of bytes that adding f to a message will cost,
+// including the task it belongs to if it's the first file for that task in the message.
+
+func rowSize(t updated.UpdateTask, f updated.UpdateFile, format string, new_task bool) (int, error) {
+
+	task := updated.UpdateTask{
+		Hash:  t.Hash,
+		Repo:  t.Repo,
+		Files: []updated.UpdateFile{f},
+	}
+
+	if format == FormatCSV {
+
+		enc, err := EncodeCSV([]updated.UpdateTask{task})
+
+		if err != nil {
+			return 0, err
+		}
+
+		return len(enc), nil
+	}
+
+	// plus one for the comma separating it from the previous file or task
+
+	enc_f, err := json.Marshal(f)
+
+	if err != nil {
+		return 0, err
+	}
+
+	size := len(enc_f) + 1
+
+	if new_task {
+
+		task.Files = make([]updated.UpdateFile, 0)
+
+		enc_t, err := json.Marshal(task)
+
+		if err != nil {
+			return 0, err
+		}
+
+		size += len(enc_t) + 1
+	}
+
+	return size, nil
+}
@@ -0,0 +1,341 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(t *testing.T) (*log.WOFLogger, *bytes.Buffer) {
+
+	var buf bytes.Buffer
+
+	logger := log.NewWOFLogger("")
+
+	_, err := logger.AddLogger(&buf, "warning")
+
+	if err != nil {
+		t.Fatalf("Failed to add logger, %s", err)
+	}
+
+	return logger, &buf
+}
+
+func testTasks() []updated.UpdateTask {
+
+	f1 := updated.NewUpdateFile("data/101/736/545/101736545.geojson", updated.ChangeModified)
+	f1.Author = "example"
+	f1.Timestamp = 1500000000
+	f1.Branch = "main"
+
+	f2 := updated.NewUpdateFile("data/101/736/545/101736545-alt-quattroshapes.geojson", updated.ChangeAdded)
+	f3 := updated.NewUpdateFile("data/85/632/685/85632685.geojson", updated.ChangeDeleted)
+
+	tasks := []updated.UpdateTask{
+		updated.UpdateTask{
+			Hash:  "abc",
+			Repo:  "whosonfirst-data",
+			Files: []updated.UpdateFile{f1, f2},
+		},
+		updated.UpdateTask{
+			Hash:  "def",
+			Repo:  "whosonfirst-data-venue-us-ca",
+			Files: make([]updated.UpdateFile, 0),
+		},
+		updated.UpdateTask{
+			Hash:  "ghi",
+			Repo:  "whosonfirst-data",
+			Files: []updated.UpdateFile{f3},
+		},
+	}
+
+	return tasks
+}
+
+func TestDecodeCSV(t *testing.T) {
+
+	logger, buf := newTestLogger(t)
+
+	rows := []string{
+		"abc,repo",
+		"abc,repo,data/1.geojson",
+		"abc,repo,data/2.geojson,D",
+		"abc,repo,data/3.geojson,added,example",
+		"abc,repo,data/4.geojson,R100,example,1500000000",
+		"abc,repo,data/5.geojson,modified,example,1500000000,main",
+		"def,other,data/6.geojson",
+	}
+
+	tasks, err := DecodeCSV(strings.Join(rows, "\n"), logger)
+
+	if err != nil {
+		t.Fatalf("Failed to decode CSV, %s", err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("Unexpected warnings %s", buf.String())
+	}
+
+	if len(tasks) != 2 || tasks[0].Hash != "abc" || tasks[1].Repo != "other" {
+		t.Fatalf("Expected two tasks, got %v", tasks)
+	}
+
+	files := tasks[0].Files
+
+	if len(files) != 5 {
+		t.Fatalf("Expected 5 files, got %d", len(files))
+	}
+
+	expected := []updated.ChangeType{
+		updated.ChangeUnknown,
+		updated.ChangeDeleted,
+		updated.ChangeAdded,
+		updated.ChangeRenamed,
+		updated.ChangeModified,
+	}
+
+	for i, f := range files {
+
+		if f.Change != expected[i] {
+			t.Fatalf("Expected %s to be %s, got %s", f.Path, expected[i], f.Change)
+		}
+	}
+
+	if files[2].Author != "example" || files[3].Timestamp != 1500000000 || files[4].Branch != "main" {
+		t.Fatalf("Unexpected files %v", files)
+	}
+}
+
+func TestDecodeCSVSkipsInvalidRows(t *testing.T) {
+
+	rows := map[string]string{
+		"change":    "abc,repo,data/1.geojson,X",
+		"timestamp": "abc,repo,data/1.geojson,A,example,yesterday",
+		"parent":    "abc,..,data/1.geojson",
+		"path":      "abc,a/b,data/1.geojson",
+		"dots":      "abc,a..b,data/1.geojson",
+		"columns":   "abc,repo,data/1.geojson,A,example,1500000000,main,extra",
+		"short":     "abc",
+	}
+
+	for label, row := range rows {
+
+		logger, buf := newTestLogger(t)
+
+		tasks, err := DecodeCSV(row+"\ndef,repo,data/2.geojson", logger)
+
+		if err != nil {
+			t.Fatalf("Failed to decode CSV (%s), %s", label, err)
+		}
+
+		if len(tasks) != 1 || tasks[0].Hash != "def" {
+			t.Fatalf("Expected the %s row to be skipped, got %v", label, tasks)
+		}
+
+		if !strings.Contains(buf.String(), "No idea how to process row") {
+			t.Fatalf("Expected a warning for the %s row, got '%s'", label, buf.String())
+		}
+	}
+}
+
+func TestIsValidRepo(t *testing.T) {
+
+	tests := map[string]bool{
+		"whosonfirst-data":     true,
+		"whosonfirst-data.git": true,
+		"":                     false,
+		".":                    false,
+		"..":                   false,
+		"a/b":                  false,
+		`a\b`:                  false,
+		"a b":                  false,
+	}
+
+	for repo, expected := range tests {
+
+		if IsValidRepo(repo) != expected {
+			t.Fatalf("Expected IsValidRepo('%s') to be %t", repo, expected)
+		}
+	}
+}
+
+func TestDecodeJSONVersion(t *testing.T) {
+
+	for _, v := range []int{0, Version + 1} {
+
+		msg := fmt.Sprintf(`{"version": %d, "tasks": [{"hash": "abc", "repo": "repo"}]}`, v)
+
+		_, err := DecodeJSON(msg)
+
+		if err == nil {
+			t.Fatalf("Expected version %d to be rejected", v)
+		}
+	}
+
+	for _, repo := range []string{"..", "a/b"} {
+
+		msg := fmt.Sprintf(`{"version": %d, "tasks": [{"hash": "abc", "repo": "%s"}]}`, Version, repo)
+
+		_, err := DecodeJSON(msg)
+
+		if err == nil {
+			t.Fatalf("Expected repo '%s' to be rejected", repo)
+		}
+	}
+
+	// IDs are derived from the path, not taken from the message
+
+	msg := fmt.Sprintf(`{"version": %d, "tasks": [{"hash": "abc", "repo": "repo", "files": [{"path": "data/101/736/545/101736545.geojson", "id": 1}]}]}`, Version)
+
+	tasks, err := DecodeJSON(msg)
+
+	if err != nil {
+		t.Fatalf("Failed to decode JSON, %s", err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Files[0].Id != 101736545 {
+		t.Fatalf("Unexpected tasks %v", tasks)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	logger, _ := newTestLogger(t)
+
+	tasks := testTasks()
+
+	for _, format := range Formats() {
+
+		msg, err := Encode(tasks, format)
+
+		if err != nil {
+			t.Fatalf("Failed to encode %s, %s", format, err)
+		}
+
+		decoded, err := Decode(msg, logger)
+
+		if err != nil {
+			t.Fatalf("Failed to decode %s, %s", format, err)
+		}
+
+		if !reflect.DeepEqual(decoded, tasks) {
+			t.Fatalf("Expected %s round trip to return %v, got %v", format, tasks, decoded)
+		}
+	}
+}
+
+func TestChunk(t *testing.T) {
+
+	logger, _ := newTestLogger(t)
+
+	tasks := make([]updated.UpdateTask, 0)
+
+	for i := 0; i < 10; i++ {
+
+		task := updated.UpdateTask{
+			Hash:  fmt.Sprintf("hash%d", i),
+			Repo:  "whosonfirst-data",
+			Files: make([]updated.UpdateFile, 0),
+		}
+
+		// every third task has no files
+
+		for j := 0; j < (i%3)*3; j++ {
+			path := fmt.Sprintf("data/%d/%d.geojson", i, j)
+			task.Files = append(task.Files, updated.NewUpdateFile(path, updated.ChangeModified))
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	limits := [][]int{
+		[]int{4, 0},
+		[]int{0, 300},
+		[]int{5, 400},
+		[]int{1, 1},
+	}
+
+	for _, format := range Formats() {
+
+		for _, l := range limits {
+
+			max_rows := l[0]
+			max_bytes := l[1]
+
+			messages, err := Chunk(tasks, format, max_rows, max_bytes)
+
+			if err != nil {
+				t.Fatalf("Failed to chunk %s, %s", format, err)
+			}
+
+			again, _ := Chunk(tasks, format, max_rows, max_bytes)
+
+			if !reflect.DeepEqual(messages, again) {
+				t.Fatalf("Expected chunking %s (%v) to be deterministic", format, l)
+			}
+
+			hashes := make(map[string]int)
+			merged := make([]updated.UpdateTask, 0)
+
+			for _, msg := range messages {
+
+				decoded, err := Decode(msg, logger)
+
+				if err != nil {
+					t.Fatalf("Failed to decode %s, %s", format, err)
+				}
+
+				rows := 0
+
+				for _, task := range decoded {
+
+					hashes[task.Hash] += 1
+
+					rows += len(task.Files)
+
+					if len(task.Files) == 0 {
+						rows += 1
+					}
+
+					// put split tasks back together
+
+					if len(merged) > 0 && merged[len(merged)-1].Hash == task.Hash {
+						last := &merged[len(merged)-1]
+						last.Files = append(last.Files, task.Files...)
+						continue
+					}
+
+					merged = append(merged, task)
+				}
+
+				if max_rows > 0 && rows > max_rows {
+					t.Fatalf("Expected at most %d rows (%s), got %d", max_rows, format, rows)
+				}
+
+				// a single row is allowed to be bigger than max_bytes
+
+				if max_bytes > 0 && rows > 1 && len(msg) > max_bytes {
+					t.Fatalf("Expected at most %d bytes (%s), got %d", max_bytes, format, len(msg))
+				}
+			}
+
+			if !reflect.DeepEqual(merged, tasks) {
+				t.Fatalf("Expected the messages (%s, %v) to contain every task, got %v", format, l, merged)
+			}
+
+			if max_rows == 4 && hashes["hash5"] != 2 {
+				t.Fatalf("Expected hash5 to be split across 2 messages (%s), got %d", format, hashes["hash5"])
+			}
+		}
+	}
+
+	_, err := Chunk(tasks, "xml", 0, 0)
+
+	if err == nil {
+		t.Fatalf("Expected an invalid format to be rejected")
+	}
+}
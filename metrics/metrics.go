@@ -0,0 +1,471 @@
+package metrics
+
+// This is a deliberately small implementation of counters, gauges and histograms that
+// can be exported using the Prometheus text exposition format. It does not try to be
+// a complete Prometheus client.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets used for histograms
+// of how long things take.
+
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Sample is a single value, for a given set of label values, reported by a GaugeFunc.
+
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	mu      *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+
+	r := Registry{
+		metrics: make([]metric, 0),
+		names:   make(map[string]bool),
+		mu:      new(sync.Mutex),
+	}
+
+	return &r
+}
+
+func (r *Registry) register(name string, m metric) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		msg := fmt.Sprintf("metric %s has already been registered", name)
+		panic(msg)
+	}
+
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in the registry to w using the Prometheus text format.
+
+func (r *Registry) WriteText(w io.Writer) error {
+
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+
+		err := m.write(w)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) Handler() http.Handler {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		var b bytes.Buffer
+
+		err := r.WriteText(&b)
+
+		if err != nil {
+			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rsp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		rsp.Write(b.Bytes())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// vec is the bookkeeping shared by metrics that have one value (or set of values) for
+// each combination of label values.
+
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     *sync.Mutex
+}
+
+func newVec(name string, help string, kind string, labels []string) vec {
+
+	v := vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		mu:     new(sync.Mutex),
+	}
+
+	return v
+}
+
+func (v *vec) key(values []string) string {
+
+	if len(values) != len(v.labels) {
+		msg := fmt.Sprintf("metric %s expects %d label values, not %d", v.name, len(v.labels), len(values))
+		panic(msg)
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) writeHeader(w io.Writer) error {
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.kind)
+	return err
+}
+
+// Counter is a value that only ever goes up.
+
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+
+	c := Counter{
+		vec:    newVec(name, help, "counter", labels),
+		values: make(map[string]float64),
+	}
+
+	r.register(name, &c)
+	return &c
+}
+
+func (c *Counter) Inc(label_values ...string) {
+	c.Add(1, label_values...)
+}
+
+func (c *Counter) Add(value float64, label_values ...string) {
+
+	if value < 0 {
+		return
+	}
+
+	k := c.key(label_values)
+
+	c.mu.Lock()
+	c.values[k] += value
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return writeValues(w, &c.vec, c.values)
+}
+
+// Gauge is a value that can go up and down.
+
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+
+	g := Gauge{
+		vec:    newVec(name, help, "gauge", labels),
+		values: make(map[string]float64),
+	}
+
+	r.register(name, &g)
+	return &g
+}
+
+func (g *Gauge) Set(value float64, label_values ...string) {
+
+	k := g.key(label_values)
+
+	g.mu.Lock()
+	g.values[k] = value
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(value float64, label_values ...string) {
+
+	k := g.key(label_values)
+
+	g.mu.Lock()
+	g.values[k] += value
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) error {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return writeValues(w, &g.vec, g.values)
+}
+
+// GaugeFunc is a gauge whose values are collected, by calling a function, each time
+// the metrics are written.
+
+type GaugeFunc struct {
+	vec
+	collect func() []Sample
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+
+	g := GaugeFunc{
+		vec:     newVec(name, help, "gauge", labels),
+		collect: collect,
+	}
+
+	r.register(name, &g)
+	return &g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+
+	values := make(map[string]float64)
+
+	for _, s := range g.collect() {
+		values[g.key(s.LabelValues)] += s.Value
+	}
+
+	return writeValues(w, &g.vec, values)
+}
+
+// Histogram counts observations (usually how long something took) in buckets.
+
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := Histogram{
+		vec:     newVec(name, help, "histogram", labels),
+		buckets: sorted,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+
+	r.register(name, &h)
+	return &h
+}
+
+func (h *Histogram) Observe(value float64, label_values ...string) {
+
+	k := h.key(label_values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[k]
+
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[k] = counts
+	}
+
+	for i, le := range h.buckets {
+
+		if value <= le {
+			counts[i] += 1
+		}
+	}
+
+	h.sums[k] += value
+	h.totals[k] += 1
+}
+
+func (h *Histogram) write(w io.Writer) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := h.writeHeader(w)
+
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	names = append(names, h.labels...)
+	names = append(names, "le")
+
+	for _, k := range sortedKeys(h.sums) {
+
+		values := splitKey(k, len(h.labels))
+
+		bucket_values := func(le string) []string {
+
+			v := make([]string, 0)
+			v = append(v, values...)
+			return append(v, le)
+		}
+
+		for i, le := range h.buckets {
+
+			labels := formatLabels(names, bucket_values(formatFloat(le)))
+
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, h.counts[k][i])
+
+			if err != nil {
+				return err
+			}
+		}
+
+		labels := formatLabels(names, bucket_values("+Inf"))
+
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, h.totals[k])
+
+		if err != nil {
+			return err
+		}
+
+		labels = formatLabels(h.labels, values)
+
+		_, err = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, formatFloat(h.sums[k]), h.name, labels, h.totals[k])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeValues(w io.Writer, v *vec, values map[string]float64) error {
+
+	err := v.writeHeader(w)
+
+	if err != nil {
+		return err
+	}
+
+	// a metric without any labels is always reported, even if nothing has happened yet
+
+	if len(v.labels) == 0 && len(values) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", v.name)
+		return err
+	}
+
+	for _, k := range sortedKeys(values) {
+
+		labels := formatLabels(v.labels, splitKey(k, len(v.labels)))
+
+		_, err := fmt.Fprintf(w, "%s%s %s\n", v.name, labels, formatFloat(values[k]))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]float64) []string {
+
+	keys := make([]string, 0)
+
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(k string, count int) []string {
+
+	if count == 0 {
+		return []string{}
+	}
+
+	return strings.Split(k, "\xff")
+}
+
+func formatLabels(names []string, values []string) string {
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func escapeHelp(str string) string {
+
+	str = strings.Replace(str, "\\", "\\\\", -1)
+	str = strings.Replace(str, "\n", "\\n", -1)
+	return str
+}
+
+func escapeLabel(str string) string {
+
+	str = strings.Replace(str, "\\", "\\\\", -1)
+	str = strings.Replace(str, "\"", "\\\"", -1)
+	str = strings.Replace(str, "\n", "\\n", -1)
+	return str
+}
@@ -0,0 +1,339 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sample is a single line, other than a comment, of the text exposition format.
+
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// scrape requests r's handler and returns the comments (HELP and TYPE lines) and samples
+// that it responds with.
+
+func scrape(t *testing.T, r *Registry) ([]string, []*sample) {
+
+	rsp := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rsp, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rsp.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rsp.Code)
+	}
+
+	if !strings.HasPrefix(rsp.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type %s", rsp.Header().Get("Content-Type"))
+	}
+
+	body, _ := ioutil.ReadAll(rsp.Body)
+
+	comments := make([]string, 0)
+	samples := make([]*sample, 0)
+
+	for _, ln := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+
+		if strings.HasPrefix(ln, "#") {
+			comments = append(comments, ln)
+			continue
+		}
+
+		samples = append(samples, parseSample(t, ln))
+	}
+
+	return comments, samples
+}
+
+func parseSample(t *testing.T, ln string) *sample {
+
+	s := sample{
+		labels: make(map[string]string),
+	}
+
+	idx := strings.LastIndex(ln, " ")
+
+	if idx == -1 {
+		t.Fatalf("Invalid sample '%s'", ln)
+	}
+
+	str_value := ln[idx+1:]
+	ln = ln[:idx]
+
+	switch str_value {
+	case "+Inf", "-Inf", "NaN":
+		t.Fatalf("Unexpected value '%s'", str_value)
+	default:
+
+		v, err := strconv.ParseFloat(str_value, 64)
+
+		if err != nil {
+			t.Fatalf("Invalid value '%s', %s", str_value, err)
+		}
+
+		s.value = v
+	}
+
+	idx = strings.Index(ln, "{")
+
+	if idx == -1 {
+		s.name = ln
+		return &s
+	}
+
+	s.name = ln[:idx]
+
+	if !strings.HasSuffix(ln, "}") {
+		t.Fatalf("Invalid labels '%s'", ln)
+	}
+
+	// labels look like 'name="value",...' where value may contain escaped
+	// backslashes, double quotes and newlines
+
+	rest := ln[idx+1 : len(ln)-1]
+
+	for rest != "" {
+
+		eq := strings.Index(rest, "=\"")
+
+		if eq == -1 {
+			t.Fatalf("Invalid labels '%s'", ln)
+		}
+
+		name := rest[:eq]
+		rest = rest[eq+2:]
+
+		var value strings.Builder
+		closed := false
+
+		for i := 0; i < len(rest); i++ {
+
+			c := rest[i]
+
+			if c == '\\' && i+1 < len(rest) {
+
+				i += 1
+
+				switch rest[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case '\\', '"':
+					value.WriteByte(rest[i])
+				default:
+					t.Fatalf("Invalid escape in '%s'", ln)
+				}
+
+				continue
+			}
+
+			if c == '"' {
+				rest = strings.TrimPrefix(rest[i+1:], ",")
+				closed = true
+				break
+			}
+
+			if c == '\n' {
+				t.Fatalf("Unescaped newline in '%s'", ln)
+			}
+
+			value.WriteByte(c)
+		}
+
+		if !closed {
+			t.Fatalf("Unterminated label value in '%s'", ln)
+		}
+
+		s.labels[name] = value.String()
+	}
+
+	return &s
+}
+
+func findSample(samples []*sample, name string, labels map[string]string) *sample {
+
+	for _, s := range samples {
+
+		if s.name != name || len(s.labels) != len(labels) {
+			continue
+		}
+
+		match := true
+
+		for k, v := range labels {
+
+			if s.labels[k] != v {
+				match = false
+			}
+		}
+
+		if match {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func TestCountersAndGauges(t *testing.T) {
+
+	r := NewRegistry()
+
+	messages := r.NewCounter("test_messages_total", "The number of messages.\nReally.")
+	files := r.NewCounter("test_files_total", "The number of files.", "processor", "uri")
+	buffered := r.NewGauge("test_buffered", "The number of buffered files.", "processor")
+
+	r.NewGaugeFunc("test_inflight", "The number of repos.", func() []Sample {
+
+		samples := []Sample{
+			Sample{LabelValues: []string{"es"}, Value: 1},
+			Sample{LabelValues: []string{"es"}, Value: 2},
+		}
+
+		return samples
+
+	}, "processor")
+
+	uri := "es://localhost:9200/\"weird\"\\index\nname"
+
+	files.Add(3, "es", uri)
+	files.Inc("es", uri)
+	files.Add(-1, "es", uri)
+	files.Inc("es", "es://localhost:9200/other")
+
+	buffered.Set(10, "s3")
+	buffered.Add(-4, "s3")
+
+	comments, samples := scrape(t, r)
+
+	expected := []string{
+		"# HELP test_messages_total The number of messages.\\nReally.",
+		"# TYPE test_messages_total counter",
+		"# HELP test_files_total The number of files.",
+		"# TYPE test_files_total counter",
+		"# HELP test_buffered The number of buffered files.",
+		"# TYPE test_buffered gauge",
+		"# HELP test_inflight The number of repos.",
+		"# TYPE test_inflight gauge",
+	}
+
+	if strings.Join(comments, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected HELP and TYPE lines %v", comments)
+	}
+
+	// metrics without labels are reported even if nothing has happened
+
+	s := findSample(samples, "test_messages_total", map[string]string{})
+
+	if s == nil || s.value != 0 {
+		t.Fatalf("Expected test_messages_total to be 0, got %v", s)
+	}
+
+	messages.Inc()
+
+	_, samples = scrape(t, r)
+
+	s = findSample(samples, "test_messages_total", map[string]string{})
+
+	if s == nil || s.value != 1 {
+		t.Fatalf("Expected test_messages_total to be 1, got %v", s)
+	}
+
+	// label values are escaped and every combination of them is reported separately
+
+	s = findSample(samples, "test_files_total", map[string]string{"processor": "es", "uri": uri})
+
+	if s == nil || s.value != 4 {
+		t.Fatalf("Expected test_files_total for %s to be 4, got %v", uri, s)
+	}
+
+	s = findSample(samples, "test_files_total", map[string]string{"processor": "es", "uri": "es://localhost:9200/other"})
+
+	if s == nil || s.value != 1 {
+		t.Fatalf("Expected test_files_total for the other index to be 1, got %v", s)
+	}
+
+	s = findSample(samples, "test_buffered", map[string]string{"processor": "s3"})
+
+	if s == nil || s.value != 6 {
+		t.Fatalf("Expected test_buffered to be 6, got %v", s)
+	}
+
+	s = findSample(samples, "test_inflight", map[string]string{"processor": "es"})
+
+	if s == nil || s.value != 3 {
+		t.Fatalf("Expected test_inflight to be 3, got %v", s)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+
+	r := NewRegistry()
+
+	h := r.NewHistogram("test_duration_seconds", "How long it took.", []float64{1, 0.1}, "processor")
+
+	for _, v := range []float64{0.05, 0.1, 0.5, 100} {
+		h.Observe(v, "es")
+	}
+
+	h.Observe(2, "s3")
+
+	comments, samples := scrape(t, r)
+
+	if len(comments) != 2 || comments[1] != "# TYPE test_duration_seconds histogram" {
+		t.Fatalf("Unexpected HELP and TYPE lines %v", comments)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"test_duration_seconds_bucket", map[string]string{"processor": "es", "le": "0.1"}, 2},
+		{"test_duration_seconds_bucket", map[string]string{"processor": "es", "le": "1"}, 3},
+		{"test_duration_seconds_bucket", map[string]string{"processor": "es", "le": "+Inf"}, 4},
+		{"test_duration_seconds_sum", map[string]string{"processor": "es"}, 100.65},
+		{"test_duration_seconds_count", map[string]string{"processor": "es"}, 4},
+		{"test_duration_seconds_bucket", map[string]string{"processor": "s3", "le": "0.1"}, 0},
+		{"test_duration_seconds_bucket", map[string]string{"processor": "s3", "le": "1"}, 0},
+		{"test_duration_seconds_bucket", map[string]string{"processor": "s3", "le": "+Inf"}, 1},
+		{"test_duration_seconds_sum", map[string]string{"processor": "s3"}, 2},
+		{"test_duration_seconds_count", map[string]string{"processor": "s3"}, 1},
+	}
+
+	if len(samples) != len(tests) {
+		t.Fatalf("Expected %d samples, got %d", len(tests), len(samples))
+	}
+
+	for _, test := range tests {
+
+		s := findSample(samples, test.name, test.labels)
+
+		if s == nil {
+			t.Fatalf("Missing %s %v", test.name, test.labels)
+		}
+
+		if s.value != test.value {
+			t.Fatalf("Expected %s %v to be %v, got %v", test.name, test.labels, test.value, s.value)
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+
+	defer func() {
+
+		if recover() == nil {
+			t.Fatalf("Expected registering test_total twice to panic")
+		}
+	}()
+
+	r.NewGauge("test_total", "")
+}
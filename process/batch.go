@@ -0,0 +1,1025 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-updated/queue"
+	"github.com/whosonfirst/go-whosonfirst-updated/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batch is a list of files, relative to Root, that have changed in Repo and a list of
+// files that have been deleted from it. A path will never be in both lists.
+
+type Batch struct {
+	Repo    string
+	Root    string
+	Files   []string
+	Deletes []string
+	origins map[string]*bufferedFile
+}
+
+func (b *Batch) Count() int {
+	return len(b.Files) + len(b.Deletes)
+}
+
+// BatchHandler does whatever a processor does with a batch of files. If it returns an
+// error then the whole batch is put back in the buffer to be tried again, so handlers
+// should be safe to call more than once with the same files.
+
+type BatchHandler func(ctx context.Context, batch *Batch) error
+
+// BatchFilter returns true if f should be added to the buffer. root is the path to the
+// repo that f belongs to.
+
+type BatchFilter func(root string, f updated.UpdateFile) bool
+
+// BatchOptions control how files are buffered. MaxBatchSize is the maximum number of
+// files (including deletions) handed to the handler at once, or 0 for no limit. If
+// either MaxBuffered or MaxWait are greater than 0 then files are held on to, rather
+// than being handled straight away, until there are at least MaxBuffered of them for a
+// repo, the oldest of them has been waiting for MaxWait or the processor is flushed,
+// whichever happens first. If Dedupe is true then a file that is already in the buffer
+// isn't added a second time. MaxAttempts is the number of batches a file may fail in
+// before it is removed from the buffer and reported as abandoned, or 0 to keep trying
+// forever.
+
+type BatchOptions struct {
+	MaxBatchSize int
+	MaxBuffered  int
+	MaxWait      time.Duration
+	MaxAttempts  int
+	Dedupe       bool
+	Filter       BatchFilter
+}
+
+func NewDefaultBatchOptions() *BatchOptions {
+
+	opts := BatchOptions{
+		MaxBatchSize: 0,
+		MaxBuffered:  0,
+		MaxWait:      0,
+		MaxAttempts:  5,
+		Dedupe:       true,
+		Filter:       nil,
+	}
+
+	return &opts
+}
+
+// BatchResult is the outcome of handling a task's files after ProcessTask returned, for
+// example because they were buffered or because they failed and were tried again when the
+// processor was flushed. Task only lists the files that were in the batch. Error is nil
+// if they were handled successfully. Attempts is the number of batches the files have
+// been in. If Abandoned is true then the files have failed too many times (see
+// BatchOptions.MaxAttempts) and have been removed from the buffer.
+
+type BatchResult struct {
+	Processor string
+	TaskId    string
+	Task      updated.UpdateTask
+	Error     error
+	Attempts  int
+	Abandoned bool
+}
+
+// BatchReporter is called with the outcome of every task whose files are handled, or fail
+// to be, after ProcessTask has returned. It may be called from any goroutine.
+
+type BatchReporter func(result *BatchResult)
+
+// bufferedFile is what is known about a file in the buffer: the task (and commit) it was
+// last changed by and the number of batches it has failed in since.
+
+type bufferedFile struct {
+	file     updated.UpdateFile
+	hash     string
+	task_id  string
+	attempts int
+}
+
+// BatchProcess buffers the files for each repo and hands them to a BatchHandler. It takes
+// care of making sure that a repo is only processed by one goroutine at a time, of putting
+// files back in the buffer if they can't be processed and of processing anything that is
+// still buffered when it is closed. Processors that work with batches of files should
+// embed it and only need to provide a BatchHandler.
+
+type BatchProcess struct {
+	Process
+	name      string
+	queue     *queue.Queue
+	handler   BatchHandler
+	options   *BatchOptions
+	data_root string
+	flushing  bool
+	mu        *sync.Mutex
+	wg        *sync.WaitGroup
+	closing   bool
+	files     map[string][]string
+	deletes   map[string][]string
+	origins   map[string]map[string]*bufferedFile
+	inflight  map[string][]*Batch
+	since     map[string]time.Time
+	timers    map[string]*time.Timer
+	reporter  BatchReporter
+	emitter   *emitter
+	logger    *log.WOFLogger
+}
+
+func NewBatchProcess(name string, data_root string, handler BatchHandler, opts *BatchOptions, logger *log.WOFLogger) (*BatchProcess, error) {
+
+	data_root, err := filepath.Abs(data_root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(data_root)
+
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if handler == nil {
+		return nil, errors.New("Missing batch handler")
+	}
+
+	if opts == nil {
+		opts = NewDefaultBatchOptions()
+	}
+
+	if opts.MaxBatchSize < 0 || opts.MaxBuffered < 0 || opts.MaxWait < 0 || opts.MaxAttempts < 0 {
+		msg := fmt.Sprintf("Invalid batch options for %s", name)
+		return nil, errors.New(msg)
+	}
+
+	q, err := queue.NewQueue()
+
+	if err != nil {
+		return nil, err
+	}
+
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	pr := BatchProcess{
+		name:      name,
+		queue:     q,
+		handler:   handler,
+		options:   opts,
+		data_root: data_root,
+		flushing:  false,
+		mu:        mu,
+		wg:        wg,
+		closing:   false,
+		files:     make(map[string][]string),
+		deletes:   make(map[string][]string),
+		origins:   make(map[string]map[string]*bufferedFile),
+		inflight:  make(map[string][]*Batch),
+		since:     make(map[string]time.Time),
+		timers:    make(map[string]*time.Timer),
+		emitter:   newEmitter(name, logger),
+		logger:    logger,
+	}
+
+	return &pr, nil
+}
+
+func (pr *BatchProcess) Name() string {
+	return pr.name
+}
+
+func (pr *BatchProcess) DataRoot() string {
+	return pr.data_root
+}
+
+// Configure applies the buffering settings, if any, in opts. Processors that embed
+// BatchProcess get this for free (see Configurable).
+
+func (pr *BatchProcess) Configure(opts *ProcessOptions) error {
+
+	if opts.MaxBufferedFiles < 0 || opts.MaxWait < 0 || opts.MaxFileAttempts < 0 {
+		msg := fmt.Sprintf("Invalid buffering options for %s", pr.name)
+		return errors.New(msg)
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if opts.MaxBufferedFiles > 0 {
+		pr.options.MaxBuffered = opts.MaxBufferedFiles
+	}
+
+	if opts.MaxWait > 0 {
+		pr.options.MaxWait = opts.MaxWait
+	}
+
+	if opts.MaxFileAttempts > 0 {
+		pr.options.MaxAttempts = opts.MaxFileAttempts
+	}
+
+	return nil
+}
+
+// SetReporter sets the function that is told what happened to files that were handled
+// after ProcessTask returned.
+
+func (pr *BatchProcess) SetReporter(reporter BatchReporter) {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.reporter = reporter
+}
+
+// SetEventLogger sets where events about the files being processed are emitted. Until
+// it is set they are logged instead.
+
+func (pr *BatchProcess) SetEventLogger(l *events.Logger) {
+	pr.emitter.setEventLogger(l)
+}
+
+// Flush processes every repo that has files in the buffer, or that was scheduled while
+// it was already being processed, and returns once they have all been processed. What
+// happened to each task's files is passed to the reporter (see SetReporter) and any
+// errors are also combined in to the error that is returned.
+
+func (pr *BatchProcess) Flush(ctx context.Context) error {
+
+	pr.mu.Lock()
+
+	if pr.flushing {
+		pr.mu.Unlock()
+		return nil
+	}
+
+	pr.flushing = true
+	pr.mu.Unlock()
+
+	repos := make(map[string]bool)
+
+	for _, repo := range pr.queue.Dispatch() {
+		repos[repo] = true
+	}
+
+	for _, repo := range pr.buffered() {
+		repos[repo] = true
+	}
+
+	errs := make([]error, 0)
+	errs_mu := new(sync.Mutex)
+
+	wg := new(sync.WaitGroup)
+
+	for repo, _ := range repos {
+
+		wg.Add(1)
+
+		go func(repo string) {
+
+			defer wg.Done()
+
+			err := pr.ProcessRepo(ctx, repo)
+
+			if err != nil && err != ErrClosing {
+
+				errs_mu.Lock()
+				errs = append(errs, err)
+				errs_mu.Unlock()
+			}
+
+		}(repo)
+	}
+
+	wg.Wait()
+
+	pr.mu.Lock()
+
+	pr.flushing = false
+	pr.mu.Unlock()
+
+	return combineErrors(errs)
+}
+
+// Close waits for any repos currently being processed and then processes whatever
+// files are still buffered, so that nothing is dropped on the floor during a restart.
+// Every repo is processed even if some of them fail, in which case the errors are
+// combined.
+
+func (pr *BatchProcess) Close(ctx context.Context) error {
+
+	pr.mu.Lock()
+
+	pr.closing = true
+
+	for repo, t := range pr.timers {
+		t.Stop()
+		delete(pr.timers, repo)
+	}
+
+	pr.mu.Unlock()
+
+	err := waitWithContext(ctx, pr.wg)
+
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+
+	for _, repo := range pr.buffered() {
+
+		pr.logger.Status("Process remaining buffered files (%s) for %s", pr.Name(), repo)
+
+		err := pr._process(ctx, repo, "")
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return combineErrors(errs)
+}
+
+func (pr *BatchProcess) IsPending(repo string) bool {
+
+	pr.mu.Lock()
+	count := len(pr.files[repo]) + len(pr.deletes[repo])
+	pr.mu.Unlock()
+
+	if count > 0 {
+		return true
+	}
+
+	return pr.queue.IsProcessing(repo)
+}
+
+// IsTaskPending returns true if any of task's files are still in the buffer, or are being
+// processed.
+
+func (pr *BatchProcess) IsTaskPending(task updated.UpdateTask) bool {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for _, b := range pr.origins[task.Repo] {
+
+		if b.hash == task.Hash {
+			return true
+		}
+	}
+
+	for _, batch := range pr.inflight[task.Repo] {
+
+		for _, b := range batch.origins {
+
+			if b.hash == task.Hash {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Discard removes task's files from the buffer, because something else (usually the dead
+// letter store) is now responsible for them. Files that have been changed by another task
+// since are left alone.
+
+func (pr *BatchProcess) Discard(task updated.UpdateTask) {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	repo := task.Repo
+
+	for path, b := range pr.origins[repo] {
+
+		if b.hash != task.Hash {
+			continue
+		}
+
+		pr.files[repo] = utils.RemovePath(pr.files[repo], path)
+		pr.deletes[repo] = utils.RemovePath(pr.deletes[repo], path)
+
+		delete(pr.origins[repo], path)
+	}
+}
+
+func (pr *BatchProcess) BufferedFiles() map[string]int {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	buffered := make(map[string]int)
+
+	for repo, files := range pr.files {
+
+		if len(files) > 0 {
+			buffered[repo] += len(files)
+		}
+	}
+
+	for repo, deletes := range pr.deletes {
+
+		if len(deletes) > 0 {
+			buffered[repo] += len(deletes)
+		}
+	}
+
+	return buffered
+}
+
+func (pr *BatchProcess) Processing() []string {
+	return pr.queue.Processing()
+}
+
+func (pr *BatchProcess) Pending() []string {
+	return pr.queue.Pending()
+}
+
+// ProcessTask adds the task's files to the buffer for its repo and then, unless they
+// should be held on to for a while (see BatchOptions.MaxWait), processes them. It returns
+// nil without having processed the task's files if they are being held on to or if the
+// repo is already being processed, in which case IsTaskPending is true until they have
+// been and what happened to them is passed to the reporter (see SetReporter) instead.
+// Errors for the task's own files are returned rather than reported.
+
+func (pr *BatchProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
+
+	repo := task.Repo
+	root := filepath.Join(pr.data_root, repo)
+
+	task_id := events.TaskId(ctx)
+
+	pr.mu.Lock()
+
+	files := pr.files[repo]
+	deletes := pr.deletes[repo]
+
+	origins, ok := pr.origins[repo]
+
+	if !ok {
+		origins = make(map[string]*bufferedFile)
+		pr.origins[repo] = origins
+	}
+
+	for _, f := range task.Files {
+
+		if pr.options.Filter != nil && !pr.options.Filter(root, f) {
+			continue
+		}
+
+		path := f.Path
+
+		// the number of attempts is only carried over if this is the same change (the
+		// same task being tried again) rather than a new one
+
+		b, ok := origins[path]
+
+		if !ok || b.hash != task.Hash {
+
+			b = &bufferedFile{
+				hash:    task.Hash,
+				task_id: task_id,
+			}
+
+			origins[path] = b
+		}
+
+		b.file = f
+
+		// a file might be deleted and then re-added (or the other way around) before
+		// the buffer is flushed in which case the last thing that happened wins
+
+		if f.IsDeleted() {
+			files = utils.RemovePath(files, path)
+			deletes = append(utils.RemovePath(deletes, path), path)
+			continue
+		}
+
+		deletes = utils.RemovePath(deletes, path)
+
+		if pr.options.Dedupe {
+			files = utils.RemovePath(files, path)
+		}
+
+		files = append(files, path)
+	}
+
+	pr.files[repo] = files
+	pr.deletes[repo] = deletes
+
+	_, ok = pr.since[repo]
+
+	if !ok && len(files)+len(deletes) > 0 {
+		pr.since[repo] = time.Now()
+		pr.startTimer(repo)
+	}
+
+	pr.mu.Unlock()
+
+	if !pr.isDue(repo) {
+		return nil
+	}
+
+	return pr.processRepo(ctx, repo, task.Hash)
+}
+
+// ProcessRepo processes everything that is buffered for repo, unless someone else is
+// already processing it in which case it is scheduled to be processed again. What happened
+// to each task's files is passed to the reporter (see SetReporter).
+
+func (pr *BatchProcess) ProcessRepo(ctx context.Context, repo string) error {
+	return pr.processRepo(ctx, repo, "")
+}
+
+// processRepo is ProcessRepo for the task identified by hash, which may be "", whose files
+// are not passed to the reporter since whoever is processing the task is told instead.
+
+func (pr *BatchProcess) processRepo(ctx context.Context, repo string, hash string) error {
+
+	pr.mu.Lock()
+
+	if pr.closing {
+		pr.mu.Unlock()
+		return ErrClosing
+	}
+
+	pr.wg.Add(1)
+	pr.mu.Unlock()
+
+	defer pr.wg.Done()
+
+	// if someone else is already processing repo then it will be processed again, the
+	// next time the processor is flushed, so nothing is lost
+
+	if !pr.queue.TryLockOrSchedule(repo) {
+		return nil
+	}
+
+	defer pr.queue.Release(repo)
+
+	return pr._process(ctx, repo, hash)
+}
+
+// _process hands everything that is buffered for repo to the handler, in batches of
+// no more than MaxBatchSize files. It assumes the caller has locked repo. Outcomes for
+// files from every task other than the one identified by hash are reported.
+
+func (pr *BatchProcess) _process(ctx context.Context, repo string, hash string) error {
+
+	root := filepath.Join(pr.data_root, repo)
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// pass
+		}
+
+		batch := pr.take(repo)
+
+		if batch.Count() == 0 {
+			return nil
+		}
+
+		batch.Root = root
+
+		_, err := os.Stat(root)
+
+		if os.IsNotExist(err) {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Can't find repo %s", root)
+			pr.failed(ctx, batch, err, hash)
+			return err
+		}
+
+		t1 := time.Now()
+
+		err = pr.handler(ctx, batch)
+
+		t2 := time.Since(t1)
+		pr.emitter.batch(ctx, events.LevelStatus, batch, "Time to process (%s) %d files for %s: %v", pr.Name(), batch.Count(), repo, t2)
+
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Failed to process (%s) %d files for %s, because %s", pr.Name(), batch.Count(), repo, err)
+			pr.failed(ctx, batch, err, hash)
+			return err
+		}
+
+		pr.done(batch)
+		pr.report(batch, nil, false, hash)
+	}
+}
+
+// failed puts the files in batch back in the buffer, except for those that have failed
+// too many times, and reports what happened to them.
+
+func (pr *BatchProcess) failed(ctx context.Context, batch *Batch, err error, hash string) {
+
+	abandoned := pr.requeue(batch)
+	pr.done(batch)
+
+	retried := Batch{
+		Repo:    batch.Repo,
+		Files:   utils.RemovePaths(batch.Files, abandoned.Files),
+		Deletes: utils.RemovePaths(batch.Deletes, abandoned.Deletes),
+		origins: batch.origins,
+	}
+
+	pr.report(&retried, err, false, hash)
+
+	if abandoned.Count() > 0 {
+		pr.emitter.batch(ctx, events.LevelError, abandoned, "Giving up on (%s) %d files for %s, after %d attempts", pr.Name(), abandoned.Count(), batch.Repo, pr.options.MaxAttempts)
+		pr.report(abandoned, err, true, hash)
+	}
+}
+
+// done removes batch from the list of batches being processed.
+
+func (pr *BatchProcess) done(batch *Batch) {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	inflight := make([]*Batch, 0)
+
+	for _, b := range pr.inflight[batch.Repo] {
+
+		if b != batch {
+			inflight = append(inflight, b)
+		}
+	}
+
+	if len(inflight) == 0 {
+		delete(pr.inflight, batch.Repo)
+	} else {
+		pr.inflight[batch.Repo] = inflight
+	}
+}
+
+// report passes what happened to the files in batch to the reporter, one task at a time,
+// skipping the files for the task identified by hash.
+
+func (pr *BatchProcess) report(batch *Batch, err error, abandoned bool, hash string) {
+
+	pr.mu.Lock()
+	reporter := pr.reporter
+	pr.mu.Unlock()
+
+	if reporter == nil {
+		return
+	}
+
+	results := make([]*BatchResult, 0)
+	lookup := make(map[string]*BatchResult)
+
+	add := func(path string) {
+
+		b, ok := batch.origins[path]
+
+		if !ok || b.hash == hash {
+			return
+		}
+
+		r, ok := lookup[b.hash]
+
+		if !ok {
+
+			r = &BatchResult{
+				Processor: pr.Name(),
+				TaskId:    b.task_id,
+				Task: updated.UpdateTask{
+					Hash:  b.hash,
+					Repo:  batch.Repo,
+					Files: make([]updated.UpdateFile, 0),
+				},
+				Error:     err,
+				Abandoned: abandoned,
+			}
+
+			lookup[b.hash] = r
+			results = append(results, r)
+		}
+
+		r.Task.Files = append(r.Task.Files, b.file)
+
+		attempts := b.attempts
+
+		// files that succeeded haven't had this attempt counted
+
+		if err == nil {
+			attempts += 1
+		}
+
+		if attempts > r.Attempts {
+			r.Attempts = attempts
+		}
+	}
+
+	for _, path := range batch.Files {
+		add(path)
+	}
+
+	for _, path := range batch.Deletes {
+		add(path)
+	}
+
+	for _, r := range results {
+		reporter(r)
+	}
+}
+
+// take removes (up to MaxBatchSize) files and deletions from the buffer for repo.
+
+func (pr *BatchProcess) take(repo string) *Batch {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	files := pr.files[repo]
+	deletes := pr.deletes[repo]
+
+	max := pr.options.MaxBatchSize
+
+	if max > 0 && len(files) > max {
+		pr.files[repo] = append([]string{}, files[max:]...)
+		files = files[:max]
+	} else {
+		delete(pr.files, repo)
+	}
+
+	if max > 0 && len(files)+len(deletes) > max {
+		n := max - len(files)
+		pr.deletes[repo] = append([]string{}, deletes[n:]...)
+		deletes = deletes[:n]
+	} else {
+		delete(pr.deletes, repo)
+	}
+
+	if len(pr.files[repo])+len(pr.deletes[repo]) == 0 {
+
+		delete(pr.since, repo)
+
+		t, ok := pr.timers[repo]
+
+		if ok {
+			t.Stop()
+			delete(pr.timers, repo)
+		}
+	}
+
+	batch := Batch{
+		Repo:    repo,
+		Files:   files,
+		Deletes: deletes,
+		origins: make(map[string]*bufferedFile),
+	}
+
+	// what is known about each file goes with it, so that it isn't confused with any
+	// changes to the same file while the batch is being processed
+
+	for _, path := range files {
+		pr.takeOrigin(&batch, path)
+	}
+
+	for _, path := range deletes {
+		pr.takeOrigin(&batch, path)
+	}
+
+	if batch.Count() > 0 {
+		pr.inflight[repo] = append(pr.inflight[repo], &batch)
+	}
+
+	return &batch
+}
+
+// takeOrigin moves what is known about path from the buffer to batch. It assumes that
+// pr.mu is already locked.
+
+func (pr *BatchProcess) takeOrigin(batch *Batch, path string) {
+
+	b, ok := pr.origins[batch.Repo][path]
+
+	if !ok {
+		return
+	}
+
+	batch.origins[path] = b
+	delete(pr.origins[batch.Repo], path)
+}
+
+// requeue puts the files in batch back at the front of the buffer for its repo, unless
+// something else has happened to a file since the batch was taken in which case that
+// wins, and schedules the repo to be processed again. Files that have now failed
+// MaxAttempts times are not put back but are returned, as a batch of their own.
+
+func (pr *BatchProcess) requeue(batch *Batch) *Batch {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	repo := batch.Repo
+
+	abandoned := Batch{
+		Repo:    repo,
+		Files:   make([]string, 0),
+		Deletes: make([]string, 0),
+		origins: batch.origins,
+	}
+
+	origins, ok := pr.origins[repo]
+
+	if !ok {
+		origins = make(map[string]*bufferedFile)
+		pr.origins[repo] = origins
+	}
+
+	// retry returns true if path should be put back in the buffer
+
+	retry := func(path string) bool {
+
+		b, ok := batch.origins[path]
+
+		if !ok {
+			return true
+		}
+
+		b.attempts += 1
+
+		if pr.options.MaxAttempts > 0 && b.attempts >= pr.options.MaxAttempts {
+			return false
+		}
+
+		origins[path] = b
+		return true
+	}
+
+	current_files := pr.files[repo]
+	current_deletes := pr.deletes[repo]
+
+	newer := make(map[string]bool)
+
+	for _, path := range current_files {
+		newer[path] = true
+	}
+
+	for _, path := range current_deletes {
+		newer[path] = true
+	}
+
+	files := make([]string, 0)
+
+	for _, path := range batch.Files {
+
+		if newer[path] {
+			continue
+		}
+
+		if !retry(path) {
+			abandoned.Files = append(abandoned.Files, path)
+			continue
+		}
+
+		files = append(files, path)
+	}
+
+	deletes := make([]string, 0)
+
+	for _, path := range batch.Deletes {
+
+		if newer[path] {
+			continue
+		}
+
+		if !retry(path) {
+			abandoned.Deletes = append(abandoned.Deletes, path)
+			continue
+		}
+
+		deletes = append(deletes, path)
+	}
+
+	if len(files)+len(deletes) == 0 {
+		return &abandoned
+	}
+
+	pr.files[repo] = append(files, current_files...)
+	pr.deletes[repo] = append(deletes, current_deletes...)
+
+	_, ok = pr.since[repo]
+
+	if !ok {
+		pr.since[repo] = time.Now()
+		pr.startTimer(repo)
+	}
+
+	// make sure the files are tried again the next time the processor is flushed
+
+	pr.queue.Schedule(repo)
+
+	return &abandoned
+}
+
+// startTimer arranges for repo to be processed once its files have been waiting for
+// MaxWait. It assumes that pr.mu is already locked.
+
+func (pr *BatchProcess) startTimer(repo string) {
+
+	if pr.options.MaxWait == 0 || pr.closing {
+		return
+	}
+
+	_, ok := pr.timers[repo]
+
+	if ok {
+		return
+	}
+
+	pr.timers[repo] = time.AfterFunc(pr.options.MaxWait, func() {
+
+		pr.mu.Lock()
+		delete(pr.timers, repo)
+		pr.mu.Unlock()
+
+		pr.ProcessRepo(context.Background(), repo)
+	})
+}
+
+// isDue returns true if the files buffered for repo should be processed now (or if there
+// aren't any, since there is nothing to wait for).
+
+func (pr *BatchProcess) isDue(repo string) bool {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.options.MaxBuffered == 0 && pr.options.MaxWait == 0 {
+		return true
+	}
+
+	count := len(pr.files[repo]) + len(pr.deletes[repo])
+
+	if count == 0 {
+		return true
+	}
+
+	if pr.options.MaxBuffered > 0 && count >= pr.options.MaxBuffered {
+		return true
+	}
+
+	if pr.options.MaxBatchSize > 0 && count >= pr.options.MaxBatchSize {
+		return true
+	}
+
+	since, ok := pr.since[repo]
+
+	if !ok || pr.options.MaxWait == 0 {
+		return false
+	}
+
+	return time.Since(since) >= pr.options.MaxWait
+}
+
+// buffered returns the (sorted) list of repos that have files in the buffer.
+
+func (pr *BatchProcess) buffered() []string {
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	lookup := make(map[string]bool)
+
+	for repo, files := range pr.files {
+
+		if len(files) > 0 {
+			lookup[repo] = true
+		}
+	}
+
+	for repo, deletes := range pr.deletes {
+
+		if len(deletes) > 0 {
+			lookup[repo] = true
+		}
+	}
+
+	repos := make([]string, 0)
+
+	for repo, _ := range lookup {
+		repos = append(repos, repo)
+	}
+
+	sort.Strings(repos)
+	return repos
+}
@@ -0,0 +1,305 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHandler fails every batch that includes a path in poison, or every batch for a repo
+// in broken, and records the paths in the batches it succeeds with.
+
+type testHandler struct {
+	mu      sync.Mutex
+	poison  map[string]bool
+	broken  map[string]bool
+	handled []string
+}
+
+func (h *testHandler) handle(ctx context.Context, batch *Batch) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.broken[batch.Repo] {
+		return errors.New("broken " + batch.Repo)
+	}
+
+	for _, path := range append(batch.Files, batch.Deletes...) {
+
+		if h.poison[path] {
+			return errors.New("poison " + path)
+		}
+	}
+
+	h.handled = append(h.handled, batch.Files...)
+	h.handled = append(h.handled, batch.Deletes...)
+
+	return nil
+}
+
+type testReporter struct {
+	mu      sync.Mutex
+	results []*BatchResult
+}
+
+func (r *testReporter) report(result *BatchResult) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results = append(r.results, result)
+}
+
+func (r *testReporter) Results() []*BatchResult {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*BatchResult{}, r.results...)
+}
+
+func newTestBatchProcess(t *testing.T, h *testHandler, opts *BatchOptions, repos ...string) (*BatchProcess, *testReporter) {
+
+	root := t.TempDir()
+
+	for _, repo := range repos {
+
+		err := os.MkdirAll(filepath.Join(root, repo), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %s", repo, err)
+		}
+	}
+
+	pr, err := NewBatchProcess("test", root, h.handle, opts, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create batch process, %s", err)
+	}
+
+	r := &testReporter{}
+	pr.SetReporter(r.report)
+
+	return pr, r
+}
+
+func testTask(hash string, repo string, paths ...string) updated.UpdateTask {
+
+	files := make([]updated.UpdateFile, 0)
+
+	for _, path := range paths {
+		files = append(files, updated.NewUpdateFile(path, updated.ChangeModified))
+	}
+
+	t := updated.UpdateTask{
+		Hash:  hash,
+		Repo:  repo,
+		Files: files,
+	}
+
+	return t
+}
+
+func TestPoisonFilesAreAbandoned(t *testing.T) {
+
+	h := &testHandler{
+		poison: map[string]bool{"data/2.geojson": true},
+	}
+
+	opts := NewDefaultBatchOptions()
+	opts.MaxAttempts = 3
+
+	pr, r := newTestBatchProcess(t, h, opts, "repo")
+	ctx := context.Background()
+
+	task := testTask("abc", "repo", "data/1.geojson", "data/2.geojson")
+
+	err := pr.ProcessTask(ctx, task)
+
+	if err == nil {
+		t.Fatal("Expected the task to fail")
+	}
+
+	// the task's own failures are returned rather than reported
+
+	if len(r.Results()) != 0 {
+		t.Fatalf("Expected nothing to be reported, got %d results", len(r.Results()))
+	}
+
+	if !pr.IsTaskPending(task) {
+		t.Fatal("Expected the task's files to be put back in the buffer")
+	}
+
+	err = pr.Flush(ctx)
+
+	if err == nil || !strings.Contains(err.Error(), "poison") {
+		t.Fatalf("Expected flush to return the handler's error, got %v", err)
+	}
+
+	results := r.Results()
+
+	if len(results) != 1 || results[0].Abandoned || results[0].Attempts != 2 || results[0].Task.Hash != "abc" {
+		t.Fatalf("Expected a failure that will be tried again, got %v", results)
+	}
+
+	pr.Flush(ctx)
+
+	results = r.Results()
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	abandoned := results[1]
+
+	if !abandoned.Abandoned || abandoned.Attempts != 3 || abandoned.Error == nil {
+		t.Fatalf("Expected files to be abandoned after 3 attempts, got %v", abandoned)
+	}
+
+	if len(abandoned.Task.Files) != 2 {
+		t.Fatalf("Expected both files in the batch to be abandoned, got %v", abandoned.Task.Files)
+	}
+
+	if pr.IsTaskPending(task) || pr.IsPending("repo") {
+		t.Fatal("Expected abandoned files to be removed from the buffer")
+	}
+
+	if len(pr.Pending()) != 0 {
+		t.Fatalf("Expected nothing to be scheduled, got %v", pr.Pending())
+	}
+}
+
+func TestBufferedFilesAreReported(t *testing.T) {
+
+	h := &testHandler{}
+
+	opts := NewDefaultBatchOptions()
+	opts.MaxBuffered = 10
+
+	pr, r := newTestBatchProcess(t, h, opts, "repo")
+	ctx := context.Background()
+
+	one := testTask("one", "repo", "data/1.geojson")
+	two := testTask("two", "repo", "data/2.geojson", "data/1.geojson")
+
+	for _, task := range []updated.UpdateTask{one, two} {
+
+		err := pr.ProcessTask(ctx, task)
+
+		if err != nil {
+			t.Fatalf("Failed to process task %s, %s", task, err)
+		}
+	}
+
+	// data/1.geojson was changed again by two so one no longer has anything waiting
+
+	if pr.IsTaskPending(one) {
+		t.Fatal("Expected one not to be pending")
+	}
+
+	if !pr.IsTaskPending(two) {
+		t.Fatal("Expected two to be pending")
+	}
+
+	if len(h.handled) != 0 {
+		t.Fatalf("Expected files to be buffered, got %v", h.handled)
+	}
+
+	err := pr.Flush(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to flush, %s", err)
+	}
+
+	results := r.Results()
+
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+
+	result := results[0]
+
+	if result.Error != nil || result.Task.Hash != "two" || len(result.Task.Files) != 2 || result.Attempts != 1 {
+		t.Fatalf("Unexpected result %v", result)
+	}
+
+	if pr.IsTaskPending(two) {
+		t.Fatal("Expected two not to be pending once it was flushed")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+
+	h := &testHandler{}
+
+	opts := NewDefaultBatchOptions()
+	opts.MaxWait = time.Hour
+
+	pr, r := newTestBatchProcess(t, h, opts, "repo")
+	ctx := context.Background()
+
+	one := testTask("one", "repo", "data/1.geojson")
+	two := testTask("two", "repo", "data/2.geojson")
+
+	pr.ProcessTask(ctx, one)
+	pr.ProcessTask(ctx, two)
+
+	pr.Discard(one)
+
+	if pr.IsTaskPending(one) || !pr.IsTaskPending(two) {
+		t.Fatal("Expected only one to be discarded")
+	}
+
+	pr.Flush(ctx)
+
+	if len(h.handled) != 1 || h.handled[0] != "data/2.geojson" {
+		t.Fatalf("Expected only two's files to be handled, got %v", h.handled)
+	}
+
+	if len(r.Results()) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(r.Results()))
+	}
+}
+
+func TestCloseProcessesEveryRepo(t *testing.T) {
+
+	h := &testHandler{
+		broken: map[string]bool{"a": true, "c": true},
+	}
+
+	opts := NewDefaultBatchOptions()
+	opts.MaxWait = time.Hour
+
+	pr, r := newTestBatchProcess(t, h, opts, "a", "b", "c")
+	ctx := context.Background()
+
+	for _, repo := range []string{"a", "b", "c"} {
+		pr.ProcessTask(ctx, testTask("abc", repo, "data/1.geojson"))
+	}
+
+	err := pr.Close(ctx)
+
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if !strings.Contains(err.Error(), "broken a") || !strings.Contains(err.Error(), "broken c") {
+		t.Fatalf("Expected errors for both a and c, got %s", err)
+	}
+
+	if len(h.handled) != 1 {
+		t.Fatalf("Expected b to be processed, got %v", h.handled)
+	}
+
+	if len(r.Results()) != 3 {
+		t.Fatalf("Expected a result for each repo, got %d", len(r.Results()))
+	}
+}
@@ -1,247 +1,288 @@
 package process
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-updated"
-	"github.com/whosonfirst/go-whosonfirst-updated/queue"
-	"github.com/whosonfirst/go-whosonfirst-updated/utils"
-	"os"
-	"os/exec"
+	"github.com/whosonfirst/go-whosonfirst-updated/es"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"net"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-type ElasticsearchProcess struct {
-	Process
-	queue      *queue.Queue
-	data_root  string
-	flushing   bool
-	mu         *sync.Mutex
-	files      map[string][]string
-	es_host    string
-	es_port    string
-	es_index   string
-	index_tool string
-	logger     *log.WOFLogger
+func init() {
+	RegisterProcess("es", newElasticsearchProcessFromURI)
+	RegisterProcess("elasticsearch", newElasticsearchProcessFromURI)
 }
 
-func NewElasticsearchProcess(data_root string, index_tool string, es_host string, es_port string, es_index string, logger *log.WOFLogger) (*ElasticsearchProcess, error) {
+type ElasticsearchProcess struct {
+	*BatchProcess
+	indexer  *es.BulkIndexer
+	es_index string
+	logger   *log.WOFLogger
+}
 
-	data_root, err := filepath.Abs(data_root)
+// newElasticsearchProcessFromURI expects a URI like 'es://localhost:9200/whosonfirst?batch-size=500&workers=4'.
+// Other valid parameters are 'scheme' (http or https), 'doctype' (which defaults to "placetype", meaning
+// the placetype of each record, and which may be left empty for newer versions of Elasticsearch) and
+// 'timeout' for individual bulk requests. Bulk requests that are rejected with a 429 or 5xx status are sent
+// again up to 'bulk-retries' times, waiting 'bulk-retry-backoff' (doubled after each attempt) in between.
 
-	if err != nil {
-		return nil, err
-	}
+func newElasticsearchProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
 
-	_, err = os.Stat(data_root)
+	q := u.Query()
 
-	if os.IsNotExist(err) {
-		return nil, err
-	}
+	es_opts := es.NewDefaultBulkOptions()
 
-	index_tool, err = filepath.Abs(index_tool)
+	scheme := q.Get("scheme")
 
-	if err != nil {
-		return nil, err
+	if scheme == "" {
+		scheme = "http"
 	}
 
-	_, err = os.Stat(index_tool)
+	host := u.Host
 
-	if os.IsNotExist(err) {
-		return nil, err
+	if host == "" {
+		host = "localhost:9200"
 	}
 
-	q, err := queue.NewQueue()
+	_, _, err := net.SplitHostPort(host)
 
 	if err != nil {
-		return nil, err
+		host = net.JoinHostPort(host, "9200")
 	}
 
-	files := make(map[string][]string)
+	es_opts.Endpoint = fmt.Sprintf("%s://%s", scheme, host)
 
-	mu := new(sync.Mutex)
+	es_index := strings.TrimLeft(u.Path, "/")
 
-	pr := ElasticsearchProcess{
-		queue:      q,
-		data_root:  data_root,
-		flushing:   false,
-		mu:         mu,
-		files:      files,
-		index_tool: index_tool,
-		es_host:    es_host,
-		es_port:    es_port,
-		es_index:   es_index,
-		logger:     logger,
+	if es_index != "" {
+		es_opts.Index = es_index
 	}
 
-	return &pr, nil
-}
+	doctype, ok := q["doctype"]
 
-func (pr *ElasticsearchProcess) Name() string {
-	return "elasticsearch"
-}
+	if ok {
+		es_opts.DocType = doctype[0]
+	}
 
-func (pr *ElasticsearchProcess) Flush() error {
+	str_batch := q.Get("batch-size")
 
-	pr.mu.Lock()
+	if str_batch != "" {
 
-	if pr.flushing {
-		pr.mu.Unlock()
-		return nil
-	}
+		batch_size, err := strconv.Atoi(str_batch)
 
-	pr.flushing = true
-	pr.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
 
-	for _, repo := range pr.queue.Pending() {
-		go pr.ProcessRepo(repo)
+		es_opts.BatchSize = batch_size
 	}
 
-	pr.mu.Lock()
+	str_workers := q.Get("workers")
 
-	pr.flushing = false
-	pr.mu.Unlock()
+	if str_workers != "" {
 
-	return nil
-}
+		workers, err := strconv.Atoi(str_workers)
+
+		if err != nil {
+			return nil, err
+		}
 
-func (pr *ElasticsearchProcess) ProcessTask(task updated.UpdateTask) error {
+		es_opts.Workers = workers
+	}
 
-	repo := task.Repo
+	str_timeout := q.Get("timeout")
 
-	pr.mu.Lock()
+	if str_timeout != "" {
 
-	files, ok := pr.files[repo]
+		timeout, err := time.ParseDuration(str_timeout)
 
-	if !ok {
-		files = make([]string, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		es_opts.Timeout = timeout
 	}
 
-	for _, path := range task.Commits {
+	str_retries := q.Get("bulk-retries")
+
+	if str_retries != "" {
+
+		retries, err := strconv.Atoi(str_retries)
 
-		if strings.HasSuffix(path, ".geojson") {
-			files = append(files, path)
+		if err != nil {
+			return nil, err
 		}
+
+		es_opts.MaxRetries = retries
 	}
 
-	pr.files[repo] = files
-	pr.mu.Unlock()
+	str_backoff := q.Get("bulk-retry-backoff")
 
-	return pr.ProcessRepo(repo)
-}
+	if str_backoff != "" {
 
-func (pr *ElasticsearchProcess) ProcessRepo(repo string) error {
+		backoff, err := time.ParseDuration(str_backoff)
 
-	if pr.queue.IsProcessing(repo) {
+		if err != nil {
+			return nil, err
+		}
 
-		return pr.queue.Schedule(repo)
+		es_opts.RetryBackoff = backoff
 	}
 
-	err := pr.queue.Lock(repo)
+	return NewElasticsearchProcess(opts.DataRoot, es_opts, opts.Logger)
+}
+
+func NewElasticsearchProcess(data_root string, es_opts *es.BulkOptions, logger *log.WOFLogger) (*ElasticsearchProcess, error) {
+
+	indexer, err := es.NewBulkIndexer(es_opts)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(pr.files[repo]) > 0 {
-		err = pr._process(repo)
-
-		if err != nil {
-			return err
-		}
+	pr := ElasticsearchProcess{
+		indexer:  indexer,
+		es_index: es_opts.Index,
+		logger:   logger,
 	}
 
-	err = pr.queue.Release(repo)
+	opts := NewDefaultBatchOptions()
+	opts.Filter = pr.filter
+
+	batch, err := NewBatchProcess("elasticsearch", data_root, pr.handle, opts, logger)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	pr.BatchProcess = batch
+	return &pr, nil
 }
 
-func (pr *ElasticsearchProcess) _process(repo string) error {
+func (pr *ElasticsearchProcess) Name() string {
+	return "elasticsearch"
+}
 
-	t1 := time.Now()
+func (pr *ElasticsearchProcess) filter(root string, f updated.UpdateFile) bool {
+	return strings.HasSuffix(f.Path, ".geojson")
+}
 
-	defer func() {
-		t2 := time.Since(t1)
-		pr.logger.Status("Time to process (%s) %s: %v", pr.Name(), repo, t2)
-	}()
+func (pr *ElasticsearchProcess) handle(ctx context.Context, batch *Batch) error {
 
-	root := filepath.Join(pr.data_root, repo)
+	repo := batch.Repo
+	root := batch.Root
 
-	_, err := os.Stat(root)
+	files := batch.Files
+	deletes := batch.Deletes
 
-	if os.IsNotExist(err) {
-		pr.logger.Error("Can't find repo", root)
-		return err
-	}
+	pr.emitter.batch(ctx, events.LevelDebug, batch, "Index files in ES (%s): %s", pr.es_index, files)
 
-	/* sudo wrap all of this in a single function somewhere... */
+	actions := make([]*es.Action, 0)
+	seen := make(map[string]bool)
 
-	pr.mu.Lock()
-	files := pr.files[repo]
+	// deletions are sent first, the same way the tile38 processor does, so that a
+	// record that has been deleted and re-added (or moved) ends up in the index
 
-	delete(pr.files, repo)
-	pr.mu.Unlock()
+	for _, path := range deletes {
 
-	pr.logger.Debug("Index files in ES: %s", files)
+		if seen[path] {
+			continue
+		}
 
-	tmpfile, err := utils.FilesToFileList(files, root)
+		seen[path] = true
 
-	if err != nil {
+		abs_path := filepath.Join(root, path)
 
-		pr.mu.Lock()
+		// alt files share the same ID as the record they are an alternate
+		// of so deleting them is not the same as deleting the record
 
-		_, ok := pr.files[repo]
+		is_alt, err := uri.IsAltFile(abs_path)
 
-		if ok {
+		if err != nil || is_alt {
+			continue
+		}
 
-			for _, path := range files {
-				pr.files[repo] = append(pr.files[repo], path)
-			}
+		id, err := uri.IdFromPath(abs_path)
 
-		} else {
-			pr.files[repo] = files
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Failed to determine ID for deleted file %s, because %s", abs_path, err)
+			continue
 		}
 
-		pr.mu.Unlock()
+		// the file is gone so we don't know its placetype, the indexer will look it up if necessary
 
-		return err
+		actions = append(actions, es.NewDeleteAction(id, ""))
 	}
 
-	/* end of sudo wrap all of this in a single function somewhere... */
+	// files that can't be turned in to documents are counted as failures, once
+	// everything else has been indexed, rather than being dropped on the floor
+
+	failed := make([]string, 0)
 
-	defer func() {
-		tmpfile.Close()
-		os.Remove(tmpfile.Name())
-	}()
+	for _, path := range files {
 
-	pr.logger.Debug("Process (ES) file list %s", tmpfile.Name())
+		if seen[path] {
+			continue
+		}
 
-	// please write me in Go... (20161222/thisisaaronland)
+		seen[path] = true
 
-	index_args := []string{
-		"--host", pr.es_host,
-		"--port", pr.es_port,
-		"--index", pr.es_index,
-		tmpfile.Name(),
-	}
+		abs_path := filepath.Join(root, path)
+
+		// see above - indexing an alt file would clobber the "real" record
+
+		is_alt, err := uri.IsAltFile(abs_path)
+
+		if err != nil || is_alt {
+			continue
+		}
 
-	cmd := exec.Command(pr.index_tool, index_args...)
+		doc, err := es.NewDocumentFromFile(abs_path)
+
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Failed to prepare %s for indexing, because %s", abs_path, err)
+			failed = append(failed, path)
+			continue
+		}
+
+		actions = append(actions, es.NewIndexAction(doc))
+	}
 
-	pr.logger.Debug("%s %s", pr.index_tool, strings.Join(index_args, " "))
+	if len(actions) == 0 && len(failed) == 0 {
+		return nil
+	}
 
-	_, err = cmd.Output()
+	err := pr.indexer.Do(ctx, actions)
 
 	if err != nil {
-		pr.logger.Error("failed to index Elasticsearch %s (%s %s)", err, pr.index_tool, strings.Join(index_args, " "))
+
+		bulk_err, ok := err.(*es.BulkError)
+
+		if ok {
+
+			for _, item := range bulk_err.Items {
+				pr.emitter.batch(ctx, events.LevelError, batch, "Failed to index (ES) %s", item)
+			}
+		}
+
+		pr.emitter.batch(ctx, events.LevelError, batch, "Failed to index (ES) files for %s, because %s", repo, err)
 		return err
 	}
 
-	pr.logger.Debug("Successfully processed (ES) file list %s", tmpfile.Name())
+	if len(failed) > 0 {
+		msg := fmt.Sprintf("Failed to prepare %d files for indexing (ES): %s", len(failed), strings.Join(failed, ","))
+		return errors.New(msg)
+	}
+
+	pr.emitter.batch(ctx, events.LevelDebug, batch, "Successfully indexed (ES) %d files (%d deletions) for %s", len(actions), len(deletes), repo)
 	return nil
 }
@@ -0,0 +1,155 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EventEmitter is implemented by processors that emit events about the tasks they process.
+// NewProcess calls SetEventLogger with ProcessOptions.Events, if it isn't nil, so that what
+// a processor does with a task can be followed (by its task ID) along with the events
+// wof-updated emits for the same task.
+
+type EventEmitter interface {
+	SetEventLogger(l *events.Logger)
+}
+
+// emitter emits plain log events on behalf of a processor, filling in the processor's
+// name and the task ID, repo and hash of whatever it is working on. Until it has an event
+// logger it logs the same messages with logger, so that processors used on their own
+// still log something.
+
+type emitter struct {
+	processor string
+	logger    *log.WOFLogger
+	events    *events.Logger
+	mu        *sync.RWMutex
+}
+
+func newEmitter(processor string, logger *log.WOFLogger) *emitter {
+
+	em := emitter{
+		processor: processor,
+		logger:    logger,
+		events:    nil,
+		mu:        new(sync.RWMutex),
+	}
+
+	return &em
+}
+
+func (em *emitter) setEventLogger(l *events.Logger) {
+
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	em.events = l
+}
+
+// task emits a message about task, which is being processed with ctx.
+
+func (em *emitter) task(ctx context.Context, level string, task updated.UpdateTask, format string, args ...interface{}) {
+
+	e := events.Event{
+		Level:     level,
+		Name:      events.Log,
+		Message:   fmt.Sprintf(format, args...),
+		TaskId:    events.TaskId(ctx),
+		Repo:      task.Repo,
+		Hash:      task.Hash,
+		Processor: em.processor,
+		Files:     len(task.Files),
+	}
+
+	em.emit(&e)
+}
+
+// batch emits a message about batch. A batch may contain files from more than one task,
+// in which case their task IDs and hashes are listed, separated by commas.
+
+func (em *emitter) batch(ctx context.Context, level string, batch *Batch, format string, args ...interface{}) {
+
+	task_ids := make(map[string]bool)
+	hashes := make(map[string]bool)
+
+	for _, path := range append(append([]string{}, batch.Files...), batch.Deletes...) {
+
+		b, ok := batch.origins[path]
+
+		if !ok {
+			continue
+		}
+
+		if b.task_id != "" {
+			task_ids[b.task_id] = true
+		}
+
+		hashes[b.hash] = true
+	}
+
+	task_id := joinKeys(task_ids)
+
+	if task_id == "" {
+		task_id = events.TaskId(ctx)
+	}
+
+	e := events.Event{
+		Level:     level,
+		Name:      events.Log,
+		Message:   fmt.Sprintf(format, args...),
+		TaskId:    task_id,
+		Repo:      batch.Repo,
+		Hash:      joinKeys(hashes),
+		Processor: em.processor,
+		Files:     batch.Count(),
+	}
+
+	em.emit(&e)
+}
+
+func (em *emitter) emit(e *events.Event) {
+
+	em.mu.RLock()
+	l := em.events
+	em.mu.RUnlock()
+
+	if l != nil {
+		l.Emit(e)
+		return
+	}
+
+	if em.logger == nil {
+		return
+	}
+
+	switch e.Level {
+	case events.LevelFatal, events.LevelError:
+		em.logger.Error("%s", e.Message)
+	case events.LevelWarning:
+		em.logger.Warning("%s", e.Message)
+	case events.LevelStatus:
+		em.logger.Status("%s", e.Message)
+	case events.LevelDebug:
+		em.logger.Debug("%s", e.Message)
+	default:
+		em.logger.Info("%s", e.Message)
+	}
+}
+
+func joinKeys(m map[string]bool) string {
+
+	keys := make([]string, 0)
+
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,123 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"strings"
+	"testing"
+)
+
+func newTestEventLogger(t *testing.T) (*events.Logger, *bytes.Buffer) {
+
+	var buf bytes.Buffer
+
+	l := events.NewLogger("")
+
+	err := l.AddWriter(&buf, events.FormatJSON, events.LevelDebug, nil)
+
+	if err != nil {
+		t.Fatalf("Failed to add writer, %s", err)
+	}
+
+	return l, &buf
+}
+
+func readEvents(t *testing.T, buf *bytes.Buffer) []*events.Event {
+
+	emitted := make([]*events.Event, 0)
+
+	for _, ln := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+
+		if ln == "" {
+			continue
+		}
+
+		var e events.Event
+
+		err := json.Unmarshal([]byte(ln), &e)
+
+		if err != nil {
+			t.Fatalf("Failed to parse event %s, %s", ln, err)
+		}
+
+		emitted = append(emitted, &e)
+	}
+
+	return emitted
+}
+
+func TestProcessorsEmitTaskEvents(t *testing.T) {
+
+	l, buf := newTestEventLogger(t)
+
+	opts := &ProcessOptions{
+		DataRoot: t.TempDir(),
+		Logger:   log.SimpleWOFLogger(),
+		Events:   l,
+	}
+
+	pr, err := NewProcess("null://", opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create processor, %s", err)
+	}
+
+	ctx := events.WithTaskId(context.Background(), "task-1")
+
+	err = pr.ProcessTask(ctx, testTask("abc", "repo", "data/1.geojson"))
+
+	if err != nil {
+		t.Fatalf("Failed to process task, %s", err)
+	}
+
+	emitted := readEvents(t, buf)
+
+	if len(emitted) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitted))
+	}
+
+	e := emitted[0]
+
+	if e.Name != events.Log || e.TaskId != "task-1" || e.Repo != "repo" || e.Hash != "abc" || e.Processor != "null" || e.Files != 1 {
+		t.Fatalf("Unexpected event %v", e)
+	}
+}
+
+func TestBatchEventsListEveryTask(t *testing.T) {
+
+	h := &testHandler{}
+
+	opts := NewDefaultBatchOptions()
+	opts.MaxBuffered = 10
+
+	pr, _ := newTestBatchProcess(t, h, opts, "repo")
+
+	l, buf := newTestEventLogger(t)
+	pr.SetEventLogger(l)
+
+	ctx := context.Background()
+
+	pr.ProcessTask(events.WithTaskId(ctx, "task-2"), testTask("two", "repo", "data/2.geojson"))
+	pr.ProcessTask(events.WithTaskId(ctx, "task-1"), testTask("one", "repo", "data/1.geojson"))
+
+	err := pr.Flush(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to flush, %s", err)
+	}
+
+	emitted := readEvents(t, buf)
+
+	if len(emitted) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitted))
+	}
+
+	e := emitted[0]
+
+	if e.TaskId != "task-1,task-2" || e.Hash != "one,two" || e.Repo != "repo" || e.Processor != "test" || e.Files != 2 {
+		t.Fatalf("Unexpected event %v", e)
+	}
+}
@@ -1,28 +1,41 @@
 package process
 
 import (
+	"context"
 	_ "fmt"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
 	"github.com/whosonfirst/go-whosonfirst-updated/queue"
 	_ "log"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 )
 
+func init() {
+	RegisterProcess("lfs", newLFSProcessFromURI)
+}
+
 type LFSProcess struct {
 	Process
 	queue     *queue.Queue
 	data_root string
 	flushing  bool
 	mu        *sync.Mutex
+	wg        *sync.WaitGroup
+	closing   bool
+	emitter   *emitter
 	logger    *log.WOFLogger
 }
 
+func newLFSProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+	return NewLFSProcess(opts.DataRoot, opts.Logger)
+}
+
 func NewLFSProcess(data_root string, logger *log.WOFLogger) (*LFSProcess, error) {
 
 	data_root, err := filepath.Abs(data_root)
@@ -44,12 +57,16 @@ func NewLFSProcess(data_root string, logger *log.WOFLogger) (*LFSProcess, error)
 	}
 
 	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
 
 	pr := LFSProcess{
 		queue:     q,
 		data_root: data_root,
 		flushing:  false,
 		mu:        mu,
+		wg:        wg,
+		closing:   false,
+		emitter:   newEmitter("lfs", logger),
 		logger:    logger,
 	}
 
@@ -60,7 +77,14 @@ func (pr *LFSProcess) Name() string {
 	return "lfs"
 }
 
-func (pr *LFSProcess) Flush() error {
+// SetEventLogger sets where events about the tasks being processed are emitted. Until
+// it is set they are logged instead.
+
+func (pr *LFSProcess) SetEventLogger(l *events.Logger) {
+	pr.emitter.setEventLogger(l)
+}
+
+func (pr *LFSProcess) Flush(ctx context.Context) error {
 
 	pr.mu.Lock()
 
@@ -72,8 +96,8 @@ func (pr *LFSProcess) Flush() error {
 	pr.flushing = true
 	pr.mu.Unlock()
 
-	for _, repo := range pr.queue.Pending() {
-		go pr.ProcessRepo(repo)
+	for _, repo := range pr.queue.Dispatch() {
+		go pr.ProcessRepo(ctx, repo)
 	}
 
 	pr.mu.Lock()
@@ -84,115 +108,111 @@ func (pr *LFSProcess) Flush() error {
 	return nil
 }
 
-func (pr *LFSProcess) ProcessTask(task updated.UpdateTask) error {
+// BufferedFiles always returns an empty map since LFSProcess doesn't hold on to any files.
 
-	repo := task.Repo
-	return pr.ProcessRepo(repo)
+func (pr *LFSProcess) BufferedFiles() map[string]int {
+	return make(map[string]int)
 }
 
-func (pr *LFSProcess) ProcessRepo(repo string) error {
+func (pr *LFSProcess) Processing() []string {
+	return pr.queue.Processing()
+}
 
-	if pr.queue.IsProcessing(repo) {
-		return pr.queue.Schedule(repo)
-	}
+func (pr *LFSProcess) Pending() []string {
+	return pr.queue.Pending()
+}
 
-	err := pr.queue.Lock(repo)
+func (pr *LFSProcess) Close(ctx context.Context) error {
 
-	if err != nil {
-		return err
-	}
+	pr.mu.Lock()
+	pr.closing = true
+	pr.mu.Unlock()
 
-	err = pr._process(repo)
+	return waitWithContext(ctx, pr.wg)
+}
 
-	if err != nil {
-		return err
-	}
+func (pr *LFSProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
+	return pr.process(ctx, task)
+}
 
-	err = pr.queue.Release(repo)
+func (pr *LFSProcess) ProcessRepo(ctx context.Context, repo string) error {
 
-	if err != nil {
-		return err
+	task := updated.UpdateTask{
+		Repo: repo,
 	}
 
-	return nil
+	return pr.process(ctx, task)
 }
 
-func (pr *LFSProcess) _process(repo string) error {
-
-	t1 := time.Now()
+func (pr *LFSProcess) process(ctx context.Context, task updated.UpdateTask) error {
 
-	defer func() {
-
-		t2 := time.Since(t1)
-		pr.logger.Status("Time to process (%s) %s: %v", pr.Name(), repo, t2)
-	}()
+	repo := task.Repo
 
-	cwd, err := os.Getwd()
+	pr.mu.Lock()
 
-	if err != nil {
-		pr.logger.Error("Can't get cwd, because %s", err)
-		return err
+	if pr.closing {
+		pr.mu.Unlock()
+		return ErrClosing
 	}
 
-	abs_path := filepath.Join(pr.data_root, repo)
+	pr.wg.Add(1)
+	pr.mu.Unlock()
 
-	_, err = os.Stat(abs_path)
+	defer pr.wg.Done()
 
-	if os.IsNotExist(err) {
-		pr.logger.Error("Can't find repo %s", abs_path)
-		return err
-	}
+	// if someone else is already processing repo then it will be processed again, the
+	// next time the processor is flushed, so nothing is lost
 
-	err = os.Chdir(abs_path)
-
-	if err != nil {
-		pr.logger.Error("Can't chdir to %s, because %s", abs_path, err)
-		return err
+	if !pr.queue.TryLockOrSchedule(repo) {
+		return nil
 	}
 
-	defer os.Chdir(cwd) // make sure we go back to where we came from
+	defer pr.queue.Release(repo)
 
-	//
+	return pr._process(ctx, task)
+}
 
-	var ta time.Time
-	var tb time.Duration
+func (pr *LFSProcess) _process(ctx context.Context, task updated.UpdateTask) error {
 
-	git_args := make([]string, 0)
-	var cmd *exec.Cmd
+	repo := task.Repo
 
-	git_args = []string{"lfs", "fetch"}
-	cmd = exec.Command("git", git_args...)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		// pass
+	}
 
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
+	t1 := time.Now()
 
-	ta = time.Now()
+	defer func() {
+
+		t2 := time.Since(t1)
+		pr.emitter.task(ctx, events.LevelStatus, task, "Time to process (%s) %s: %v", pr.Name(), repo, t2)
+	}()
 
-	_, err = cmd.Output()
+	abs_path := filepath.Join(pr.data_root, repo)
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to fetch LFS: %v", tb)
+	r, err := git.NewRepo(abs_path, pr.logger)
 
 	if err != nil {
-		pr.logger.Error("Failed to fetch LFS: %s (git %s)", err, strings.Join(git_args, " "))
+		pr.emitter.task(ctx, events.LevelError, task, "Can't find repo %s, because %s", abs_path, err)
 		return err
 	}
 
 	//
 
-	git_args = []string{"lfs", "checkout"}
-	cmd = exec.Command("git", git_args...)
-
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
-
-	ta = time.Now()
+	err = r.LFSFetch(ctx)
 
-	_, err = cmd.Output()
+	if err != nil {
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to fetch LFS: %s", err)
+		return err
+	}
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to checkout LFS: %v", tb)
+	err = r.LFSCheckout(ctx)
 
 	if err != nil {
-		pr.logger.Error("Failed to checkout LFS: %s (git %s)", err, strings.Join(git_args, " "))
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to checkout LFS: %s", err)
 		return err
 	}
 
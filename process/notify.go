@@ -0,0 +1,550 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NotifyFormatSlack = "slack"
+	NotifyFormatJSON  = "json"
+)
+
+// the maximum number of commits that are listed individually in a digest
+
+const max_digest_commits = 20
+
+func init() {
+	RegisterProcess("notify", newNotifyProcessFromURI)
+}
+
+// Notification summarises what happened to a task. Results are only known when the
+// notify processor is run as a post-processor, after everything else.
+
+type Notification struct {
+	TaskId   string    `json:"task_id,omitempty"`
+	Repo     string    `json:"repo"`
+	Hash     string    `json:"hash"`
+	Files    int       `json:"files"`
+	Ok       bool      `json:"ok"`
+	Results  []Result  `json:"results"`
+	Duration float64   `json:"duration_seconds"`
+	Time     time.Time `json:"time"`
+}
+
+// NotifyOptions describe where notifications are sent and when they are combined in to a
+// digest: once DigestThreshold notifications have been sent within DigestWindow any more
+// are held on to and sent as a single digest at the end of the window.
+
+type NotifyOptions struct {
+	Endpoint        string
+	Format          string
+	DigestThreshold int
+	DigestWindow    time.Duration
+	Timeout         time.Duration
+}
+
+func NewDefaultNotifyOptions() *NotifyOptions {
+
+	opts := NotifyOptions{
+		Format:          NotifyFormatSlack,
+		DigestThreshold: 5,
+		DigestWindow:    time.Minute * 1,
+		Timeout:         time.Second * 30,
+	}
+
+	return &opts
+}
+
+func (o *NotifyOptions) Validate() error {
+
+	if o.Endpoint == "" {
+		return errors.New("Missing endpoint")
+	}
+
+	switch o.Format {
+	case NotifyFormatSlack, NotifyFormatJSON:
+		// pass
+	default:
+		msg := fmt.Sprintf("Invalid format '%s'", o.Format)
+		return errors.New(msg)
+	}
+
+	if o.DigestThreshold < 0 {
+		return errors.New("Invalid digest threshold")
+	}
+
+	if o.DigestWindow <= 0 {
+		return errors.New("Invalid digest window")
+	}
+
+	return nil
+}
+
+type NotifyProcess struct {
+	Process
+	options *NotifyOptions
+	client  *http.Client
+	sent    []time.Time
+	pending []*Notification
+	timer   *time.Timer
+	closing bool
+	mu      *sync.Mutex
+	wg      *sync.WaitGroup
+	logger  *log.WOFLogger
+}
+
+// newNotifyProcessFromURI expects a URI like 'notify://hooks.slack.com/services/T000/B000/XXXX'
+// which sends a Slack-compatible JSON message to https://hooks.slack.com/services/T000/B000/XXXX
+// for every task. Other valid parameters are 'scheme' (http or https), 'format' (slack or json),
+// 'digest-threshold', 'digest-window' and 'timeout' for individual requests.
+
+func newNotifyProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+
+	q := u.Query()
+
+	notify_opts := NewDefaultNotifyOptions()
+
+	scheme := q.Get("scheme")
+
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	endpoint := url.URL{
+		Scheme: scheme,
+		Host:   u.Host,
+		Path:   u.Path,
+	}
+
+	notify_opts.Endpoint = endpoint.String()
+
+	if q.Get("format") != "" {
+		notify_opts.Format = q.Get("format")
+	}
+
+	str_threshold := q.Get("digest-threshold")
+
+	if str_threshold != "" {
+
+		threshold, err := strconv.Atoi(str_threshold)
+
+		if err != nil {
+			return nil, err
+		}
+
+		notify_opts.DigestThreshold = threshold
+	}
+
+	str_window := q.Get("digest-window")
+
+	if str_window != "" {
+
+		window, err := time.ParseDuration(str_window)
+
+		if err != nil {
+			return nil, err
+		}
+
+		notify_opts.DigestWindow = window
+	}
+
+	str_timeout := q.Get("timeout")
+
+	if str_timeout != "" {
+
+		timeout, err := time.ParseDuration(str_timeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		notify_opts.Timeout = timeout
+	}
+
+	return NewNotifyProcess(notify_opts, opts.Logger)
+}
+
+func NewNotifyProcess(opts *NotifyOptions, logger *log.WOFLogger) (*NotifyProcess, error) {
+
+	err := opts.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: opts.Timeout,
+	}
+
+	pr := NotifyProcess{
+		options: opts,
+		client:  client,
+		sent:    make([]time.Time, 0),
+		pending: make([]*Notification, 0),
+		closing: false,
+		mu:      new(sync.Mutex),
+		wg:      new(sync.WaitGroup),
+		logger:  logger,
+	}
+
+	return &pr, nil
+}
+
+func (pr *NotifyProcess) Name() string {
+	return "notify"
+}
+
+func (pr *NotifyProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
+	return pr.Notify(ctx, task)
+}
+
+// Notify sends a notification for task straight away, unless too many have been sent
+// recently in which case it is added to the next digest.
+
+func (pr *NotifyProcess) Notify(ctx context.Context, task updated.UpdateTask) error {
+
+	n := newNotification(ctx, task)
+
+	pr.mu.Lock()
+
+	if pr.closing {
+		pr.mu.Unlock()
+		return ErrClosing
+	}
+
+	now := time.Now()
+	recent := make([]time.Time, 0)
+
+	for _, t := range pr.sent {
+
+		if now.Sub(t) < pr.options.DigestWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	pr.sent = recent
+
+	if len(pr.pending) == 0 && len(pr.sent) < pr.options.DigestThreshold {
+
+		pr.sent = append(pr.sent, now)
+		pr.mu.Unlock()
+
+		return pr.send(ctx, []*Notification{n})
+	}
+
+	pr.pending = append(pr.pending, n)
+
+	if pr.timer == nil {
+
+		pr.wg.Add(1)
+
+		pr.timer = time.AfterFunc(pr.options.DigestWindow, func() {
+
+			defer pr.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), pr.options.Timeout)
+			defer cancel()
+
+			pr.sendDigest(ctx)
+		})
+	}
+
+	pr.mu.Unlock()
+	return nil
+}
+
+// Flush sends any notifications that are waiting for the next digest.
+
+func (pr *NotifyProcess) Flush(ctx context.Context) error {
+	return pr.sendDigest(ctx)
+}
+
+func (pr *NotifyProcess) Close(ctx context.Context) error {
+
+	pr.mu.Lock()
+	pr.closing = true
+	pr.mu.Unlock()
+
+	err := pr.sendDigest(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return waitWithContext(ctx, pr.wg)
+}
+
+func (pr *NotifyProcess) sendDigest(ctx context.Context) error {
+
+	pr.mu.Lock()
+
+	pending := pr.pending
+	pr.pending = make([]*Notification, 0)
+
+	if pr.timer != nil {
+
+		// if the timer hadn't fired yet then it never will, so its function
+		// won't be calling wg.Done
+
+		if pr.timer.Stop() {
+			pr.wg.Done()
+		}
+
+		pr.timer = nil
+	}
+
+	if len(pending) > 0 {
+		pr.sent = append(pr.sent, time.Now())
+	}
+
+	pr.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := pr.send(ctx, pending)
+
+	// there's no one to return the error to if this was called by the timer, and
+	// retrying a digest is likely to make a burst worse, so it is only logged
+
+	if err != nil {
+		pr.logger.Error("Failed to send digest of %d notifications, because %s", len(pending), err)
+	}
+
+	return err
+}
+
+func (pr *NotifyProcess) send(ctx context.Context, notifications []*Notification) error {
+
+	var body interface{}
+
+	switch pr.options.Format {
+	case NotifyFormatJSON:
+		body = map[string]interface{}{
+			"notifications": notifications,
+		}
+	default:
+		body = slackMessage(notifications)
+	}
+
+	enc, err := json.Marshal(body)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", pr.options.Endpoint, bytes.NewReader(enc))
+
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := pr.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+
+		err_msg := fmt.Sprintf("Notification failed with status %d: %s", rsp.StatusCode, strings.TrimSpace(string(msg)))
+		return errors.New(err_msg)
+	}
+
+	io.Copy(ioutil.Discard, rsp.Body)
+
+	pr.logger.Debug("Sent %d notification(s) to %s", len(notifications), pr.options.Endpoint)
+	return nil
+}
+
+func newNotification(ctx context.Context, task updated.UpdateTask) *Notification {
+
+	now := time.Now()
+
+	n := Notification{
+		TaskId:  events.TaskId(ctx),
+		Repo:    task.Repo,
+		Hash:    task.Hash,
+		Files:   len(task.Files),
+		Ok:      true,
+		Results: make([]Result, 0),
+		Time:    now,
+	}
+
+	results := ResultsFromContext(ctx)
+
+	if results != nil {
+
+		n.Results = results.List()
+		n.Duration = now.Sub(results.Started()).Seconds()
+
+		for _, r := range n.Results {
+
+			if !r.Ok() {
+				n.Ok = false
+			}
+		}
+	}
+
+	return &n
+}
+
+// these are the parts of Slack's incoming webhook message format that are used,
+// which other chat services also understand
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Fields   []slackField `json:"fields"`
+	Footer   string       `json:"footer,omitempty"`
+}
+
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+func slackMessage(notifications []*Notification) *slackPayload {
+
+	failed := 0
+
+	for _, n := range notifications {
+
+		if !n.Ok {
+			failed += 1
+		}
+	}
+
+	var text string
+
+	if len(notifications) == 1 {
+
+		n := notifications[0]
+
+		status := "Processed"
+
+		if !n.Ok {
+			status = "Failed to process"
+		}
+
+		text = fmt.Sprintf("%s %s (%s), %d files in %.1fs", status, n.Hash, n.Repo, n.Files, n.Duration)
+
+	} else {
+		text = fmt.Sprintf("Processed %d commits, %d of which failed", len(notifications), failed)
+	}
+
+	attachments := make([]slackAttachment, 0)
+
+	for idx, n := range notifications {
+
+		if idx == max_digest_commits {
+
+			a := slackAttachment{
+				Fallback: fmt.Sprintf("and %d more", len(notifications)-idx),
+				Title:    fmt.Sprintf("and %d more", len(notifications)-idx),
+				Fields:   make([]slackField, 0),
+			}
+
+			attachments = append(attachments, a)
+			break
+		}
+
+		attachments = append(attachments, slackAttachmentForNotification(n))
+	}
+
+	p := slackPayload{
+		Text:        text,
+		Attachments: attachments,
+	}
+
+	return &p
+}
+
+func slackAttachmentForNotification(n *Notification) slackAttachment {
+
+	color := "good"
+
+	if !n.Ok {
+		color = "danger"
+	}
+
+	succeeded := make([]string, 0)
+	pending := make([]string, 0)
+	failed := make([]string, 0)
+
+	for _, r := range n.Results {
+
+		str := fmt.Sprintf("%s (%.1fs)", r.Processor, r.Duration)
+
+		switch {
+		case !r.Ok():
+			failed = append(failed, fmt.Sprintf("%s: %s", str, r.Error))
+		case r.Pending:
+			pending = append(pending, str)
+		default:
+			succeeded = append(succeeded, str)
+		}
+	}
+
+	fields := []slackField{
+		slackField{Title: "Repo", Value: n.Repo, Short: true},
+		slackField{Title: "Commit", Value: n.Hash, Short: true},
+		slackField{Title: "Files", Value: strconv.Itoa(n.Files), Short: true},
+		slackField{Title: "Time", Value: fmt.Sprintf("%.1fs", n.Duration), Short: true},
+	}
+
+	if len(succeeded) > 0 {
+		fields = append(fields, slackField{Title: "Succeeded", Value: strings.Join(succeeded, ", ")})
+	}
+
+	if len(pending) > 0 {
+		fields = append(fields, slackField{Title: "Pending", Value: strings.Join(pending, ", ")})
+	}
+
+	if len(failed) > 0 {
+		fields = append(fields, slackField{Title: "Failed", Value: strings.Join(failed, "\n")})
+	}
+
+	a := slackAttachment{
+		Fallback: fmt.Sprintf("%s (%s)", n.Hash, n.Repo),
+		Color:    color,
+		Title:    fmt.Sprintf("%s (%s)", n.Hash, n.Repo),
+		Fields:   fields,
+	}
+
+	if n.TaskId != "" {
+		a.Footer = fmt.Sprintf("task %s", n.TaskId)
+	}
+
+	return a
+}
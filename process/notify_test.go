@@ -0,0 +1,171 @@
+package process
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyStub is a local HTTP endpoint that records the notifications it is sent and
+// responds with status.
+
+type notifyStub struct {
+	mu       sync.Mutex
+	status   int
+	received [][]*Notification
+}
+
+func (s *notifyStub) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+
+	body, _ := ioutil.ReadAll(req.Body)
+
+	var payload struct {
+		Notifications []*Notification `json:"notifications"`
+	}
+
+	json.Unmarshal(body, &payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received = append(s.received, payload.Notifications)
+
+	if s.status != 0 {
+		http.Error(rsp, "nope", s.status)
+	}
+}
+
+func (s *notifyStub) Received() [][]*Notification {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]*Notification{}, s.received...)
+}
+
+func newTestNotifyProcess(t *testing.T, stub *notifyStub, threshold int) *NotifyProcess {
+
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	opts := NewDefaultNotifyOptions()
+	opts.Endpoint = server.URL
+	opts.Format = NotifyFormatJSON
+	opts.DigestThreshold = threshold
+	opts.DigestWindow = time.Hour
+
+	pr, err := NewNotifyProcess(opts, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create notify process, %s", err)
+	}
+
+	return pr
+}
+
+func TestNotifyReportsResults(t *testing.T) {
+
+	stub := &notifyStub{}
+	pr := newTestNotifyProcess(t, stub, 5)
+
+	results := NewResults()
+	results.Add(Result{Processor: "pull", Stage: "pre", Attempts: 1})
+	results.Add(Result{Processor: "s3", Stage: "async", Attempts: 3, Error: "broken"})
+
+	ctx := events.WithTaskId(context.Background(), "task-1")
+	ctx = WithResults(ctx, results)
+
+	err := pr.Notify(ctx, testTask("abc", "repo", "data/1.geojson"))
+
+	if err != nil {
+		t.Fatalf("Failed to notify, %s", err)
+	}
+
+	received := stub.Received()
+
+	if len(received) != 1 || len(received[0]) != 1 {
+		t.Fatalf("Expected a single notification, got %v", received)
+	}
+
+	n := received[0][0]
+
+	if n.TaskId != "task-1" || n.Repo != "repo" || n.Hash != "abc" || n.Files != 1 {
+		t.Fatalf("Unexpected notification %v", n)
+	}
+
+	if n.Ok || len(n.Results) != 2 || n.Results[1].Error != "broken" {
+		t.Fatalf("Expected the failed result to be reported, got %v", n)
+	}
+}
+
+func TestNotifyFailure(t *testing.T) {
+
+	stub := &notifyStub{
+		status: http.StatusInternalServerError,
+	}
+
+	pr := newTestNotifyProcess(t, stub, 5)
+
+	err := pr.Notify(context.Background(), testTask("abc", "repo"))
+
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("Expected the endpoint's status to be returned, got %v", err)
+	}
+
+	// notifications are only ever sent once, wof-updated doesn't retry them
+
+	if len(stub.Received()) != 1 {
+		t.Fatalf("Expected a single request, got %d", len(stub.Received()))
+	}
+}
+
+func TestNotifyDigest(t *testing.T) {
+
+	stub := &notifyStub{}
+	pr := newTestNotifyProcess(t, stub, 1)
+
+	ctx := context.Background()
+
+	for _, hash := range []string{"one", "two", "three"} {
+
+		err := pr.Notify(ctx, testTask(hash, "repo"))
+
+		if err != nil {
+			t.Fatalf("Failed to notify %s, %s", hash, err)
+		}
+	}
+
+	if len(stub.Received()) != 1 {
+		t.Fatalf("Expected only the first notification to be sent, got %d", len(stub.Received()))
+	}
+
+	err := pr.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to close, %s", err)
+	}
+
+	received := stub.Received()
+
+	if len(received) != 2 || len(received[1]) != 2 {
+		t.Fatalf("Expected the rest to be sent as a digest, got %v", received)
+	}
+
+	if received[1][0].Hash != "two" || received[1][1].Hash != "three" {
+		t.Fatalf("Unexpected digest %v", received[1])
+	}
+
+	err = pr.Notify(ctx, testTask("four", "repo"))
+
+	if err != ErrClosing {
+		t.Fatalf("Expected %s, got %v", ErrClosing, err)
+	}
+}
@@ -1,21 +1,34 @@
 package process
 
 import (
+	"context"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"net/url"
 	"strings"
 )
 
+func init() {
+	RegisterProcess("null", newNullProcessFromURI)
+}
+
 type NullProcess struct {
 	Process
 	data_root string
+	emitter   *emitter
 	logger    *log.WOFLogger
 }
 
+func newNullProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+	return NewNullProcess(opts.DataRoot, opts.Logger)
+}
+
 func NewNullProcess(data_root string, logger *log.WOFLogger) (*NullProcess, error) {
 
 	pr := NullProcess{
 		data_root: data_root,
+		emitter:   newEmitter("null", logger),
 		logger:    logger,
 	}
 
@@ -26,12 +39,23 @@ func (pr *NullProcess) Name() string {
 	return "null"
 }
 
-func (pr *NullProcess) Flush() error {
+// SetEventLogger sets where events about the tasks being processed are emitted. Until
+// it is set they are logged instead.
+
+func (pr *NullProcess) SetEventLogger(l *events.Logger) {
+	pr.emitter.setEventLogger(l)
+}
+
+func (pr *NullProcess) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (pr *NullProcess) Close(ctx context.Context) error {
 	return nil
 }
 
-func (pr *NullProcess) ProcessTask(task updated.UpdateTask) error {
+func (pr *NullProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
 
-	pr.logger.Info("process task repo: %s hash: %s files: %s", task.Repo, task.Hash, strings.Join(task.Commits, ";"))
+	pr.emitter.task(ctx, events.LevelInfo, task, "process task repo: %s hash: %s files: %s", task.Repo, task.Hash, strings.Join(task.Paths(), ";"))
 	return nil
 }
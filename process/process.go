@@ -1,11 +1,111 @@
 package process
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-updated"
+	"strings"
+	"sync"
 )
 
+var ErrClosing = errors.New("processor is closing")
+
+// Process is the interface that every processor implements. ProcessTask and Flush
+// should stop what they are doing, where possible, when ctx is cancelled. Close is
+// called once when wof-updated is shutting down and should not return until any
+// buffered work has been completed or ctx has been cancelled.
+
 type Process interface {
-	ProcessTask(task updated.UpdateTask) error
+	ProcessTask(ctx context.Context, task updated.UpdateTask) error
 	Name() string
-	Flush() error
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Buffered is implemented by processors that may still be holding on to files for
+// a repo after ProcessTask has returned. IsPending should return true until all of
+// those files have been successfully processed.
+
+type Buffered interface {
+	IsPending(repo string) bool
+}
+
+// Inspector is implemented by processors that can report what they are working on.
+// BufferedFiles returns the number of files (including deletions) being held on to for
+// each repo, Processing returns the repos that are currently being processed and Pending
+// returns the repos that are waiting to be processed (again).
+
+type Inspector interface {
+	BufferedFiles() map[string]int
+	Processing() []string
+	Pending() []string
+}
+
+// Deferred is implemented by processors that may finish with (or give up on) a task's
+// files after ProcessTask has returned, usually because they buffer files (see
+// BatchProcess). IsTaskPending should return true until all of task's files have been
+// dealt with one way or another and what happened to them is passed to the function given
+// to SetReporter. Discard is called when a task has been given up on (dead-lettered) so
+// that its files aren't tried again.
+
+type Deferred interface {
+	Buffered
+	IsTaskPending(task updated.UpdateTask) bool
+	Discard(task updated.UpdateTask)
+	SetReporter(reporter BatchReporter)
+}
+
+// Notifier is implemented by processors that report what happened to a task, rather than
+// doing anything with its files. When they are used as post-processors wof-updated calls
+// Notify once every other processor has finished with a task, whether or not they
+// succeeded (including when a pre-processor fails and the rest of the task is skipped),
+// and never retries a notification or adds the task to the dead letter store because one
+// couldn't be sent.
+
+type Notifier interface {
+	Notify(ctx context.Context, task updated.UpdateTask) error
+}
+
+// combineErrors returns nil if there aren't any errors, the error itself if there is only
+// one or a single error listing all of them.
+
+func combineErrors(errs []error) error {
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+
+		msgs := make([]string, len(errs))
+
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+
+		msg := fmt.Sprintf("%d errors: %s", len(errs), strings.Join(msgs, "; "))
+		return errors.New(msg)
+	}
+}
+
+// waitWithContext waits for wg to complete or for ctx to be cancelled, whichever
+// happens first.
+
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+
+	done_ch := make(chan bool, 1)
+
+	go func() {
+		wg.Wait()
+		done_ch <- true
+	}()
+
+	select {
+	case <-done_ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
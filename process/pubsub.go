@@ -1,16 +1,25 @@
 package process
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-updated"
 	// "github.com/whosonfirst/go-whosonfirst-updated/queue"
 	"gopkg.in/redis.v1"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	// "sync"
 	// "time"
 )
 
+func init() {
+	RegisterProcess("pubsub", newPubSubProcessFromURI)
+}
+
 type PubSubProcess struct {
 	Process
 	// queue     *queue.Queue
@@ -24,6 +33,44 @@ type PubSubProcess struct {
 	pubsub_channel string
 }
 
+// newPubSubProcessFromURI expects a URI like 'pubsub://localhost:6379/pubssed'
+
+func newPubSubProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+
+	pubsub_host := "localhost"
+	pubsub_port := 6379
+
+	if u.Host != "" {
+
+		host, str_port, err := net.SplitHostPort(u.Host)
+
+		if err != nil {
+			host = u.Host
+		} else {
+
+			port, err := strconv.Atoi(str_port)
+
+			if err != nil {
+				return nil, err
+			}
+
+			pubsub_port = port
+		}
+
+		if host != "" {
+			pubsub_host = host
+		}
+	}
+
+	pubsub_channel := strings.TrimLeft(u.Path, "/")
+
+	if pubsub_channel == "" {
+		pubsub_channel = "pubssed"
+	}
+
+	return NewPubSubProcess(opts.DataRoot, pubsub_host, pubsub_port, pubsub_channel, opts.Logger)
+}
+
 func NewPubSubProcess(data_root, pubsub_host string, pubsub_port int, pubsub_channel string, logger *log.WOFLogger) (*PubSubProcess, error) {
 
 	// TO DO: ensure pubsub connection here
@@ -46,11 +93,15 @@ func (pr *PubSubProcess) Name() string {
 
 // TO DO: figure out what blocking/flushing means here...
 
-func (pr *PubSubProcess) Flush() error {
+func (pr *PubSubProcess) Flush(ctx context.Context) error {
 	return nil
 }
 
-func (pr *PubSubProcess) ProcessTask(task updated.UpdateTask) error {
+func (pr *PubSubProcess) Close(ctx context.Context) error {
+	return nil
+}
+
+func (pr *PubSubProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
 
 	redis_endpoint := fmt.Sprintf("%s:%d", pr.pubsub_host, pr.pubsub_port)
 
@@ -60,9 +111,17 @@ func (pr *PubSubProcess) ProcessTask(task updated.UpdateTask) error {
 
 	defer redis_client.Close()
 
-	for _, path := range task.Commits {
-		if strings.HasSuffix(path, ".geojson") {
-			redis_client.Publish(pr.pubsub_channel, path)
+	for _, f := range task.Files {
+
+		if !strings.HasSuffix(f.Path, ".geojson") {
+			continue
+		}
+
+		err := redis_client.Publish(pr.pubsub_channel, f.Path).Err()
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to publish %s to %s, because %s", f.Path, pr.pubsub_channel, err)
+			return errors.New(msg)
 		}
 	}
 
@@ -1,29 +1,159 @@
 package process
 
 import (
-	_ "fmt"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
 	"github.com/whosonfirst/go-whosonfirst-updated/queue"
-	_ "log"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	PullStrategyMerge  = "merge"
+	PullStrategyRebase = "rebase"
+	PullStrategyReset  = "reset"
+)
+
+func init() {
+	RegisterProcess("pull", newPullProcessFromURI)
+}
+
+// PullOptions describe where to pull a repo from and how to bring the local copy up to
+// date. Strategy is one of "merge", "rebase" or "reset" (which discards any local changes
+// and resets the repo to match the remote branch).
+
+type PullOptions struct {
+	Remote   string
+	Branch   string
+	Strategy string
+}
+
+func NewDefaultPullOptions() *PullOptions {
+
+	opts := PullOptions{
+		Remote:   "origin",
+		Branch:   "master",
+		Strategy: PullStrategyMerge,
+	}
+
+	return &opts
+}
+
+func (o *PullOptions) Validate() error {
+
+	if o.Remote == "" {
+		return errors.New("Missing remote")
+	}
+
+	if o.Branch == "" {
+		return errors.New("Missing branch")
+	}
+
+	switch o.Strategy {
+	case PullStrategyMerge, PullStrategyRebase, PullStrategyReset:
+		// pass
+	default:
+		msg := fmt.Sprintf("Invalid strategy '%s'", o.Strategy)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// Upstream returns the remote branch that a repo is brought up to date with, for example
+// "origin/master".
+
+func (o *PullOptions) Upstream() string {
+	return fmt.Sprintf("%s/%s", o.Remote, o.Branch)
+}
+
 type PullProcess struct {
 	Process
-	queue     *queue.Queue
 	data_root string
-	flushing  bool
+	defaults  *PullOptions
+	repos     map[string]*PullOptions
+	queue     *queue.Queue
 	mu        *sync.Mutex
+	wg        *sync.WaitGroup
+	closing   bool
+	emitter   *emitter
 	logger    *log.WOFLogger
 }
 
-func NewPullProcess(data_root string, logger *log.WOFLogger) (*PullProcess, error) {
+// The remote, branch and strategy for every repo are set with the remote, branch and
+// strategy parameters and can be overridden for an individual repo by adding its name,
+// for example: pull://?branch=main&branch.whosonfirst-data=master&strategy.whosonfirst-data=reset
+
+func newPullProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+
+	q := u.Query()
+
+	defaults := NewDefaultPullOptions()
+
+	if q.Get("remote") != "" {
+		defaults.Remote = q.Get("remote")
+	}
+
+	if q.Get("branch") != "" {
+		defaults.Branch = q.Get("branch")
+	}
+
+	if q.Get("strategy") != "" {
+		defaults.Strategy = q.Get("strategy")
+	}
+
+	pr, err := NewPullProcess(opts.DataRoot, defaults, opts.Logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range q {
+
+		parts := strings.SplitN(k, ".", 2)
+
+		if len(parts) != 2 || len(v) == 0 {
+			continue
+		}
+
+		param := parts[0]
+		repo := parts[1]
+
+		repo_opts := pr.RepoOptions(repo)
+
+		switch param {
+		case "remote":
+			repo_opts.Remote = v[0]
+		case "branch":
+			repo_opts.Branch = v[0]
+		case "strategy":
+			repo_opts.Strategy = v[0]
+		default:
+			continue
+		}
+
+		err = pr.SetRepoOptions(repo, repo_opts)
+
+		if err != nil {
+			msg := fmt.Sprintf("Invalid pull options for %s, %s", repo, err)
+			return nil, errors.New(msg)
+		}
+	}
+
+	return pr, nil
+}
+
+func NewPullProcess(data_root string, defaults *PullOptions, logger *log.WOFLogger) (*PullProcess, error) {
 
 	data_root, err := filepath.Abs(data_root)
 
@@ -37,6 +167,16 @@ func NewPullProcess(data_root string, logger *log.WOFLogger) (*PullProcess, erro
 		return nil, err
 	}
 
+	if defaults == nil {
+		defaults = NewDefaultPullOptions()
+	}
+
+	err = defaults.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
 	q, err := queue.NewQueue()
 
 	if err != nil {
@@ -44,12 +184,17 @@ func NewPullProcess(data_root string, logger *log.WOFLogger) (*PullProcess, erro
 	}
 
 	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
 
 	pr := PullProcess{
-		queue:     q,
 		data_root: data_root,
-		flushing:  false,
+		defaults:  defaults,
+		repos:     make(map[string]*PullOptions),
+		queue:     q,
 		mu:        mu,
+		wg:        wg,
+		closing:   false,
+		emitter:   newEmitter("pull", logger),
 		logger:    logger,
 	}
 
@@ -60,179 +205,296 @@ func (pr *PullProcess) Name() string {
 	return "pull"
 }
 
-func (pr *PullProcess) Flush() error {
+// RepoOptions returns a copy of the options used to pull repo.
+
+func (pr *PullProcess) RepoOptions(repo string) *PullOptions {
 
 	pr.mu.Lock()
+	defer pr.mu.Unlock()
 
-	if pr.flushing {
-		pr.mu.Unlock()
-		return nil
+	opts, ok := pr.repos[repo]
+
+	if !ok {
+		opts = pr.defaults
 	}
 
-	pr.flushing = true
-	pr.mu.Unlock()
+	copy_opts := *opts
+	return &copy_opts
+}
+
+func (pr *PullProcess) SetRepoOptions(repo string, opts *PullOptions) error {
 
-	for _, repo := range pr.queue.Pending() {
-		go pr.ProcessRepo(repo)
+	err := opts.Validate()
+
+	if err != nil {
+		return err
 	}
 
-	pr.mu.Lock()
+	copy_opts := *opts
 
-	pr.flushing = false
+	pr.mu.Lock()
+	pr.repos[repo] = &copy_opts
 	pr.mu.Unlock()
 
 	return nil
 }
 
-func (pr *PullProcess) ProcessTask(task updated.UpdateTask) error {
+// Flush is a no-op because repos are pulled as soon as a task arrives.
 
-	repo := task.Repo
-	return pr.ProcessRepo(repo)
+func (pr *PullProcess) Flush(ctx context.Context) error {
+	return nil
+}
+
+// BufferedFiles always returns an empty map since PullProcess doesn't hold on to any files.
+
+func (pr *PullProcess) BufferedFiles() map[string]int {
+	return make(map[string]int)
 }
 
-func (pr *PullProcess) ProcessRepo(repo string) error {
+func (pr *PullProcess) Processing() []string {
+	return pr.queue.Processing()
+}
+
+// SetEventLogger sets where events about the tasks being processed are emitted. Until
+// it is set they are logged instead.
 
-	if pr.queue.IsProcessing(repo) {
-		return pr.queue.Schedule(repo)
+func (pr *PullProcess) SetEventLogger(l *events.Logger) {
+	pr.emitter.setEventLogger(l)
+}
+
+func (pr *PullProcess) Pending() []string {
+	return pr.queue.Pending()
+}
+
+func (pr *PullProcess) Close(ctx context.Context) error {
+
+	pr.mu.Lock()
+	pr.closing = true
+	pr.mu.Unlock()
+
+	return waitWithContext(ctx, pr.wg)
+}
+
+// ProcessTask brings the task's repo up to date and then checks that it contains the
+// task's commit, so that processors which run afterwards will see the files it changed.
+// If the repo already contains the commit then it isn't pulled at all.
+
+func (pr *PullProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
+
+	repo := task.Repo
+	hash := taskCommit(task)
+
+	// tasks are (or should be) checked when they are decoded but since we're about to
+	// run 'git reset --hard' in whatever directory repo names, check again
+
+	if !message.IsValidRepo(repo) {
+		msg := fmt.Sprintf("Invalid repo name '%s'", repo)
+		return errors.New(msg)
 	}
 
-	err := pr.queue.Lock(repo)
+	unlock, err := pr.lock(ctx, repo)
 
 	if err != nil {
 		return err
 	}
 
-	err = pr._process(repo)
+	defer unlock()
+
+	if hash != "" {
+
+		ok, err := pr.contains(ctx, repo, hash)
+
+		if err == nil && ok {
+			pr.emitter.task(ctx, events.LevelDebug, task, "%s already contains %s, skipping pull", repo, hash)
+			return nil
+		}
+	}
+
+	err = pr._process(ctx, task)
 
 	if err != nil {
 		return err
 	}
 
-	err = pr.queue.Release(repo)
+	if hash == "" {
+		return nil
+	}
+
+	ok, err := pr.contains(ctx, repo, hash)
 
 	if err != nil {
-		return err
+		msg := fmt.Sprintf("Failed to verify that %s contains %s, because %s", repo, hash, err)
+		return errors.New(msg)
+	}
+
+	if !ok {
+		msg := fmt.Sprintf("%s does not contain %s after pulling from %s", repo, hash, pr.RepoOptions(repo).Upstream())
+		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (pr *PullProcess) _process(repo string) error {
+func (pr *PullProcess) ProcessRepo(ctx context.Context, repo string) error {
 
-	t1 := time.Now()
+	unlock, err := pr.lock(ctx, repo)
 
-	defer func() {
+	if err != nil {
+		return err
+	}
 
-		t2 := time.Since(t1)
-		pr.logger.Status("Time to process (%s) %s: %v", pr.Name(), repo, t2)
-	}()
+	defer unlock()
 
-	cwd, err := os.Getwd()
+	task := updated.UpdateTask{
+		Repo: repo,
+	}
 
-	if err != nil {
-		pr.logger.Error("Can't get cwd, because %s", err)
-		return err
+	return pr._process(ctx, task)
+}
+
+// lock waits until no one else is pulling repo. The function it returns must be called
+// once the caller is done with the repo.
+
+func (pr *PullProcess) lock(ctx context.Context, repo string) (func(), error) {
+
+	pr.mu.Lock()
+
+	if pr.closing {
+		pr.mu.Unlock()
+		return nil, ErrClosing
 	}
 
-	abs_path := filepath.Join(pr.data_root, repo)
+	pr.wg.Add(1)
+	pr.mu.Unlock()
 
-	_, err = os.Stat(abs_path)
+	err := pr.queue.Lock(ctx, repo)
 
-	if os.IsNotExist(err) {
-		pr.logger.Error("Can't find repo %s", abs_path)
-		return err
+	if err != nil {
+		pr.wg.Done()
+		return nil, err
 	}
 
-	err = os.Chdir(abs_path)
+	unlock := func() {
+		pr.queue.Release(repo)
+		pr.wg.Done()
+	}
+
+	return unlock, nil
+}
+
+func (pr *PullProcess) contains(ctx context.Context, repo string, hash string) (bool, error) {
+
+	r, err := git.NewRepo(filepath.Join(pr.data_root, repo), pr.logger)
 
 	if err != nil {
-		pr.logger.Error("Can't chdir to %s, because %s", abs_path, err)
-		return err
+		return false, err
 	}
 
-	defer os.Chdir(cwd) // make sure we go back to where we came from
+	return r.IsAncestor(ctx, hash, "HEAD")
+}
 
-	//
+func (pr *PullProcess) _process(ctx context.Context, task updated.UpdateTask) error {
 
-	var ta time.Time
-	var tb time.Duration
+	repo := task.Repo
 
-	git_args := make([]string, 0)
-	var cmd *exec.Cmd
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		// pass
+	}
 
-	git_args = []string{"log", "--pretty=format:%H", "-n", "1"}
-	cmd = exec.Command("git", git_args...)
+	t1 := time.Now()
 
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
+	defer func() {
 
-	ta = time.Now()
+		t2 := time.Since(t1)
+		pr.emitter.task(ctx, events.LevelStatus, task, "Time to process (%s) %s: %v", pr.Name(), repo, t2)
+	}()
 
-	hash, err := cmd.Output()
+	abs_path := filepath.Join(pr.data_root, repo)
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to determine current hash: %v", tb)
+	r, err := git.NewRepo(abs_path, pr.logger)
 
 	if err != nil {
-		pr.logger.Error("Failed to determine current hash: %s (git %s)", err, strings.Join(git_args, " "))
+		pr.emitter.task(ctx, events.LevelError, task, "Can't find repo %s, because %s", abs_path, err)
 		return err
 	}
 
-	pr.logger.Debug("current git hash is %s", hash)
+	opts := pr.RepoOptions(repo)
+	upstream := opts.Upstream()
 
 	//
 
-	git_args = []string{"reset", "--hard", string(hash)}
-	cmd = exec.Command("git", git_args...)
+	err = r.Fetch(ctx, opts.Remote, opts.Branch)
 
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
+	if err != nil {
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to fetch: %s", err)
+		return err
+	}
+
+	if opts.Strategy == PullStrategyReset {
+
+		err = r.ResetHard(ctx, upstream)
 
-	ta = time.Now()
+		if err != nil {
+			pr.emitter.task(ctx, events.LevelError, task, "Failed to reset to %s: %s", upstream, err)
+			return err
+		}
+
+		return nil
+	}
 
-	_, err = cmd.Output()
+	// throw away any local changes before merging or rebasing
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to reset: %v", tb)
+	hash, err := r.Head(ctx)
 
 	if err != nil {
-		pr.logger.Error("Failed to reset: %s (git %s)", err, strings.Join(git_args, " "))
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to determine current hash: %s", err)
 		return err
 	}
 
-	//
-
-	git_args = []string{"fetch", "origin", "master"}
-	cmd = exec.Command("git", git_args...)
+	pr.emitter.task(ctx, events.LevelDebug, task, "current git hash is %s", hash)
 
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
+	err = r.ResetHard(ctx, hash)
 
-	ta = time.Now()
-	_, err = cmd.Output()
+	if err != nil {
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to reset: %s", err)
+		return err
+	}
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to fetch origin: %v", tb)
+	switch opts.Strategy {
+	case PullStrategyRebase:
+		err = r.Rebase(ctx, upstream)
+	default:
+		err = r.Merge(ctx, upstream)
+	}
 
 	if err != nil {
-		pr.logger.Error("Failed to fetch: %s (git %s)", err, strings.Join(git_args, " "))
+		pr.emitter.task(ctx, events.LevelError, task, "Failed to %s from %s: %s", opts.Strategy, upstream, err)
 		return err
 	}
 
-	//
+	return nil
+}
 
-	git_args = []string{"merge", "origin", "master"}
-	cmd = exec.Command("git", git_args...)
+// taskCommit returns the commit that a repo must contain for task to have been pulled, or
+// an empty string if the task's hash isn't something that can be checked. Tasks for a range
+// of commits ("before..after") are checked using the last commit.
 
-	pr.logger.Debug("git %s", strings.Join(git_args, " "))
+func taskCommit(task updated.UpdateTask) string {
 
-	ta = time.Now()
-	_, err = cmd.Output()
+	hash := task.Hash
 
-	tb = time.Since(ta)
-	pr.logger.Debug("Time to merge origin: %v", tb)
+	idx := strings.LastIndex(hash, "..")
 
-	if err != nil {
-		pr.logger.Error("Failed to merge from origin/master: %s (git %s)", err, strings.Join(git_args, " "))
-		return err
+	if idx != -1 {
+		hash = hash[idx+2:]
 	}
 
-	return nil
+	if !git.IsHash(hash) {
+		return ""
+	}
+
+	return hash
 }
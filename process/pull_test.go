@@ -0,0 +1,353 @@
+package process
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRemote is a bare repo, and a clone of it that commits are pushed from, standing
+// in for GitHub.
+
+type testRemote struct {
+	t        *testing.T
+	bare     string
+	upstream string
+}
+
+func gitIn(t *testing.T, dir string, args ...string) string {
+
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Failed to run git %s, %s %s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func configureGit(t *testing.T, dir string) {
+	gitIn(t, dir, "config", "user.name", "example")
+	gitIn(t, dir, "config", "user.email", "example@example.com")
+}
+
+// newTestRemote returns a bare repo with a single commit on its main branch, or skips the
+// test if git isn't installed.
+
+func newTestRemote(t *testing.T) *testRemote {
+
+	_, err := exec.LookPath("git")
+
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+
+	r := &testRemote{
+		t:        t,
+		bare:     filepath.Join(root, "remote.git"),
+		upstream: filepath.Join(root, "upstream"),
+	}
+
+	gitIn(t, root, "init", "-q", "--bare", r.bare)
+	gitIn(t, root, "init", "-q", r.upstream)
+	configureGit(t, r.upstream)
+
+	gitIn(t, r.upstream, "checkout", "-q", "-b", "main")
+	gitIn(t, r.upstream, "remote", "add", "origin", r.bare)
+
+	r.commit("data/1.geojson", "one")
+
+	return r
+}
+
+// commit writes body to path in the upstream clone, commits it and pushes it to the
+// current branch, returning the new commit's hash.
+
+func (r *testRemote) commit(path string, body string) string {
+
+	abs_path := filepath.Join(r.upstream, path)
+
+	err := os.MkdirAll(filepath.Dir(abs_path), 0755)
+
+	if err == nil {
+		err = ioutil.WriteFile(abs_path, []byte(body), 0644)
+	}
+
+	if err != nil {
+		r.t.Fatalf("Failed to write %s, %s", path, err)
+	}
+
+	gitIn(r.t, r.upstream, "add", path)
+	gitIn(r.t, r.upstream, "commit", "-q", "-m", path)
+	gitIn(r.t, r.upstream, "push", "-q", "origin", "HEAD")
+
+	return gitIn(r.t, r.upstream, "rev-parse", "HEAD")
+}
+
+// clone clones the bare repo in to data_root/repo, naming the remote remote.
+
+func (r *testRemote) clone(data_root string, repo string, remote string) string {
+
+	path := filepath.Join(data_root, repo)
+
+	gitIn(r.t, data_root, "clone", "-q", "-o", remote, "-b", "main", r.bare, path)
+	configureGit(r.t, path)
+
+	return path
+}
+
+func newTestPullProcess(t *testing.T, uri string, data_root string) *PullProcess {
+
+	opts := &ProcessOptions{
+		DataRoot: data_root,
+		Logger:   log.SimpleWOFLogger(),
+	}
+
+	pr, err := NewProcess(uri, opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %s", uri, err)
+	}
+
+	return pr.(*PullProcess)
+}
+
+func assertFile(t *testing.T, path string, expected string) {
+
+	t.Helper()
+
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %s", path, err)
+	}
+
+	if string(body) != expected {
+		t.Fatalf("Expected %s to contain '%s', got '%s'", path, expected, body)
+	}
+}
+
+func TestPullOptionsFromURI(t *testing.T) {
+
+	uri := "pull://?remote=upstream&branch=main&strategy=rebase&branch.whosonfirst-data=master&strategy.whosonfirst-data=reset&remote.other=mirror"
+
+	pr := newTestPullProcess(t, uri, t.TempDir())
+
+	tests := map[string]PullOptions{
+		"whosonfirst-data": PullOptions{Remote: "upstream", Branch: "master", Strategy: PullStrategyReset},
+		"other":            PullOptions{Remote: "mirror", Branch: "main", Strategy: PullStrategyRebase},
+		"unknown":          PullOptions{Remote: "upstream", Branch: "main", Strategy: PullStrategyRebase},
+	}
+
+	for repo, expected := range tests {
+
+		opts := pr.RepoOptions(repo)
+
+		if *opts != expected {
+			t.Fatalf("Expected %v for %s, got %v", expected, repo, opts)
+		}
+	}
+
+	opts := &ProcessOptions{
+		DataRoot: t.TempDir(),
+		Logger:   log.SimpleWOFLogger(),
+	}
+
+	// there is no fast-forward only strategy, the merge strategy simply fast-forwards
+	// repos without any local commits
+
+	for _, uri := range []string{"pull://?strategy=ff-only", "pull://?strategy.whosonfirst-data=ff-only"} {
+
+		_, err := NewProcess(uri, opts)
+
+		if err == nil {
+			t.Fatalf("Expected %s to be rejected", uri)
+		}
+	}
+}
+
+func TestPullStrategies(t *testing.T) {
+
+	for _, strategy := range []string{PullStrategyMerge, PullStrategyRebase, PullStrategyReset} {
+
+		remote := newTestRemote(t)
+		data_root := t.TempDir()
+
+		path := remote.clone(data_root, "repo", "origin")
+
+		// a local commit that isn't on the remote
+
+		err := ioutil.WriteFile(filepath.Join(path, "local.txt"), []byte("local"), 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write file, %s", err)
+		}
+
+		gitIn(t, path, "add", "local.txt")
+		gitIn(t, path, "commit", "-q", "-m", "local")
+
+		// and a local change that hasn't been committed
+
+		err = ioutil.WriteFile(filepath.Join(path, "data", "1.geojson"), []byte("changed"), 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write file, %s", err)
+		}
+
+		hash := remote.commit("data/2.geojson", "two")
+
+		pr := newTestPullProcess(t, "pull://?branch=main&strategy="+strategy, data_root)
+
+		err = pr.ProcessTask(context.Background(), testTask(hash, "repo", "data/2.geojson"))
+
+		if err != nil {
+			t.Fatalf("Failed to pull (%s), %s", strategy, err)
+		}
+
+		assertFile(t, filepath.Join(path, "data", "2.geojson"), "two")
+		assertFile(t, filepath.Join(path, "data", "1.geojson"), "one")
+
+		_, err = os.Stat(filepath.Join(path, "local.txt"))
+
+		switch strategy {
+		case PullStrategyReset:
+
+			if !os.IsNotExist(err) {
+				t.Fatalf("Expected the local commit to be discarded (%s)", strategy)
+			}
+
+			if gitIn(t, path, "rev-parse", "HEAD") != hash {
+				t.Fatalf("Expected HEAD to be %s (%s)", hash, strategy)
+			}
+
+		case PullStrategyRebase:
+
+			if err != nil {
+				t.Fatalf("Expected the local commit to be kept (%s), %s", strategy, err)
+			}
+
+			if gitIn(t, path, "rev-parse", "HEAD^") != hash {
+				t.Fatalf("Expected the local commit to be rebased on to %s (%s)", hash, strategy)
+			}
+
+		default:
+
+			if err != nil {
+				t.Fatalf("Expected the local commit to be kept (%s), %s", strategy, err)
+			}
+
+			if gitIn(t, path, "rev-parse", "HEAD^2") != hash {
+				t.Fatalf("Expected %s to be merged (%s)", hash, strategy)
+			}
+		}
+	}
+}
+
+func TestPullPerRepoOptions(t *testing.T) {
+
+	remote := newTestRemote(t)
+	data_root := t.TempDir()
+
+	path := remote.clone(data_root, "repo", "upstream")
+	remote.clone(data_root, "other", "origin")
+
+	hash := remote.commit("data/2.geojson", "two")
+
+	// the defaults don't work for repo, which has a different remote
+
+	uri := "pull://?branch=main&remote.repo=upstream&strategy.repo=reset"
+
+	pr := newTestPullProcess(t, uri, data_root)
+
+	for _, repo := range []string{"repo", "other"} {
+
+		err := pr.ProcessTask(context.Background(), testTask(hash, repo, "data/2.geojson"))
+
+		if err != nil {
+			t.Fatalf("Failed to pull %s, %s", repo, err)
+		}
+
+		assertFile(t, filepath.Join(data_root, repo, "data", "2.geojson"), "two")
+	}
+
+	// other doesn't have any local commits so merging it is a fast-forward
+
+	if gitIn(t, filepath.Join(data_root, "other"), "rev-parse", "HEAD") != hash {
+		t.Fatalf("Expected other to have been fast-forwarded to %s", hash)
+	}
+
+	pr = newTestPullProcess(t, "pull://?branch=main", data_root)
+
+	hash = remote.commit("data/3.geojson", "three")
+
+	err := pr.ProcessTask(context.Background(), testTask(hash, "repo", "data/3.geojson"))
+
+	if err == nil {
+		t.Fatalf("Expected pulling from a remote that doesn't exist to fail")
+	}
+
+	_, err = os.Stat(filepath.Join(path, "data", "3.geojson"))
+
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected data/3.geojson not to have been pulled")
+	}
+}
+
+func TestPullCommitNotOnBranch(t *testing.T) {
+
+	remote := newTestRemote(t)
+	data_root := t.TempDir()
+
+	path := remote.clone(data_root, "repo", "origin")
+
+	gitIn(t, remote.upstream, "checkout", "-q", "-b", "other")
+	hash := remote.commit("data/2.geojson", "two")
+
+	// the commit is known to the repo, just not on the branch that is pulled
+
+	gitIn(t, path, "fetch", "-q", "origin", "other")
+
+	pr := newTestPullProcess(t, "pull://?branch=main", data_root)
+
+	err := pr.ProcessTask(context.Background(), testTask(hash, "repo", "data/2.geojson"))
+
+	if err == nil || !strings.Contains(err.Error(), "does not contain "+hash) {
+		t.Fatalf("Expected the task to fail because the commit isn't on main, got %v", err)
+	}
+
+	// and a commit the repo has never heard of
+
+	missing := strings.Repeat("a", 40)
+
+	err = pr.ProcessTask(context.Background(), testTask(missing, "repo"))
+
+	if err == nil || !strings.Contains(err.Error(), "Failed to verify") {
+		t.Fatalf("Expected the task to fail because the commit is unknown, got %v", err)
+	}
+
+	// tasks for a range of commits are checked using the last one
+
+	gitIn(t, remote.upstream, "checkout", "-q", "main")
+	before := gitIn(t, remote.upstream, "rev-parse", "HEAD")
+	after := remote.commit("data/3.geojson", "three")
+
+	err = pr.ProcessTask(context.Background(), testTask(before+".."+after, "repo"))
+
+	if err != nil {
+		t.Fatalf("Failed to pull %s..%s, %s", before, after, err)
+	}
+
+	assertFile(t, filepath.Join(path, "data", "3.geojson"), "three")
+}
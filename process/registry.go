@@ -0,0 +1,196 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProcessOptions are the settings shared by every processor, regardless of
+// its scheme. Anything processor-specific belongs in the URI itself. MaxBufferedFiles,
+// MaxWait and MaxFileAttempts are only used by processors that buffer files (see
+// BatchOptions). Events, if it isn't nil, is where processors emit events about the
+// tasks they process (see EventEmitter).
+
+type ProcessOptions struct {
+	DataRoot         string
+	Logger           *log.WOFLogger
+	MaxBufferedFiles int
+	MaxWait          time.Duration
+	MaxFileAttempts  int
+	Events           *events.Logger
+}
+
+// Configurable is implemented by processors whose settings can be adjusted, after they
+// have been created, by the parameters that any process URI may include (for example
+// max-buffered-files and max-wait). NewProcess calls Configure with the processor's
+// options once its ProcessInitializeFunc has returned, so processors registered by other
+// packages pick up these parameters the same way the built-in ones do, whether or not
+// they embed BatchProcess.
+
+type Configurable interface {
+	Configure(opts *ProcessOptions) error
+}
+
+type ProcessInitializeFunc func(u *url.URL, opts *ProcessOptions) (Process, error)
+
+// these are initialized here, rather than in an init function, because the init
+// functions that register schemes may well be run first
+
+var registry = make(map[string]ProcessInitializeFunc)
+var registry_mu = new(sync.RWMutex)
+
+// RegisterProcess makes a processor available to NewProcess for URIs using
+// scheme. It is meant to be called from an init function, including from
+// packages outside this one.
+
+func RegisterProcess(scheme string, f ProcessInitializeFunc) error {
+
+	scheme = strings.ToLower(scheme)
+
+	registry_mu.Lock()
+	defer registry_mu.Unlock()
+
+	_, exists := registry[scheme]
+
+	if exists {
+		msg := fmt.Sprintf("A processor for the '%s' scheme has already been registered", scheme)
+		return errors.New(msg)
+	}
+
+	registry[scheme] = f
+	return nil
+}
+
+// NewProcess returns a configured Process for a URI like 's3://bucket/prefix?procs=20'
+// or 'tile38://localhost:9851/collection'.
+
+func NewProcess(uri string, opts *ProcessOptions) (Process, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+
+	if scheme == "" {
+		msg := fmt.Sprintf("Invalid process URI '%s', missing scheme", uri)
+		return nil, errors.New(msg)
+	}
+
+	registry_mu.RLock()
+	f, ok := registry[scheme]
+	registry_mu.RUnlock()
+
+	if !ok {
+		msg := fmt.Sprintf("Unknown process scheme '%s', valid options are: %s", scheme, strings.Join(Schemes(), ","))
+		return nil, errors.New(msg)
+	}
+
+	local_opts := *opts
+
+	q := u.Query()
+
+	data_root := q.Get("data-root")
+
+	if data_root != "" {
+		local_opts.DataRoot = data_root
+	}
+
+	str_max_files := q.Get("max-buffered-files")
+
+	if str_max_files != "" {
+
+		max_files, err := strconv.Atoi(str_max_files)
+
+		if err != nil || max_files < 0 {
+			msg := fmt.Sprintf("Invalid max-buffered-files parameter '%s'", str_max_files)
+			return nil, errors.New(msg)
+		}
+
+		local_opts.MaxBufferedFiles = max_files
+	}
+
+	str_max_wait := q.Get("max-wait")
+
+	if str_max_wait != "" {
+
+		max_wait, err := time.ParseDuration(str_max_wait)
+
+		if err != nil || max_wait < 0 {
+			msg := fmt.Sprintf("Invalid max-wait parameter '%s'", str_max_wait)
+			return nil, errors.New(msg)
+		}
+
+		local_opts.MaxWait = max_wait
+	}
+
+	str_max_attempts := q.Get("max-file-attempts")
+
+	if str_max_attempts != "" {
+
+		max_attempts, err := strconv.Atoi(str_max_attempts)
+
+		if err != nil || max_attempts < 0 {
+			msg := fmt.Sprintf("Invalid max-file-attempts parameter '%s'", str_max_attempts)
+			return nil, errors.New(msg)
+		}
+
+		local_opts.MaxFileAttempts = max_attempts
+	}
+
+	pr, err := f(u, &local_opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// processors that buffer files (usually by embedding BatchProcess) pick up
+	// the max-buffered-files, max-wait and max-file-attempts parameters here
+
+	c, ok := pr.(Configurable)
+
+	if ok {
+
+		err = c.Configure(&local_opts)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if local_opts.Events != nil {
+
+		em, ok := pr.(EventEmitter)
+
+		if ok {
+			em.SetEventLogger(local_opts.Events)
+		}
+	}
+
+	return pr, nil
+}
+
+func Schemes() []string {
+
+	registry_mu.RLock()
+	defer registry_mu.RUnlock()
+
+	schemes := make([]string, 0)
+
+	for scheme, _ := range registry {
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
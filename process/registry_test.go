@@ -0,0 +1,75 @@
+package process
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// configuredProcess is a processor, like one registered by another package, that
+// doesn't embed BatchProcess but does want the buffering parameters.
+
+type configuredProcess struct {
+	Process
+	options *ProcessOptions
+}
+
+func (pr *configuredProcess) Name() string {
+	return "configured"
+}
+
+func (pr *configuredProcess) ProcessTask(ctx context.Context, task updated.UpdateTask) error {
+	return nil
+}
+
+func (pr *configuredProcess) Configure(opts *ProcessOptions) error {
+	pr.options = opts
+	return nil
+}
+
+func TestNewProcessConfiguresProcessors(t *testing.T) {
+
+	err := RegisterProcess("configured-test", func(u *url.URL, opts *ProcessOptions) (Process, error) {
+		return &configuredProcess{}, nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to register processor, %s", err)
+	}
+
+	opts := &ProcessOptions{
+		DataRoot: t.TempDir(),
+		Logger:   log.SimpleWOFLogger(),
+	}
+
+	pr, err := NewProcess("configured-test://?max-buffered-files=10&max-wait=5s&max-file-attempts=2", opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create processor, %s", err)
+	}
+
+	configured := pr.(*configuredProcess).options
+
+	if configured == nil {
+		t.Fatal("Expected Configure to be called")
+	}
+
+	if configured.MaxBufferedFiles != 10 || configured.MaxWait != time.Second*5 || configured.MaxFileAttempts != 2 {
+		t.Fatalf("Unexpected options %v", configured)
+	}
+
+	// the options passed to NewProcess are shared by every processor and are left alone
+
+	if opts.MaxBufferedFiles != 0 || opts.MaxWait != 0 || opts.MaxFileAttempts != 0 {
+		t.Fatalf("Expected shared options not to change, got %v", opts)
+	}
+
+	_, err = NewProcess("configured-test://?max-wait=soon", opts)
+
+	if err == nil {
+		t.Fatal("Expected an invalid max-wait parameter to be rejected")
+	}
+}
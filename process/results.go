@@ -0,0 +1,92 @@
+package process
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of running a processor on a task. Error is empty if the processor
+// completed the task, or accepted it if Pending is true, which means that the processor
+// is holding on to some of the task's files to deal with later. Duration is in seconds
+// and includes any retries.
+
+type Result struct {
+	Processor string  `json:"processor"`
+	Stage     string  `json:"stage"`
+	Error     string  `json:"error,omitempty"`
+	Pending   bool    `json:"pending,omitempty"`
+	Attempts  int     `json:"attempts"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+func (r Result) Ok() bool {
+	return r.Error == ""
+}
+
+// Results collects the outcome of every processor that has been run on a task so far. It
+// is passed to processors in the context so that post-processors, which run last, can
+// report on what happened to a task.
+
+type Results struct {
+	started time.Time
+	results []Result
+	mu      *sync.Mutex
+}
+
+func NewResults() *Results {
+
+	r := Results{
+		started: time.Now(),
+		results: make([]Result, 0),
+		mu:      new(sync.Mutex),
+	}
+
+	return &r
+}
+
+// Started returns the time the task started being processed.
+
+func (r *Results) Started() time.Time {
+	return r.started
+}
+
+func (r *Results) Add(result Result) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results = append(r.results, result)
+}
+
+// List returns a copy of the results, in the order they were added.
+
+func (r *Results) List() []Result {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]Result, len(r.results))
+	copy(results, r.results)
+
+	return results
+}
+
+type results_key struct{}
+
+func WithResults(ctx context.Context, r *Results) context.Context {
+	return context.WithValue(ctx, results_key{}, r)
+}
+
+// ResultsFromContext returns the Results carried by ctx or nil if there aren't any.
+
+func ResultsFromContext(ctx context.Context) *Results {
+
+	r, ok := ctx.Value(results_key{}).(*Results)
+
+	if !ok {
+		return nil
+	}
+
+	return r
+}
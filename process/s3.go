@@ -1,257 +1,201 @@
 package process
 
 import (
-	"fmt"
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-s3"
 	"github.com/whosonfirst/go-whosonfirst-updated"
-	"github.com/whosonfirst/go-whosonfirst-updated/queue"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
 	"github.com/whosonfirst/go-whosonfirst-updated/utils"
 	"github.com/whosonfirst/go-whosonfirst-uri"
+	"net/url"
 	"os"
-	_ "os/exec"
+	"path"
 	"path/filepath"
-	"sync"
-	"time"
+	"strconv"
+	"strings"
 )
 
+func init() {
+	RegisterProcess("s3", newS3ProcessFromURI)
+}
+
 type S3Process struct {
-	Process
-	queue     *queue.Queue
-	data_root string
-	flushing  bool
-	mu        *sync.Mutex
-	files     map[string][]string
+	*BatchProcess
 	s3_bucket string
 	s3_prefix string
+	procs     int
 	logger    *log.WOFLogger
 }
 
-func NewS3Process(data_root string, s3_bucket string, s3_prefix string, logger *log.WOFLogger) (*S3Process, error) {
+// newS3ProcessFromURI expects a URI like 's3://bucket/prefix?procs=20'
+
+func newS3ProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
+
+	bucket := u.Host
+	prefix := strings.TrimLeft(u.Path, "/")
 
-	data_root, err := filepath.Abs(data_root)
+	pr, err := NewS3Process(opts.DataRoot, bucket, prefix, opts.Logger)
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = os.Stat(data_root)
+	str_procs := u.Query().Get("procs")
 
-	if os.IsNotExist(err) {
-		return nil, err
-	}
+	if str_procs != "" {
 
-	q, err := queue.NewQueue()
+		procs, err := strconv.Atoi(str_procs)
 
-	if err != nil {
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
+
+		pr.procs = procs
 	}
 
-	files := make(map[string][]string)
+	return pr, nil
+}
 
-	mu := new(sync.Mutex)
+func NewS3Process(data_root string, s3_bucket string, s3_prefix string, logger *log.WOFLogger) (*S3Process, error) {
 
 	pr := S3Process{
-		queue:     q,
-		data_root: data_root,
-		flushing:  false,
-		mu:        mu,
-		files:     files,
 		s3_bucket: s3_bucket,
 		s3_prefix: s3_prefix,
+		procs:     10,
 		logger:    logger,
 	}
 
-	return &pr, nil
-}
-
-func (pr *S3Process) Flush() error {
+	opts := NewDefaultBatchOptions()
+	opts.Filter = pr.filter
 
-	pr.mu.Lock()
-
-	if pr.flushing {
-		pr.mu.Unlock()
-		return nil
-	}
+	batch, err := NewBatchProcess("s3", data_root, pr.handle, opts, logger)
 
-	pr.flushing = true
-	pr.mu.Unlock()
-
-	for _, repo := range pr.queue.Pending() {
-		go pr.ProcessRepo(repo)
+	if err != nil {
+		return nil, err
 	}
 
-	pr.mu.Lock()
-
-	pr.flushing = false
-	pr.mu.Unlock()
-
-	return nil
+	pr.BatchProcess = batch
+	return &pr, nil
 }
 
 func (pr *S3Process) Name() string {
 	return "s3"
 }
 
-func (pr *S3Process) ProcessTask(task updated.UpdateTask) error {
-
-	repo := task.Repo
+func (pr *S3Process) filter(root string, f updated.UpdateFile) bool {
 
-	pr.mu.Lock()
+	abs_path := filepath.Join(root, f.Path)
 
-	files, ok := pr.files[repo]
+	wof, err := uri.IsWOFFile(abs_path)
 
-	if !ok {
-		files = make([]string, 0)
+	if err != nil {
+		pr.logger.Warning("Failed to determine if %s is a WOF file, because %s", abs_path, err)
+		return false
 	}
 
-	for _, path := range task.Commits {
-
-		repo_path := filepath.Join(pr.data_root, repo)
-		abs_path := filepath.Join(repo_path, path)
-
-		wof, err := uri.IsWOFFile(abs_path)
-
-		if err != nil {
-			pr.logger.Warning(fmt.Sprintf("Failed to determine if %s is a WOF file, because %s", abs_path, err))
-			continue
-		}
-
-		if !wof {
-			continue
-		}
+	if !wof {
+		return false
+	}
 
-		_, err = os.Stat(abs_path)
+	if f.IsDeleted() {
+		return true
+	}
 
-		// because this: https://github.com/whosonfirst/go-whosonfirst-updated/issues/8
-		//
-		// this one is a bit complicated and the decision to disable explicit warnings
-		// may well bite us in the ass one day but the problem is that there are sometimes
-		// legitimate reasons why a file (specifically an -alt file for which we don't
-		// make the same kinds of promises) might be deleted from a repo, but will still
-		// show up in the list of files for a commit - maybe it's possible to filter that
-		// list to prune things that have been deleted and maybe the rule needs to be that
-		// dealing with non-existant files needs to be handled before we get here but today
-		// and right now we're not... (20170713/thisisaaronland)
+	_, err = os.Stat(abs_path)
 
-		if os.IsNotExist(err) {
+	// because this: https://github.com/whosonfirst/go-whosonfirst-updated/issues/8
+	//
+	// this one is a bit complicated and the decision to disable explicit warnings
+	// may well bite us in the ass one day but the problem is that there are sometimes
+	// legitimate reasons why a file (specifically an -alt file for which we don't
+	// make the same kinds of promises) might be deleted from a repo, but will still
+	// show up in the list of files for a commit - maybe it's possible to filter that
+	// list to prune things that have been deleted and maybe the rule needs to be that
+	// dealing with non-existant files needs to be handled before we get here but today
+	// and right now we're not... (20170713/thisisaaronland)
 
-			// because this... at least for now...
-			// https://github.com/whosonfirst/go-whosonfirst-updated/issues/9
-			// https://github.com/whosonfirst/go-writer-slackcat/issues/1
+	if os.IsNotExist(err) {
 
-			// pr.logger.Warning(fmt.Sprintf("Failed to clone %s, because it doesn't exist", abs_path))
-			continue
-		}
+		// because this... at least for now...
+		// https://github.com/whosonfirst/go-whosonfirst-updated/issues/9
+		// https://github.com/whosonfirst/go-writer-slackcat/issues/1
 
-		files = append(files, path)
+		// pr.logger.Warning(fmt.Sprintf("Failed to clone %s, because it doesn't exist", abs_path))
+		return false
 	}
 
-	pr.files[repo] = files
-	pr.mu.Unlock()
-
-	return pr.ProcessRepo(repo)
+	return true
 }
 
-func (pr *S3Process) ProcessRepo(repo string) error {
+func (pr *S3Process) handle(ctx context.Context, batch *Batch) error {
 
-	if pr.queue.IsProcessing(repo) {
-		return pr.queue.Schedule(repo)
-	}
+	root := batch.Root
 
-	err := pr.queue.Lock(repo)
+	debug := false
 
-	if err != nil {
-		return err
-	}
+	sink := s3.WOFSync(pr.s3_bucket, pr.s3_prefix, pr.procs, debug, pr.logger)
+
+	if len(batch.Files) > 0 {
 
-	if len(pr.files[repo]) > 0 {
-		err = pr._process(repo)
+		tmpfile, err := utils.FilesToFileList(batch.Files, root)
 
 		if err != nil {
 			return err
 		}
-	}
-
-	err = pr.queue.Release(repo)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
 
-func (pr *S3Process) _process(repo string) error {
+		defer func() {
+			tmpfile.Close()
+			os.Remove(tmpfile.Name())
+		}()
 
-	t1 := time.Now()
+		pr.emitter.batch(ctx, events.LevelDebug, batch, "Process (S3) file list %s", tmpfile.Name())
 
-	defer func() {
-		t2 := time.Since(t1)
-		pr.logger.Status("Time to process (%s) %s: %v", pr.Name(), repo, t2)
-	}()
+		err = sink.SyncFileList(tmpfile.Name(), root)
 
-	root := filepath.Join(pr.data_root, repo)
-
-	_, err := os.Stat(root)
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Failed to process (S3) file list because %s (%s)", err, tmpfile.Name())
+			return err
+		}
 
-	if os.IsNotExist(err) {
-		pr.logger.Error("Can't find repo", root)
-		return err
+		pr.emitter.batch(ctx, events.LevelDebug, batch, "Successfully processed (S3) file list %s", tmpfile.Name())
 	}
 
-	/* sudo wrap all of this in a single function somewhere... */
+	for _, rel_path := range batch.Deletes {
 
-	pr.mu.Lock()
-	files := pr.files[repo]
+		err := pr.deleteFile(ctx, sink, root, rel_path)
 
-	delete(pr.files, repo)
-	pr.mu.Unlock()
-
-	tmpfile, err := utils.FilesToFileList(files, root)
-
-	if err != nil {
-
-		pr.mu.Lock()
-
-		_, ok := pr.files[repo]
-
-		if ok {
-
-			for _, path := range files {
-				pr.files[repo] = append(pr.files[repo], path)
-			}
-
-		} else {
-			pr.files[repo] = files
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelError, batch, "Failed to delete (S3) %s because %s", rel_path, err)
+			return err
 		}
-
-		pr.mu.Unlock()
-
-		return err
 	}
 
-	defer func() {
-		tmpfile.Close()
-		os.Remove(tmpfile.Name())
-	}()
+	return nil
+}
 
-	/* end of sudo wrap all of this in a single function somewhere... */
+// deleteFile removes the object for a file that has been deleted from a repo, using the
+// same rules to derive its key as go-whosonfirst-s3 does when it syncs a file.
 
-	debug := false
-	procs := 10
+func (pr *S3Process) deleteFile(ctx context.Context, sink *s3.Sync, root string, rel_path string) error {
 
-	pr.logger.Debug("Process (S3) file list %s", tmpfile.Name())
+	abs_path := filepath.Join(root, rel_path)
 
-	sink := s3.WOFSync(pr.s3_bucket, pr.s3_prefix, procs, debug, pr.logger)
+	dest := strings.Replace(abs_path, root, "", -1)
 
-	err = sink.SyncFileList(tmpfile.Name(), root)
+	if pr.s3_prefix != "" {
+		dest = path.Join(pr.s3_prefix, dest)
+	}
 
-	if err != nil {
-		pr.logger.Error("Failed to process (S3) file list because %s (%s)", err, tmpfile.Name())
-		return err
+	params := &aws_s3.DeleteObjectInput{
+		Bucket: aws.String(pr.s3_bucket),
+		Key:    aws.String(dest),
 	}
 
-	pr.logger.Debug("Successfully processed (S3) file list %s", tmpfile.Name())
-	return nil
+	pr.logger.Debug("DELETE %s from %s", dest, pr.s3_bucket)
+
+	_, err := sink.Service.DeleteObjectWithContext(ctx, params)
+	return err
 }
@@ -2,71 +2,93 @@ package process
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-geojson-v2/feature"
 	idx "github.com/whosonfirst/go-whosonfirst-index"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"github.com/whosonfirst/go-whosonfirst-tile38"
+	t38_flags "github.com/whosonfirst/go-whosonfirst-tile38/flags"
 	"github.com/whosonfirst/go-whosonfirst-tile38/index"
 	"github.com/whosonfirst/go-whosonfirst-updated"
-	"github.com/whosonfirst/go-whosonfirst-updated/queue"
+	"github.com/whosonfirst/go-whosonfirst-updated/events"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
 	"github.com/whosonfirst/go-whosonfirst-updated/utils"
 	"github.com/whosonfirst/go-whosonfirst-uri"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sync"
-	"time"
+	"strings"
 )
 
+func init() {
+	RegisterProcess("tile38", newTile38ProcessFromURI)
+}
+
 type Tile38Process struct {
-	Process
-	queue      *queue.Queue
+	*BatchProcess
 	indexer    *index.Tile38Indexer
-	data_root  string
-	flushing   bool
-	mu         *sync.Mutex
-	files      map[string][]string
 	collection string
 	logger     *log.WOFLogger
 }
 
-func NewTile38Process(data_root string, t38_clients []tile38.Tile38Client, t38_collection string, logger *log.WOFLogger) (*Tile38Process, error) {
+// newTile38ProcessFromURI expects a URI like 'tile38://localhost:9851/collection'. Additional
+// endpoints may be specified with one or more '?endpoint=host:port' parameters.
 
-	data_root, err := filepath.Abs(data_root)
+func newTile38ProcessFromURI(u *url.URL, opts *ProcessOptions) (Process, error) {
 
-	if err != nil {
-		return nil, err
-	}
+	var endpoints t38_flags.Endpoints
 
-	_, err = os.Stat(data_root)
+	if u.Host != "" {
+		endpoints.Set(u.Host)
+	}
 
-	if os.IsNotExist(err) {
-		return nil, err
+	for _, e := range u.Query()["endpoint"] {
+		endpoints.Set(e)
 	}
 
-	t38_indexer, err := index.NewTile38Indexer(t38_clients...)
+	if len(endpoints) == 0 {
+		endpoints.Set("localhost")
+	}
 
-	q, err := queue.NewQueue()
+	t38_clients, err := endpoints.ToClients()
 
 	if err != nil {
 		return nil, err
 	}
 
-	files := make(map[string][]string)
+	collection := strings.TrimLeft(u.Path, "/")
+
+	return NewTile38Process(opts.DataRoot, t38_clients, collection, opts.Logger)
+}
+
+func NewTile38Process(data_root string, t38_clients []tile38.Tile38Client, t38_collection string, logger *log.WOFLogger) (*Tile38Process, error) {
+
+	t38_indexer, err := index.NewTile38Indexer(t38_clients...)
 
-	mu := new(sync.Mutex)
+	if err != nil {
+		return nil, err
+	}
 
 	pr := Tile38Process{
 		indexer:    t38_indexer,
-		data_root:  data_root,
 		collection: t38_collection,
-		queue:      q,
-		flushing:   false,
-		mu:         mu,
-		files:      files,
 		logger:     logger,
 	}
 
+	opts := NewDefaultBatchOptions()
+	opts.Filter = pr.filter
+
+	batch, err := NewBatchProcess("tile38", data_root, pr.handle, opts, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pr.BatchProcess = batch
 	return &pr, nil
 }
 
@@ -74,188 +96,194 @@ func (pr *Tile38Process) Name() string {
 	return "tile38"
 }
 
-func (pr *Tile38Process) Flush() error {
+func (pr *Tile38Process) filter(root string, f updated.UpdateFile) bool {
+	return f.IsWOFFile() && !f.IsAlt
+}
 
-	pr.mu.Lock()
+func (pr *Tile38Process) handle(ctx context.Context, batch *Batch) error {
 
-	if pr.flushing {
-		pr.mu.Unlock()
-		return nil
-	}
+	root := batch.Root
 
-	pr.flushing = true
-	pr.mu.Unlock()
+	err := pr.deleteFiles(ctx, batch)
 
-	for _, repo := range pr.queue.Pending() {
-		go pr.ProcessRepo(repo)
+	if err != nil {
+		return err
 	}
 
-	pr.mu.Lock()
-
-	pr.flushing = false
-	pr.mu.Unlock()
-
-	return nil
-}
-
-func (pr *Tile38Process) ProcessTask(task updated.UpdateTask) error {
-
-	repo := task.Repo
-
-	pr.mu.Lock()
+	if len(batch.Files) == 0 {
+		return nil
+	}
 
-	files, ok := pr.files[repo]
+	tmpfile, err := utils.FilesToFileList(batch.Files, root)
 
-	if !ok {
-		files = make([]string, 0)
+	if err != nil {
+		return err
 	}
 
-	for _, path := range task.Commits {
+	defer func() {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+	}()
 
-		is_wof, _ := uri.IsWOFFile(path)
+	/*
+		err = pr.indexer.IndexFileList(tmpfile.Name(), pr.collection)
 
-		if !is_wof {
-			continue
+		if err != nil {
+			pr.logger.Error("Failed to process (Tile38) file list because %s (%s)", err, tmpfile.Name())
+			return err
 		}
+	*/
 
-		is_alt, _ := uri.IsAltFile(path)
+	cb := func(fh io.Reader, fh_ctx context.Context, args ...interface{}) error {
 
-		if is_alt {
-			continue
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// pass
 		}
 
-		files = append(files, path)
-	}
-
-	pr.files[repo] = files
-	pr.mu.Unlock()
-
-	return pr.ProcessRepo(repo)
-}
-
-func (pr *Tile38Process) ProcessRepo(repo string) error {
+		f, err := feature.LoadWOFFeatureFromReader(fh)
 
-	if pr.queue.IsProcessing(repo) {
+		if err != nil {
+			return err
+		}
 
-		return pr.queue.Schedule(repo)
+		return pr.indexer.IndexFeature(f, pr.collection)
 	}
 
-	err := pr.queue.Lock(repo)
+	wof_indexer, err := idx.NewIndexer("filelist", cb)
 
 	if err != nil {
+		pr.emitter.batch(ctx, events.LevelError, batch, "Failed to create new indexer because %s", err)
 		return err
 	}
 
-	if len(pr.files[repo]) > 0 {
-
-		err = pr._process(repo)
-
-		if err != nil {
-			return err
-		}
-	}
+	paths := []string{tmpfile.Name()}
 
-	err = pr.queue.Release(repo)
+	err = wof_indexer.IndexPaths(paths)
 
 	if err != nil {
+		pr.emitter.batch(ctx, events.LevelError, batch, "Failed to index %s mode because %s", tmpfile.Name(), err)
 		return err
 	}
 
+	pr.emitter.batch(ctx, events.LevelDebug, batch, "Successfully processed (Tile38) file list %s", tmpfile.Name())
+
 	return nil
+
 }
 
-func (pr *Tile38Process) _process(repo string) error {
+// deleteFiles removes the geometry and meta keys for files that have been deleted from
+// batch's repo. If the processor doesn't have a collection then records are indexed in to a
+// collection for their placetype (see go-whosonfirst-tile38) so the placetype of each
+// deleted file is looked up in the last version of it in git.
 
-	t1 := time.Now()
+func (pr *Tile38Process) deleteFiles(ctx context.Context, batch *Batch) error {
 
-	defer func() {
-		t2 := time.Since(t1)
-		pr.logger.Status("Time to process (%s) %s: %v", pr.Name(), repo, t2)
-	}()
+	repo := batch.Repo
+	root := batch.Root
+	deletes := batch.Deletes
 
-	root := filepath.Join(pr.data_root, repo)
+	var gr *git.Repo
 
-	_, err := os.Stat(root)
+	if pr.collection == "" && len(deletes) > 0 {
 
-	if os.IsNotExist(err) {
-		pr.logger.Error("Can't find repo", root)
-		return err
+		r, err := git.NewRepo(root, pr.logger)
+
+		if err != nil {
+			return err
+		}
+
+		gr = r
 	}
 
-	/* sudo wrap all of this in a single function somewhere... */
+	for _, path := range deletes {
 
-	pr.mu.Lock()
-	files := pr.files[repo]
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// pass
+		}
 
-	delete(pr.files, repo)
-	pr.mu.Unlock()
+		id, err := uri.IdFromPath(path)
 
-	tmpfile, err := utils.FilesToFileList(files, root)
+		if err != nil {
+			pr.emitter.batch(ctx, events.LevelWarning, batch, "Failed to determine ID for deleted file %s, because %s", path, err)
+			continue
+		}
 
-	if err != nil {
+		// the file is gone so we can't read its wof:repo property but it will (should) be
+		// the same as the repo it was deleted from
 
-		pr.mu.Lock()
+		collection := pr.collection
 
-		_, ok := pr.files[repo]
+		if collection == "" {
 
-		if ok {
+			placetype, err := previousPlacetype(ctx, gr, path)
 
-			for _, path := range files {
-				pr.files[repo] = append(pr.files[repo], path)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to determine placetype (and Tile38 collection) for deleted file %s, because %s", path, err)
+				return errors.New(msg)
 			}
 
-		} else {
-			pr.files[repo] = files
+			collection = "whosonfirst-" + placetype
 		}
 
-		pr.mu.Unlock()
-
-		return err
-	}
+		keys := []string{
+			fmt.Sprintf("%d#%s", id, repo),
+			fmt.Sprintf("%d#meta", id),
+		}
 
-	defer func() {
-		tmpfile.Close()
-		os.Remove(tmpfile.Name())
-	}()
+		for _, key := range keys {
 
-	/*
-		err = pr.indexer.IndexFileList(tmpfile.Name(), pr.collection)
+			err := pr.indexer.Do("DEL", collection, key)
 
-		if err != nil {
-			pr.logger.Error("Failed to process (Tile38) file list because %s (%s)", err, tmpfile.Name())
-			return err
+			if err != nil {
+				pr.emitter.batch(ctx, events.LevelError, batch, "Failed to delete (Tile38) %s, because %s", key, err)
+				return err
+			}
 		}
-	*/
 
-	cb := func(fh io.Reader, ctx context.Context, args ...interface{}) error {
+		pr.emitter.batch(ctx, events.LevelDebug, batch, "Successfully deleted (Tile38) %d from %s", id, collection)
+	}
 
-		f, err := feature.LoadWOFFeatureFromReader(fh)
+	return nil
+}
 
-		if err != nil {
-			return err
-		}
+// previousPlacetype returns the 'wof:placetype' property of the last version of path
+// in gr. If the file is still there, because it is being removed for no longer matching
+// the processor's filter rather than for being deleted, then the file itself is read.
 
-		return pr.indexer.IndexFeature(f, pr.collection)
-	}
+func previousPlacetype(ctx context.Context, gr *git.Repo, path string) (string, error) {
 
-	wof_indexer, err := idx.NewIndexer("filelist", cb)
+	body, err := ioutil.ReadFile(filepath.Join(gr.Path(), path))
+
+	if os.IsNotExist(err) {
+		body, err = gr.Previous(ctx, path)
+	}
 
 	if err != nil {
-		pr.logger.Error("Failed to create new indexer because %s", err)
-		return err
+		return "", err
 	}
 
-	paths := []string{tmpfile.Name()}
+	var f struct {
+		Properties struct {
+			Placetype string `json:"wof:placetype"`
+		} `json:"properties"`
+	}
 
-	err = wof_indexer.IndexPaths(paths)
+	err = json.Unmarshal(body, &f)
 
 	if err != nil {
-		pr.logger.Error("Failed to index %s mode because %s", tmpfile.Name(), err)
-		return err
+		return "", err
 	}
 
-	pr.logger.Debug("Successfully processed (Tile38) file list %s", tmpfile.Name())
-
-	return nil
+	if f.Properties.Placetype == "" {
+		msg := fmt.Sprintf("%s is missing wof:placetype", path)
+		return "", errors.New(msg)
+	}
 
+	return f.Properties.Placetype, nil
 }
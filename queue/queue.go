@@ -1,20 +1,28 @@
 package queue
 
+// Queue keeps track of which repos are being processed and which repos have more work
+// waiting for them. Work that is scheduled for a repo while it is being processed is
+// coalesced, so no matter how many times a repo is scheduled it will only be handed out
+// once by Dispatch. Every method is safe to call from multiple goroutines.
+
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 )
 
 type Queue struct {
 	pending    map[string]int
-	processing map[string]int
+	processing map[string]chan bool
 	mu         *sync.Mutex
 }
 
 func NewQueue() (*Queue, error) {
 
 	pending := make(map[string]int)
-	processing := make(map[string]int)
+	processing := make(map[string]chan bool)
 
 	mu := new(sync.Mutex)
 
@@ -27,55 +35,87 @@ func NewQueue() (*Queue, error) {
 	return &queue, nil
 }
 
-func (q *Queue) Schedule(repo string) error {
+// Schedule records that there is work waiting for repo.
 
-	count, ok := q.pending[repo]
-
-	if ok {
-		count += 1
-	} else {
-		count = 1
-	}
+func (q *Queue) Schedule(repo string) {
 
 	q.mu.Lock()
-	q.pending[repo] = count
+	defer q.mu.Unlock()
 
-	q.mu.Unlock()
+	q.pending[repo] += 1
+}
 
-	return nil
+// TryLock marks repo as being processed and returns true, unless it is already being
+// processed in which case it returns false. If it returns true then Release must be
+// called once the caller is done with repo.
+
+func (q *Queue) TryLock(repo string) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.tryLock(repo)
 }
 
-func (q *Queue) Lock(repo string) error {
+// TryLockOrSchedule is like TryLock except that if repo is already being processed it is
+// scheduled, in a single step, so that the work isn't lost if the repo is released in
+// between.
+
+func (q *Queue) TryLockOrSchedule(repo string) bool {
 
 	q.mu.Lock()
-	_, ok := q.processing[repo]
-	q.mu.Unlock()
+	defer q.mu.Unlock()
 
-	if ok {
-		return errors.New("repo is already being processed")
+	if q.tryLock(repo) {
+		return true
 	}
 
-	q.mu.Lock()
-	q.processing[repo] = 1
-	q.mu.Unlock()
+	q.pending[repo] += 1
+	return false
+}
 
-	return nil
+// Lock waits until repo is not being processed by anyone else and then marks it as
+// being processed. It returns an error if ctx is cancelled first.
+
+func (q *Queue) Lock(ctx context.Context, repo string) error {
+
+	for {
+
+		q.mu.Lock()
+
+		if q.tryLock(repo) {
+			q.mu.Unlock()
+			return nil
+		}
+
+		done_ch := q.processing[repo]
+		q.mu.Unlock()
+
+		select {
+		case <-done_ch:
+			// try again
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
+// Release marks repo as no longer being processed.
+
 func (q *Queue) Release(repo string) error {
 
 	q.mu.Lock()
-	_, ok := q.processing[repo]
-	q.mu.Unlock()
+	defer q.mu.Unlock()
+
+	done_ch, ok := q.processing[repo]
 
 	if !ok {
-		return errors.New("repo has already been released")
+		msg := fmt.Sprintf("%s is not being processed", repo)
+		return errors.New(msg)
 	}
 
-	q.mu.Lock()
-
 	delete(q.processing, repo)
-	q.mu.Unlock()
+	close(done_ch)
 
 	return nil
 }
@@ -83,24 +123,94 @@ func (q *Queue) Release(repo string) error {
 func (q *Queue) IsProcessing(repo string) bool {
 
 	q.mu.Lock()
+	defer q.mu.Unlock()
+
 	_, ok := q.processing[repo]
-	q.mu.Unlock()
+	return ok
+}
+
+func (q *Queue) IsPending(repo string) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
+	_, ok := q.pending[repo]
 	return ok
 }
 
+// Processing returns the (sorted) list of repos that are being processed.
+
+func (q *Queue) Processing() []string {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	processing := make([]string, 0)
+
+	for repo, _ := range q.processing {
+		processing = append(processing, repo)
+	}
+
+	sort.Strings(processing)
+	return processing
+}
+
+// Pending returns the (sorted) list of repos that have work waiting for them, without
+// changing anything.
+
 func (q *Queue) Pending() []string {
 
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
 	pending := make([]string, 0)
 
 	for repo, _ := range q.pending {
+		pending = append(pending, repo)
+	}
+
+	sort.Strings(pending)
+	return pending
+}
+
+// Dispatch returns the (sorted) list of repos that have work waiting for them and that
+// aren't being processed, and removes them from the list of pending repos. The caller is
+// responsible for processing them (usually by calling TryLockOrSchedule, which will
+// schedule the repo again if someone else has started processing it in the meantime).
+
+func (q *Queue) Dispatch() []string {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dispatch := make([]string, 0)
+
+	for repo, _ := range q.pending {
+
+		_, processing := q.processing[repo]
 
-		if q.IsProcessing(repo) {
+		if processing {
 			continue
 		}
 
-		pending = append(pending, repo)
+		delete(q.pending, repo)
+		dispatch = append(dispatch, repo)
 	}
 
-	return pending
+	sort.Strings(dispatch)
+	return dispatch
+}
+
+// tryLock assumes that q.mu is already locked.
+
+func (q *Queue) tryLock(repo string) bool {
+
+	_, ok := q.processing[repo]
+
+	if ok {
+		return false
+	}
+
+	q.processing[repo] = make(chan bool)
+	return true
 }
@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+
+	q, err := NewQueue()
+
+	if err != nil {
+		t.Fatalf("Failed to create queue, %s", err)
+	}
+
+	return q
+}
+
+func assertRepos(t *testing.T, got []string, expected ...string) {
+
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	for i, repo := range expected {
+
+		if got[i] != repo {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestTryLock(t *testing.T) {
+
+	q := newTestQueue(t)
+
+	if !q.TryLock("a") {
+		t.Fatal("Expected to lock a")
+	}
+
+	if q.TryLock("a") {
+		t.Fatal("Expected a to be locked already")
+	}
+
+	if !q.TryLock("b") {
+		t.Fatal("Expected to lock b")
+	}
+
+	assertRepos(t, q.Processing(), "a", "b")
+
+	// TryLock never schedules anything
+
+	assertRepos(t, q.Pending())
+
+	err := q.Release("a")
+
+	if err != nil {
+		t.Fatalf("Failed to release a, %s", err)
+	}
+
+	if q.IsProcessing("a") {
+		t.Fatal("Expected a to have been released")
+	}
+
+	if !q.TryLock("a") {
+		t.Fatal("Expected to lock a again")
+	}
+}
+
+func TestReleaseUnlocked(t *testing.T) {
+
+	q := newTestQueue(t)
+
+	err := q.Release("a")
+
+	if err == nil {
+		t.Fatal("Expected an error releasing a repo that isn't being processed")
+	}
+
+	q.TryLock("a")
+	q.Release("a")
+
+	err = q.Release("a")
+
+	if err == nil {
+		t.Fatal("Expected an error releasing a repo twice")
+	}
+}
+
+func TestTryLockOrSchedule(t *testing.T) {
+
+	q := newTestQueue(t)
+
+	if !q.TryLockOrSchedule("a") {
+		t.Fatal("Expected to lock a")
+	}
+
+	if q.IsPending("a") {
+		t.Fatal("Expected a not to be scheduled when it was locked")
+	}
+
+	for i := 0; i < 3; i++ {
+
+		if q.TryLockOrSchedule("a") {
+			t.Fatal("Expected a to be locked already")
+		}
+	}
+
+	if !q.IsPending("a") {
+		t.Fatal("Expected a to be scheduled")
+	}
+
+	// a is being processed so it isn't dispatched, but it stays scheduled
+
+	assertRepos(t, q.Dispatch())
+	assertRepos(t, q.Pending(), "a")
+
+	q.Release("a")
+
+	// scheduling a repo more than once only dispatches it once
+
+	assertRepos(t, q.Dispatch(), "a")
+	assertRepos(t, q.Dispatch())
+	assertRepos(t, q.Pending())
+}
+
+func TestDispatch(t *testing.T) {
+
+	q := newTestQueue(t)
+
+	q.Schedule("c")
+	q.Schedule("a")
+	q.Schedule("b")
+	q.Schedule("a")
+
+	q.TryLock("b")
+
+	assertRepos(t, q.Pending(), "a", "b", "c")
+	assertRepos(t, q.Dispatch(), "a", "c")
+	assertRepos(t, q.Pending(), "b")
+
+	q.Release("b")
+
+	assertRepos(t, q.Dispatch(), "b")
+	assertRepos(t, q.Pending())
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+
+	q := newTestQueue(t)
+	q.TryLock("a")
+
+	locked := make(chan error)
+
+	go func() {
+		locked <- q.Lock(context.Background(), "a")
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Expected Lock to wait until a was released")
+	case <-time.After(time.Millisecond * 50):
+		// pass
+	}
+
+	q.Release("a")
+
+	select {
+	case err := <-locked:
+
+		if err != nil {
+			t.Fatalf("Failed to lock a, %s", err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("Expected Lock to return once a was released")
+	}
+
+	if !q.IsProcessing("a") {
+		t.Fatal("Expected a to be locked")
+	}
+}
+
+func TestLockCancelled(t *testing.T) {
+
+	q := newTestQueue(t)
+	q.TryLock("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	locked := make(chan error)
+
+	go func() {
+		locked <- q.Lock(ctx, "a")
+	}()
+
+	cancel()
+
+	select {
+	case err := <-locked:
+
+		if err != context.Canceled {
+			t.Fatalf("Expected %s, got %v", context.Canceled, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("Expected Lock to return once ctx was cancelled")
+	}
+
+	// cancelling doesn't take the lock away from whoever has it
+
+	if !q.IsProcessing("a") {
+		t.Fatal("Expected a to still be locked")
+	}
+
+	err := q.Release("a")
+
+	if err != nil {
+		t.Fatalf("Failed to release a, %s", err)
+	}
+}
+
+func TestConcurrentLockAndRelease(t *testing.T) {
+
+	q := newTestQueue(t)
+
+	repos := []string{"a", "b", "c"}
+
+	// the number of callers that hold each repo at the same time, which must never be
+	// more than one
+
+	holders := make(map[string]*int32)
+
+	for _, repo := range repos {
+		holders[repo] = new(int32)
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+
+	for i := 0; i < 50; i++ {
+
+		wg.Add(1)
+
+		go func(i int) {
+
+			defer wg.Done()
+
+			repo := repos[i%len(repos)]
+
+			for j := 0; j < 20; j++ {
+
+				switch (i + j) % 3 {
+				case 0:
+
+					err := q.Lock(context.Background(), repo)
+
+					if err != nil {
+						atomic.AddInt32(&failed, 1)
+						return
+					}
+
+				case 1:
+
+					if !q.TryLock(repo) {
+						continue
+					}
+
+				default:
+
+					if !q.TryLockOrSchedule(repo) {
+						q.Dispatch()
+						continue
+					}
+				}
+
+				if atomic.AddInt32(holders[repo], 1) != 1 {
+					atomic.AddInt32(&failed, 1)
+				}
+
+				atomic.AddInt32(holders[repo], -1)
+
+				err := q.Release(repo)
+
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if failed != 0 {
+		t.Fatalf("Expected each repo to have a single holder at a time, %d failures", failed)
+	}
+
+	assertRepos(t, q.Processing())
+}
+
+func TestConcurrentSchedule(t *testing.T) {
+
+	q := newTestQueue(t)
+	q.TryLock("a")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			q.TryLockOrSchedule(fmt.Sprintf("%c", 'a'+i%4))
+		}(i)
+	}
+
+	wg.Wait()
+
+	// b, c and d were locked by whichever caller got to them first and scheduled by the
+	// rest, and a was locked already so it was only ever scheduled
+
+	assertRepos(t, q.Processing(), "a", "b", "c", "d")
+	assertRepos(t, q.Pending(), "a", "b", "c", "d")
+
+	for _, repo := range []string{"a", "b", "c", "d"} {
+		q.Release(repo)
+	}
+
+	assertRepos(t, q.Dispatch(), "a", "b", "c", "d")
+}
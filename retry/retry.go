@@ -0,0 +1,163 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Policy describes how many times, and how often, a failed task should be retried.
+// The delay before each retry doubles, starting at Backoff and never exceeding
+// MaxBackoff, and is then randomly adjusted by up to +/- Jitter (a fraction between
+// 0 and 1) so that processors that fail together don't all retry together.
+
+type Policy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+}
+
+func NewDefaultPolicy() *Policy {
+
+	p := Policy{
+		MaxAttempts: 3,
+		Backoff:     time.Second * 1,
+		MaxBackoff:  time.Minute * 1,
+		Jitter:      0.2,
+	}
+
+	return &p
+}
+
+// NewPolicyFromURI returns a copy of defaults updated with any 'retry-attempts',
+// 'retry-backoff', 'retry-max-backoff' or 'retry-jitter' query parameters in uri.
+
+func NewPolicyFromURI(defaults *Policy, uri string) (*Policy, error) {
+
+	p := *defaults
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+
+	str_attempts := q.Get("retry-attempts")
+
+	if str_attempts != "" {
+
+		attempts, err := strconv.Atoi(str_attempts)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.MaxAttempts = attempts
+	}
+
+	str_backoff := q.Get("retry-backoff")
+
+	if str_backoff != "" {
+
+		backoff, err := time.ParseDuration(str_backoff)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.Backoff = backoff
+	}
+
+	str_max := q.Get("retry-max-backoff")
+
+	if str_max != "" {
+
+		max, err := time.ParseDuration(str_max)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.MaxBackoff = max
+	}
+
+	str_jitter := q.Get("retry-jitter")
+
+	if str_jitter != "" {
+
+		jitter, err := strconv.ParseFloat(str_jitter, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.Jitter = jitter
+	}
+
+	return &p, nil
+}
+
+// Delay returns how long to wait before making attempt (which starts at 1 for
+// the first retry).
+
+func (p *Policy) Delay(attempt int) time.Duration {
+
+	d := float64(p.Backoff) * math.Pow(2, float64(attempt-1))
+
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		d = d + (d * p.Jitter * (rand.Float64()*2 - 1))
+	}
+
+	if d < 0 {
+		d = 0
+	}
+
+	return time.Duration(d)
+}
+
+// Do calls f until it succeeds, ctx is cancelled or the policy's MaxAttempts have been
+// used up. It returns the number of attempts that were made and the last error, if any.
+
+func Do(ctx context.Context, p *Policy, f func(context.Context) error) (int, error) {
+
+	attempts := 0
+
+	for {
+
+		attempts += 1
+
+		err := f(ctx)
+
+		if err == nil {
+			return attempts, nil
+		}
+
+		if attempts >= p.MaxAttempts {
+			return attempts, err
+		}
+
+		if ctx.Err() != nil {
+			return attempts, err
+		}
+
+		timer := time.NewTimer(p.Delay(attempts))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, err
+		case <-timer.C:
+			// pass
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+
+	tests := []struct {
+		policy Policy
+		min    []time.Duration
+		max    []time.Duration
+	}{
+		{
+			policy: Policy{Backoff: time.Second, MaxBackoff: time.Second * 5},
+			min:    []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5},
+			max:    []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5},
+		},
+		{
+			policy: Policy{Backoff: time.Second, MaxBackoff: time.Second * 5, Jitter: 0.5},
+			min:    []time.Duration{time.Millisecond * 500, time.Second, time.Second * 2, time.Millisecond * 2500, time.Millisecond * 2500},
+			max:    []time.Duration{time.Millisecond * 1500, time.Second * 3, time.Second * 6, time.Millisecond * 7500, time.Millisecond * 7500},
+		},
+		{
+			policy: Policy{Backoff: time.Second, MaxBackoff: 0},
+			min:    []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 16},
+			max:    []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 16},
+		},
+		{
+			policy: Policy{Backoff: time.Second, MaxBackoff: time.Second, Jitter: 2},
+			min:    []time.Duration{0, 0, 0, 0, 0},
+			max:    []time.Duration{time.Second * 3, time.Second * 3, time.Second * 3, time.Second * 3, time.Second * 3},
+		},
+	}
+
+	for i, test := range tests {
+
+		for attempt := 1; attempt <= len(test.min); attempt++ {
+
+			// jitter is random so check plenty of times
+
+			for n := 0; n < 100; n++ {
+
+				d := test.policy.Delay(attempt)
+
+				if d < test.min[attempt-1] || d > test.max[attempt-1] {
+					t.Fatalf("Expected delay for attempt %d (test %d) to be between %v and %v, got %v", attempt, i, test.min[attempt-1], test.max[attempt-1], d)
+				}
+			}
+		}
+	}
+}
+
+func TestNewPolicyFromURI(t *testing.T) {
+
+	p, err := NewPolicyFromURI(NewDefaultPolicy(), "es://localhost:9200/?retry-attempts=5&retry-backoff=2s&retry-max-backoff=10s&retry-jitter=0")
+
+	if err != nil {
+		t.Fatalf("Failed to parse policy, %s", err)
+	}
+
+	if p.MaxAttempts != 5 || p.Backoff != time.Second*2 || p.MaxBackoff != time.Second*10 || p.Jitter != 0 {
+		t.Fatalf("Unexpected policy %v", p)
+	}
+
+	p, err = NewPolicyFromURI(NewDefaultPolicy(), "null://")
+
+	if err != nil {
+		t.Fatalf("Failed to parse policy, %s", err)
+	}
+
+	if *p != *NewDefaultPolicy() {
+		t.Fatalf("Expected the default policy, got %v", p)
+	}
+
+	for _, uri := range []string{"null://?retry-attempts=many", "null://?retry-backoff=1", "null://?retry-max-backoff=x", "null://?retry-jitter=x"} {
+
+		_, err := NewPolicyFromURI(NewDefaultPolicy(), uri)
+
+		if err == nil {
+			t.Fatalf("Expected %s to be rejected", uri)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+
+	broken := errors.New("broken")
+
+	tests := []struct {
+		max_attempts int
+		succeed_on   int
+		attempts     int
+		err          error
+	}{
+		{max_attempts: 3, succeed_on: 1, attempts: 1, err: nil},
+		{max_attempts: 3, succeed_on: 2, attempts: 2, err: nil},
+		{max_attempts: 3, succeed_on: 0, attempts: 3, err: broken},
+		{max_attempts: 1, succeed_on: 0, attempts: 1, err: broken},
+		{max_attempts: 0, succeed_on: 0, attempts: 1, err: broken},
+	}
+
+	for i, test := range tests {
+
+		p := &Policy{
+			MaxAttempts: test.max_attempts,
+			Backoff:     time.Millisecond,
+		}
+
+		calls := 0
+
+		f := func(ctx context.Context) error {
+
+			calls += 1
+
+			if calls == test.succeed_on {
+				return nil
+			}
+
+			return broken
+		}
+
+		attempts, err := Do(context.Background(), p, f)
+
+		if attempts != test.attempts || calls != test.attempts || err != test.err {
+			t.Fatalf("Expected %d attempts and %v (test %d), got %d (%d calls) and %v", test.attempts, test.err, i, attempts, calls, err)
+		}
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+
+	p := &Policy{
+		MaxAttempts: 3,
+		Backoff:     time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	broken := errors.New("broken")
+
+	f := func(ctx context.Context) error {
+		return broken
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+
+	done := make(chan bool)
+
+	var attempts int
+	var err error
+
+	go func() {
+		attempts, err = Do(ctx, p, f)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		// pass
+	case <-time.After(time.Second * 10):
+		t.Fatalf("Expected Do to return once the context was cancelled")
+	}
+
+	if attempts != 1 || err != broken {
+		t.Fatalf("Expected 1 attempt and %v, got %d and %v", broken, attempts, err)
+	}
+
+	// and if the context is already cancelled there's no point in waiting at all
+
+	attempts, err = Do(ctx, p, f)
+
+	if attempts != 1 || err != broken {
+		t.Fatalf("Expected 1 attempt and %v, got %d and %v", broken, attempts, err)
+	}
+}
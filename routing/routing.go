@@ -0,0 +1,532 @@
+package routing
+
+// Routing rules decide which processors handle which files, so that (for example) venue
+// repos can be indexed in to a different Elasticsearch cluster than admin repos by the
+// same instance of wof-updated. Each file in a task is sent to the processors of the
+// first rule that matches it, or to the default processors if no rule matches.
+//
+// Processors are referred to by their full URI, by the value of the 'id' parameter in
+// their URI (for example 'es://venues.example.com:9200/venues?id=es-venues') or by their
+// scheme (for example 'tile38'), which refers to every processor with that scheme.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/git"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the maximum amount of time to spend looking up a deleted file in git
+
+const git_timeout = time.Second * 30
+
+// Rule matches files by the name of their repo, the placetype of the record and their
+// path. Repos and Paths are globs in which '*' matches anything except '/' and '**'
+// matches anything. A rule matches a file if every list that isn't empty has something
+// in it that matches.
+
+type Rule struct {
+	Name       string   `json:"name"`
+	Repos      []string `json:"repos,omitempty"`
+	Placetypes []string `json:"placetypes,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+	Processors []string `json:"processors"`
+}
+
+// Rules are a list of rules and the processors that files which don't match any of them
+// are sent to. If Default is nil then those files are sent to every processor.
+
+type Rules struct {
+	Rules   []*Rule  `json:"rules"`
+	Default []string `json:"default,omitempty"`
+}
+
+// PlacetypeFunc returns the placetype of the record in a file, or an error if it can't
+// be determined.
+
+type PlacetypeFunc func(repo string, f updated.UpdateFile) (string, error)
+
+type rule struct {
+	name       string
+	repos      []*regexp.Regexp
+	placetypes map[string]bool
+	paths      []*regexp.Regexp
+	keys       map[string]bool
+}
+
+type Router struct {
+	rules     []*rule
+	defaults  map[string]bool
+	keys      []string
+	placetype PlacetypeFunc
+}
+
+// Load reads rules from str, which is either the path to a JSON file or (if it starts
+// with '{') the JSON itself.
+
+func Load(str string) (*Rules, error) {
+
+	var body []byte
+
+	if strings.HasPrefix(strings.TrimSpace(str), "{") {
+		body = []byte(str)
+	} else {
+
+		b, err := ioutil.ReadFile(str)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = b
+	}
+
+	var r Rules
+
+	err := json.Unmarshal(body, &r)
+
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse routing rules, %s", err)
+		return nil, errors.New(msg)
+	}
+
+	return &r, nil
+}
+
+// NewRouter returns a Router for rules. keys are the URIs of the processors that may be
+// routed to and every processor a rule refers to must be one of them. placetype is used
+// to look up the placetype of files for rules that have placetypes.
+
+func NewRouter(rules *Rules, keys []string, placetype PlacetypeFunc) (*Router, error) {
+
+	// the same processor URI may be used in more than one stage
+
+	unique_keys := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, key := range keys {
+
+		if !seen[key] {
+			unique_keys = append(unique_keys, key)
+			seen[key] = true
+		}
+	}
+
+	rt := Router{
+		rules:     make([]*rule, 0),
+		keys:      unique_keys,
+		placetype: placetype,
+	}
+
+	for idx, r := range rules.Rules {
+
+		name := r.Name
+
+		if name == "" {
+			name = fmt.Sprintf("#%d", idx+1)
+		}
+
+		if len(r.Processors) == 0 {
+			msg := fmt.Sprintf("Routing rule %s does not have any processors", name)
+			return nil, errors.New(msg)
+		}
+
+		matched_keys, err := rt.resolve(r.Processors)
+
+		if err != nil {
+			msg := fmt.Sprintf("Invalid routing rule %s, %s", name, err)
+			return nil, errors.New(msg)
+		}
+
+		cr := rule{
+			name:       name,
+			repos:      make([]*regexp.Regexp, 0),
+			placetypes: make(map[string]bool),
+			paths:      make([]*regexp.Regexp, 0),
+			keys:       matched_keys,
+		}
+
+		for _, g := range r.Repos {
+			cr.repos = append(cr.repos, globToRegexp(g))
+		}
+
+		for _, g := range r.Paths {
+			cr.paths = append(cr.paths, globToRegexp(g))
+		}
+
+		for _, pt := range r.Placetypes {
+			cr.placetypes[pt] = true
+		}
+
+		if len(cr.placetypes) > 0 && placetype == nil {
+			msg := fmt.Sprintf("Routing rule %s matches placetypes but there is no way to look them up", name)
+			return nil, errors.New(msg)
+		}
+
+		rt.rules = append(rt.rules, &cr)
+	}
+
+	if rules.Default != nil {
+
+		defaults, err := rt.resolve(rules.Default)
+
+		if err != nil {
+			msg := fmt.Sprintf("Invalid default routing, %s", err)
+			return nil, errors.New(msg)
+		}
+
+		rt.defaults = defaults
+	}
+
+	return &rt, nil
+}
+
+// Route returns, for each processor (identified by its URI) that should handle some
+// of task, a copy of task with just those files. Processors that aren't included
+// shouldn't be run at all. Tasks without any files (because they only name a commit)
+// are routed using the first rule that matches their repo, ignoring its placetypes and
+// paths. If the placetype of a deleted file is needed but can't be looked up then it is
+// sent to every processor that it could have been routed to (see candidateKeys), so that
+// it is removed from wherever it was added.
+
+func (rt *Router) Route(task updated.UpdateTask) map[string]updated.UpdateTask {
+
+	routed := make(map[string]updated.UpdateTask)
+
+	if len(task.Files) == 0 {
+
+		for _, key := range rt.keysFor(rt.matchRepo(task.Repo)) {
+			routed[key] = task
+		}
+
+		return routed
+	}
+
+	for _, f := range task.Files {
+
+		var keys []string
+
+		r, err := rt.match(task.Repo, f)
+
+		if err == nil {
+			keys = rt.keysFor(r)
+		} else {
+			keys = rt.candidateKeys(task.Repo, f)
+		}
+
+		for _, key := range keys {
+
+			t, ok := routed[key]
+
+			if !ok {
+				t = task
+				t.Files = make([]updated.UpdateFile, 0)
+			}
+
+			t.Files = append(t.Files, f)
+			routed[key] = t
+		}
+	}
+
+	return routed
+}
+
+// match returns the first rule that matches f, or nil if none do. It returns an error if
+// f has been deleted and it isn't possible to say which rule it matches because its
+// placetype couldn't be looked up.
+
+func (rt *Router) match(repo string, f updated.UpdateFile) (*rule, error) {
+
+	placetype := ""
+	looked_up := false
+
+	var lookup_err error
+
+	for _, r := range rt.rules {
+
+		if !matchAny(r.repos, repo) {
+			continue
+		}
+
+		if !matchAny(r.paths, f.Path) {
+			continue
+		}
+
+		if len(r.placetypes) > 0 {
+
+			if !looked_up {
+
+				pt, err := rt.placetype(repo, f)
+
+				if err == nil {
+					placetype = pt
+				} else {
+					lookup_err = err
+				}
+
+				looked_up = true
+			}
+
+			if lookup_err != nil && f.IsDeleted() {
+				return nil, lookup_err
+			}
+
+			if !r.placetypes[placetype] {
+				continue
+			}
+		}
+
+		return r, nil
+	}
+
+	return nil, nil
+}
+
+// candidateKeys returns the URIs of the processors of every rule that f could match if
+// its placetype were known: each rule that matches its repo and path, up to and including
+// the first one that doesn't have any placetypes, and the defaults if every one of them
+// does.
+
+func (rt *Router) candidateKeys(repo string, f updated.UpdateFile) []string {
+
+	candidates := make(map[string]bool)
+
+	add := func(r *rule) {
+
+		for _, key := range rt.keysFor(r) {
+			candidates[key] = true
+		}
+	}
+
+	definite := false
+
+	for _, r := range rt.rules {
+
+		if !matchAny(r.repos, repo) || !matchAny(r.paths, f.Path) {
+			continue
+		}
+
+		add(r)
+
+		if len(r.placetypes) == 0 {
+			definite = true
+			break
+		}
+	}
+
+	if !definite {
+		add(nil)
+	}
+
+	keys := make([]string, 0)
+
+	for _, key := range rt.keys {
+
+		if candidates[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (rt *Router) matchRepo(repo string) *rule {
+
+	for _, r := range rt.rules {
+
+		if matchAny(r.repos, repo) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// keysFor returns the URIs of the processors for r or, if r is nil, the defaults.
+
+func (rt *Router) keysFor(r *rule) []string {
+
+	keys := make([]string, 0)
+
+	for _, key := range rt.keys {
+
+		switch {
+		case r != nil:
+
+			if r.keys[key] {
+				keys = append(keys, key)
+			}
+
+		case rt.defaults != nil:
+
+			if rt.defaults[key] {
+				keys = append(keys, key)
+			}
+
+		default:
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// resolve returns the URIs of the processors that refs refer to.
+
+func (rt *Router) resolve(refs []string) (map[string]bool, error) {
+
+	matched := make(map[string]bool)
+
+	for _, ref := range refs {
+
+		found := false
+
+		for _, key := range rt.keys {
+
+			if refersTo(ref, key) {
+				matched[key] = true
+				found = true
+			}
+		}
+
+		if !found {
+			msg := fmt.Sprintf("'%s' does not refer to any processor", ref)
+			return nil, errors.New(msg)
+		}
+	}
+
+	return matched, nil
+}
+
+func refersTo(ref string, key string) bool {
+
+	if ref == key {
+		return true
+	}
+
+	u, err := url.Parse(key)
+
+	if err != nil {
+		return false
+	}
+
+	id := u.Query().Get("id")
+
+	if id != "" && ref == id {
+		return true
+	}
+
+	return strings.EqualFold(ref, u.Scheme)
+}
+
+func matchAny(patterns []*regexp.Regexp, str string) bool {
+
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, re := range patterns {
+
+		if re.MatchString(str) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globToRegexp turns a glob, where '**' matches anything and '*' and '?' match anything
+// except '/', in to a regular expression that matches the whole of a string.
+
+func globToRegexp(glob string) *regexp.Regexp {
+
+	var b strings.Builder
+
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+
+		c := glob[i]
+
+		switch {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i += 1
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return regexp.MustCompile(b.String())
+}
+
+// NewFilePlacetypeFunc returns a PlacetypeFunc that reads the 'wof:placetype' property
+// of records in the copy of each repo in data_root. A file that has been deleted is read
+// as it was before it was deleted, from git, unless the copy of the repo hasn't caught up
+// yet in which case it is still there to be read.
+
+func NewFilePlacetypeFunc(data_root string) PlacetypeFunc {
+
+	return func(repo string, f updated.UpdateFile) (string, error) {
+
+		body, err := ioutil.ReadFile(filepath.Join(data_root, repo, f.Path))
+
+		if os.IsNotExist(err) && f.IsDeleted() {
+			body, err = previousFile(filepath.Join(data_root, repo), f.Path)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		var feature struct {
+			Properties struct {
+				Placetype string `json:"wof:placetype"`
+			} `json:"properties"`
+		}
+
+		err = json.Unmarshal(body, &feature)
+
+		if err != nil {
+			return "", err
+		}
+
+		if feature.Properties.Placetype == "" {
+			msg := fmt.Sprintf("%s is missing wof:placetype", f.Path)
+			return "", errors.New(msg)
+		}
+
+		return feature.Properties.Placetype, nil
+	}
+}
+
+// previousFile returns the contents of path, in the repo at root, before it was deleted.
+
+func previousFile(root string, path string) ([]byte, error) {
+
+	r, err := git.NewRepo(root, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), git_timeout)
+	defer cancel()
+
+	return r.Previous(ctx, path)
+}
@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var test_keys = []string{"es://localhost:9200/admin", "tile38://localhost:9851/localities", "null://"}
+
+const test_rules = `{
+  "rules": [
+    {"name": "localities", "placetypes": ["locality"], "processors": ["tile38"]},
+    {"name": "venues", "placetypes": ["venue"], "processors": ["null"]}
+  ],
+  "default": ["es"]
+}`
+
+// newTestDataRoot returns a data root with a 'repo' repo in which data/1.geojson, a
+// locality, was added and then deleted, or skips the test if git isn't installed.
+
+func newTestDataRoot(t *testing.T) string {
+
+	_, err := exec.LookPath("git")
+
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+
+	git := func(args ...string) {
+
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+
+		out, err := cmd.CombinedOutput()
+
+		if err != nil {
+			t.Fatalf("Failed to run git %s, %s %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Join(repo, "data"), 0755)
+
+	if err != nil {
+		t.Fatalf("Failed to create repo, %s", err)
+	}
+
+	git("init", "-q")
+	git("config", "user.name", "example")
+	git("config", "user.email", "example@example.com")
+
+	body := `{"type": "Feature", "properties": {"wof:placetype": "locality"}}`
+
+	err = ioutil.WriteFile(filepath.Join(repo, "data", "1.geojson"), []byte(body), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write file, %s", err)
+	}
+
+	git("add", "data/1.geojson")
+	git("commit", "-q", "-m", "add")
+	git("rm", "-q", "data/1.geojson")
+	git("commit", "-q", "-m", "delete")
+
+	return root
+}
+
+func newTestRouter(t *testing.T, data_root string) *Router {
+
+	rules, err := Load(test_rules)
+
+	if err != nil {
+		t.Fatalf("Failed to load rules, %s", err)
+	}
+
+	rt, err := NewRouter(rules, test_keys, NewFilePlacetypeFunc(data_root))
+
+	if err != nil {
+		t.Fatalf("Failed to create router, %s", err)
+	}
+
+	return rt
+}
+
+func routedKeys(routed map[string]updated.UpdateTask) []string {
+
+	keys := make([]string, 0)
+
+	for _, key := range test_keys {
+
+		_, ok := routed[key]
+
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func TestRouteDeletedFileByPreviousPlacetype(t *testing.T) {
+
+	rt := newTestRouter(t, newTestDataRoot(t))
+
+	task := updated.UpdateTask{
+		Hash: "abc",
+		Repo: "repo",
+		Files: []updated.UpdateFile{
+			updated.NewUpdateFile("data/1.geojson", updated.ChangeDeleted),
+		},
+	}
+
+	keys := routedKeys(rt.Route(task))
+
+	if len(keys) != 1 || keys[0] != "tile38://localhost:9851/localities" {
+		t.Fatalf("Expected the deleted locality to be routed to tile38, got %v", keys)
+	}
+}
+
+func TestRouteDeletedFileWithUnknownPlacetype(t *testing.T) {
+
+	rt := newTestRouter(t, newTestDataRoot(t))
+
+	task := updated.UpdateTask{
+		Hash: "abc",
+		Repo: "repo",
+		Files: []updated.UpdateFile{
+			updated.NewUpdateFile("data/2.geojson", updated.ChangeDeleted),
+		},
+	}
+
+	// data/2.geojson was never in the repo so it could have been anything
+
+	keys := routedKeys(rt.Route(task))
+
+	if len(keys) != len(test_keys) {
+		t.Fatalf("Expected the deleted file to be routed to every processor, got %v", keys)
+	}
+
+	// a file that hasn't been deleted is routed to the defaults if its placetype is unknown
+
+	task.Files = []updated.UpdateFile{
+		updated.NewUpdateFile("data/2.geojson", updated.ChangeModified),
+	}
+
+	keys = routedKeys(rt.Route(task))
+
+	if len(keys) != 1 || keys[0] != "es://localhost:9200/admin" {
+		t.Fatalf("Expected the modified file to be routed to es, got %v", keys)
+	}
+}
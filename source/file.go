@@ -0,0 +1,265 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("file", newFileSourceFromURI)
+}
+
+// max_line_length is the longest line (message) that the stdin and file sources will read.
+
+const max_line_length = 64 * 1024 * 1024
+
+// FileSource follows a file (usually a JSONL file, with one JSON envelope per line) in the
+// same way that `tail -F` does, sending every new line as a message. If the file is
+// truncated or replaced (rotated) it is read again from the beginning.
+
+type FileSource struct {
+	Source
+	path   string
+	start  string
+	poll   time.Duration
+	logger *log.WOFLogger
+}
+
+// newFileSourceFromURI expects a URI like 'file:///var/log/updated.jsonl?start=end&poll=1s'
+// where start is either 'end' (only read lines added from now on, the default) or
+// 'beginning'.
+
+func newFileSourceFromURI(u *url.URL, opts *SourceOptions) (Source, error) {
+
+	path := u.Path
+
+	if u.Host != "" {
+		path = filepath.Join(u.Host, u.Path)
+	}
+
+	q := u.Query()
+
+	start := q.Get("start")
+
+	if start == "" {
+		start = "end"
+	}
+
+	poll := time.Second
+
+	str_poll := q.Get("poll")
+
+	if str_poll != "" {
+
+		d, err := time.ParseDuration(str_poll)
+
+		if err != nil {
+			return nil, err
+		}
+
+		poll = d
+	}
+
+	return NewFileSource(path, start, poll, opts.Logger)
+}
+
+func NewFileSource(path string, start string, poll time.Duration, logger *log.WOFLogger) (*FileSource, error) {
+
+	if path == "" {
+		return nil, errors.New("Missing file path")
+	}
+
+	if start != "end" && start != "beginning" {
+		msg := fmt.Sprintf("Invalid start '%s'", start)
+		return nil, errors.New(msg)
+	}
+
+	if poll <= 0 {
+		return nil, errors.New("Invalid poll interval")
+	}
+
+	abs_path, err := filepath.Abs(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := FileSource{
+		path:   abs_path,
+		start:  start,
+		poll:   poll,
+		logger: logger,
+	}
+
+	return &s, nil
+}
+
+func (s *FileSource) Name() string {
+	return "file"
+}
+
+func (s *FileSource) Start(ctx context.Context, ch chan<- *Message) error {
+
+	whence := io.SeekEnd
+
+	if s.start == "beginning" {
+		whence = io.SeekStart
+	}
+
+	var fh *os.File
+	var reader *bufio.Reader
+	var offset int64
+
+	defer func() {
+
+		if fh != nil {
+			fh.Close()
+		}
+	}()
+
+	// the file may not exist yet, or be in the middle of being rotated, so keep trying
+
+	open := func() error {
+
+		f, err := os.Open(s.path)
+
+		if err != nil {
+			return err
+		}
+
+		pos, err := f.Seek(0, whence)
+
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		if fh != nil {
+			fh.Close()
+		}
+
+		fh = f
+		reader = bufio.NewReaderSize(fh, 64*1024)
+		offset = pos
+
+		// anything written to a new file after we first open one should be read in full
+
+		whence = io.SeekStart
+		return nil
+	}
+
+	partial := ""
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			// pass
+		}
+
+		if fh == nil {
+
+			err := open()
+
+			if err != nil {
+
+				if !os.IsNotExist(err) {
+					return err
+				}
+
+				s.wait(ctx)
+				continue
+			}
+
+			s.logger.Debug("Ready to read messages from %s (starting at %d)", s.path, offset)
+		}
+
+		ln, err := reader.ReadString('\n')
+		offset += int64(len(ln))
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err == io.EOF {
+
+			// wait for the rest of the line
+
+			partial += ln
+
+			if len(partial) > max_line_length {
+				msg := fmt.Sprintf("Line in %s exceeds maximum length", s.path)
+				return errors.New(msg)
+			}
+
+			if s.rotated(fh, offset) {
+				s.logger.Status("%s has been truncated or replaced, reading it again from the beginning", s.path)
+				fh.Close()
+				fh = nil
+				partial = ""
+				continue
+			}
+
+			s.wait(ctx)
+			continue
+		}
+
+		ln = partial + ln
+		partial = ""
+
+		ln = strings.TrimSpace(ln)
+
+		if ln == "" {
+			continue
+		}
+
+		if !send(ctx, ch, NewMessage(ln, nil)) {
+			return nil
+		}
+	}
+}
+
+// rotated returns true if the file at s.path is no longer the file that fh points to or
+// if it has been truncated to less than offset bytes.
+
+func (s *FileSource) rotated(fh *os.File, offset int64) bool {
+
+	current, err := os.Stat(s.path)
+
+	if err != nil {
+		return false
+	}
+
+	info, err := fh.Stat()
+
+	if err != nil {
+		return true
+	}
+
+	if !os.SameFile(current, info) {
+		return true
+	}
+
+	return info.Size() < offset
+}
+
+func (s *FileSource) wait(ctx context.Context) {
+
+	select {
+	case <-ctx.Done():
+		// pass
+	case <-time.After(s.poll):
+		// pass
+	}
+}
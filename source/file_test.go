@@ -0,0 +1,117 @@
+package source
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path string, body string) {
+
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %s", path, err)
+	}
+
+	defer fh.Close()
+
+	_, err = fh.Write([]byte(body))
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", path, err)
+	}
+}
+
+func expectMessage(t *testing.T, ch chan *Message, expected string) {
+
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+
+		if msg.Body != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, msg.Body)
+		}
+
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected '%s', got nothing", expected)
+	}
+}
+
+func TestFileSourceTail(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "updated.jsonl")
+
+	// this was written before the source started so it's skipped
+
+	appendFile(t, path, "abc,repo,data/1.geojson\n")
+
+	s, err := NewFileSource(path, "end", time.Millisecond*10, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create source, %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan *Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.Start(ctx, ch)
+	}()
+
+	// there's no way of knowing when the source has opened the file, so wait a little
+
+	time.Sleep(time.Millisecond * 100)
+
+	appendFile(t, path, "def,repo,data/2.geojson\n")
+	expectMessage(t, ch, "def,repo,data/2.geojson")
+
+	// lines are only sent once they are complete
+
+	appendFile(t, path, "ghi,repo,")
+	time.Sleep(time.Millisecond * 50)
+	appendFile(t, path, "data/3.geojson\n\n")
+
+	expectMessage(t, ch, "ghi,repo,data/3.geojson")
+
+	// a file that is replaced is read from the beginning
+
+	err = ioutil.WriteFile(path+".new", []byte("jkl,repo,data/4.geojson\n"), 0644)
+
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to replace %s, %s", path, err)
+	}
+
+	expectMessage(t, ch, "jkl,repo,data/4.geojson")
+
+	cancel()
+
+	select {
+	case err := <-done:
+
+		if err != nil {
+			t.Fatalf("Failed to tail %s, %s", path, err)
+		}
+
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected the source to stop once the context was cancelled")
+	}
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("Unexpected message '%s'", msg.Body)
+	default:
+		// pass
+	}
+}
@@ -0,0 +1,450 @@
+package source
+
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#push
+// https://docs.github.com/en/webhooks/using-webhooks/validating-webhook-deliveries
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("github", newGitHubSourceFromURI)
+}
+
+// github_max_commits is the most commits that GitHub will include in a push event. If
+// there are more than that then we can't tell what's missing from the payload itself.
+
+const github_max_commits = 2048
+
+// github_max_files is the most files (added, removed and modified) that GitHub will list
+// for a commit in a push event. Commits with that many files (or more) may have had some
+// left out, so their files have to be worked out from git instead.
+
+const github_max_files = 300
+
+// GitHubPush is the subset of a GitHub push event that we care about.
+
+type GitHubPush struct {
+	Ref        string         `json:"ref"`
+	Before     string         `json:"before"`
+	After      string         `json:"after"`
+	Created    bool           `json:"created"`
+	Deleted    bool           `json:"deleted"`
+	Forced     bool           `json:"forced"`
+	Repository GitHubRepo     `json:"repository"`
+	Commits    []GitHubCommit `json:"commits"`
+}
+
+type GitHubRepo struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+}
+
+type GitHubCommit struct {
+	Id        string       `json:"id"`
+	Timestamp string       `json:"timestamp"`
+	Author    GitHubAuthor `json:"author"`
+	Added     []string     `json:"added"`
+	Removed   []string     `json:"removed"`
+	Modified  []string     `json:"modified"`
+}
+
+type GitHubAuthor struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+// Branch returns the name of the branch that was pushed to, or "" if it wasn't a branch
+// (a tag, for example).
+
+func (p *GitHubPush) Branch() string {
+
+	if !strings.HasPrefix(p.Ref, "refs/heads/") {
+		return ""
+	}
+
+	return strings.TrimPrefix(p.Ref, "refs/heads/")
+}
+
+// Tasks returns one task for each commit in the push. If the payload doesn't list every
+// commit (because there were too many, or history was rewritten) or every file in a commit
+// then a single task for the range of commits 'before..after', with no files, is returned
+// instead. When a new branch is pushed there is no 'before' commit, so commits that may
+// be missing files become tasks with no files of their own instead.
+
+func (p *GitHubPush) Tasks() ([]updated.UpdateTask, error) {
+
+	tasks := make([]updated.UpdateTask, 0)
+
+	if p.Deleted || p.Branch() == "" {
+		return tasks, nil
+	}
+
+	repo := p.Repository.Name
+
+	if repo == "" {
+		return nil, errors.New("Push event is missing repository name")
+	}
+
+	truncated := len(p.Commits) >= github_max_commits || (p.Forced && !p.Created)
+
+	for _, c := range p.Commits {
+
+		if !p.Created && c.isTruncated() {
+			truncated = true
+			break
+		}
+	}
+
+	if truncated || (len(p.Commits) == 0 && !p.Created) {
+
+		if p.Before == "" || p.After == "" {
+			return nil, errors.New("Push event is missing before or after commit")
+		}
+
+		t := updated.UpdateTask{
+			Hash:  fmt.Sprintf("%s..%s", p.Before, p.After),
+			Repo:  repo,
+			Files: make([]updated.UpdateFile, 0),
+		}
+
+		tasks = append(tasks, t)
+		return tasks, nil
+	}
+
+	for _, c := range p.Commits {
+
+		author := c.Author.Username
+
+		if author == "" {
+			author = c.Author.Name
+		}
+
+		var timestamp int64
+
+		if c.Timestamp != "" {
+
+			tm, err := time.Parse(time.RFC3339, c.Timestamp)
+
+			if err != nil {
+				return nil, err
+			}
+
+			timestamp = tm.Unix()
+		}
+
+		files := make([]updated.UpdateFile, 0)
+
+		if c.isTruncated() {
+
+			t := updated.UpdateTask{
+				Hash:  c.Id,
+				Repo:  repo,
+				Files: files,
+			}
+
+			tasks = append(tasks, t)
+			continue
+		}
+
+		add := func(paths []string, change updated.ChangeType) {
+
+			for _, path := range paths {
+
+				f := updated.NewUpdateFile(path, change)
+				f.Author = author
+				f.Timestamp = timestamp
+				f.Branch = p.Branch()
+
+				files = append(files, f)
+			}
+		}
+
+		add(c.Added, updated.ChangeAdded)
+		add(c.Modified, updated.ChangeModified)
+		add(c.Removed, updated.ChangeDeleted)
+
+		if len(files) == 0 {
+			continue
+		}
+
+		t := updated.UpdateTask{
+			Hash:  c.Id,
+			Repo:  repo,
+			Files: files,
+		}
+
+		tasks = append(tasks, t)
+	}
+
+	return tasks, nil
+}
+
+// isTruncated returns true if GitHub may have left some of the commit's files out.
+
+func (c *GitHubCommit) isTruncated() bool {
+	return len(c.Added)+len(c.Removed)+len(c.Modified) >= github_max_files
+}
+
+// GitHubSource listens for GitHub push webhooks and turns them in to messages (JSON
+// envelopes) directly, rather than relying on something like go-webhookd to do it.
+
+type GitHubSource struct {
+	Source
+	address    string
+	path       string
+	secret     string
+	branches   map[string]bool
+	max_bytes  int64
+	queue_size int
+	logger     *log.WOFLogger
+}
+
+// newGitHubSourceFromURI expects a URI like 'github://localhost:8080/webhook?secret-env=GITHUB_WEBHOOK_SECRET&branch=master'
+// where secret-env is the name of the environment variable containing the webhook's secret.
+// The secret may also be passed directly, with a 'secret' parameter. 'branch' may be passed
+// more than once and if it is absent pushes to any branch are accepted. 'queue-size' is the
+// number of pushes to accept before wof-updated has got to them.
+
+func newGitHubSourceFromURI(u *url.URL, opts *SourceOptions) (Source, error) {
+
+	path := u.Path
+
+	if path == "" {
+		path = "/"
+	}
+
+	q := u.Query()
+
+	secret := q.Get("secret")
+
+	env := q.Get("secret-env")
+
+	if env != "" {
+		secret = os.Getenv(env)
+	}
+
+	max_bytes := int64(25 * 1024 * 1024)
+
+	str_max := q.Get("max-bytes")
+
+	if str_max != "" {
+
+		m, err := strconv.ParseInt(str_max, 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		max_bytes = m
+	}
+
+	queue_size, err := queueSize(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewGitHubSource(u.Host, path, secret, q["branch"], max_bytes, opts.Logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.queue_size = queue_size
+
+	return s, nil
+}
+
+func NewGitHubSource(address string, path string, secret string, branches []string, max_bytes int64, logger *log.WOFLogger) (*GitHubSource, error) {
+
+	if address == "" {
+		return nil, errors.New("Missing address to listen on")
+	}
+
+	// we are not in the business of accepting unsigned payloads from the internet
+
+	if secret == "" {
+		return nil, errors.New("Missing webhook secret")
+	}
+
+	if max_bytes < 1 {
+		return nil, errors.New("Invalid max bytes")
+	}
+
+	lookup := make(map[string]bool)
+
+	for _, b := range branches {
+		lookup[b] = true
+	}
+
+	s := GitHubSource{
+		address:    address,
+		path:       path,
+		secret:     secret,
+		branches:   lookup,
+		max_bytes:  max_bytes,
+		queue_size: default_queue_size,
+		logger:     logger,
+	}
+
+	return &s, nil
+}
+
+func (s *GitHubSource) Name() string {
+	return "github"
+}
+
+func (s *GitHubSource) Start(ctx context.Context, ch chan<- *Message) error {
+
+	s.logger.Debug("Ready to receive GitHub webhooks at http://%s%s", s.address, s.path)
+	return serve(ctx, s.address, s.path, s.Handler(ctx, ch))
+}
+
+// Verify returns true if signature (the value of the X-Hub-Signature-256 header) is
+// the HMAC of body using the webhook's secret.
+
+func (s *GitHubSource) Verify(body []byte, signature string) bool {
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Handler returns an http.Handler that turns push webhooks in to messages. Like the http
+// source it responds as soon as a message has been queued, rather than processed, since
+// GitHub gives up on (and delivers again) webhooks that take more than 10 seconds.
+
+func (s *GitHubSource) Handler(ctx context.Context, ch chan<- *Message) http.Handler {
+
+	q := newMessageQueue(s.queue_size)
+	go q.run(ctx, ch)
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.Method != "POST" {
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(rsp, req.Body, s.max_bytes))
+
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Failed to read payload, %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if !s.Verify(body, req.Header.Get("X-Hub-Signature-256")) {
+			s.logger.Warning("Invalid signature for GitHub webhook %s", req.Header.Get("X-GitHub-Delivery"))
+			http.Error(rsp, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		event := req.Header.Get("X-GitHub-Event")
+
+		switch event {
+		case "ping":
+			rsp.WriteHeader(http.StatusOK)
+			return
+		case "push":
+			// pass
+		default:
+			s.logger.Debug("Ignoring GitHub %s event", event)
+			rsp.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// the signature is for the raw body regardless of how it's encoded
+
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+
+			form, err := url.ParseQuery(string(body))
+
+			if err != nil {
+				http.Error(rsp, fmt.Sprintf("Failed to parse payload, %s", err), http.StatusBadRequest)
+				return
+			}
+
+			body = []byte(form.Get("payload"))
+		}
+
+		var push GitHubPush
+
+		err = json.Unmarshal(body, &push)
+
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Failed to parse payload, %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(s.branches) > 0 && !s.branches[push.Branch()] {
+			s.logger.Debug("Ignoring push to %s for %s", push.Ref, push.Repository.Name)
+			rsp.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		tasks, err := push.Tasks()
+
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Failed to derive tasks, %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(tasks) == 0 {
+			rsp.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		msg, err := message.EncodeJSON(tasks)
+
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Failed to encode tasks, %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		if ctx.Err() != nil {
+			http.Error(rsp, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !q.put(NewMessage(msg, nil)) {
+			s.logger.Warning("Too many messages waiting to be processed, rejecting push to %s for %s", push.Ref, push.Repository.Name)
+			rsp.Header().Set("Retry-After", "60")
+			http.Error(rsp, "Too many messages waiting to be processed", http.StatusServiceUnavailable)
+			return
+		}
+
+		s.logger.Status("Accepted push to %s for %s (%d tasks)", push.Ref, push.Repository.Name, len(tasks))
+		rsp.WriteHeader(http.StatusAccepted)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,283 @@
+package source
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/message"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const test_secret = "s33kret"
+
+func readPayload(t *testing.T, name string) []byte {
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "github", name))
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %s", name, err)
+	}
+
+	return body
+}
+
+func sign(body []byte, secret string) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs body to a GitHubSource's handler, as a push event signed with signature,
+// and returns the status code and the message it sent, if any.
+
+func deliver(t *testing.T, branches []string, body []byte, signature string) (int, *Message) {
+
+	s, err := NewGitHubSource("localhost:8080", "/", test_secret, branches, 1024*1024, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create source, %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan *Message, 1)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature-256", signature)
+	}
+
+	rsp := httptest.NewRecorder()
+
+	s.Handler(ctx, ch).ServeHTTP(rsp, req)
+
+	select {
+	case msg := <-ch:
+		return rsp.Code, msg
+	case <-time.After(time.Millisecond * 100):
+		return rsp.Code, nil
+	}
+}
+
+func decodeMessage(t *testing.T, msg *Message) []updated.UpdateTask {
+
+	tasks, err := message.DecodeJSON(msg.Body)
+
+	if err != nil {
+		t.Fatalf("Failed to decode message %s, %s", msg.Body, err)
+	}
+
+	return tasks
+}
+
+func TestGitHubRejectsInvalidSignatures(t *testing.T) {
+
+	body := readPayload(t, "push.json")
+
+	signatures := map[string]string{
+		"missing":        "",
+		"wrong secret":   sign(body, "not the secret"),
+		"not hex":        "sha256=not-hex",
+		"wrong hash":     strings.Replace(sign(body, test_secret), "sha256=", "sha1=", 1),
+		"modified body":  sign(append([]byte(" "), body...), test_secret),
+		"missing prefix": strings.TrimPrefix(sign(body, test_secret), "sha256="),
+	}
+
+	for label, signature := range signatures {
+
+		status, msg := deliver(t, nil, body, signature)
+
+		if status != http.StatusUnauthorized {
+			t.Fatalf("Expected %d for %s signature, got %d", http.StatusUnauthorized, label, status)
+		}
+
+		if msg != nil {
+			t.Fatalf("Expected no message for %s signature, got %s", label, msg.Body)
+		}
+	}
+
+	status, msg := deliver(t, nil, body, sign(body, test_secret))
+
+	if status != http.StatusAccepted || msg == nil {
+		t.Fatalf("Expected a valid signature to be accepted, got %d", status)
+	}
+}
+
+func TestGitHubFiltersBranches(t *testing.T) {
+
+	body := readPayload(t, "push-branch.json")
+
+	status, msg := deliver(t, []string{"master"}, body, sign(body, test_secret))
+
+	if status != http.StatusAccepted {
+		t.Fatalf("Expected %d, got %d", http.StatusAccepted, status)
+	}
+
+	if msg != nil {
+		t.Fatalf("Expected push to staging to be ignored, got %s", msg.Body)
+	}
+
+	status, msg = deliver(t, []string{"master", "staging"}, body, sign(body, test_secret))
+
+	if status != http.StatusAccepted || msg == nil {
+		t.Fatalf("Expected push to staging to be accepted, got %d", status)
+	}
+
+	status, msg = deliver(t, nil, body, sign(body, test_secret))
+
+	if status != http.StatusAccepted || msg == nil {
+		t.Fatalf("Expected push to any branch to be accepted, got %d", status)
+	}
+}
+
+func TestGitHubDeletedAndRenamedFiles(t *testing.T) {
+
+	body := readPayload(t, "push.json")
+
+	status, msg := deliver(t, nil, body, sign(body, test_secret))
+
+	if status != http.StatusAccepted || msg == nil {
+		t.Fatalf("Expected push to be accepted, got %d", status)
+	}
+
+	tasks := decodeMessage(t, msg)
+
+	if len(tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d", len(tasks))
+	}
+
+	if tasks[0].Hash != "2222222222222222222222222222222222222222" || tasks[0].Repo != "whosonfirst-data" {
+		t.Fatalf("Unexpected first task %s", tasks[0])
+	}
+
+	// GitHub describes a rename as the old path being removed and the new one added
+
+	expected := map[string]updated.ChangeType{
+		"data/101/736/545/101736545-alt-quattroshapes.geojson": updated.ChangeAdded,
+		"data/102/087/579/102087579.geojson":                   updated.ChangeDeleted,
+		"data/101/736/545/101736545-alt-mapzen.geojson":        updated.ChangeDeleted,
+	}
+
+	files := tasks[1].Files
+
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %d", len(expected), len(files))
+	}
+
+	for _, f := range files {
+
+		change, ok := expected[f.Path]
+
+		if !ok || f.Change != change {
+			t.Fatalf("Unexpected file %s (%s)", f.Path, f.Change)
+		}
+
+		if f.Author != "example" || f.Branch != "master" || f.Timestamp != 1496343900 {
+			t.Fatalf("Unexpected author, branch or timestamp for %s: %s %s %d", f.Path, f.Author, f.Branch, f.Timestamp)
+		}
+	}
+
+	deleted := files[1]
+
+	if deleted.Id != 102087579 || deleted.IsAlt || !deleted.IsDeleted() {
+		t.Fatalf("Unexpected deleted file %v", deleted)
+	}
+
+	deleted_alt := files[2]
+
+	if deleted_alt.Id != 101736545 || !deleted_alt.IsAlt || !deleted_alt.IsDeleted() {
+		t.Fatalf("Unexpected deleted alt file %v", deleted_alt)
+	}
+}
+
+// pushWithFiles returns push.json with count files added to its first commit.
+
+func pushWithFiles(t *testing.T, count int, created bool) GitHubPush {
+
+	var push GitHubPush
+
+	err := json.Unmarshal(readPayload(t, "push.json"), &push)
+
+	if err != nil {
+		t.Fatalf("Failed to parse push.json, %s", err)
+	}
+
+	push.Created = created
+	push.Commits[0].Added = make([]string, 0)
+
+	for i := 0; i < count-len(push.Commits[0].Modified); i++ {
+		push.Commits[0].Added = append(push.Commits[0].Added, fmt.Sprintf("data/%d.geojson", i))
+	}
+
+	return push
+}
+
+func TestGitHubCommitsWithTooManyFiles(t *testing.T) {
+
+	push := pushWithFiles(t, github_max_files-1, false)
+
+	tasks, err := push.Tasks()
+
+	if err != nil {
+		t.Fatalf("Failed to derive tasks, %s", err)
+	}
+
+	if len(tasks) != 2 || len(tasks[0].Files) != github_max_files-1 {
+		t.Fatalf("Expected every file to be listed, got %d tasks", len(tasks))
+	}
+
+	push = pushWithFiles(t, github_max_files, false)
+
+	tasks, err = push.Tasks()
+
+	if err != nil {
+		t.Fatalf("Failed to derive tasks, %s", err)
+	}
+
+	if len(tasks) != 1 {
+		t.Fatalf("Expected a single task, got %d", len(tasks))
+	}
+
+	if tasks[0].Hash != push.Before+".."+push.After || len(tasks[0].Files) != 0 {
+		t.Fatalf("Expected a task for the range of commits with no files, got %s", tasks[0])
+	}
+
+	// there is no range of commits for a new branch
+
+	push = pushWithFiles(t, github_max_files, true)
+
+	tasks, err = push.Tasks()
+
+	if err != nil {
+		t.Fatalf("Failed to derive tasks, %s", err)
+	}
+
+	if len(tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d", len(tasks))
+	}
+
+	if tasks[0].Hash != push.Commits[0].Id || len(tasks[0].Files) != 0 {
+		t.Fatalf("Expected a task for the first commit with no files, got %s", tasks[0])
+	}
+
+	if len(tasks[1].Files) != 3 {
+		t.Fatalf("Expected the second commit's files to be listed, got %s", tasks[1])
+	}
+}
@@ -0,0 +1,249 @@
+package source
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("http", newHTTPSourceFromURI)
+}
+
+// HTTPSource listens for messages POST-ed to an HTTP endpoint, for example by go-webhookd.
+
+type HTTPSource struct {
+	Source
+	address    string
+	path       string
+	max_bytes  int64
+	token      string
+	queue_size int
+	logger     *log.WOFLogger
+}
+
+// default_queue_size is the number of messages that the http and github sources will
+// hold on to, waiting for wof-updated to get to them, before rejecting new ones.
+
+const default_queue_size = 1000
+
+// newHTTPSourceFromURI expects a URI like 'http://localhost:8080/updated?max-bytes=10485760'
+// which means: listen on localhost:8080 and accept messages POST-ed to /updated. If there
+// is a 'token-env' parameter, naming an environment variable, (or a 'token' parameter)
+// then requests must include an 'Authorization: Bearer {TOKEN}' header. 'queue-size' is
+// the number of messages to accept before wof-updated has got to them.
+
+func newHTTPSourceFromURI(u *url.URL, opts *SourceOptions) (Source, error) {
+
+	path := u.Path
+
+	if path == "" {
+		path = "/"
+	}
+
+	q := u.Query()
+
+	max_bytes := int64(10 * 1024 * 1024)
+
+	str_max := q.Get("max-bytes")
+
+	if str_max != "" {
+
+		m, err := strconv.ParseInt(str_max, 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		max_bytes = m
+	}
+
+	token := q.Get("token")
+
+	env := q.Get("token-env")
+
+	if env != "" {
+
+		token = os.Getenv(env)
+
+		if token == "" {
+			msg := fmt.Sprintf("Environment variable %s is empty", env)
+			return nil, errors.New(msg)
+		}
+	}
+
+	queue_size, err := queueSize(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewHTTPSource(u.Host, path, max_bytes, opts.Logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.token = token
+	s.queue_size = queue_size
+
+	return s, nil
+}
+
+func NewHTTPSource(address string, path string, max_bytes int64, logger *log.WOFLogger) (*HTTPSource, error) {
+
+	if address == "" {
+		return nil, errors.New("Missing address to listen on")
+	}
+
+	if max_bytes < 1 {
+		return nil, errors.New("Invalid max bytes")
+	}
+
+	s := HTTPSource{
+		address:    address,
+		path:       path,
+		max_bytes:  max_bytes,
+		queue_size: default_queue_size,
+		logger:     logger,
+	}
+
+	return &s, nil
+}
+
+func (s *HTTPSource) Name() string {
+	return "http"
+}
+
+func (s *HTTPSource) Start(ctx context.Context, ch chan<- *Message) error {
+
+	s.logger.Debug("Ready to receive (updated) messages at http://%s%s", s.address, s.path)
+	return serve(ctx, s.address, s.path, s.Handler(ctx, ch))
+}
+
+// Handler returns an http.Handler that sends the body of every POST request to ch. It
+// responds with a 202 status code once the message has been accepted (queued), which is
+// not the same thing as it having been processed, or a 503 status code if too many
+// messages are already waiting to be processed.
+
+func (s *HTTPSource) Handler(ctx context.Context, ch chan<- *Message) http.Handler {
+
+	q := newMessageQueue(s.queue_size)
+	go q.run(ctx, ch)
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.Method != "POST" {
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if s.token != "" && !checkToken(req, s.token) {
+			s.logger.Warning("Invalid or missing token for request from %s", req.RemoteAddr)
+			http.Error(rsp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(rsp, req.Body, s.max_bytes))
+
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Failed to read message, %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(body) == 0 {
+			http.Error(rsp, "Empty message", http.StatusBadRequest)
+			return
+		}
+
+		if ctx.Err() != nil {
+			http.Error(rsp, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !q.put(NewMessage(string(body), nil)) {
+			rsp.Header().Set("Retry-After", "60")
+			http.Error(rsp, "Too many messages waiting to be processed", http.StatusServiceUnavailable)
+			return
+		}
+
+		rsp.WriteHeader(http.StatusAccepted)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// checkToken returns true if req has an 'Authorization: Bearer {TOKEN}' header for token.
+
+func checkToken(req *http.Request, token string) bool {
+
+	auth := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	candidate := strings.TrimPrefix(auth, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1
+}
+
+// queueSize returns the value of the 'queue-size' parameter in q, or the default.
+
+func queueSize(q url.Values) (int, error) {
+
+	str_size := q.Get("queue-size")
+
+	if str_size == "" {
+		return default_queue_size, nil
+	}
+
+	size, err := strconv.Atoi(str_size)
+
+	if err != nil || size < 1 {
+		msg := fmt.Sprintf("Invalid queue-size parameter '%s'", str_size)
+		return 0, errors.New(msg)
+	}
+
+	return size, nil
+}
+
+// serve listens on address, sending requests for path to handler, until ctx is cancelled.
+
+func serve(ctx context.Context, address string, path string, handler http.Handler) error {
+
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+
+		<-ctx.Done()
+
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		server.Shutdown(shutdown_ctx)
+	}()
+
+	err := server.ListenAndServe()
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
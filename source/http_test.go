@@ -0,0 +1,100 @@
+package source
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSourceToken(t *testing.T) {
+
+	t.Setenv("TEST_WOF_UPDATED_TOKEN", "s33kret")
+
+	opts := &SourceOptions{
+		Logger: log.SimpleWOFLogger(),
+	}
+
+	src, err := NewSource("http://localhost:8080/updated?token-env=TEST_WOF_UPDATED_TOKEN", opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create source, %s", err)
+	}
+
+	s := src.(*HTTPSource)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan *Message, 1)
+	h := s.Handler(ctx, ch)
+
+	tests := []struct {
+		method string
+		auth   string
+		body   string
+		code   int
+	}{
+		{"POST", "", "abc,repo,data/1.geojson", http.StatusUnauthorized},
+		{"POST", "Bearer nope", "abc,repo,data/1.geojson", http.StatusUnauthorized},
+		{"POST", "s33kret", "abc,repo,data/1.geojson", http.StatusUnauthorized},
+		{"POST", "Basic s33kret", "abc,repo,data/1.geojson", http.StatusUnauthorized},
+		{"GET", "Bearer s33kret", "", http.StatusMethodNotAllowed},
+		{"POST", "Bearer s33kret", "", http.StatusBadRequest},
+		{"POST", "Bearer s33kret", "abc,repo,data/1.geojson", http.StatusAccepted},
+	}
+
+	for _, test := range tests {
+
+		req := httptest.NewRequest(test.method, "/updated", strings.NewReader(test.body))
+
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+
+		rsp := httptest.NewRecorder()
+		h.ServeHTTP(rsp, req)
+
+		if rsp.Code != test.code {
+			t.Fatalf("Expected %d for %s request with '%s', got %d", test.code, test.method, test.auth, rsp.Code)
+		}
+	}
+
+	// only the last request should have made it through
+
+	select {
+	case msg := <-ch:
+
+		if msg.Body != "abc,repo,data/1.geojson" {
+			t.Fatalf("Unexpected message '%s'", msg.Body)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a message")
+	}
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("Unexpected message '%s'", msg.Body)
+	case <-time.After(time.Millisecond * 100):
+		// pass
+	}
+}
+
+func TestHTTPSourceMissingToken(t *testing.T) {
+
+	t.Setenv("TEST_WOF_UPDATED_TOKEN", "")
+
+	opts := &SourceOptions{
+		Logger: log.SimpleWOFLogger(),
+	}
+
+	_, err := NewSource("http://localhost:8080/updated?token-env=TEST_WOF_UPDATED_TOKEN", opts)
+
+	if err == nil {
+		t.Fatalf("Expected an empty token to be rejected")
+	}
+}
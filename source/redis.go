@@ -0,0 +1,314 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-updated/stream"
+	"gopkg.in/redis.v1"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("redis", newRedisSourceFromURI)
+}
+
+type RedisSource struct {
+	Source
+	endpoint string
+	channel  string
+	mode     string
+	options  *stream.ConsumerOptions
+	status   *statusTracker
+	logger   *log.WOFLogger
+}
+
+// newRedisSourceFromURI expects a URI like 'redis://localhost:6379/updated' for PubSub or
+// 'redis://localhost:6379/updated?mode=stream&group=wof-updated&consumer=example&claim-idle=5m'
+// for Redis streams.
+
+func newRedisSourceFromURI(u *url.URL, opts *SourceOptions) (Source, error) {
+
+	host := u.Hostname()
+	port := u.Port()
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	if port == "" {
+		port = "6379"
+	}
+
+	channel := strings.TrimLeft(u.Path, "/")
+
+	if channel == "" {
+		channel = "updated"
+	}
+
+	q := u.Query()
+
+	mode := q.Get("mode")
+
+	if mode == "" {
+		mode = stream.ModePubSub
+	}
+
+	stream_opts := stream.NewDefaultConsumerOptions()
+	stream_opts.Stream = channel
+
+	group := q.Get("group")
+
+	if group != "" {
+		stream_opts.Group = group
+	}
+
+	consumer := q.Get("consumer")
+
+	if consumer != "" {
+		stream_opts.Consumer = consumer
+	}
+
+	str_idle := q.Get("claim-idle")
+
+	if str_idle != "" {
+
+		idle, err := time.ParseDuration(str_idle)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stream_opts.ClaimIdle = idle
+	}
+
+	return NewRedisSource(net.JoinHostPort(host, port), channel, mode, stream_opts, opts.Logger)
+}
+
+// NewRedisSource returns a source that reads messages from a Redis PubSub channel or, if
+// mode is 'stream', from a Redis stream as part of a consumer group (described by opts).
+
+func NewRedisSource(endpoint string, channel string, mode string, opts *stream.ConsumerOptions, logger *log.WOFLogger) (*RedisSource, error) {
+
+	if !stream.IsValidMode(mode) {
+		msg := fmt.Sprintf("Invalid Redis mode '%s'", mode)
+		return nil, errors.New(msg)
+	}
+
+	s := RedisSource{
+		endpoint: endpoint,
+		channel:  channel,
+		mode:     mode,
+		options:  opts,
+		status:   newStatusTracker(),
+		logger:   logger,
+	}
+
+	return &s, nil
+}
+
+func (s *RedisSource) Name() string {
+	return "redis"
+}
+
+// Status reports whether or not the source is subscribed to (or reading from) Redis.
+
+func (s *RedisSource) Status() Status {
+	return s.status.Status()
+}
+
+func (s *RedisSource) Start(ctx context.Context, ch chan<- *Message) error {
+
+	defer s.status.set(StateStopped, nil)
+
+	redis_client := redis.NewTCPClient(&redis.Options{
+		Addr: s.endpoint,
+	})
+
+	defer redis_client.Close()
+
+	if s.mode == stream.ModeStream {
+		return s.startStream(ctx, redis_client, ch)
+	}
+
+	return s.startPubSub(ctx, redis_client, ch)
+}
+
+// max_reconnect_backoff is the longest the Redis source waits between attempts to
+// subscribe again after it has lost its connection.
+
+const max_reconnect_backoff = time.Second * 30
+
+// startPubSub subscribes to the channel and, if the connection is lost, waits (for longer
+// each time it fails) and subscribes again until ctx is cancelled. It only returns an
+// error if the first attempt to subscribe fails, since that is more likely to be a
+// configuration problem than a transient one.
+
+func (s *RedisSource) startPubSub(ctx context.Context, redis_client *redis.Client, ch chan<- *Message) error {
+
+	pubsub_client := redis_client.PubSub()
+
+	err := pubsub_client.Subscribe(s.channel)
+
+	if err != nil {
+		pubsub_client.Close()
+		s.status.set(StateDisconnected, err)
+		return err
+	}
+
+	s.status.set(StateConnected, nil)
+
+	s.logger.Debug("Ready to receive (updated) PubSub messages")
+
+	backoff := time.Second
+
+	for {
+
+		err := s.receivePubSub(ctx, pubsub_client, ch)
+		pubsub_client.Close()
+
+		if err == nil {
+			s.logger.Debug("Stop receiving (updated) PubSub messages")
+			return nil
+		}
+
+		s.logger.Error("Lost connection to Redis PubSub channel %s, because %s", s.channel, err)
+		s.status.set(StateDisconnected, err)
+
+		for {
+
+			s.logger.Status("Resubscribing to Redis PubSub channel %s in %v", s.channel, backoff)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+				// pass
+			}
+
+			backoff = backoff * 2
+
+			if backoff > max_reconnect_backoff {
+				backoff = max_reconnect_backoff
+			}
+
+			pubsub_client = redis_client.PubSub()
+
+			err = pubsub_client.Subscribe(s.channel)
+
+			if err == nil {
+				break
+			}
+
+			pubsub_client.Close()
+
+			s.logger.Error("Failed to resubscribe to Redis PubSub channel %s, because %s", s.channel, err)
+			s.status.set(StateDisconnected, err)
+		}
+
+		s.logger.Status("Resubscribed to Redis PubSub channel %s", s.channel)
+		s.status.set(StateConnected, nil)
+
+		backoff = time.Second
+	}
+}
+
+// receivePubSub sends messages from pubsub_client to ch until ctx is cancelled, in which
+// case it returns nil, or until there is an error other than a timeout.
+
+func (s *RedisSource) receivePubSub(ctx context.Context, pubsub_client *redis.PubSub, ch chan<- *Message) error {
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			pubsub_client.Unsubscribe(s.channel)
+			return nil
+		default:
+			// pass
+		}
+
+		// time out periodically so that we notice when ctx has been cancelled
+
+		i, err := pubsub_client.ReceiveTimeout(time.Second)
+
+		if err != nil {
+
+			net_err, ok := err.(net.Error)
+
+			if ok && net_err.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		s.status.set(StateConnected, nil)
+
+		if msg, _ := i.(*redis.Message); msg != nil {
+
+			if !send(ctx, ch, NewMessage(msg.Payload, nil)) {
+				return nil
+			}
+		}
+	}
+}
+
+func (s *RedisSource) startStream(ctx context.Context, redis_client *redis.Client, ch chan<- *Message) error {
+
+	consumer, err := stream.NewConsumer(stream.NewRedisClient(redis_client), s.options)
+
+	if err != nil {
+		s.status.set(StateDisconnected, err)
+		return err
+	}
+
+	s.status.set(StateConnected, nil)
+
+	s.logger.Debug("Ready to receive (updated) stream messages as %s (%s)", s.options.Consumer, s.options.Group)
+
+	for {
+
+		if ctx.Err() != nil {
+			s.logger.Debug("Stop receiving (updated) stream messages")
+			return nil
+		}
+
+		entries, err := consumer.Read(ctx)
+
+		if err != nil {
+
+			if ctx.Err() == nil {
+				s.logger.Error("Failed to read from Redis stream: %s", err)
+				s.status.set(StateDisconnected, err)
+				time.Sleep(time.Second)
+			}
+
+			continue
+		}
+
+		s.status.set(StateConnected, nil)
+
+		for _, e := range entries {
+
+			id := e.Id
+
+			ack := func() {
+
+				err := consumer.Ack(id)
+
+				if err != nil {
+					s.logger.Warning("Failed to acknowledge stream message %s, because %s", id, err)
+				}
+			}
+
+			if !send(ctx, ch, NewMessage(e.Message, ack)) {
+				return nil
+			}
+		}
+	}
+}
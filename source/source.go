@@ -0,0 +1,263 @@
+package source
+
+// Sources are where wof-updated gets its messages from. Each message is decoded (by the
+// message package) in to one or more tasks. Sources are configured using URIs, in the same
+// way that processors are, for example 'redis://localhost:6379/updated' or 'stdin://'.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Source interface {
+	// Start sends messages to ch until ctx is cancelled, or there are no more messages
+	// (for example when reading from STDIN), or something goes wrong.
+	Start(ctx context.Context, ch chan<- *Message) error
+	Name() string
+}
+
+const (
+	StateStarting     = "starting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateStopped      = "stopped"
+)
+
+// Status describes what a source is doing, for example whether or not it is connected to
+// Redis, and since when. Error is the reason the source is disconnected, if it is.
+
+type Status struct {
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// Inspector is implemented by sources that can report their Status.
+
+type Inspector interface {
+	Status() Status
+}
+
+// statusTracker is a helper for sources that implement Inspector.
+
+type statusTracker struct {
+	status Status
+	mu     *sync.Mutex
+}
+
+func newStatusTracker() *statusTracker {
+
+	t := statusTracker{
+		status: Status{
+			State: StateStarting,
+			Since: time.Now(),
+		},
+		mu: new(sync.Mutex),
+	}
+
+	return &t
+}
+
+func (t *statusTracker) Status() Status {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status
+}
+
+// set updates the state, and the time it changed, unless it hasn't changed.
+
+func (t *statusTracker) set(state string, err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	str_err := ""
+
+	if err != nil {
+		str_err = err.Error()
+	}
+
+	if t.status.State == state && t.status.Error == str_err {
+		return
+	}
+
+	t.status = Status{
+		State: state,
+		Error: str_err,
+		Since: time.Now(),
+	}
+}
+
+// Message is a single message from a source. Ack should be called once every task in the
+// message has been processed, which only matters for sources that will deliver a message
+// again if it isn't acknowledged.
+
+type Message struct {
+	Body string
+	ack  func()
+}
+
+func NewMessage(body string, ack func()) *Message {
+
+	m := Message{
+		Body: body,
+		ack:  ack,
+	}
+
+	return &m
+}
+
+func (m *Message) Ack() {
+
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+type SourceOptions struct {
+	Logger *log.WOFLogger
+}
+
+type SourceInitializeFunc func(u *url.URL, opts *SourceOptions) (Source, error)
+
+// these are initialized here, rather than in an init function, because the init
+// functions that register schemes may well be run first
+
+var registry = make(map[string]SourceInitializeFunc)
+var registry_mu = new(sync.RWMutex)
+
+// RegisterSource makes a source available to NewSource for URIs using scheme. It is meant
+// to be called from an init function, including from packages outside this one.
+
+func RegisterSource(scheme string, f SourceInitializeFunc) error {
+
+	scheme = strings.ToLower(scheme)
+
+	registry_mu.Lock()
+	defer registry_mu.Unlock()
+
+	_, exists := registry[scheme]
+
+	if exists {
+		msg := fmt.Sprintf("A source for the '%s' scheme has already been registered", scheme)
+		return errors.New(msg)
+	}
+
+	registry[scheme] = f
+	return nil
+}
+
+// NewSource returns a configured Source for a URI like 'redis://localhost:6379/updated'
+// or 'file:///var/log/updated.jsonl'.
+
+func NewSource(uri string, opts *SourceOptions) (Source, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+
+	if scheme == "" {
+		msg := fmt.Sprintf("Invalid source URI '%s', missing scheme", uri)
+		return nil, errors.New(msg)
+	}
+
+	registry_mu.RLock()
+	f, ok := registry[scheme]
+	registry_mu.RUnlock()
+
+	if !ok {
+		msg := fmt.Sprintf("Unknown source scheme '%s', valid options are: %s", scheme, strings.Join(Schemes(), ","))
+		return nil, errors.New(msg)
+	}
+
+	return f(u, opts)
+}
+
+func Schemes() []string {
+
+	registry_mu.RLock()
+	defer registry_mu.RUnlock()
+
+	schemes := make([]string, 0)
+
+	for scheme, _ := range registry {
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// send hands msg to ch unless ctx is cancelled first, in which case it returns false.
+
+func send(ctx context.Context, ch chan<- *Message, msg *Message) bool {
+
+	select {
+	case ch <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// messageQueue is a buffer between HTTP handlers and the channel that wof-updated reads
+// messages from, so that handlers can respond as soon as a message has been accepted
+// instead of waiting for wof-updated to finish with whatever it is working on. That
+// matters for things like GitHub webhooks, which are delivered again if they take more
+// than 10 seconds.
+
+type messageQueue struct {
+	messages chan *Message
+}
+
+func newMessageQueue(size int) *messageQueue {
+
+	q := messageQueue{
+		messages: make(chan *Message, size),
+	}
+
+	return &q
+}
+
+// put adds msg to the queue without waiting, returning false if the queue is full.
+
+func (q *messageQueue) put(msg *Message) bool {
+
+	select {
+	case q.messages <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends everything that is put in the queue to ch until ctx is cancelled.
+
+func (q *messageQueue) run(ctx context.Context, ch chan<- *Message) {
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-q.messages:
+
+			if !send(ctx, ch, msg) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("stdin", newStdinSourceFromURI)
+}
+
+const (
+	SplitRow  = "row"
+	SplitLine = "line"
+	SplitNone = "none"
+)
+
+// row_idle is how long the stdin source waits for another row for the same commit before
+// sending the rows it already has.
+
+const row_idle = time.Second
+
+type StdinSource struct {
+	Source
+	reader io.Reader
+	split  string
+	logger *log.WOFLogger
+}
+
+// newStdinSourceFromURI expects a URI like 'stdin://' (where consecutive CSV rows for the
+// same commit and repo are a single message), 'stdin://?split=line' (where every line is
+// a message) or 'stdin://?split=none' (where everything that is read is a single message).
+
+func newStdinSourceFromURI(u *url.URL, opts *SourceOptions) (Source, error) {
+
+	split := u.Query().Get("split")
+
+	if split == "" {
+		split = SplitRow
+	}
+
+	return NewStdinSource(os.Stdin, split, opts.Logger)
+}
+
+func NewStdinSource(reader io.Reader, split string, logger *log.WOFLogger) (*StdinSource, error) {
+
+	if split != SplitRow && split != SplitLine && split != SplitNone {
+		msg := fmt.Sprintf("Invalid split '%s'", split)
+		return nil, errors.New(msg)
+	}
+
+	s := StdinSource{
+		reader: reader,
+		split:  split,
+		logger: logger,
+	}
+
+	return &s, nil
+}
+
+func (s *StdinSource) Name() string {
+	return "stdin"
+}
+
+// Start returns once there is nothing left to read.
+
+func (s *StdinSource) Start(ctx context.Context, ch chan<- *Message) error {
+
+	if s.split == SplitNone {
+
+		body, err := ioutil.ReadAll(s.reader)
+
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(body)) != "" {
+			send(ctx, ch, NewMessage(string(body), nil))
+		}
+
+		return nil
+	}
+
+	scanner := bufio.NewScanner(s.reader)
+	scanner.Buffer(make([]byte, 64*1024), max_line_length)
+
+	if s.split == SplitRow {
+		return s.startRows(ctx, scanner, ch)
+	}
+
+	for scanner.Scan() {
+
+		ln := scanner.Text()
+
+		if strings.TrimSpace(ln) == "" {
+			continue
+		}
+
+		if !send(ctx, ch, NewMessage(ln, nil)) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// startRows sends consecutive rows for the same commit and repo (the first two columns)
+// as a single message, so that a commit's files end up in the same task rather than one
+// task per file. Rows are sent when a row for a different commit or repo is read, when
+// nothing has been read for a while or when there is nothing left to read. Lines that
+// aren't CSV rows (JSON messages) are sent on their own.
+
+func (s *StdinSource) startRows(ctx context.Context, scanner *bufio.Scanner, ch chan<- *Message) error {
+
+	lines := make(chan string)
+	done := make(chan error, 1)
+
+	go func() {
+
+		defer close(lines)
+
+		for scanner.Scan() {
+
+			select {
+			case lines <- scanner.Text():
+				// pass
+			case <-ctx.Done():
+				done <- nil
+				return
+			}
+		}
+
+		done <- scanner.Err()
+	}()
+
+	rows := make([]string, 0)
+	key := ""
+
+	flush := func() bool {
+
+		if len(rows) == 0 {
+			return true
+		}
+
+		msg := strings.Join(rows, "\n")
+
+		rows = make([]string, 0)
+		key = ""
+
+		return send(ctx, ch, NewMessage(msg, nil))
+	}
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(row_idle):
+
+			if !flush() {
+				return nil
+			}
+
+		case ln, ok := <-lines:
+
+			if !ok {
+
+				if !flush() {
+					return nil
+				}
+
+				return <-done
+			}
+
+			if strings.TrimSpace(ln) == "" {
+				continue
+			}
+
+			if strings.HasPrefix(strings.TrimSpace(ln), "{") {
+
+				if !flush() || !send(ctx, ch, NewMessage(ln, nil)) {
+					return nil
+				}
+
+				continue
+			}
+
+			row_key := rowKey(ln)
+
+			if row_key != key && !flush() {
+				return nil
+			}
+
+			key = row_key
+			rows = append(rows, ln)
+		}
+	}
+}
+
+// rowKey returns the commit and repo (the first two columns) of a CSV row.
+
+func rowKey(ln string) string {
+
+	parts := strings.SplitN(ln, ",", 3)
+
+	if len(parts) < 2 {
+		return ln
+	}
+
+	return parts[0] + "," + parts[1]
+}
@@ -0,0 +1,87 @@
+package source
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-log"
+	"strings"
+	"testing"
+)
+
+// readStdin returns the messages that a StdinSource reading input with split sends.
+
+func readStdin(t *testing.T, input string, split string) []string {
+
+	s, err := NewStdinSource(strings.NewReader(input), split, log.SimpleWOFLogger())
+
+	if err != nil {
+		t.Fatalf("Failed to create source, %s", err)
+	}
+
+	ch := make(chan *Message, 100)
+
+	err = s.Start(context.Background(), ch)
+
+	if err != nil {
+		t.Fatalf("Failed to read input, %s", err)
+	}
+
+	close(ch)
+
+	messages := make([]string, 0)
+
+	for msg := range ch {
+		messages = append(messages, msg.Body)
+	}
+
+	return messages
+}
+
+func TestStdinSourceRows(t *testing.T) {
+
+	rows := []string{
+		"abc,repo,data/1.geojson",
+		"abc,repo,data/2.geojson",
+		"",
+		"abc,repo,data/3.geojson",
+		"abc,other,data/4.geojson",
+		`{"version": 1, "tasks": [{"hash": "def", "repo": "repo"}]}`,
+		"ghi,repo,data/5.geojson",
+		"ghi,repo,data/6.geojson",
+	}
+
+	messages := readStdin(t, strings.Join(rows, "\n"), SplitRow)
+
+	expected := []string{
+		"abc,repo,data/1.geojson\nabc,repo,data/2.geojson\nabc,repo,data/3.geojson",
+		"abc,other,data/4.geojson",
+		`{"version": 1, "tasks": [{"hash": "def", "repo": "repo"}]}`,
+		"ghi,repo,data/5.geojson\nghi,repo,data/6.geojson",
+	}
+
+	if strings.Join(messages, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected %q, got %q", expected, messages)
+	}
+}
+
+func TestStdinSourceSplit(t *testing.T) {
+
+	input := "abc,repo,data/1.geojson\nabc,repo,data/2.geojson\n"
+
+	messages := readStdin(t, input, SplitLine)
+
+	if len(messages) != 2 || messages[1] != "abc,repo,data/2.geojson" {
+		t.Fatalf("Expected a message for each line, got %q", messages)
+	}
+
+	messages = readStdin(t, input, SplitNone)
+
+	if len(messages) != 1 || messages[0] != input {
+		t.Fatalf("Expected a single message, got %q", messages)
+	}
+
+	_, err := NewStdinSource(strings.NewReader(input), "word", log.SimpleWOFLogger())
+
+	if err == nil {
+		t.Fatalf("Expected an invalid split to be rejected")
+	}
+}
@@ -0,0 +1,404 @@
+package status
+
+// Tracker keeps track of what wof-updated's sources and processors are doing so that it
+// can be reported over HTTP, as JSON, for health checks and for people trying to work out
+// why something hasn't been updated yet. Every method is safe to call from multiple
+// goroutines.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-updated"
+	"github.com/whosonfirst/go-whosonfirst-updated/process"
+	"github.com/whosonfirst/go-whosonfirst-updated/source"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK        = "ok"
+	StatusUnhealthy = "unhealthy"
+)
+
+// state_failed is the state of a source that has stopped because something went wrong.
+
+const state_failed = "failed"
+
+type SourceReport struct {
+	Name  string     `json:"name"`
+	URI   string     `json:"uri"`
+	State string     `json:"state"`
+	Error string     `json:"error,omitempty"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// ProcessorReport describes a processor. Pending, Processing and BufferedFiles are only
+// known for processors that implement the process.Inspector interface. LastCommits is the
+// last commit (or range of commits) that the processor completed for each repo.
+
+type ProcessorReport struct {
+	Name             string            `json:"name"`
+	URI              string            `json:"uri"`
+	Stage            string            `json:"stage"`
+	Pending          []string          `json:"pending"`
+	Processing       []string          `json:"processing"`
+	BufferedFiles    map[string]int    `json:"buffered_files"`
+	LastSuccess      *time.Time        `json:"last_success,omitempty"`
+	LastError        *time.Time        `json:"last_error,omitempty"`
+	LastErrorMessage string            `json:"last_error_message,omitempty"`
+	LastCommits      map[string]string `json:"last_commits"`
+}
+
+type Report struct {
+	Status     string             `json:"status"`
+	Problems   []string           `json:"problems,omitempty"`
+	Started    time.Time          `json:"started"`
+	Uptime     float64            `json:"uptime_seconds"`
+	Sources    []*SourceReport    `json:"sources"`
+	Processors []*ProcessorReport `json:"processors"`
+}
+
+type trackedSource struct {
+	uri    string
+	source source.Source
+	err    error
+}
+
+type trackedProcessor struct {
+	uri          string
+	stage        string
+	process      process.Process
+	last_success time.Time
+	last_error   time.Time
+	error_msg    string
+	commits      map[string]string
+}
+
+type Tracker struct {
+	started    time.Time
+	sources    []*trackedSource
+	processors []*trackedProcessor
+	keys       map[string]*trackedProcessor
+	mu         *sync.Mutex
+}
+
+func NewTracker() *Tracker {
+
+	t := Tracker{
+		started:    time.Now(),
+		sources:    make([]*trackedSource, 0),
+		processors: make([]*trackedProcessor, 0),
+		keys:       make(map[string]*trackedProcessor),
+		mu:         new(sync.Mutex),
+	}
+
+	return &t
+}
+
+// AddSource adds src, which was created from uri, to the list of sources to report on.
+
+func (t *Tracker) AddSource(uri string, src source.Source) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := trackedSource{
+		uri:    uri,
+		source: src,
+	}
+
+	t.sources = append(t.sources, &s)
+}
+
+// SourceFailed records that src stopped reading messages because of err.
+
+func (t *Tracker) SourceFailed(src source.Source, err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.sources {
+
+		if s.source == src {
+			s.err = err
+		}
+	}
+}
+
+// AddProcessor adds pr, which is identified by its URI (key), to the list of processors
+// to report on. stage is one of "pre", "async" or "post".
+
+func (t *Tracker) AddProcessor(key string, stage string, pr process.Process) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := trackedProcessor{
+		uri:     key,
+		stage:   stage,
+		process: pr,
+		commits: make(map[string]string),
+	}
+
+	t.processors = append(t.processors, &p)
+	t.keys[key] = &p
+}
+
+// Success records that the processor identified by key completed task.
+
+func (t *Tracker) Success(key string, task updated.UpdateTask) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.keys[key]
+
+	if !ok {
+		return
+	}
+
+	p.last_success = time.Now()
+	p.commits[task.Repo] = task.Hash
+}
+
+// Failure records that the processor identified by key failed to complete task.
+
+func (t *Tracker) Failure(key string, task updated.UpdateTask, err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.keys[key]
+
+	if !ok {
+		return
+	}
+
+	p.last_error = time.Now()
+	p.error_msg = err.Error()
+}
+
+// Report returns a snapshot of what every source and processor is doing. wof-updated is
+// considered unhealthy if any source has failed, or is disconnected, in which case the
+// reasons are listed in Problems.
+
+func (t *Tracker) Report() *Report {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	r := Report{
+		Status:     StatusOK,
+		Problems:   make([]string, 0),
+		Started:    t.started,
+		Uptime:     now.Sub(t.started).Seconds(),
+		Sources:    make([]*SourceReport, 0),
+		Processors: make([]*ProcessorReport, 0),
+	}
+
+	for _, s := range t.sources {
+
+		sr := SourceReport{
+			Name:  s.source.Name(),
+			URI:   Redact(s.uri),
+			State: "unknown",
+		}
+
+		i, ok := s.source.(source.Inspector)
+
+		if ok {
+			st := i.Status()
+			sr.State = st.State
+			sr.Error = st.Error
+			sr.Since = &st.Since
+		}
+
+		if s.err != nil {
+			sr.State = state_failed
+			sr.Error = s.err.Error()
+		}
+
+		switch sr.State {
+		case state_failed:
+			r.Problems = append(r.Problems, fmt.Sprintf("%s source (%s) has failed", sr.Name, sr.URI))
+		case source.StateDisconnected:
+			r.Problems = append(r.Problems, fmt.Sprintf("%s source (%s) is disconnected", sr.Name, sr.URI))
+		default:
+			// pass
+		}
+
+		r.Sources = append(r.Sources, &sr)
+	}
+
+	for _, p := range t.processors {
+
+		pr := ProcessorReport{
+			Name:             p.process.Name(),
+			URI:              Redact(p.uri),
+			Stage:            p.stage,
+			Pending:          make([]string, 0),
+			Processing:       make([]string, 0),
+			BufferedFiles:    make(map[string]int),
+			LastErrorMessage: p.error_msg,
+			LastCommits:      make(map[string]string),
+		}
+
+		i, ok := p.process.(process.Inspector)
+
+		if ok {
+			pr.Pending = i.Pending()
+			pr.Processing = i.Processing()
+			pr.BufferedFiles = i.BufferedFiles()
+		}
+
+		if !p.last_success.IsZero() {
+			ts := p.last_success
+			pr.LastSuccess = &ts
+		}
+
+		if !p.last_error.IsZero() {
+			ts := p.last_error
+			pr.LastError = &ts
+		}
+
+		for repo, hash := range p.commits {
+			pr.LastCommits[repo] = hash
+		}
+
+		r.Processors = append(r.Processors, &pr)
+	}
+
+	if len(r.Problems) > 0 {
+		r.Status = StatusUnhealthy
+	}
+
+	return &r
+}
+
+// HealthHandler responds with a short JSON summary, and a 503 status code if anything is
+// wrong, for use by load balancers and process supervisors.
+
+func (t *Tracker) HealthHandler() http.Handler {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		r := t.Report()
+
+		health := map[string]interface{}{
+			"status": r.Status,
+		}
+
+		if len(r.Problems) > 0 {
+			health["problems"] = r.Problems
+		}
+
+		code := http.StatusOK
+
+		if r.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(rsp, health, code)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// StatusHandler responds with the complete Report. Unlike HealthHandler it always uses a
+// 200 status code, since being able to produce the report is what matters here.
+
+func (t *Tracker) StatusHandler() http.Handler {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		r := t.Report()
+		writeJSON(rsp, r, http.StatusOK)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func writeJSON(rsp http.ResponseWriter, body interface{}, code int) {
+
+	enc, err := json.Marshal(body)
+
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.WriteHeader(code)
+	rsp.Write(enc)
+}
+
+// Redact removes any credentials from uri, since it is going to be shown to anyone
+// who can reach the status endpoint (or who can see what -check-config prints). Webhooks,
+// like the ones notify:// processors send to, carry their secret in the path so it is
+// masked too. Anything that isn't a URI with credentials is returned as is.
+
+func Redact(uri string) string {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return uri
+	}
+
+	q := u.Query()
+	redacted := false
+
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+		redacted = true
+	}
+
+	if u.Scheme == "notify" || strings.Contains(u.Path, "/services/") {
+
+		path := redactPath(u.Path)
+
+		if path != u.Path {
+			u.Path = path
+			u.RawPath = ""
+			redacted = true
+		}
+	}
+
+	for _, k := range []string{"password", "secret", "token", "credentials"} {
+
+		if q.Get(k) != "" {
+			q.Set(k, "xxxxx")
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return uri
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// redactPath masks everything after "/services/" in path (which is how Slack, and things
+// that copy Slack, lay out their webhooks) or, failing that, the whole of path.
+
+func redactPath(path string) string {
+
+	idx := strings.Index(path, "/services/")
+
+	if idx != -1 {
+		return path[:idx] + "/services/xxxxx"
+	}
+
+	if path == "" || path == "/" {
+		return path
+	}
+
+	return "/xxxxx"
+}
@@ -0,0 +1,510 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/redis.v1"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeClient is an in-process stand-in for the Redis commands that streams use (XADD,
+// XGROUP CREATE, XREADGROUP, XACK, XPENDING and XCLAIM) so that consumers can be tested
+// without a Redis server. XREADGROUP never blocks. Now is used to work out how long
+// messages have been pending and may be replaced to pretend that time has passed.
+
+type FakeClient struct {
+	Client
+	Now     func() time.Time
+	streams map[string]*fake_stream
+	mu      *sync.Mutex
+}
+
+type fake_entry struct {
+	id     string
+	seq    int64
+	fields []string
+}
+
+type fake_pending struct {
+	consumer   string
+	delivered  time.Time
+	deliveries int64
+}
+
+type fake_group struct {
+	last    int64
+	pending map[string]*fake_pending
+}
+
+type fake_stream struct {
+	entries []*fake_entry
+	groups  map[string]*fake_group
+	seq     int64
+}
+
+func NewFakeClient() *FakeClient {
+
+	c := FakeClient{
+		Now:     time.Now,
+		streams: make(map[string]*fake_stream),
+		mu:      new(sync.Mutex),
+	}
+
+	return &c
+}
+
+func (c *FakeClient) Do(args ...string) (interface{}, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(args) == 0 {
+		return nil, errors.New("ERR missing command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "XADD":
+		return c.xadd(args[1:])
+	case "XGROUP":
+		return c.xgroup(args[1:])
+	case "XREADGROUP":
+		return c.xreadgroup(args[1:])
+	case "XACK":
+		return c.xack(args[1:])
+	case "XPENDING":
+		return c.xpending(args[1:])
+	case "XCLAIM":
+		return c.xclaim(args[1:])
+	default:
+		msg := fmt.Sprintf("ERR unknown command '%s'", args[0])
+		return nil, errors.New(msg)
+	}
+}
+
+// Trim removes every entry from key, the same way that XADD with MAXLEN (or XTRIM)
+// might, without touching the lists of pending messages.
+
+func (c *FakeClient) Trim(key string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.streams[key]
+
+	if ok {
+		s.entries = make([]*fake_entry, 0)
+	}
+}
+
+// xadd expects 'key [MAXLEN ~ count] * field value ...'
+
+func (c *FakeClient) xadd(args []string) (interface{}, error) {
+
+	if len(args) < 4 {
+		return nil, errors.New("ERR wrong number of arguments for 'xadd' command")
+	}
+
+	key := args[0]
+	args = args[1:]
+
+	max_len := int64(0)
+
+	if strings.ToUpper(args[0]) == "MAXLEN" {
+
+		args = args[1:]
+
+		if len(args) > 0 && (args[0] == "~" || args[0] == "=") {
+			args = args[1:]
+		}
+
+		if len(args) == 0 {
+			return nil, errors.New("ERR syntax error")
+		}
+
+		n, err := strconv.ParseInt(args[0], 10, 64)
+
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		max_len = n
+		args = args[1:]
+	}
+
+	if len(args) < 3 || args[0] != "*" || len(args[1:])%2 != 0 {
+		return nil, errors.New("ERR syntax error")
+	}
+
+	s := c.stream(key)
+	s.seq += 1
+
+	e := fake_entry{
+		id:     fmt.Sprintf("%d-0", s.seq),
+		seq:    s.seq,
+		fields: append([]string{}, args[1:]...),
+	}
+
+	s.entries = append(s.entries, &e)
+
+	if max_len > 0 && int64(len(s.entries)) > max_len {
+		s.entries = s.entries[int64(len(s.entries))-max_len:]
+	}
+
+	return e.id, nil
+}
+
+// xgroup expects 'CREATE key group start [MKSTREAM]'
+
+func (c *FakeClient) xgroup(args []string) (interface{}, error) {
+
+	if len(args) < 4 || strings.ToUpper(args[0]) != "CREATE" {
+		return nil, errors.New("ERR syntax error")
+	}
+
+	key := args[1]
+	group := args[2]
+	start := args[3]
+
+	s, ok := c.streams[key]
+
+	if !ok {
+
+		if len(args) < 5 || strings.ToUpper(args[4]) != "MKSTREAM" {
+			return nil, errors.New("ERR The XGROUP subcommand requires the key to exist")
+		}
+
+		s = c.stream(key)
+	}
+
+	_, exists := s.groups[group]
+
+	if exists {
+		return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+	}
+
+	g := fake_group{
+		pending: make(map[string]*fake_pending),
+	}
+
+	if start == "$" {
+		g.last = s.seq
+	} else {
+		g.last = parseSeq(start)
+	}
+
+	s.groups[group] = &g
+	return "OK", nil
+}
+
+// xreadgroup expects 'GROUP group consumer [COUNT count] [BLOCK ms] STREAMS key id'
+
+func (c *FakeClient) xreadgroup(args []string) (interface{}, error) {
+
+	if len(args) < 3 || strings.ToUpper(args[0]) != "GROUP" {
+		return nil, errors.New("ERR syntax error")
+	}
+
+	group := args[1]
+	consumer := args[2]
+	args = args[3:]
+
+	count := -1
+	var key, id string
+
+	for i := 0; i < len(args); i++ {
+
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+
+			n, err := strconv.Atoi(args[i+1])
+
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+
+			count = n
+			i += 1
+
+		case "BLOCK":
+			i += 1
+		case "STREAMS":
+
+			if len(args) != i+3 {
+				return nil, errors.New("ERR syntax error")
+			}
+
+			key = args[i+1]
+			id = args[i+2]
+			i = len(args)
+
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	s, g, err := c.group(key, group)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]interface{}, 0)
+
+	if id == ">" {
+
+		for _, e := range s.entries {
+
+			if count >= 0 && len(entries) >= count {
+				break
+			}
+
+			if e.seq <= g.last {
+				continue
+			}
+
+			g.last = e.seq
+
+			g.pending[e.id] = &fake_pending{
+				consumer:   consumer,
+				delivered:  c.Now(),
+				deliveries: 1,
+			}
+
+			entries = append(entries, e.reply())
+		}
+
+		// this is what a real server returns once BLOCK has timed out
+
+		if len(entries) == 0 {
+			return nil, redis.Nil
+		}
+
+	} else {
+
+		// this consumer's pending entries, which are returned without any fields if
+		// they are no longer in the stream
+
+		after := parseSeq(id)
+
+		for _, pending_id := range g.pendingIds() {
+
+			if count >= 0 && len(entries) >= count {
+				break
+			}
+
+			p := g.pending[pending_id]
+
+			if p.consumer != consumer || parseSeq(pending_id) <= after {
+				continue
+			}
+
+			p.deliveries += 1
+			entries = append(entries, s.reply(pending_id))
+		}
+	}
+
+	return []interface{}{[]interface{}{key, entries}}, nil
+}
+
+// xack expects 'key group id ...'
+
+func (c *FakeClient) xack(args []string) (interface{}, error) {
+
+	if len(args) < 3 {
+		return nil, errors.New("ERR wrong number of arguments for 'xack' command")
+	}
+
+	_, g, err := c.group(args[0], args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	acked := int64(0)
+
+	for _, id := range args[2:] {
+
+		_, ok := g.pending[id]
+
+		if ok {
+			delete(g.pending, id)
+			acked += 1
+		}
+	}
+
+	return acked, nil
+}
+
+// xpending expects 'key group start end count', where start and end are ignored
+
+func (c *FakeClient) xpending(args []string) (interface{}, error) {
+
+	if len(args) != 5 {
+		return nil, errors.New("ERR syntax error")
+	}
+
+	_, g, err := c.group(args[0], args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(args[4])
+
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+
+	now := c.Now()
+	pending := make([]interface{}, 0)
+
+	for _, id := range g.pendingIds() {
+
+		if len(pending) >= count {
+			break
+		}
+
+		p := g.pending[id]
+		idle := int64(now.Sub(p.delivered) / time.Millisecond)
+
+		pending = append(pending, []interface{}{id, p.consumer, idle, p.deliveries})
+	}
+
+	return pending, nil
+}
+
+// xclaim expects 'key group consumer min-idle-time id ...'
+
+func (c *FakeClient) xclaim(args []string) (interface{}, error) {
+
+	if len(args) < 5 {
+		return nil, errors.New("ERR wrong number of arguments for 'xclaim' command")
+	}
+
+	s, g, err := c.group(args[0], args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	consumer := args[2]
+
+	min_idle, err := strconv.ParseInt(args[3], 10, 64)
+
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	now := c.Now()
+	entries := make([]interface{}, 0)
+
+	for _, id := range args[4:] {
+
+		p, ok := g.pending[id]
+
+		if !ok || int64(now.Sub(p.delivered)/time.Millisecond) < min_idle {
+			continue
+		}
+
+		p.consumer = consumer
+		p.delivered = now
+		p.deliveries += 1
+
+		entries = append(entries, s.reply(id))
+	}
+
+	return entries, nil
+}
+
+func (c *FakeClient) stream(key string) *fake_stream {
+
+	s, ok := c.streams[key]
+
+	if !ok {
+
+		s = &fake_stream{
+			entries: make([]*fake_entry, 0),
+			groups:  make(map[string]*fake_group),
+		}
+
+		c.streams[key] = s
+	}
+
+	return s
+}
+
+func (c *FakeClient) group(key string, group string) (*fake_stream, *fake_group, error) {
+
+	s, ok := c.streams[key]
+
+	if ok {
+
+		g, ok := s.groups[group]
+
+		if ok {
+			return s, g, nil
+		}
+	}
+
+	msg := fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+	return nil, nil, errors.New(msg)
+}
+
+func (s *fake_stream) reply(id string) interface{} {
+
+	for _, e := range s.entries {
+
+		if e.id == id {
+			return e.reply()
+		}
+	}
+
+	return []interface{}{id, nil}
+}
+
+func (e *fake_entry) reply() interface{} {
+
+	fields := make([]interface{}, len(e.fields))
+
+	for i, f := range e.fields {
+		fields[i] = f
+	}
+
+	return []interface{}{e.id, fields}
+}
+
+// pendingIds returns the IDs of the pending entries in the order they were added.
+
+func (g *fake_group) pendingIds() []string {
+
+	ids := make([]string, 0)
+
+	for id, _ := range g.pending {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return parseSeq(ids[i]) < parseSeq(ids[j])
+	})
+
+	return ids
+}
+
+func parseSeq(id string) int64 {
+
+	n, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
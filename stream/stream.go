@@ -0,0 +1,421 @@
+package stream
+
+// Redis Streams are used (instead of PubSub) when messages must not be lost if nothing
+// happens to be listening when they are sent. Messages are added to a stream with XADD
+// and read by consumers in a consumer group with XREADGROUP, each of which acknowledges
+// the messages it has finished with using XACK. Messages that a consumer read but never
+// acknowledged (because it crashed, say) are re-read when it starts again or, after they
+// have been idle for long enough, claimed by another consumer.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/redis.v1"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ModePubSub = "pubsub"
+	ModeStream = "stream"
+)
+
+// MessageField is the name of the field, in each stream entry, containing the message.
+
+const MessageField = "message"
+
+// Client is the subset of a Redis client that streams need. It exists mostly so that
+// consumers can be exercised against something other than a real Redis server, like
+// FakeClient.
+
+type Client interface {
+	Do(args ...string) (interface{}, error)
+}
+
+type RedisClient struct {
+	Client
+	client *redis.Client
+}
+
+func NewRedisClient(client *redis.Client) *RedisClient {
+
+	c := RedisClient{
+		client: client,
+	}
+
+	return &c
+}
+
+func (c *RedisClient) Do(args ...string) (interface{}, error) {
+
+	cmd := redis.NewCmd(args...)
+	c.client.Process(cmd)
+
+	return cmd.Result()
+}
+
+func IsValidMode(mode string) bool {
+	return mode == ModePubSub || mode == ModeStream
+}
+
+// Publish sends body to key, which is either a PubSub channel or a stream depending on
+// mode. When adding to a stream max_len, if greater than 0, is the (approximate) maximum
+// number of entries to keep in it.
+
+func Publish(client *redis.Client, mode string, key string, body string, max_len int64) error {
+
+	switch mode {
+	case ModePubSub:
+		return client.Publish(key, body).Err()
+	case ModeStream:
+		_, err := Add(NewRedisClient(client), key, body, max_len)
+		return err
+	default:
+		msg := fmt.Sprintf("Invalid Redis mode '%s'", mode)
+		return errors.New(msg)
+	}
+}
+
+// Add appends msg to the stream key and returns the ID of the new entry.
+
+func Add(c Client, key string, msg string, max_len int64) (string, error) {
+
+	args := []string{"XADD", key}
+
+	if max_len > 0 {
+		args = append(args, "MAXLEN", "~", strconv.FormatInt(max_len, 10))
+	}
+
+	args = append(args, "*", MessageField, msg)
+
+	rsp, err := c.Do(args...)
+
+	if err != nil {
+		return "", err
+	}
+
+	id, ok := rsp.(string)
+
+	if !ok {
+		msg := fmt.Sprintf("Unexpected XADD response %v", rsp)
+		return "", errors.New(msg)
+	}
+
+	return id, nil
+}
+
+type Entry struct {
+	Id      string
+	Message string
+}
+
+type ConsumerOptions struct {
+	Stream string
+	Group  string
+	// Consumer should be the same every time a given worker starts so that it can pick up
+	// any messages it hadn't acknowledged when it stopped.
+	Consumer string
+	// Start is the ID to start reading the stream from if the group doesn't exist yet, where
+	// "$" means only new messages and "0" means everything still in the stream.
+	Start string
+	Count int
+	// Block is how long to wait for new messages before returning (nothing).
+	Block time.Duration
+	// ClaimIdle is how long a message must have gone unacknowledged by another consumer
+	// before it is claimed by this one. 0 means never claim messages.
+	ClaimIdle time.Duration
+}
+
+func NewDefaultConsumerOptions() *ConsumerOptions {
+
+	consumer, err := os.Hostname()
+
+	if err != nil {
+		consumer = fmt.Sprintf("wof-updated-%d", os.Getpid())
+	}
+
+	opts := ConsumerOptions{
+		Stream:    "updated",
+		Group:     "wof-updated",
+		Consumer:  consumer,
+		Start:     "$",
+		Count:     10,
+		Block:     time.Second * 1,
+		ClaimIdle: time.Minute * 5,
+	}
+
+	return &opts
+}
+
+type Consumer struct {
+	client     Client
+	options    *ConsumerOptions
+	draining   bool
+	drain_from string
+	last_claim time.Time
+}
+
+// NewConsumer returns a consumer for opts.Stream, creating the consumer group (and the
+// stream) if necessary.
+
+func NewConsumer(c Client, opts *ConsumerOptions) (*Consumer, error) {
+
+	if opts.Stream == "" || opts.Group == "" || opts.Consumer == "" {
+		return nil, errors.New("Missing stream, group or consumer name")
+	}
+
+	if opts.Count < 1 {
+		return nil, errors.New("Invalid count")
+	}
+
+	start := opts.Start
+
+	if start == "" {
+		start = "$"
+	}
+
+	_, err := c.Do("XGROUP", "CREATE", opts.Stream, opts.Group, start, "MKSTREAM")
+
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	cn := Consumer{
+		client:     c,
+		options:    opts,
+		draining:   true,
+		drain_from: "0",
+		last_claim: time.Time{},
+	}
+
+	return &cn, nil
+}
+
+// Read returns the next batch of messages for this consumer. Messages that this consumer
+// has already read but not acknowledged are returned first, followed by any messages that
+// have been abandoned by other consumers, followed by new messages. If there are no new
+// messages Read waits for (up to) opts.Block before returning an empty list.
+
+func (cn *Consumer) Read(ctx context.Context) ([]*Entry, error) {
+
+	if cn.draining {
+
+		// pending messages stay pending until they are acknowledged so keep track of
+		// the last one returned rather than returning the same ones over and over
+
+		entries, err := cn.readGroup(cn.drain_from, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(entries) > 0 {
+			cn.drain_from = entries[len(entries)-1].Id
+			return entries, nil
+		}
+
+		cn.draining = false
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if cn.options.ClaimIdle > 0 && time.Since(cn.last_claim) > cn.options.ClaimIdle/2 {
+
+		cn.last_claim = time.Now()
+
+		entries, err := cn.claim()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(entries) > 0 {
+			return entries, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return cn.readGroup(">", cn.options.Block)
+}
+
+func (cn *Consumer) Ack(id string) error {
+
+	_, err := cn.client.Do("XACK", cn.options.Stream, cn.options.Group, id)
+	return err
+}
+
+func (cn *Consumer) readGroup(id string, block time.Duration) ([]*Entry, error) {
+
+	args := []string{
+		"XREADGROUP", "GROUP", cn.options.Group, cn.options.Consumer,
+		"COUNT", strconv.Itoa(cn.options.Count),
+	}
+
+	if block > 0 {
+		args = append(args, "BLOCK", strconv.FormatInt(int64(block/time.Millisecond), 10))
+	}
+
+	args = append(args, "STREAMS", cn.options.Stream, id)
+
+	rsp, err := cn.client.Do(args...)
+
+	if err == redis.Nil {
+		return []*Entry{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// [[stream, [[id, [field, value, ...]], ...]]]
+
+	streams, ok := rsp.([]interface{})
+
+	if !ok {
+		return []*Entry{}, nil
+	}
+
+	entries := make([]*Entry, 0)
+
+	for _, s := range streams {
+
+		details, ok := s.([]interface{})
+
+		if !ok || len(details) != 2 {
+			msg := fmt.Sprintf("Unexpected XREADGROUP response %v", rsp)
+			return nil, errors.New(msg)
+		}
+
+		e, err := cn.parseEntries(details[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e...)
+	}
+
+	return entries, nil
+}
+
+// claim takes ownership of (up to opts.Count) messages that other consumers have left
+// unacknowledged for longer than opts.ClaimIdle.
+
+func (cn *Consumer) claim() ([]*Entry, error) {
+
+	rsp, err := cn.client.Do("XPENDING", cn.options.Stream, cn.options.Group, "-", "+", strconv.Itoa(cn.options.Count))
+
+	if err != nil {
+		return nil, err
+	}
+
+	pending, _ := rsp.([]interface{})
+
+	min_idle := int64(cn.options.ClaimIdle / time.Millisecond)
+	ids := make([]string, 0)
+
+	// [[id, consumer, idle (ms), deliveries], ...]
+
+	for _, p := range pending {
+
+		details, ok := p.([]interface{})
+
+		if !ok || len(details) != 4 {
+			msg := fmt.Sprintf("Unexpected XPENDING response %v", rsp)
+			return nil, errors.New(msg)
+		}
+
+		id, _ := details[0].(string)
+		consumer, _ := details[1].(string)
+		idle, _ := details[2].(int64)
+
+		if id == "" || consumer == cn.options.Consumer || idle < min_idle {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return []*Entry{}, nil
+	}
+
+	args := []string{
+		"XCLAIM", cn.options.Stream, cn.options.Group, cn.options.Consumer,
+		strconv.FormatInt(min_idle, 10),
+	}
+
+	args = append(args, ids...)
+
+	rsp, err = cn.client.Do(args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cn.parseEntries(rsp)
+}
+
+// parseEntries parses a list of [id, [field, value, ...]] entries. Entries that have since
+// been removed from the stream (trimmed, for example) come back without any fields and are
+// acknowledged, since there is nothing to be done with them, and skipped.
+
+func (cn *Consumer) parseEntries(rsp interface{}) ([]*Entry, error) {
+
+	items, _ := rsp.([]interface{})
+
+	entries := make([]*Entry, 0)
+
+	for _, i := range items {
+
+		details, ok := i.([]interface{})
+
+		if !ok || len(details) != 2 {
+			msg := fmt.Sprintf("Unexpected stream entry %v", i)
+			return nil, errors.New(msg)
+		}
+
+		id, _ := details[0].(string)
+
+		if id == "" {
+			msg := fmt.Sprintf("Unexpected stream entry %v", i)
+			return nil, errors.New(msg)
+		}
+
+		fields, _ := details[1].([]interface{})
+
+		if len(fields) == 0 {
+			cn.Ack(id)
+			continue
+		}
+
+		var message string
+
+		for j := 0; j+1 < len(fields); j += 2 {
+
+			k, _ := fields[j].(string)
+
+			if k == MessageField {
+				message, _ = fields[j+1].(string)
+				break
+			}
+		}
+
+		e := Entry{
+			Id:      id,
+			Message: message,
+		}
+
+		entries = append(entries, &e)
+	}
+
+	return entries, nil
+}
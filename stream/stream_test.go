@@ -0,0 +1,223 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestConsumer(t *testing.T, c Client, name string, claim_idle time.Duration) *Consumer {
+
+	opts := NewDefaultConsumerOptions()
+	opts.Stream = "test"
+	opts.Group = "test-group"
+	opts.Consumer = name
+	opts.Start = "0"
+	opts.ClaimIdle = claim_idle
+
+	cn, err := NewConsumer(c, opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create consumer %s, %s", name, err)
+	}
+
+	return cn
+}
+
+func addMessages(t *testing.T, c Client, messages ...string) []string {
+
+	ids := make([]string, 0)
+
+	for _, msg := range messages {
+
+		id, err := Add(c, "test", msg, 0)
+
+		if err != nil {
+			t.Fatalf("Failed to add %s, %s", msg, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func read(t *testing.T, cn *Consumer) []string {
+
+	entries, err := cn.Read(context.Background())
+
+	if err != nil {
+		t.Fatalf("Failed to read, %s", err)
+	}
+
+	messages := make([]string, 0)
+
+	for _, e := range entries {
+		messages = append(messages, e.Message)
+	}
+
+	return messages
+}
+
+func pending(t *testing.T, c Client) map[string]string {
+
+	rsp, err := c.Do("XPENDING", "test", "test-group", "-", "+", "100")
+
+	if err != nil {
+		t.Fatalf("Failed to list pending messages, %s", err)
+	}
+
+	owners := make(map[string]string)
+
+	for _, p := range rsp.([]interface{}) {
+		details := p.([]interface{})
+		owners[details[0].(string)] = details[1].(string)
+	}
+
+	return owners
+}
+
+func assertMessages(t *testing.T, got []string, expected ...string) {
+
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	for i, msg := range expected {
+
+		if got[i] != msg {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestReadGroupAndAck(t *testing.T) {
+
+	c := NewFakeClient()
+	cn := newTestConsumer(t, c, "a", 0)
+
+	ids := addMessages(t, c, "one", "two", "three")
+
+	assertMessages(t, read(t, cn), "one", "two", "three")
+
+	// nothing new has been added so there's nothing left to read
+
+	assertMessages(t, read(t, cn))
+
+	err := cn.Ack(ids[1])
+
+	if err != nil {
+		t.Fatalf("Failed to acknowledge %s, %s", ids[1], err)
+	}
+
+	owners := pending(t, c)
+
+	if len(owners) != 2 || owners[ids[0]] != "a" || owners[ids[2]] != "a" {
+		t.Fatalf("Unexpected pending messages %v", owners)
+	}
+
+	addMessages(t, c, "four")
+
+	assertMessages(t, read(t, cn), "four")
+}
+
+func TestNewConsumerWithExistingGroup(t *testing.T) {
+
+	c := NewFakeClient()
+
+	newTestConsumer(t, c, "a", 0)
+	newTestConsumer(t, c, "b", 0)
+}
+
+func TestUnacknowledgedMessagesAreReadAgainOnRestart(t *testing.T) {
+
+	c := NewFakeClient()
+	cn := newTestConsumer(t, c, "a", 0)
+
+	ids := addMessages(t, c, "one", "two")
+
+	assertMessages(t, read(t, cn), "one", "two")
+
+	cn.Ack(ids[0])
+
+	// a consumer with the same name, as if wof-updated had been restarted
+
+	restarted := newTestConsumer(t, c, "a", 0)
+
+	addMessages(t, c, "three")
+
+	assertMessages(t, read(t, restarted), "two")
+	assertMessages(t, read(t, restarted), "three")
+}
+
+func TestIdleMessagesAreClaimed(t *testing.T) {
+
+	now := time.Now()
+
+	c := NewFakeClient()
+
+	c.Now = func() time.Time {
+		return now
+	}
+
+	a := newTestConsumer(t, c, "a", 0)
+
+	ids := addMessages(t, c, "one", "two")
+
+	assertMessages(t, read(t, a), "one", "two")
+
+	// the messages haven't been idle for long enough to be claimed yet
+
+	now = now.Add(time.Minute)
+
+	b := newTestConsumer(t, c, "b", time.Minute*5)
+	assertMessages(t, read(t, b))
+
+	now = now.Add(time.Minute * 10)
+
+	c2 := newTestConsumer(t, c, "c", time.Minute*5)
+	assertMessages(t, read(t, c2), "one", "two")
+
+	owners := pending(t, c)
+
+	for _, id := range ids {
+
+		if owners[id] != "c" {
+			t.Fatalf("Expected %s to be claimed by c, got %v", id, owners)
+		}
+	}
+
+	// messages that a consumer has claimed aren't claimed again by the same consumer
+
+	assertMessages(t, read(t, c2))
+
+	for _, id := range ids {
+		c2.Ack(id)
+	}
+
+	if len(pending(t, c)) != 0 {
+		t.Fatalf("Expected no pending messages, got %v", pending(t, c))
+	}
+}
+
+func TestTrimmedPendingMessagesAreAcknowledged(t *testing.T) {
+
+	c := NewFakeClient()
+	cn := newTestConsumer(t, c, "a", 0)
+
+	addMessages(t, c, "one")
+
+	assertMessages(t, read(t, cn), "one")
+
+	c.Trim("test")
+
+	restarted := newTestConsumer(t, c, "a", 0)
+
+	assertMessages(t, read(t, restarted))
+
+	if len(pending(t, c)) != 0 {
+		t.Fatalf("Expected trimmed message to be acknowledged, got %v", pending(t, c))
+	}
+}
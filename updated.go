@@ -1,18 +1,128 @@
 package updated
 
 import (
+	"errors"
 	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+	"strings"
 )
 
+// ChangeType describes what happened to a file in a commit.
+
+type ChangeType string
+
+const (
+	ChangeUnknown  ChangeType = ""
+	ChangeAdded    ChangeType = "added"
+	ChangeModified ChangeType = "modified"
+	ChangeDeleted  ChangeType = "deleted"
+	ChangeRenamed  ChangeType = "renamed"
+)
+
+// ParseChangeType understands both the words above and the status letters that
+// `git diff --name-status` and `git show --name-status` emit (A, M, D, R100, etc.)
+
+func ParseChangeType(str string) (ChangeType, error) {
+
+	str = strings.TrimSpace(str)
+
+	switch strings.ToLower(str) {
+	case "":
+		return ChangeUnknown, nil
+	case "a", "added":
+		return ChangeAdded, nil
+	case "m", "modified", "t":
+		return ChangeModified, nil
+	case "d", "deleted", "removed":
+		return ChangeDeleted, nil
+	case "renamed":
+		return ChangeRenamed, nil
+	}
+
+	// renames and copies are followed by a similarity score
+
+	switch strings.ToUpper(str)[0] {
+	case 'R':
+		return ChangeRenamed, nil
+	case 'C':
+		return ChangeAdded, nil
+	}
+
+	msg := fmt.Sprintf("Invalid change type '%s'", str)
+	return ChangeUnknown, errors.New(msg)
+}
+
+// UpdateFile is a single file that was changed by a commit. Id is -1 if the path
+// is not a Who's On First record.
+
+type UpdateFile struct {
+	Path      string     `json:"path"`
+	Id        int64      `json:"id"`
+	IsAlt     bool       `json:"is_alt"`
+	Change    ChangeType `json:"change,omitempty"`
+	Author    string     `json:"author,omitempty"`
+	Timestamp int64      `json:"timestamp,omitempty"`
+	Branch    string     `json:"branch,omitempty"`
+}
+
+// NewUpdateFile returns an UpdateFile for path with its Id and IsAlt properties derived
+// from the filename. This does not require that path actually exists, which it won't if
+// it has been deleted.
+
+func NewUpdateFile(path string, change ChangeType) UpdateFile {
+
+	id, err := uri.IdFromPath(path)
+
+	if err != nil {
+		id = -1
+	}
+
+	is_alt, err := uri.IsAltFile(path)
+
+	if err != nil {
+		is_alt = false
+	}
+
+	f := UpdateFile{
+		Path:   path,
+		Id:     id,
+		IsAlt:  is_alt,
+		Change: change,
+	}
+
+	return f
+}
+
+func (f UpdateFile) IsWOFFile() bool {
+	return f.Id > -1
+}
+
+func (f UpdateFile) IsDeleted() bool {
+	return f.Change == ChangeDeleted
+}
+
 type UpdateTask struct {
-	Hash    string
-	Repo    string
-	Commits []string
+	Hash  string       `json:"hash"`
+	Repo  string       `json:"repo"`
+	Files []UpdateFile `json:"files"`
+}
+
+// Paths returns the path of every file in the task.
+
+func (t UpdateTask) Paths() []string {
+
+	paths := make([]string, len(t.Files))
+
+	for i, f := range t.Files {
+		paths[i] = f.Path
+	}
+
+	return paths
 }
 
 func (t UpdateTask) String() string {
 
-	count := len(t.Commits)
+	count := len(t.Files)
 
 	if count == 1 {
 		return fmt.Sprintf("%s#%s (1 file)", t.Hash, t.Repo)
@@ -35,3 +35,45 @@ func FilesToFileList(files []string, root string) (*os.File, error) {
 
 	return tmpfile, nil
 }
+
+// RemovePath returns a copy of paths without any instances of path.
+
+func RemovePath(paths []string, path string) []string {
+
+	pruned := make([]string, 0)
+
+	for _, p := range paths {
+
+		if p == path {
+			continue
+		}
+
+		pruned = append(pruned, p)
+	}
+
+	return pruned
+}
+
+// RemovePaths returns a copy of paths without any instances of the paths in remove.
+
+func RemovePaths(paths []string, remove []string) []string {
+
+	lookup := make(map[string]bool)
+
+	for _, p := range remove {
+		lookup[p] = true
+	}
+
+	pruned := make([]string, 0)
+
+	for _, p := range paths {
+
+		if lookup[p] {
+			continue
+		}
+
+		pruned = append(pruned, p)
+	}
+
+	return pruned
+}